@@ -0,0 +1,480 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"example.com/m/v2/auth"
+	"example.com/m/v2/catalog"
+	"example.com/m/v2/logging"
+	"example.com/m/v2/store"
+	"github.com/go-chi/chi/v5"
+)
+
+// usernamePattern keeps usernames readable in logs and the dashboard.
+var usernamePattern = regexp.MustCompile(`^[a-zA-Z0-9._-]{3,64}$`)
+
+// Credentials is the body of the login and setup endpoints.
+type Credentials struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// UserView is a user as returned by the API, without the password hash.
+type UserView struct {
+	ID        string    `json:"id"`
+	Username  string    `json:"username"`
+	Role      string    `json:"role"`
+	AppGrants []string  `json:"app_grants"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// newUserView builds the API representation of a user.
+func newUserView(u *store.User) UserView {
+	grants := u.AppGrants
+	if grants == nil {
+		grants = []string{}
+	}
+	return UserView{ID: u.ID, Username: u.Username, Role: u.Role, AppGrants: grants, CreatedAt: u.CreatedAt}
+}
+
+// handleSetupStatus is the HTTP handler for GET /api/auth/setup.
+// It tells the frontend whether to show the first-run setup form instead of the login form.
+func handleSetupStatus(db *store.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		hasUsers, err := db.HasUsers()
+		if err != nil {
+			http.Error(w, "Failed to check setup", http.StatusInternalServerError)
+			logging.Errorf("Error checking for users: %v", err)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"setup_required": !hasUsers})
+	}
+}
+
+// handleSetup is the HTTP handler for POST /api/auth/setup.
+// It creates the initial admin and signs them in; once any user exists it always fails.
+func handleSetup(db *store.DB, sessions *auth.Sessions) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var creds Credentials
+		if err := json.NewDecoder(r.Body).Decode(&creds); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		if err := checkCredentials(creds); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		user, err := newUser(creds, auth.RoleAdmin, nil)
+		if err != nil {
+			http.Error(w, "Failed to create user", http.StatusInternalServerError)
+			logging.Errorf("Error creating user: %v", err)
+			return
+		}
+		err = db.CreateFirstUser(user)
+		if errors.Is(err, store.ErrSetupDone) {
+			http.Error(w, "Setup has already been completed", http.StatusConflict)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Failed to create user", http.StatusInternalServerError)
+			logging.Errorf("Error saving user: %v", err)
+			return
+		}
+		log.Printf("Created initial admin %s", user.Username)
+		event := newAuditEvent(r, auditSetup)
+		event.Actor, event.ActorID, event.Target = user.Username, user.ID, user.ID
+		recordAudit(db, event, store.OutcomeSuccess, "created the initial admin")
+
+		if err := sessions.Start(w, user); err != nil {
+			http.Error(w, "Failed to start session", http.StatusInternalServerError)
+			logging.Errorf("Error starting session: %v", err)
+			return
+		}
+		writeJSON(w, http.StatusCreated, map[string]interface{}{"user": newUserView(user)})
+	}
+}
+
+// handleLogin is the HTTP handler for POST /api/auth/login.
+// Unknown users and wrong passwords get the same answer, after the same amount of work.
+func handleLogin(db *store.DB, sessions *auth.Sessions) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var creds Credentials
+		if err := json.NewDecoder(r.Body).Decode(&creds); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+
+		user, err := db.GetUserByUsername(creds.Username)
+		if err != nil && !errors.Is(err, store.ErrNotFound) {
+			http.Error(w, "Failed to log in", http.StatusInternalServerError)
+			logging.Errorf("Error loading user: %v", err)
+			return
+		}
+
+		valid := false
+		if user == nil {
+			auth.BurnVerify(creds.Password)
+		} else if valid, err = auth.VerifyPassword(creds.Password, user.PasswordHash); err != nil {
+			http.Error(w, "Failed to log in", http.StatusInternalServerError)
+			logging.Errorf("Error verifying password for %s: %v", user.Username, err)
+			return
+		}
+		event := newAuditEvent(r, auditLogin)
+		event.Actor = creds.Username
+		if user != nil {
+			event.ActorID = user.ID
+		}
+		if !valid {
+			logging.Errorf("Failed login for %q from %s", creds.Username, r.RemoteAddr)
+			recordAudit(db, event, store.OutcomeFailure, "invalid username or password")
+			http.Error(w, "Invalid username or password", http.StatusUnauthorized)
+			return
+		}
+
+		if err := sessions.Start(w, user); err != nil {
+			http.Error(w, "Failed to start session", http.StatusInternalServerError)
+			logging.Errorf("Error starting session: %v", err)
+			return
+		}
+		recordAudit(db, event, store.OutcomeSuccess, "")
+		writeJSON(w, http.StatusOK, map[string]interface{}{"user": newUserView(user)})
+	}
+}
+
+// handleLogout is the HTTP handler for POST /api/auth/logout.
+func handleLogout(db *store.DB, sessions *auth.Sessions) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// The route is public, so look up who is logging out before the session goes
+		if user, err := sessions.Authenticate(r); err == nil {
+			event := newAuditEvent(r, auditLogout)
+			event.Actor, event.ActorID = user.Username, user.ID
+			recordAudit(db, event, store.OutcomeSuccess, "")
+		}
+
+		if err := sessions.End(w, r); err != nil {
+			http.Error(w, "Failed to log out", http.StatusInternalServerError)
+			logging.Errorf("Error ending session: %v", err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// handleCurrentUser is the HTTP handler for GET /api/auth/me.
+func handleCurrentUser() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, _ := auth.UserFromContext(r.Context())
+		writeJSON(w, http.StatusOK, map[string]interface{}{"user": newUserView(user)})
+	}
+}
+
+// UserRequest is the body of the user management endpoints.
+// On update, fields left out are not changed.
+type UserRequest struct {
+	Username  string    `json:"username"`
+	Password  *string   `json:"password"`
+	Role      *string   `json:"role"`
+	AppGrants *[]string `json:"app_grants"`
+}
+
+// errLastAdmin is returned when a change would leave nobody able to manage users.
+var errLastAdmin = errors.New("at least one admin must remain")
+
+// keepAnAdmin is the store check that stops the last admin being demoted or deleted.
+func keepAnAdmin(users []*store.User) error {
+	for _, u := range users {
+		if u.Role == auth.RoleAdmin {
+			return nil
+		}
+	}
+	return errLastAdmin
+}
+
+// handleListUsers is the HTTP handler for GET /api/users.
+func handleListUsers(db *store.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		users, err := db.ListUsers()
+		if err != nil {
+			http.Error(w, "Failed to load users", http.StatusInternalServerError)
+			logging.Errorf("Error listing users: %v", err)
+			return
+		}
+
+		views := []UserView{}
+		for _, u := range users {
+			views = append(views, newUserView(u))
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"users": views})
+	}
+}
+
+// handleCreateUser is the HTTP handler for POST /api/users.
+// Role defaults to viewer.
+func handleCreateUser(db *store.DB, cat *catalog.Catalog) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req UserRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		if req.Password == nil {
+			http.Error(w, "password is required", http.StatusBadRequest)
+			return
+		}
+		creds := Credentials{Username: req.Username, Password: *req.Password}
+		if err := checkCredentials(creds); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		role, grants := auth.RoleViewer, []string(nil)
+		if req.Role != nil {
+			role = *req.Role
+		}
+		if req.AppGrants != nil {
+			grants = *req.AppGrants
+		}
+		if err := checkAccess(cat, role, grants); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		user, err := newUser(creds, role, grants)
+		if err != nil {
+			http.Error(w, "Failed to create user", http.StatusInternalServerError)
+			logging.Errorf("Error creating user: %v", err)
+			return
+		}
+		err = db.CreateUser(user)
+		if errors.Is(err, store.ErrUsernameTaken) {
+			http.Error(w, "Username is already taken", http.StatusConflict)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Failed to create user", http.StatusInternalServerError)
+			logging.Errorf("Error saving user: %v", err)
+			return
+		}
+
+		log.Printf("Created user %s with role %s", user.Username, user.Role)
+		event := newAuditEvent(r, auditUserCreate)
+		event.Target = user.Username
+		event.Diff = accessDiff(nil, user)
+		recordAudit(db, event, store.OutcomeSuccess, "")
+		writeJSON(w, http.StatusCreated, map[string]interface{}{"user": newUserView(user)})
+	}
+}
+
+// handleUpdateUser is the HTTP handler for PUT /api/users/{id}.
+// It changes a user's role, app grants or password; usernames are fixed. A new
+// password ends the user's other sessions, and narrower access revokes their API tokens.
+func handleUpdateUser(db *store.DB, cat *catalog.Catalog) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := chi.URLParam(r, "id")
+
+		var req UserRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+
+		// Hash outside the transaction; argon2 is deliberately slow
+		var hash string
+		if req.Password != nil {
+			if len(*req.Password) < auth.MinPasswordLength {
+				http.Error(w, fmt.Sprintf("password must be at least %d characters long", auth.MinPasswordLength), http.StatusBadRequest)
+				return
+			}
+			var err error
+			if hash, err = auth.HashPassword(*req.Password); err != nil {
+				http.Error(w, "Failed to update user", http.StatusInternalServerError)
+				logging.Errorf("Error hashing password: %v", err)
+				return
+			}
+		}
+
+		var before store.User
+		var updated *store.User
+		err := db.UpdateUser(id, func(u *store.User) error {
+			before = *u
+			if req.Role != nil {
+				u.Role = *req.Role
+			}
+			if req.AppGrants != nil {
+				u.AppGrants = *req.AppGrants
+			}
+			if hash != "" {
+				u.PasswordHash = hash
+			}
+			updated = u
+			return checkAccess(cat, u.Role, u.AppGrants)
+		}, keepAnAdmin)
+		switch {
+		case errors.Is(err, store.ErrNotFound):
+			http.Error(w, "User not found", http.StatusNotFound)
+			return
+		case errors.Is(err, errLastAdmin), errors.Is(err, errInvalidAccess):
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		case err != nil:
+			http.Error(w, "Failed to update user", http.StatusInternalServerError)
+			logging.Errorf("Error updating user %s: %v", id, err)
+			return
+		}
+
+		log.Printf("Updated user %s (role %s, grants %v)", updated.Username, updated.Role, updated.AppGrants)
+		event := newAuditEvent(r, auditUserUpdate)
+		event.Target = updated.Username
+		event.Diff = accessDiff(&before, updated)
+
+		// A new password signs the user out everywhere else; users changing their own
+		// keep the session they did it from
+		var revoked []string
+		if hash != "" {
+			keep := ""
+			if caller, _ := auth.UserFromContext(r.Context()); caller != nil && caller.ID == updated.ID {
+				keep = auth.SessionID(r)
+			}
+			ended, err := db.EndSessions(updated.ID, keep)
+			if err != nil {
+				recordAudit(db, event, store.OutcomeFailure, "failed to end sessions: "+err.Error())
+				http.Error(w, "User updated, but their other sessions could not be ended", http.StatusInternalServerError)
+				logging.Errorf("Error ending sessions of %s: %v", updated.Username, err)
+				return
+			}
+			revoked = append(revoked, fmt.Sprintf("%d sessions ended", ended))
+		}
+		// Tokens were made for the access the user had; once it narrows they have to be made again
+		if auth.Narrows(before.Role, before.AppGrants, updated.Role, updated.AppGrants) {
+			removed, err := db.RevokeTokens(updated.ID)
+			if err != nil {
+				recordAudit(db, event, store.OutcomeFailure, "failed to revoke API tokens: "+err.Error())
+				http.Error(w, "User updated, but their API tokens could not be revoked", http.StatusInternalServerError)
+				logging.Errorf("Error revoking API tokens of %s: %v", updated.Username, err)
+				return
+			}
+			revoked = append(revoked, fmt.Sprintf("%d API tokens revoked", removed))
+		}
+		recordAudit(db, event, store.OutcomeSuccess, strings.Join(revoked, ", "))
+		writeJSON(w, http.StatusOK, map[string]interface{}{"user": newUserView(updated)})
+	}
+}
+
+// handleDeleteUser is the HTTP handler for DELETE /api/users/{id}.
+// The user's sessions are ended with it.
+func handleDeleteUser(db *store.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := chi.URLParam(r, "id")
+
+		err := db.DeleteUser(id, keepAnAdmin)
+		switch {
+		case errors.Is(err, store.ErrNotFound):
+			http.Error(w, "User not found", http.StatusNotFound)
+			return
+		case errors.Is(err, errLastAdmin):
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		case err != nil:
+			http.Error(w, "Failed to delete user", http.StatusInternalServerError)
+			logging.Errorf("Error deleting user %s: %v", id, err)
+			return
+		}
+
+		log.Printf("Deleted user %s", id)
+		event := newAuditEvent(r, auditUserDelete)
+		event.Target = id
+		recordAudit(db, event, store.OutcomeSuccess, "")
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// accessDiff describes how a user's access changed, for the audit log.
+// Password changes are recorded without the hash.
+func accessDiff(before, after *store.User) map[string]store.Change {
+	if before == nil {
+		before = &store.User{}
+	}
+	diff := make(map[string]store.Change)
+	if before.Role != after.Role {
+		diff["role"] = store.Change{From: before.Role, To: after.Role}
+	}
+	if !slices.Equal(before.AppGrants, after.AppGrants) {
+		diff["app_grants"] = store.Change{From: before.AppGrants, To: after.AppGrants}
+	}
+	if before.PasswordHash != after.PasswordHash {
+		change := store.Change{To: "[REDACTED]"}
+		if before.PasswordHash != "" {
+			change.From = "[REDACTED]"
+		}
+		diff["password"] = change
+	}
+	return diff
+}
+
+// errInvalidAccess wraps role and grant validation failures.
+var errInvalidAccess = errors.New("invalid access")
+
+// checkAccess validates a role and a list of app grants.
+func checkAccess(cat *catalog.Catalog, role string, grants []string) error {
+	if !auth.ValidRole(role) {
+		return fmt.Errorf("%w: role must be viewer, operator or admin", errInvalidAccess)
+	}
+	for _, appID := range grants {
+		if _, ok := cat.Get(appID); !ok {
+			return fmt.Errorf("%w: unknown app %q in app_grants", errInvalidAccess, appID)
+		}
+	}
+	return nil
+}
+
+// checkCredentials validates a new account's username and password.
+func checkCredentials(creds Credentials) error {
+	if !usernamePattern.MatchString(creds.Username) {
+		return errors.New("username must be 3-64 letters, digits, dots, dashes or underscores")
+	}
+	if len(creds.Password) < auth.MinPasswordLength {
+		return fmt.Errorf("password must be at least %d characters long", auth.MinPasswordLength)
+	}
+	return nil
+}
+
+// newUser builds a user with a fresh ID and a hashed password.
+func newUser(creds Credentials, role string, grants []string) (*store.User, error) {
+	hash, err := auth.HashPassword(creds.Password)
+	if err != nil {
+		return nil, err
+	}
+	id, err := randomID()
+	if err != nil {
+		return nil, err
+	}
+	return &store.User{ID: id, Username: creds.Username, PasswordHash: hash, Role: role, AppGrants: grants}, nil
+}
+
+// writeJSON writes v as a JSON response with the given status code.
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		logging.Errorf("Error encoding response: %v", err)
+	}
+}
+
+// randomID returns a random hex ID for new records.
+func randomID() (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", fmt.Errorf("failed to generate ID: %w", err)
+	}
+	return hex.EncodeToString(buf), nil
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"example.com/m/v2/auth"
+	"example.com/m/v2/catalog"
+	"example.com/m/v2/store"
+	"github.com/go-chi/chi/v5"
+)
+
+func TestSetupOnlyOnce(t *testing.T) {
+	db, err := store.Open(filepath.Join(t.TempDir(), "being.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if err := db.SetAuditKey([]byte("audit key")); err != nil {
+		t.Fatal(err)
+	}
+	handler := handleSetup(db, auth.NewSessions(db, true))
+
+	setup := func(username string) *httptest.ResponseRecorder {
+		body := `{"username": "` + username + `", "password": "a long enough password"}`
+		rec := httptest.NewRecorder()
+		handler(rec, httptest.NewRequest(http.MethodPost, "/api/auth/setup", strings.NewReader(body)))
+		return rec
+	}
+
+	first := setup("alice")
+	if first.Code != http.StatusCreated {
+		t.Fatalf("first setup: %d %s", first.Code, first.Body)
+	}
+	if len(first.Result().Cookies()) != 1 {
+		t.Error("first setup did not sign the admin in")
+	}
+	user, err := db.GetUserByUsername("alice")
+	if err != nil || user.Role != auth.RoleAdmin {
+		t.Fatalf("initial user %+v, %v, want an admin", user, err)
+	}
+
+	// Once a user exists, setup can't be used to make another admin
+	second := setup("mallory")
+	if second.Code != http.StatusConflict {
+		t.Errorf("second setup: %d, want %d", second.Code, http.StatusConflict)
+	}
+	if len(second.Result().Cookies()) != 0 {
+		t.Error("second setup started a session")
+	}
+	if _, err := db.GetUserByUsername("mallory"); err == nil {
+		t.Error("second setup created a user")
+	}
+}
+
+func TestUpdateUserRevokes(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		// self means bob makes the change from one of his sessions.
+		self         bool
+		wantSessions int
+		wantTokens   int
+	}{
+		{name: "password", body: `{"password": "another long password"}`, wantSessions: 0, wantTokens: 1},
+		{name: "own password", body: `{"password": "another long password"}`, self: true, wantSessions: 1, wantTokens: 1},
+		{name: "role lowered", body: `{"role": "viewer"}`, wantSessions: 2, wantTokens: 0},
+		{name: "grant removed", body: `{"app_grants": []}`, wantSessions: 2, wantTokens: 0},
+		{name: "role raised", body: `{"role": "admin"}`, wantSessions: 2, wantTokens: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, err := store.Open(filepath.Join(t.TempDir(), "being.db"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() { db.Close() })
+			if err := db.SetAuditKey([]byte("audit key")); err != nil {
+				t.Fatal(err)
+			}
+			cat, err := catalog.Load(filepath.Join("catalog", "apps"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			sessions := auth.NewSessions(db, true)
+			admin := &store.User{ID: "a1", Username: "alice", Role: auth.RoleAdmin}
+			bob := &store.User{ID: "b1", Username: "bob", Role: auth.RoleOperator, AppGrants: []string{"jellyfin"}}
+			for _, u := range []*store.User{admin, bob} {
+				if err := db.CreateUser(u); err != nil {
+					t.Fatal(err)
+				}
+			}
+			var cookies []*http.Cookie
+			for i := 0; i < 2; i++ {
+				rec := httptest.NewRecorder()
+				if err := sessions.Start(rec, bob); err != nil {
+					t.Fatal(err)
+				}
+				cookies = append(cookies, rec.Result().Cookies()[0])
+			}
+			if err := db.CreateToken(&store.APIToken{ID: "t1", Hash: "h1", UserID: bob.ID, ExpiresAt: time.Now().Add(time.Hour)}); err != nil {
+				t.Fatal(err)
+			}
+
+			r := chi.NewRouter()
+			r.Put("/api/users/{id}", handleUpdateUser(db, cat))
+			req := httptest.NewRequest(http.MethodPut, "/api/users/b1", strings.NewReader(tt.body))
+			caller := admin
+			if tt.self {
+				caller = bob
+				req.AddCookie(cookies[0])
+			}
+			req = req.WithContext(auth.WithUser(req.Context(), caller))
+			rec := httptest.NewRecorder()
+			r.ServeHTTP(rec, req)
+			if rec.Code != http.StatusOK {
+				t.Fatalf("status %d: %s", rec.Code, rec.Body)
+			}
+
+			left := 0
+			for _, cookie := range cookies {
+				req := httptest.NewRequest(http.MethodGet, "/", nil)
+				req.AddCookie(cookie)
+				if _, err := sessions.Authenticate(req); err == nil {
+					left++
+				}
+			}
+			if left != tt.wantSessions {
+				t.Errorf("%d sessions left, want %d", left, tt.wantSessions)
+			}
+			if tt.self && left == 1 {
+				req := httptest.NewRequest(http.MethodGet, "/", nil)
+				req.AddCookie(cookies[0])
+				if _, err := sessions.Authenticate(req); err != nil {
+					t.Error("the session the change was made from was ended")
+				}
+			}
+			tokens, err := db.ListTokens(bob.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(tokens) != tt.wantTokens {
+				t.Errorf("%d API tokens left, want %d", len(tokens), tt.wantTokens)
+			}
+		})
+	}
+}
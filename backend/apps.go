@@ -0,0 +1,39 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"example.com/m/v2/catalog"
+	"example.com/m/v2/logging"
+	"github.com/go-chi/chi/v5"
+)
+
+// handleListApps is the HTTP handler for GET /api/apps.
+// It returns every app in the catalog along with the form fields the frontend renders.
+func handleListApps(cat *catalog.Catalog) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(map[string]interface{}{"apps": cat.List()}); err != nil {
+			http.Error(w, "Failed to write response", http.StatusInternalServerError)
+			logging.Errorf("Error encoding app list: %v", err)
+		}
+	}
+}
+
+// handleGetApp is the HTTP handler for GET /api/apps/{id}.
+func handleGetApp(cat *catalog.Catalog) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		app, ok := cat.Get(chi.URLParam(r, "id"))
+		if !ok {
+			http.Error(w, "App not found", http.StatusNotFound)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(app); err != nil {
+			http.Error(w, "Failed to write response", http.StatusInternalServerError)
+			logging.Errorf("Error encoding app %s: %v", app.ID, err)
+		}
+	}
+}
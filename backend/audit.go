@@ -0,0 +1,167 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"reflect"
+	"strconv"
+	"time"
+
+	"example.com/m/v2/auth"
+	"example.com/m/v2/logging"
+	"example.com/m/v2/store"
+)
+
+// Audited actions.
+const (
+	auditSetup         = "auth.setup"
+	auditLogin         = "auth.login"
+	auditLogout        = "auth.logout"
+	auditDeploy        = "deploy"
+	auditDeployFinish  = "deploy.finish"
+	auditDeployRecover = "deploy.recover"
+	auditDeployAdopt   = "deploy.adopt"
+	auditDeployUpgrade = "deploy.upgrade"
+	auditDeployUpdate  = "deploy.update"
+	auditDestroy       = "destroy"
+	auditSecretsList   = "secrets.list"
+	auditSecretsReveal = "secrets.reveal"
+	auditSecretsDelete = "secrets.delete"
+	auditUserCreate    = "user.create"
+	auditUserUpdate    = "user.update"
+	auditUserDelete    = "user.delete"
+	auditTokenCreate   = "token.create"
+	auditTokenRevoke   = "token.revoke"
+)
+
+// defaultAuditLimit and maxAuditLimit bound how many events GET /api/audit returns.
+const (
+	defaultAuditLimit = 100
+	maxAuditLimit     = 1000
+)
+
+// newAuditEvent starts an audit event for an action taken by the request's user.
+// Requests without a signed-in user, such as logins, are attributed to "anonymous"
+// until the handler knows better.
+func newAuditEvent(r *http.Request, action string) store.AuditEvent {
+	e := store.AuditEvent{Action: action, Actor: "anonymous", SourceIP: sourceIP(r)}
+	if user, ok := auth.UserFromContext(r.Context()); ok {
+		e.Actor = user.Username
+		e.ActorID = user.ID
+	}
+	if token, ok := auth.TokenFromContext(r.Context()); ok {
+		e.Message = fmt.Sprintf("via API token %s", token.Prefix)
+	}
+	return e
+}
+
+// recordAudit appends an event to the audit log with the given outcome.
+// A failure to record is logged but never undoes the action it describes.
+func recordAudit(db *store.DB, e store.AuditEvent, outcome, message string) {
+	e.Outcome = outcome
+	if message != "" {
+		if e.Message != "" {
+			message = e.Message + ": " + message
+		}
+		e.Message = message
+	}
+	if err := db.AppendAudit(&e); err != nil {
+		logging.Errorf("Error recording audit event %s by %s: %v", e.Action, e.Actor, err)
+	}
+}
+
+// sourceIP returns the address a request came from, without its port.
+func sourceIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// configDiff returns the fields that differ between two configurations.
+// Both are redacted first, so a changed credential shows up as changed without its value.
+func configDiff(before, after map[string]interface{}) map[string]store.Change {
+	before, after = redactConfiguration(before), redactConfiguration(after)
+	diff := make(map[string]store.Change)
+	for field, to := range after {
+		from, existed := before[field]
+		if !existed || !reflect.DeepEqual(from, to) {
+			diff[field] = store.Change{From: from, To: to}
+		}
+	}
+	for field, from := range before {
+		if _, kept := after[field]; !kept {
+			diff[field] = store.Change{From: from}
+		}
+	}
+	return diff
+}
+
+// handleListAudit is the HTTP handler for GET /api/audit.
+// It filters by ?since= and ?until= (RFC 3339), ?actor=, ?app_id= and ?action=,
+// and returns at most ?limit= events newest first. With ?verify=true it also walks the
+// whole log to report whether the hash chain is intact.
+func handleListAudit(db *store.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		filter := store.AuditFilter{
+			Actor:  query.Get("actor"),
+			AppID:  query.Get("app_id"),
+			Action: query.Get("action"),
+			Limit:  defaultAuditLimit,
+		}
+
+		for name, dest := range map[string]*time.Time{"since": &filter.Since, "until": &filter.Until} {
+			if value := query.Get(name); value != "" {
+				parsed, err := time.Parse(time.RFC3339, value)
+				if err != nil {
+					http.Error(w, fmt.Sprintf("%s must be an RFC 3339 time", name), http.StatusBadRequest)
+					return
+				}
+				*dest = parsed
+			}
+		}
+		if value := query.Get("limit"); value != "" {
+			limit, err := strconv.Atoi(value)
+			if err != nil || limit < 1 || limit > maxAuditLimit {
+				http.Error(w, fmt.Sprintf("limit must be between 1 and %d", maxAuditLimit), http.StatusBadRequest)
+				return
+			}
+			filter.Limit = limit
+		}
+
+		verify := false
+		if value := query.Get("verify"); value != "" {
+			parsed, err := strconv.ParseBool(value)
+			if err != nil {
+				http.Error(w, "verify must be true or false", http.StatusBadRequest)
+				return
+			}
+			verify = parsed
+		}
+
+		events, err := db.ListAudit(filter)
+		if err != nil {
+			http.Error(w, "Failed to load audit log", http.StatusInternalServerError)
+			logging.Errorf("Error listing audit events: %v", err)
+			return
+		}
+		response := map[string]interface{}{"events": events}
+
+		if verify {
+			verification, err := db.VerifyAudit()
+			if err != nil {
+				http.Error(w, "Failed to verify audit log", http.StatusInternalServerError)
+				logging.Errorf("Error verifying audit log: %v", err)
+				return
+			}
+			if !verification.Intact {
+				logging.Errorf("Audit log hash chain is broken at event %d: %s", verification.BrokenAt, verification.Reason)
+			}
+			response["verification"] = verification
+		}
+		writeJSON(w, http.StatusOK, response)
+	}
+}
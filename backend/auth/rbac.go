@@ -0,0 +1,137 @@
+package auth
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+
+	"example.com/m/v2/logging"
+	"example.com/m/v2/store"
+)
+
+// Roles, from least to most privileged.
+const (
+	// RoleViewer can see apps, deployments and job progress.
+	RoleViewer = "viewer"
+	// RoleOperator can also deploy and destroy any app.
+	RoleOperator = "operator"
+	// RoleAdmin can also manage users.
+	RoleAdmin = "admin"
+)
+
+var roleRank = map[string]int{RoleViewer: 1, RoleOperator: 2, RoleAdmin: 3}
+
+// ValidRole reports whether role is one of the known roles.
+func ValidRole(role string) bool {
+	return roleRank[role] > 0
+}
+
+// Narrows reports whether changing a user's role and app grants from before to
+// after takes away anything they could do.
+func Narrows(beforeRole string, beforeGrants []string, afterRole string, afterGrants []string) bool {
+	if roleRank[afterRole] < roleRank[beforeRole] {
+		return true
+	}
+	for _, app := range beforeGrants {
+		if !slices.Contains(afterGrants, app) {
+			return true
+		}
+	}
+	return false
+}
+
+// Action is something a user can be allowed to do.
+type Action string
+
+// Actions checked by Authorize and Check.
+const (
+	ActionView    Action = "view"
+	ActionDeploy  Action = "deploy"
+	ActionDestroy Action = "destroy"
+	ActionAdmin   Action = "admin"
+)
+
+// requiredRole is the least role that may perform each action on any app.
+var requiredRole = map[Action]string{
+	ActionView:    RoleViewer,
+	ActionDeploy:  RoleOperator,
+	ActionDestroy: RoleOperator,
+	ActionAdmin:   RoleAdmin,
+}
+
+// Check reports whether user may perform action on appID.
+// Pass an empty appID for actions not tied to one app; a user with any app grant
+// then passes deploy and destroy checks, and the handler checks the app itself.
+//
+// App grants let a viewer deploy and destroy the granted apps, so a household member
+// can manage only Jellyfin without being able to touch anything else.
+func Check(user *store.User, action Action, appID string) bool {
+	if roleRank[user.Role] >= roleRank[requiredRole[action]] {
+		return true
+	}
+	if action != ActionDeploy && action != ActionDestroy {
+		return false
+	}
+	if appID == "" {
+		return len(user.AppGrants) > 0
+	}
+	return slices.Contains(user.AppGrants, appID)
+}
+
+// Denial is the body of a 403 response, for the frontend to explain what's missing.
+type Denial struct {
+	Error        string `json:"error"`
+	Message      string `json:"message"`
+	Action       Action `json:"action"`
+	AppID        string `json:"app_id,omitempty"`
+	Role         string `json:"role"`
+	RequiredRole string `json:"required_role"`
+}
+
+// WriteForbidden sends a structured 403 for a denied action.
+func WriteForbidden(w http.ResponseWriter, user *store.User, action Action, appID string) {
+	denial := Denial{
+		Error:        "forbidden",
+		Message:      fmt.Sprintf("Your %s role does not allow %s", user.Role, action),
+		Action:       action,
+		AppID:        appID,
+		Role:         user.Role,
+		RequiredRole: requiredRole[action],
+	}
+	if appID != "" {
+		denial.Message = fmt.Sprintf("Your %s role does not allow %s on %s", user.Role, action, appID)
+	}
+	logging.Warnf("Denied %s on %q to %s (%s)", action, appID, user.Username, user.Role)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusForbidden)
+	if err := json.NewEncoder(w).Encode(denial); err != nil {
+		logging.Errorf("Error encoding denial: %v", err)
+	}
+}
+
+// Authorize is chi middleware that only lets through users allowed to perform action.
+// appID extracts the app a request acts on from the URL; pass nil for routes that
+// aren't tied to one app, or whose app is only known once the body is read.
+// It must run after Sessions.Require.
+func Authorize(action Action, appID func(*http.Request) string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			user, ok := UserFromContext(r.Context())
+			if !ok {
+				http.Error(w, "Authentication required", http.StatusUnauthorized)
+				return
+			}
+			app := ""
+			if appID != nil {
+				app = appID(r)
+			}
+			if !Check(user, action, app) {
+				WriteForbidden(w, user, action, app)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,161 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"example.com/m/v2/logging"
+	"example.com/m/v2/store"
+)
+
+const (
+	// CookieName is the session cookie set on login.
+	CookieName = "being_session"
+	// SessionTTL is how long a login lasts before the user has to sign in again.
+	SessionTTL = 7 * 24 * time.Hour
+)
+
+type userKey struct{}
+
+// Sessions issues and checks login sessions.
+type Sessions struct {
+	db *store.DB
+	// secureCookie sets the Secure flag; only turn it off for plain-HTTP development.
+	secureCookie bool
+}
+
+// NewSessions creates a session manager backed by db.
+func NewSessions(db *store.DB, secureCookie bool) *Sessions {
+	return &Sessions{db: db, secureCookie: secureCookie}
+}
+
+// Start creates a session for user and sets its cookie on the response.
+func (s *Sessions) Start(w http.ResponseWriter, user *store.User) error {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return fmt.Errorf("failed to generate session token: %w", err)
+	}
+	token := base64.RawURLEncoding.EncodeToString(buf)
+
+	now := time.Now().UTC()
+	session := &store.Session{
+		ID:        hashSecret(token),
+		UserID:    user.ID,
+		CreatedAt: now,
+		ExpiresAt: now.Add(SessionTTL),
+	}
+	if err := s.db.CreateSession(session); err != nil {
+		return err
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     CookieName,
+		Value:    token,
+		Path:     "/",
+		Expires:  session.ExpiresAt,
+		HttpOnly: true,
+		Secure:   s.secureCookie,
+		SameSite: http.SameSiteStrictMode,
+	})
+	return nil
+}
+
+// End deletes the request's session, if any, and clears its cookie.
+func (s *Sessions) End(w http.ResponseWriter, r *http.Request) error {
+	if cookie, err := r.Cookie(CookieName); err == nil {
+		if err := s.db.DeleteSession(hashSecret(cookie.Value)); err != nil {
+			return err
+		}
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     CookieName,
+		Value:    "",
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   s.secureCookie,
+		SameSite: http.SameSiteStrictMode,
+	})
+	return nil
+}
+
+// Authenticate returns the user the request's session cookie belongs to.
+// It returns store.ErrNotFound when there is no valid session.
+func (s *Sessions) Authenticate(r *http.Request) (*store.User, error) {
+	cookie, err := r.Cookie(CookieName)
+	if err != nil {
+		return nil, fmt.Errorf("%w: no session cookie", store.ErrNotFound)
+	}
+	session, err := s.db.GetSession(hashSecret(cookie.Value))
+	if err != nil {
+		return nil, err
+	}
+	return s.db.GetUser(session.UserID)
+}
+
+// SessionID returns the stored ID of the request's session, or "" if it has no
+// session cookie.
+func SessionID(r *http.Request) string {
+	cookie, err := r.Cookie(CookieName)
+	if err != nil {
+		return ""
+	}
+	return hashSecret(cookie.Value)
+}
+
+// Require is middleware that rejects requests without a valid session or API token with 401.
+// The signed-in user is available to handlers through UserFromContext.
+func (s *Sessions) Require(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Scripts send an API token instead of a session cookie
+		if header := r.Header.Get("Authorization"); header != "" {
+			s.requireToken(w, r, header, next)
+			return
+		}
+
+		user, err := s.Authenticate(r)
+		if errors.Is(err, store.ErrNotFound) {
+			http.Error(w, "Authentication required", http.StatusUnauthorized)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Failed to check session", http.StatusInternalServerError)
+			logging.Errorf("Error checking session: %v", err)
+			return
+		}
+
+		// Cookies are sent on cross-site requests too; a custom header can only be set by
+		// same-origin scripts or CORS-approved ones, which rules out form-post CSRF.
+		if r.Method != http.MethodGet && r.Method != http.MethodHead && r.Header.Get("X-Requested-With") == "" {
+			http.Error(w, "Missing X-Requested-With header", http.StatusForbidden)
+			return
+		}
+
+		next.ServeHTTP(w, r.WithContext(WithUser(r.Context(), user)))
+	})
+}
+
+// WithUser returns a context carrying the signed-in user.
+func WithUser(ctx context.Context, user *store.User) context.Context {
+	return context.WithValue(ctx, userKey{}, user)
+}
+
+// UserFromContext returns the signed-in user set by Require, if any.
+func UserFromContext(ctx context.Context) (*store.User, bool) {
+	user, ok := ctx.Value(userKey{}).(*store.User)
+	return user, ok
+}
+
+// hashSecret derives the ID a secret is stored under: a session cookie's token
+// or an API token. Only the hash is stored, so a leaked database can't sign anyone in.
+func hashSecret(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,138 @@
+package auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"example.com/m/v2/store"
+)
+
+func newTestSessions(t *testing.T, secure bool) (*Sessions, *store.DB, *store.User) {
+	t.Helper()
+	db, err := store.Open(filepath.Join(t.TempDir(), "being.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	user := &store.User{ID: "u1", Username: "alice", Role: RoleAdmin}
+	if err := db.CreateUser(user); err != nil {
+		t.Fatal(err)
+	}
+	return NewSessions(db, secure), db, user
+}
+
+// startSession signs user in and returns the cookie the response set.
+func startSession(t *testing.T, s *Sessions, user *store.User) *http.Cookie {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	if err := s.Start(rec, user); err != nil {
+		t.Fatal(err)
+	}
+	cookies := rec.Result().Cookies()
+	if len(cookies) != 1 {
+		t.Fatalf("Start set %d cookies, want 1", len(cookies))
+	}
+	return cookies[0]
+}
+
+func TestStartCookie(t *testing.T) {
+	for _, secure := range []bool{true, false} {
+		s, db, user := newTestSessions(t, secure)
+		cookie := startSession(t, s, user)
+
+		if cookie.Name != CookieName || cookie.Path != "/" || !cookie.HttpOnly || cookie.SameSite != http.SameSiteStrictMode {
+			t.Errorf("cookie %+v, want %s on / with HttpOnly and SameSite=Strict", cookie, CookieName)
+		}
+		if cookie.Secure != secure {
+			t.Errorf("Secure = %v, want %v", cookie.Secure, secure)
+		}
+		if until := time.Until(cookie.Expires); until < SessionTTL-time.Minute || until > SessionTTL {
+			t.Errorf("cookie expires in %v, want %v", until, SessionTTL)
+		}
+		// The database only knows the token's hash
+		if _, err := db.GetSession(cookie.Value); err == nil {
+			t.Error("session stored under the raw token")
+		}
+		if _, err := db.GetSession(hashSecret(cookie.Value)); err != nil {
+			t.Errorf("session not stored under the token's hash: %v", err)
+		}
+	}
+}
+
+func TestEnd(t *testing.T) {
+	s, db, user := newTestSessions(t, true)
+	cookie := startSession(t, s, user)
+
+	req := httptest.NewRequest(http.MethodPost, "/api/auth/logout", nil)
+	req.AddCookie(cookie)
+	rec := httptest.NewRecorder()
+	if err := s.End(rec, req); err != nil {
+		t.Fatal(err)
+	}
+	if cleared := rec.Result().Cookies(); len(cleared) != 1 || cleared[0].MaxAge >= 0 || cleared[0].Value != "" {
+		t.Errorf("End set %+v, want the cookie cleared", cleared)
+	}
+	if _, err := db.GetSession(hashSecret(cookie.Value)); err == nil {
+		t.Error("session still exists after End")
+	}
+}
+
+func TestRequire(t *testing.T) {
+	tests := []struct {
+		name   string
+		method string
+		cookie bool
+		// expired backdates the session past its expiry.
+		expired       bool
+		requestedWith string
+		want          int
+	}{
+		{name: "no session", method: http.MethodGet, want: http.StatusUnauthorized},
+		{name: "GET", method: http.MethodGet, cookie: true, want: http.StatusOK},
+		{name: "HEAD", method: http.MethodHead, cookie: true, want: http.StatusOK},
+		{name: "POST with header", method: http.MethodPost, cookie: true, requestedWith: "XMLHttpRequest", want: http.StatusOK},
+		{name: "POST without header", method: http.MethodPost, cookie: true, want: http.StatusForbidden},
+		{name: "DELETE without header", method: http.MethodDelete, cookie: true, want: http.StatusForbidden},
+		{name: "expired", method: http.MethodGet, cookie: true, expired: true, want: http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, db, user := newTestSessions(t, true)
+			cookie := startSession(t, s, user)
+			if tt.expired {
+				session, err := db.GetSession(hashSecret(cookie.Value))
+				if err != nil {
+					t.Fatal(err)
+				}
+				session.ExpiresAt = time.Now().Add(-time.Second)
+				if err := db.CreateSession(session); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			var seen *store.User
+			handler := s.Require(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				seen, _ = UserFromContext(r.Context())
+			}))
+			req := httptest.NewRequest(tt.method, "/api/deployments", nil)
+			if tt.cookie {
+				req.AddCookie(cookie)
+			}
+			if tt.requestedWith != "" {
+				req.Header.Set("X-Requested-With", tt.requestedWith)
+			}
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+
+			if rec.Code != tt.want {
+				t.Fatalf("status %d, want %d", rec.Code, tt.want)
+			}
+			if tt.want == http.StatusOK && (seen == nil || seen.ID != user.ID) {
+				t.Errorf("handler saw user %+v, want %s", seen, user.ID)
+			}
+		})
+	}
+}
@@ -0,0 +1,121 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"example.com/m/v2/logging"
+	"example.com/m/v2/store"
+)
+
+// TokenPrefix starts every API token, which makes leaked tokens easy to grep for.
+const TokenPrefix = "bst_"
+
+// touchInterval limits how often a token's last-used time is written,
+// so a busy script doesn't turn every request into a database write.
+const touchInterval = time.Minute
+
+type tokenKey struct{}
+
+// NewToken generates an API token and returns it along with the hash to store.
+func NewToken() (token, hash string, err error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", "", fmt.Errorf("failed to generate token: %w", err)
+	}
+	token = TokenPrefix + base64.RawURLEncoding.EncodeToString(buf)
+	return token, hashSecret(token), nil
+}
+
+// MetricsPath is where Prometheus scrapes metrics. It lives outside /api, where
+// Prometheus looks by default, and a token can be restricted to it alone.
+const MetricsPath = "/metrics"
+
+// ValidEndpoint reports whether pattern can be used to restrict a token.
+// Patterns are API paths such as "/api/deploy", prefixes ending in "*"
+// such as "/api/deployments/*", or MetricsPath for a scraper's token.
+func ValidEndpoint(pattern string) bool {
+	if pattern == MetricsPath {
+		return true
+	}
+	return strings.HasPrefix(pattern, "/api/") && !strings.Contains(strings.TrimSuffix(pattern, "*"), "*")
+}
+
+// EndpointAllowed reports whether a token restricted to endpoints may call path.
+// An empty list allows every path.
+func EndpointAllowed(endpoints []string, path string) bool {
+	if len(endpoints) == 0 {
+		return true
+	}
+	for _, pattern := range endpoints {
+		if prefix, ok := strings.CutSuffix(pattern, "*"); ok {
+			if strings.HasPrefix(path, prefix) {
+				return true
+			}
+		} else if path == pattern {
+			return true
+		}
+	}
+	return false
+}
+
+// TokenFromContext returns the API token a request authenticated with, if it used one.
+func TokenFromContext(ctx context.Context) (*store.APIToken, bool) {
+	token, ok := ctx.Value(tokenKey{}).(*store.APIToken)
+	return token, ok
+}
+
+// requireToken authenticates a request by its Bearer token and, if the token
+// is valid and allowed on this path, calls next as the token's user.
+func (s *Sessions) requireToken(w http.ResponseWriter, r *http.Request, header string, next http.Handler) {
+	value, ok := strings.CutPrefix(header, "Bearer ")
+	if !ok || !strings.HasPrefix(value, TokenPrefix) {
+		http.Error(w, "Authorization must be a Bearer API token", http.StatusUnauthorized)
+		return
+	}
+
+	token, err := s.db.GetTokenByHash(hashSecret(value))
+	if errors.Is(err, store.ErrNotFound) {
+		http.Error(w, "Invalid or expired API token", http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to check API token", http.StatusInternalServerError)
+		logging.Errorf("Error checking API token: %v", err)
+		return
+	}
+	user, err := s.db.GetUser(token.UserID)
+	if err != nil {
+		http.Error(w, "Invalid or expired API token", http.StatusUnauthorized)
+		return
+	}
+
+	if !EndpointAllowed(token.Endpoints, r.URL.Path) {
+		logging.Warnf("Token %s of %s is not allowed on %s", token.ID, user.Username, r.URL.Path)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusForbidden)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"error":     "forbidden",
+			"message":   fmt.Sprintf("This API token is not allowed to call %s", r.URL.Path),
+			"endpoints": token.Endpoints,
+		})
+		return
+	}
+
+	now := time.Now().UTC()
+	if token.LastUsedAt == nil || now.Sub(*token.LastUsedAt) >= touchInterval {
+		if err := s.db.TouchToken(token.Hash, now); err != nil {
+			logging.Errorf("Error recording use of token %s: %v", token.ID, err)
+		}
+	}
+
+	ctx := context.WithValue(WithUser(r.Context(), user), tokenKey{}, token)
+	next.ServeHTTP(w, r.WithContext(ctx))
+}
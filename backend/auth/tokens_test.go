@@ -0,0 +1,43 @@
+package auth
+
+import "testing"
+
+func TestValidEndpoint(t *testing.T) {
+	tests := []struct {
+		pattern string
+		want    bool
+	}{
+		{"/api/deploy", true},
+		{"/api/deployments/*", true},
+		{MetricsPath, true},
+		{"/metrics/*", false},
+		{"/api/*/logs", false},
+		{"/", false},
+		{"/admin", false},
+	}
+	for _, tt := range tests {
+		if got := ValidEndpoint(tt.pattern); got != tt.want {
+			t.Errorf("ValidEndpoint(%q) = %v, want %v", tt.pattern, got, tt.want)
+		}
+	}
+}
+
+func TestEndpointAllowed(t *testing.T) {
+	tests := []struct {
+		endpoints []string
+		path      string
+		want      bool
+	}{
+		{nil, "/api/deploy", true},
+		{[]string{MetricsPath}, "/metrics", true},
+		{[]string{MetricsPath}, "/api/deployments", false},
+		{[]string{"/api/deployments/*"}, "/api/deployments/immich-1/logs", true},
+		{[]string{"/api/deployments/*"}, "/metrics", false},
+		{[]string{"/api/deploy"}, "/api/deploy/x", false},
+	}
+	for _, tt := range tests {
+		if got := EndpointAllowed(tt.endpoints, tt.path); got != tt.want {
+			t.Errorf("EndpointAllowed(%v, %q) = %v, want %v", tt.endpoints, tt.path, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,537 @@
+// Package catalog loads the declarative app manifests that describe everything
+// the backend knows about an app: its image, how the user's configuration maps
+// onto the container, the form fields the frontend renders, and validation rules.
+//
+// The built-in manifests are embedded from apps/*.json. Adding an app means adding
+// a manifest there, or dropping one into the catalog directory on disk.
+package catalog
+
+import (
+	"embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//go:embed apps/*.json
+var builtin embed.FS
+
+// App is a single app manifest.
+type App struct {
+	ID           string `json:"id"`
+	Name         string `json:"name"`
+	Version      string `json:"version"`
+	Title        string `json:"title"`
+	Description  string `json:"description"`
+	SecurityNote string `json:"securityNote,omitempty"`
+
+	// Image is the container image reference, including its tag.
+	Image string `json:"image"`
+	// ContainerPort is the port the application listens on inside the container.
+	ContainerPort string `json:"containerPort"`
+	// DefaultHostPort is published on the host when the user doesn't pick a port.
+	DefaultHostPort string `json:"defaultHostPort"`
+	// Volumes maps a named volume suffix to its mount point in the container.
+	Volumes map[string]string `json:"volumes,omitempty"`
+	// Binds mount host directories taken from the configuration into the container.
+	Binds []Bind `json:"binds,omitempty"`
+	// Env maps configuration fields onto container environment variables.
+	Env []EnvVar `json:"env,omitempty"`
+	// StaticEnv holds environment variables that are always set for the app.
+	StaticEnv map[string]string `json:"staticEnv,omitempty"`
+	// Health declares the probes that tell a working app from a merely running container.
+	Health *Health `json:"health,omitempty"`
+	// Services are the supporting containers the app runs with, such as its database.
+	Services []Service `json:"services,omitempty"`
+	// DependsOn names the services that must be healthy before the app starts.
+	DependsOn []string `json:"dependsOn,omitempty"`
+
+	// Fields is the form schema the frontend renders for the app.
+	Fields []Field `json:"fields"`
+	// Rules are app-specific checks run by /api/validate.
+	Rules []Rule `json:"rules,omitempty"`
+}
+
+// Bind mounts a host directory taken from the configuration into the container.
+type Bind struct {
+	Field    string `json:"field"`
+	Target   string `json:"target"`
+	ReadOnly bool   `json:"readOnly,omitempty"`
+}
+
+// EnvVar copies a configuration field into a container environment variable, or
+// with Service set instead, the host name another service of the stack is reached at.
+// Format is an optional fmt pattern applied to the value (e.g. "https://%s").
+type EnvVar struct {
+	Field   string `json:"field,omitempty"`
+	Service string `json:"service,omitempty"`
+	Name    string `json:"name"`
+	Format  string `json:"format,omitempty"`
+}
+
+// Service is a supporting container of an app's stack. Services share the
+// deployment's private network, where each is reached by its name, and take their
+// environment from the same configuration as the app, so one password field can
+// set up both a database and the app that uses it.
+type Service struct {
+	// Name identifies the service in the stack and is its host name there.
+	Name  string `json:"name"`
+	Image string `json:"image"`
+	// Port is the port the service listens on, which its probes default to.
+	Port string `json:"port,omitempty"`
+	// Volumes maps a named volume suffix to its mount point in the container.
+	Volumes   map[string]string `json:"volumes,omitempty"`
+	Env       []EnvVar          `json:"env,omitempty"`
+	StaticEnv map[string]string `json:"staticEnv,omitempty"`
+	Health    *Health           `json:"health,omitempty"`
+	// DependsOn names the services that must be healthy before this one starts.
+	DependsOn []string `json:"dependsOn,omitempty"`
+	// EnabledBy names a checkbox field; the service only runs when it's ticked.
+	EnabledBy string `json:"enabledBy,omitempty"`
+
+	// Binds is only set on the app's own entry in a stack; services keep their data in volumes.
+	Binds []Bind `json:"-"`
+}
+
+// Probe types.
+const (
+	// ProbeHTTP passes when a GET of Path answers with the expected status.
+	ProbeHTTP = "http"
+	// ProbeTCP passes when Port accepts a connection.
+	ProbeTCP = "tcp"
+	// ProbeExec passes when Command exits 0 inside the container.
+	ProbeExec = "exec"
+)
+
+// Health lists the probes an app must pass to count as working.
+type Health struct {
+	// Probes must all pass for the app to be healthy.
+	Probes []Probe `json:"probes"`
+	// StartupTimeout bounds how long a deploy waits for the probes to pass, as a
+	// duration such as "5m". Apps that migrate a database on first start need longer.
+	StartupTimeout string `json:"startupTimeout,omitempty"`
+}
+
+// Probe is one check of whether the app is working.
+type Probe struct {
+	Type string `json:"type"`
+	// Port is the container port http and tcp probes connect to; defaults to ContainerPort.
+	Port string `json:"port,omitempty"`
+	// Path is requested by http probes; defaults to "/".
+	Path string `json:"path,omitempty"`
+	// ExpectStatus is the status an http probe wants; any 2xx or 3xx passes when unset.
+	ExpectStatus int `json:"expectStatus,omitempty"`
+	// Command is run by exec probes, without a shell.
+	Command []string `json:"command,omitempty"`
+}
+
+// String describes the probe for health reports, e.g. "http :80/status.php".
+func (p Probe) String() string {
+	switch p.Type {
+	case ProbeHTTP:
+		path := p.Path
+		if path == "" {
+			path = "/"
+		}
+		return fmt.Sprintf("http :%s%s", p.Port, path)
+	case ProbeTCP:
+		return "tcp :" + p.Port
+	default:
+		return p.Type + " " + strings.Join(p.Command, " ")
+	}
+}
+
+// Field is one input in the app's deployment form.
+// It mirrors the field objects in frontend/src/lib/deploymentForms.js.
+type Field struct {
+	ID             string `json:"id"`
+	Label          string `json:"label"`
+	Type           string `json:"type"`
+	Placeholder    string `json:"placeholder,omitempty"`
+	Required       bool   `json:"required,omitempty"`
+	Description    string `json:"description,omitempty"`
+	Sensitive      bool   `json:"sensitive"`
+	GenerateOption bool   `json:"generateOption,omitempty"`
+}
+
+// Rule checks.
+const (
+	// CheckMin flags a positive number below Value.
+	CheckMin = "min"
+	// CheckMax flags a number above Value.
+	CheckMax = "max"
+	// CheckEnabled flags a checkbox that is turned on.
+	CheckEnabled = "enabled"
+	// CheckResolves flags a host name that doesn't resolve.
+	CheckResolves = "resolves"
+	// CheckNonEmptyDir flags an existing directory with nothing in it.
+	CheckNonEmptyDir = "nonEmptyDir"
+	// CheckDiskSpace checks a path can hold at least Value bytes.
+	CheckDiskSpace = "diskSpace"
+)
+
+var knownChecks = map[string]bool{
+	CheckMin: true, CheckMax: true, CheckEnabled: true,
+	CheckResolves: true, CheckNonEmptyDir: true, CheckDiskSpace: true,
+}
+
+// Rule is a declarative validation check on one configuration field.
+type Rule struct {
+	Field string  `json:"field"`
+	Check string  `json:"check"`
+	Value float64 `json:"value,omitempty"`
+	// Severity is "error", "warning" or "info", matching ValidationResult.Type.
+	Severity string `json:"severity"`
+	Message  string `json:"message"`
+}
+
+// Probes returns the app's health probes, with ports defaulted to ContainerPort.
+func (a *App) Probes() []Probe {
+	return a.Self().Probes()
+}
+
+// StartupTimeout returns how long a deploy should wait for the app to become
+// healthy, or 0 if the manifest leaves it to the backend.
+func (a *App) StartupTimeout() time.Duration {
+	return a.Self().StartupTimeout()
+}
+
+// Self describes the app's own container as a service of its stack, with no name.
+func (a *App) Self() Service {
+	return Service{
+		Image:     a.Image,
+		Port:      a.ContainerPort,
+		Volumes:   a.Volumes,
+		Env:       a.Env,
+		StaticEnv: a.StaticEnv,
+		Health:    a.Health,
+		DependsOn: a.DependsOn,
+		Binds:     a.Binds,
+	}
+}
+
+// Service returns the named service of the app's stack; "" is the app itself.
+func (a *App) Service(name string) (Service, bool) {
+	if name == "" {
+		return a.Self(), true
+	}
+	for _, svc := range a.Services {
+		if svc.Name == name {
+			return svc, true
+		}
+	}
+	return Service{}, false
+}
+
+// Stack returns the services config enables, dependencies before the services
+// that need them, ending with the app itself. validate has ruled out cycles.
+func (a *App) Stack(config map[string]interface{}) []Service {
+	var stack []Service
+	added := map[string]bool{}
+	var add func(svc Service)
+	add = func(svc Service) {
+		for _, dep := range svc.DependsOn {
+			if !added[dep] {
+				added[dep] = true
+				if next, ok := a.Service(dep); ok {
+					add(next)
+				}
+			}
+		}
+		stack = append(stack, svc)
+	}
+	for _, svc := range a.Services {
+		if !added[svc.Name] && svc.Enabled(config) {
+			added[svc.Name] = true
+			add(svc)
+		}
+	}
+	add(a.Self())
+	return stack
+}
+
+// Enabled reports whether config turns the service on.
+func (s Service) Enabled(config map[string]interface{}) bool {
+	if s.EnabledBy == "" {
+		return true
+	}
+	switch v := config[s.EnabledBy].(type) {
+	case bool:
+		return v
+	case string:
+		return v == "true"
+	default:
+		return false
+	}
+}
+
+// Probes returns the service's health probes, with ports defaulted to its own.
+func (s Service) Probes() []Probe {
+	if s.Health == nil {
+		return nil
+	}
+	probes := make([]Probe, len(s.Health.Probes))
+	for i, probe := range s.Health.Probes {
+		if probe.Port == "" && probe.Type != ProbeExec {
+			probe.Port = s.Port
+		}
+		probes[i] = probe
+	}
+	return probes
+}
+
+// StartupTimeout returns how long to wait for the service to become healthy, or 0
+// if the manifest leaves it to the backend.
+func (s Service) StartupTimeout() time.Duration {
+	if s.Health == nil {
+		return 0
+	}
+	// validate has already checked it parses
+	timeout, _ := time.ParseDuration(s.Health.StartupTimeout)
+	return timeout
+}
+
+// SensitiveField reports whether the manifest marks a field as sensitive.
+func (a *App) SensitiveField(fieldID string) bool {
+	for _, field := range a.Fields {
+		if field.ID == fieldID {
+			return field.Sensitive
+		}
+	}
+	return false
+}
+
+// Catalog holds every loaded app manifest.
+type Catalog struct {
+	apps map[string]*App
+}
+
+// Load reads the built-in manifests, then any *.json manifests in dir.
+// A manifest in dir replaces a built-in one with the same ID. dir may be empty.
+func Load(dir string) (*Catalog, error) {
+	c := &Catalog{apps: make(map[string]*App)}
+
+	if err := c.loadFS(builtin, "apps"); err != nil {
+		return nil, err
+	}
+	if dir != "" {
+		if _, err := os.Stat(dir); errors.Is(err, fs.ErrNotExist) {
+			return c, nil
+		}
+		if err := c.loadFS(os.DirFS(dir), "."); err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// Get returns the manifest for an app ID.
+func (c *Catalog) Get(appID string) (*App, bool) {
+	app, ok := c.apps[appID]
+	return app, ok
+}
+
+// List returns every app, sorted by ID.
+func (c *Catalog) List() []*App {
+	apps := make([]*App, 0, len(c.apps))
+	for _, app := range c.apps {
+		apps = append(apps, app)
+	}
+	sort.Slice(apps, func(i, j int) bool { return apps[i].ID < apps[j].ID })
+	return apps
+}
+
+// loadFS loads every manifest in a directory of fsys.
+func (c *Catalog) loadFS(fsys fs.FS, dir string) error {
+	paths, err := fs.Glob(fsys, path.Join(dir, "*.json"))
+	if err != nil {
+		return err
+	}
+	for _, p := range paths {
+		data, err := fs.ReadFile(fsys, p)
+		if err != nil {
+			return fmt.Errorf("failed to read manifest %s: %w", p, err)
+		}
+		var app App
+		if err := json.Unmarshal(data, &app); err != nil {
+			return fmt.Errorf("failed to parse manifest %s: %w", p, err)
+		}
+		if err := app.validate(); err != nil {
+			return fmt.Errorf("invalid manifest %s: %w", p, err)
+		}
+		c.apps[app.ID] = &app
+	}
+	return nil
+}
+
+// appIDPattern keeps IDs safe for Docker names, Helm releases and URLs.
+var appIDPattern = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]*[a-z0-9])?$`)
+
+// validate checks a manifest is complete and internally consistent.
+func (a *App) validate() error {
+	if !appIDPattern.MatchString(a.ID) {
+		return fmt.Errorf("id %q must be lowercase letters, digits and dashes", a.ID)
+	}
+	if a.Image == "" {
+		return errors.New("image is required")
+	}
+	if _, err := strconv.Atoi(a.ContainerPort); err != nil {
+		return fmt.Errorf("containerPort %q is not a number", a.ContainerPort)
+	}
+
+	// Everything that refers to a field must refer to one the form actually has.
+	fields := map[string]bool{"port": true}
+	for _, field := range a.Fields {
+		if field.ID == "" {
+			return errors.New("every field needs an id")
+		}
+		fields[field.ID] = true
+	}
+	for _, bind := range a.Binds {
+		if !fields[bind.Field] {
+			return fmt.Errorf("bind refers to unknown field %q", bind.Field)
+		}
+	}
+	if err := a.validateServices(fields); err != nil {
+		return err
+	}
+	if err := a.Self().validate(a, fields); err != nil {
+		return err
+	}
+	for _, rule := range a.Rules {
+		if !fields[rule.Field] {
+			return fmt.Errorf("rule refers to unknown field %q", rule.Field)
+		}
+		if !knownChecks[rule.Check] {
+			return fmt.Errorf("rule on %s has unknown check %q", rule.Field, rule.Check)
+		}
+	}
+	return nil
+}
+
+// validateServices checks the services of the stack are named uniquely, and that
+// dependencies between them can be started in some order.
+func (a *App) validateServices(fields map[string]bool) error {
+	names := map[string]bool{}
+	for _, svc := range a.Services {
+		if !appIDPattern.MatchString(svc.Name) {
+			return fmt.Errorf("service name %q must be lowercase letters, digits and dashes", svc.Name)
+		}
+		if names[svc.Name] {
+			return fmt.Errorf("service %s is declared twice", svc.Name)
+		}
+		names[svc.Name] = true
+	}
+	for _, svc := range a.Services {
+		if svc.Image == "" {
+			return fmt.Errorf("service %s needs an image", svc.Name)
+		}
+		if svc.EnabledBy != "" && !fields[svc.EnabledBy] {
+			return fmt.Errorf("service %s is enabled by unknown field %q", svc.Name, svc.EnabledBy)
+		}
+		if err := svc.validate(a, fields); err != nil {
+			return fmt.Errorf("service %s: %w", svc.Name, err)
+		}
+	}
+
+	// Walk the dependencies from every service; meeting one again on the way is a cycle
+	const (
+		visiting = 1
+		done     = 2
+	)
+	state := map[string]int{}
+	var visit func(name string, deps []string) error
+	visit = func(name string, deps []string) error {
+		state[name] = visiting
+		for _, dep := range deps {
+			svc, ok := a.Service(dep)
+			if dep == "" || !ok {
+				return fmt.Errorf("%s depends on unknown service %q", name, dep)
+			}
+			switch state[dep] {
+			case visiting:
+				return fmt.Errorf("services %s and %s form a dependency cycle", name, dep)
+			case 0:
+				if err := visit(dep, svc.DependsOn); err != nil {
+					return err
+				}
+			}
+		}
+		state[name] = done
+		return nil
+	}
+	for _, svc := range a.Services {
+		if state[svc.Name] == 0 {
+			if err := visit(svc.Name, svc.DependsOn); err != nil {
+				return err
+			}
+		}
+	}
+	return visit(a.ID, a.DependsOn)
+}
+
+// validate checks a service's env and probes refer to things that exist.
+func (s Service) validate(a *App, fields map[string]bool) error {
+	if s.Port != "" {
+		if _, err := strconv.Atoi(s.Port); err != nil {
+			return fmt.Errorf("port %q is not a number", s.Port)
+		}
+	}
+	for _, env := range s.Env {
+		switch {
+		case env.Field != "" && env.Service != "":
+			return fmt.Errorf("env %s takes either a field or a service, not both", env.Name)
+		case env.Service != "":
+			if _, ok := a.Service(env.Service); !ok || env.Service == "" {
+				return fmt.Errorf("env %s refers to unknown service %q", env.Name, env.Service)
+			}
+		case !fields[env.Field]:
+			return fmt.Errorf("env %s refers to unknown field %q", env.Name, env.Field)
+		}
+	}
+	if s.Health != nil {
+		return s.Health.validate()
+	}
+	return nil
+}
+
+// validate checks every probe has what its type needs.
+func (h *Health) validate() error {
+	if h.StartupTimeout != "" {
+		if timeout, err := time.ParseDuration(h.StartupTimeout); err != nil || timeout <= 0 {
+			return fmt.Errorf("health startupTimeout %q is not a positive duration", h.StartupTimeout)
+		}
+	}
+	for _, probe := range h.Probes {
+		if probe.Port != "" {
+			if _, err := strconv.Atoi(probe.Port); err != nil {
+				return fmt.Errorf("health probe port %q is not a number", probe.Port)
+			}
+		}
+		switch probe.Type {
+		case ProbeHTTP:
+			if probe.Path != "" && !strings.HasPrefix(probe.Path, "/") {
+				return fmt.Errorf("health probe path %q must start with /", probe.Path)
+			}
+			if probe.ExpectStatus != 0 && (probe.ExpectStatus < 100 || probe.ExpectStatus > 599) {
+				return fmt.Errorf("health probe expects invalid status %d", probe.ExpectStatus)
+			}
+		case ProbeTCP:
+		case ProbeExec:
+			if len(probe.Command) == 0 {
+				return errors.New("exec health probe needs a command")
+			}
+		default:
+			return fmt.Errorf("health probe has unknown type %q", probe.Type)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,187 @@
+package catalog
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// parseApp reads a manifest without validating it.
+func parseApp(t *testing.T, manifest string) *App {
+	t.Helper()
+	var app App
+	if err := json.Unmarshal([]byte(manifest), &app); err != nil {
+		t.Fatal(err)
+	}
+	return &app
+}
+
+// stackNames lists a stack by service name, with "app" for the app itself.
+func stackNames(stack []Service) []string {
+	names := make([]string, len(stack))
+	for i, svc := range stack {
+		names[i] = svc.Name
+		if svc.Name == "" {
+			names[i] = "app"
+		}
+	}
+	return names
+}
+
+func TestStack(t *testing.T) {
+	tests := []struct {
+		name     string
+		manifest string
+		config   map[string]interface{}
+		want     []string
+	}{
+		{
+			name:     "no services",
+			manifest: `{"id": "web", "image": "web:1", "containerPort": "80"}`,
+			want:     []string{"app"},
+		},
+		{
+			// Services come up before what depends on them, whatever order they're declared in
+			name: "chain declared backwards",
+			manifest: `{"id": "web", "image": "web:1", "containerPort": "80", "dependsOn": ["cache"],
+				"services": [
+					{"name": "cache", "image": "redis:7", "dependsOn": ["database"]},
+					{"name": "database", "image": "postgres:16"}
+				]}`,
+			want: []string{"database", "cache", "app"},
+		},
+		{
+			name: "shared dependency started once",
+			manifest: `{"id": "web", "image": "web:1", "containerPort": "80", "dependsOn": ["worker", "search"],
+				"services": [
+					{"name": "worker", "image": "worker:1", "dependsOn": ["database"]},
+					{"name": "search", "image": "search:1", "dependsOn": ["database"]},
+					{"name": "database", "image": "postgres:16"}
+				]}`,
+			want: []string{"database", "worker", "search", "app"},
+		},
+		{
+			name: "optional service off",
+			manifest: `{"id": "web", "image": "web:1", "containerPort": "80", "dependsOn": ["database"],
+				"fields": [{"id": "ml", "label": "ML", "type": "checkbox"}],
+				"services": [
+					{"name": "database", "image": "postgres:16"},
+					{"name": "ml", "image": "ml:1", "enabledBy": "ml"}
+				]}`,
+			config: map[string]interface{}{"ml": false},
+			want:   []string{"database", "app"},
+		},
+		{
+			name: "optional service on",
+			manifest: `{"id": "web", "image": "web:1", "containerPort": "80", "dependsOn": ["database"],
+				"fields": [{"id": "ml", "label": "ML", "type": "checkbox"}],
+				"services": [
+					{"name": "database", "image": "postgres:16"},
+					{"name": "ml", "image": "ml:1", "enabledBy": "ml"}
+				]}`,
+			config: map[string]interface{}{"ml": "true"},
+			want:   []string{"database", "ml", "app"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := parseApp(t, tt.manifest)
+			if err := app.validate(); err != nil {
+				t.Fatalf("validate: %v", err)
+			}
+			if got := stackNames(app.Stack(tt.config)); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Stack = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateServices(t *testing.T) {
+	tests := []struct {
+		name      string
+		dependsOn string
+		services  string
+		wantErr   string
+	}{
+		{
+			name:      "unknown dependency of the app",
+			dependsOn: `["database"]`,
+			services:  `[]`,
+			wantErr:   `web depends on unknown service "database"`,
+		},
+		{
+			name:      "unknown dependency of a service",
+			dependsOn: `["cache"]`,
+			services:  `[{"name": "cache", "image": "redis:7", "dependsOn": ["database"]}]`,
+			wantErr:   `cache depends on unknown service "database"`,
+		},
+		{
+			// "" is the app itself, which no service can wait for
+			name:      "dependency on the app",
+			dependsOn: `[]`,
+			services:  `[{"name": "cache", "image": "redis:7", "dependsOn": [""]}]`,
+			wantErr:   `cache depends on unknown service ""`,
+		},
+		{
+			name:      "service depends on itself",
+			dependsOn: `[]`,
+			services:  `[{"name": "cache", "image": "redis:7", "dependsOn": ["cache"]}]`,
+			wantErr:   "dependency cycle",
+		},
+		{
+			name:      "cycle",
+			dependsOn: `["a"]`,
+			services: `[
+				{"name": "a", "image": "a:1", "dependsOn": ["b"]},
+				{"name": "b", "image": "b:1", "dependsOn": ["c"]},
+				{"name": "c", "image": "c:1", "dependsOn": ["a"]}
+			]`,
+			wantErr: "dependency cycle",
+		},
+		{
+			name:      "duplicate service",
+			dependsOn: `[]`,
+			services:  `[{"name": "db", "image": "postgres:16"}, {"name": "db", "image": "mysql:8"}]`,
+			wantErr:   "service db is declared twice",
+		},
+		{
+			name:      "valid",
+			dependsOn: `["a", "b"]`,
+			services:  `[{"name": "a", "image": "a:1", "dependsOn": ["b"]}, {"name": "b", "image": "b:1"}]`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := parseApp(t, `{"id": "web", "image": "web:1", "containerPort": "80",
+				"dependsOn": `+tt.dependsOn+`, "services": `+tt.services+`}`)
+			err := app.validate()
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("validate: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("validate = %v, want an error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestLoadBuiltin(t *testing.T) {
+	c, err := Load("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(c.List()) == 0 {
+		t.Fatal("no built-in apps")
+	}
+	// Every built-in stack ends with its app, after all of its services
+	for _, app := range c.List() {
+		stack := app.Stack(nil)
+		if last := stack[len(stack)-1]; last.Name != "" {
+			t.Errorf("%s: stack ends with %s, not the app", app.ID, last.Name)
+		}
+	}
+}
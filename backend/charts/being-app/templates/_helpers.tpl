@@ -0,0 +1,42 @@
+{{- define "being-app.labels" -}}
+app.kubernetes.io/instance: {{ .Release.Name }}
+app.kubernetes.io/managed-by: {{ .Release.Service }}
+helm.sh/chart: {{ .Chart.Name }}-{{ .Chart.Version }}
+{{- with .Values.labels }}
+{{ toYaml . }}
+{{- end }}
+{{- end }}
+
+{{- define "being-app.selectorLabels" -}}
+app.kubernetes.io/instance: {{ .Release.Name }}
+{{- end }}
+
+{{- /*
+Labels for the workloads of a stack's services. They leave out the instance label,
+so the app's Service, which selects on it, never sends them traffic.
+Called with a dict of the chart root and the service.
+*/}}
+{{- define "being-app.serviceLabels" -}}
+being.software/stack: {{ .root.Release.Name }}
+being.software/service: {{ .service.name }}
+app.kubernetes.io/managed-by: {{ .root.Release.Service }}
+helm.sh/chart: {{ .root.Chart.Name }}-{{ .root.Chart.Version }}
+{{- with .root.Values.labels }}
+{{ toYaml . }}
+{{- end }}
+{{- end }}
+
+{{- /*
+Init containers that hold a pod back until the services in a waitFor list accept
+connections, which their Services only do once a pod behind them is ready.
+*/}}
+{{- define "being-app.waitFor" -}}
+{{- range . }}
+- name: wait-for-{{ .name }}
+  image: busybox:1.36
+  command:
+    - sh
+    - -c
+    - until nc -z {{ .host }} {{ .port }}; do echo "waiting for {{ .name }}"; sleep 2; done
+{{- end }}
+{{- end }}
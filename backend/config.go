@@ -0,0 +1,387 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"example.com/m/v2/logging"
+)
+
+// serverConfig is everything the backend needs to start.
+//
+// Settings are read from defaults, then the JSON file named by -config or CONFIG_FILE,
+// then environment variables, then command-line flags; each layer overrides the one before.
+type serverConfig struct {
+	// Listen is the address the HTTP server binds, e.g. ":8081" or "127.0.0.1:8081".
+	Listen string `json:"listen"`
+	// TLSCert and TLSKey serve HTTPS when both are set.
+	TLSCert string `json:"tls_cert"`
+	TLSKey  string `json:"tls_key"`
+	// CORSOrigins may make credentialed requests from a browser.
+	CORSOrigins []string `json:"cors_origins"`
+	// CookieSecure marks session cookies Secure; only turn it off for plain-HTTP development.
+	CookieSecure bool `json:"cookie_secure"`
+
+	// DockerHost overrides DOCKER_HOST for the Docker client, e.g. "unix:///var/run/docker.sock".
+	DockerHost    string `json:"docker_host"`
+	DeployBackend string `json:"deploy_backend"`
+	DataDir       string `json:"data_dir"`
+	CatalogDir    string `json:"catalog_dir"`
+	VaultKeyFile  string `json:"vault_key_file"`
+	LogLevel      string `json:"log_level"`
+	// WebDir serves the frontend from disk instead of the copy built into the binary.
+	WebDir string `json:"web_dir"`
+	// MetricsEnabled serves Prometheus metrics at /metrics, behind the same auth as the API.
+	MetricsEnabled bool `json:"metrics_enabled"`
+
+	// RequestTimeout bounds ordinary API requests; event streams are exempt.
+	RequestTimeout duration `json:"request_timeout"`
+	// ReadHeaderTimeout bounds how long a client may take to send request headers.
+	ReadHeaderTimeout duration `json:"read_header_timeout"`
+	// IdleTimeout closes keep-alive connections that sit unused.
+	IdleTimeout duration `json:"idle_timeout"`
+	// ShutdownTimeout is how long requests and deployments get to finish on SIGTERM.
+	ShutdownTimeout duration `json:"shutdown_timeout"`
+	// ReplayWindow and RequestRetention configure replay protection; see replay.go.
+	ReplayWindow     duration `json:"replay_window"`
+	RequestRetention duration `json:"request_retention"`
+	// StatsInterval is how often container resource usage is sampled.
+	StatsInterval duration `json:"stats_interval"`
+	// HealthInterval is how often every deployment's health probes are run.
+	HealthInterval duration `json:"health_interval"`
+	// UpdateCheckInterval is how often registries are asked about newer images.
+	UpdateCheckInterval duration `json:"update_check_interval"`
+	// Helm configures the helm deploy backend; the docker one ignores it.
+	Helm helmConfig `json:"helm"`
+}
+
+// helmConfig selects the helm binary, chart and cluster the helm backend deploys with.
+type helmConfig struct {
+	// Binary is the helm executable, looked up on the PATH unless it's a path.
+	Binary string `json:"binary"`
+	// Chart is the chart every app is installed from: a directory, archive or repo/name reference.
+	Chart     string `json:"chart"`
+	Namespace string `json:"namespace"`
+	// KubeConfig and KubeContext select the cluster the way kubectl does; without
+	// either, the default kubeconfig or the in-cluster service account is used.
+	KubeConfig  string `json:"kubeconfig"`
+	KubeContext string `json:"kube_context"`
+}
+
+// duration is a time.Duration written as a Go duration string ("60s", "5m") in the config file.
+type duration time.Duration
+
+// UnmarshalJSON parses a duration string.
+func (d *duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("durations are strings such as \"60s\": %w", err)
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = duration(parsed)
+	return nil
+}
+
+// String formats the duration like time.Duration, for flag defaults and errors.
+func (d duration) String() string { return time.Duration(d).String() }
+
+// Set parses a duration from a flag.
+func (d *duration) Set(s string) error {
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = duration(parsed)
+	return nil
+}
+
+// defaultConfig returns the settings used when nothing overrides them.
+func defaultConfig() serverConfig {
+	return serverConfig{
+		Listen:              ":8081",
+		CORSOrigins:         []string{"http://localhost:5173", "http://127.0.0.1:5173"},
+		CookieSecure:        true,
+		DeployBackend:       "docker",
+		DataDir:             "data",
+		LogLevel:            "info",
+		RequestTimeout:      duration(60 * time.Second),
+		ReadHeaderTimeout:   duration(10 * time.Second),
+		IdleTimeout:         duration(2 * time.Minute),
+		ShutdownTimeout:     duration(30 * time.Second),
+		ReplayWindow:        duration(5 * time.Minute),
+		RequestRetention:    duration(24 * time.Hour),
+		StatsInterval:       duration(15 * time.Second),
+		HealthInterval:      duration(30 * time.Second),
+		UpdateCheckInterval: duration(6 * time.Hour),
+		Helm: helmConfig{
+			Binary:    "helm",
+			Chart:     "charts/being-app",
+			Namespace: "being-software",
+		},
+	}
+}
+
+// loadConfig builds the server config from the config file, the environment and args,
+// and validates the result. Every problem found is reported, not just the first.
+func loadConfig(args []string) (serverConfig, error) {
+	cfg := defaultConfig()
+
+	// The config file is named before anything else is parsed, since it is the lowest layer.
+	flags := flag.NewFlagSet("being", flag.ContinueOnError)
+	configFile := flags.String("config", os.Getenv("CONFIG_FILE"), "path to a JSON config file")
+	listen := flags.String("listen", "", "address to listen on, e.g. :8081")
+	tlsCert := flags.String("tls-cert", "", "TLS certificate file")
+	tlsKey := flags.String("tls-key", "", "TLS private key file")
+	corsOrigins := flags.String("cors-origins", "", "comma-separated origins allowed to call the API from a browser")
+	dockerHost := flags.String("docker-host", "", "Docker daemon address")
+	dataDir := flags.String("data-dir", "", "directory for the database and vault key")
+	logLevel := flags.String("log-level", "", "debug, info, warn or error")
+	webDir := flags.String("web-dir", "", "serve the frontend from this directory instead of the built-in copy")
+	var requestTimeout duration
+	flags.Var(&requestTimeout, "request-timeout", "timeout for API requests, e.g. 60s")
+	if err := flags.Parse(args); err != nil {
+		return cfg, err
+	}
+
+	if *configFile != "" {
+		if err := cfg.readFile(*configFile); err != nil {
+			return cfg, err
+		}
+	}
+	if err := cfg.applyEnv(); err != nil {
+		return cfg, err
+	}
+
+	// Only flags given on the command line override the layers below.
+	flags.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "listen":
+			cfg.Listen = *listen
+		case "tls-cert":
+			cfg.TLSCert = *tlsCert
+		case "tls-key":
+			cfg.TLSKey = *tlsKey
+		case "cors-origins":
+			cfg.CORSOrigins = splitList(*corsOrigins)
+		case "docker-host":
+			cfg.DockerHost = *dockerHost
+		case "data-dir":
+			cfg.DataDir = *dataDir
+		case "log-level":
+			cfg.LogLevel = *logLevel
+		case "web-dir":
+			cfg.WebDir = *webDir
+		case "request-timeout":
+			cfg.RequestTimeout = requestTimeout
+		}
+	})
+
+	return cfg, cfg.validate()
+}
+
+// readFile overlays the settings in a JSON config file. Unknown keys are rejected
+// so a typo doesn't silently leave a setting at its default.
+func (cfg *serverConfig) readFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read config file: %w", err)
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(cfg); err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("failed to parse config file %s: %w", path, err)
+	}
+	return nil
+}
+
+// applyEnv overlays settings from environment variables.
+func (cfg *serverConfig) applyEnv() error {
+	settings := map[string]*string{
+		"LISTEN_ADDR":    &cfg.Listen,
+		"TLS_CERT_FILE":  &cfg.TLSCert,
+		"TLS_KEY_FILE":   &cfg.TLSKey,
+		"DOCKER_HOST":    &cfg.DockerHost,
+		"DEPLOY_BACKEND": &cfg.DeployBackend,
+		"DATA_DIR":       &cfg.DataDir,
+		"CATALOG_DIR":    &cfg.CatalogDir,
+		"VAULT_KEY_FILE": &cfg.VaultKeyFile,
+		"LOG_LEVEL":      &cfg.LogLevel,
+		"WEB_DIR":        &cfg.WebDir,
+		"HELM_BINARY":    &cfg.Helm.Binary,
+		"HELM_CHART":     &cfg.Helm.Chart,
+		"KUBE_NAMESPACE": &cfg.Helm.Namespace,
+		"KUBECONFIG":     &cfg.Helm.KubeConfig,
+		"KUBE_CONTEXT":   &cfg.Helm.KubeContext,
+	}
+	for name, dest := range settings {
+		if value := os.Getenv(name); value != "" {
+			*dest = value
+		}
+	}
+
+	durations := map[string]*duration{
+		"REQUEST_TIMEOUT":       &cfg.RequestTimeout,
+		"READ_HEADER_TIMEOUT":   &cfg.ReadHeaderTimeout,
+		"IDLE_TIMEOUT":          &cfg.IdleTimeout,
+		"SHUTDOWN_TIMEOUT":      &cfg.ShutdownTimeout,
+		"REPLAY_WINDOW":         &cfg.ReplayWindow,
+		"REQUEST_RETENTION":     &cfg.RequestRetention,
+		"STATS_INTERVAL":        &cfg.StatsInterval,
+		"HEALTH_INTERVAL":       &cfg.HealthInterval,
+		"UPDATE_CHECK_INTERVAL": &cfg.UpdateCheckInterval,
+	}
+	for name, dest := range durations {
+		if value := os.Getenv(name); value != "" {
+			if err := dest.Set(value); err != nil {
+				return fmt.Errorf("invalid %s %q: %w", name, value, err)
+			}
+		}
+	}
+
+	if value := os.Getenv("CORS_ORIGINS"); value != "" {
+		cfg.CORSOrigins = splitList(value)
+	}
+	if value := os.Getenv("COOKIE_SECURE"); value != "" {
+		secure, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("invalid COOKIE_SECURE %q: %w", value, err)
+		}
+		cfg.CookieSecure = secure
+	}
+	if value := os.Getenv("METRICS_ENABLED"); value != "" {
+		enabled, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("invalid METRICS_ENABLED %q: %w", value, err)
+		}
+		cfg.MetricsEnabled = enabled
+	}
+	return nil
+}
+
+// validate checks the settings make sense together.
+func (cfg *serverConfig) validate() error {
+	var errs []error
+	fail := func(format string, args ...interface{}) {
+		errs = append(errs, fmt.Errorf(format, args...))
+	}
+
+	if _, port, err := net.SplitHostPort(cfg.Listen); err != nil {
+		fail("listen %q must be host:port or :port", cfg.Listen)
+	} else if n, err := strconv.Atoi(port); err != nil || n < 0 || n > 65535 {
+		fail("listen %q has an invalid port", cfg.Listen)
+	}
+
+	if (cfg.TLSCert == "") != (cfg.TLSKey == "") {
+		fail("tls_cert and tls_key must be set together")
+	}
+	for _, file := range []string{cfg.TLSCert, cfg.TLSKey} {
+		if file == "" {
+			continue
+		}
+		if _, err := os.Stat(file); err != nil {
+			fail("TLS file %s is not readable: %v", file, err)
+		}
+	}
+
+	// Credentialed requests can't use a wildcard, and a sloppy origin would never match.
+	for _, origin := range cfg.CORSOrigins {
+		if origin == "*" {
+			fail("cors_origins can't contain \"*\": list each origin that serves the frontend")
+			continue
+		}
+		u, err := url.Parse(origin)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || (u.Path != "" && u.Path != "/") || u.RawQuery != "" {
+			fail("cors origin %q must look like https://host[:port]", origin)
+		}
+	}
+	if !cfg.CookieSecure && cfg.TLSCert != "" {
+		logging.Warnf("Cookie_secure is off although TLS is enabled")
+	}
+
+	if cfg.DeployBackend != "docker" && cfg.DeployBackend != "helm" {
+		fail("deploy_backend %q must be docker or helm", cfg.DeployBackend)
+	}
+	if cfg.DeployBackend == "helm" {
+		if _, err := exec.LookPath(cfg.Helm.Binary); err != nil {
+			fail("helm.binary %q is not an executable: %v", cfg.Helm.Binary, err)
+		}
+		if cfg.Helm.Chart == "" {
+			fail("helm.chart can't be empty")
+		}
+		if len(cfg.Helm.Namespace) > 63 || !namespacePattern.MatchString(cfg.Helm.Namespace) {
+			fail("helm.namespace %q is not a valid Kubernetes namespace", cfg.Helm.Namespace)
+		}
+		// Like KUBECONFIG, this may list several files
+		for _, path := range filepath.SplitList(cfg.Helm.KubeConfig) {
+			if _, err := os.Stat(path); err != nil {
+				fail("helm.kubeconfig %s is not readable: %v", path, err)
+			}
+		}
+	}
+	if cfg.DataDir == "" {
+		fail("data_dir can't be empty")
+	}
+	if cfg.WebDir != "" {
+		if info, err := os.Stat(cfg.WebDir); err != nil || !info.IsDir() {
+			fail("web_dir %s is not a directory", cfg.WebDir)
+		}
+	}
+	if _, ok := logging.Levels[cfg.LogLevel]; !ok {
+		fail("log_level %q must be debug, info, warn or error", cfg.LogLevel)
+	}
+
+	timeouts := []struct {
+		name  string
+		value duration
+	}{
+		{"request_timeout", cfg.RequestTimeout},
+		{"read_header_timeout", cfg.ReadHeaderTimeout},
+		{"idle_timeout", cfg.IdleTimeout},
+		{"shutdown_timeout", cfg.ShutdownTimeout},
+		{"replay_window", cfg.ReplayWindow},
+		{"request_retention", cfg.RequestRetention},
+		{"stats_interval", cfg.StatsInterval},
+		{"health_interval", cfg.HealthInterval},
+		{"update_check_interval", cfg.UpdateCheckInterval},
+	}
+	for _, t := range timeouts {
+		if t.value <= 0 {
+			fail("%s must be positive, got %s", t.name, t.value)
+		}
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("invalid configuration:\n%w", errors.Join(errs...))
+	}
+	return nil
+}
+
+// namespacePattern matches a Kubernetes namespace name, an RFC 1123 label.
+var namespacePattern = regexp.MustCompile(`^[a-z0-9]([-a-z0-9]*[a-z0-9])?$`)
+
+// splitList splits a comma-separated setting, dropping blanks.
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
@@ -0,0 +1,228 @@
+package deploy
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"example.com/m/v2/catalog"
+)
+
+var (
+	// ErrUnknownApp is returned when a deployment is requested for an app missing from the catalog.
+	ErrUnknownApp = errors.New("unknown app")
+	// ErrNotFound is returned when a deployment ID doesn't match anything the backend manages.
+	ErrNotFound = errors.New("deployment not found")
+	// ErrNotAdoptable is returned when an existing workload can't be brought under management as asked.
+	ErrNotAdoptable = errors.New("workload cannot be adopted")
+	// ErrRolledBack is wrapped by a PipelineError when every step the failed operation
+	// had completed was undone, leaving the deployment as it was before it started.
+	ErrRolledBack = errors.New("failed and was rolled back")
+)
+
+// Deployer is implemented by every backend that can run apps (Docker, Helm, ...).
+// The backend is picked once at startup and shared by all handlers.
+type Deployer interface {
+	// Deploy creates a new deployment of an app from the user's configuration.
+	// The deployment ID comes from NewDeploymentID so callers can record it up front.
+	// If a step fails, whatever was created is removed again and the error is a
+	// *PipelineError listing the steps.
+	Deploy(ctx context.Context, deploymentID, appID string, config map[string]interface{}) (*Result, error)
+	// Destroy removes a deployment, reporting the outcome of every step.
+	Destroy(ctx context.Context, deploymentID string, opts DestroyOptions) (*DestroyReport, error)
+	// Status reports the live state of a deployment.
+	Status(ctx context.Context, deploymentID string) (*Status, error)
+	// Update re-applies a deployment with a new configuration, keeping its data and
+	// the image it runs.
+	// If a step fails, the previous containers are restored as for Upgrade.
+	Update(ctx context.Context, deploymentID string, config map[string]interface{}) (*Result, error)
+	// Upgrade moves a deployment to another image of its app, keeping its configuration
+	// and data. If the new image doesn't become healthy the previous one is restored
+	// and the error is a *PipelineError wrapping ErrRolledBack.
+	Upgrade(ctx context.Context, deploymentID string, config map[string]interface{}, image string) (*Result, error)
+	// Restore undoes an Upgrade or Update that was cut off part way, such as by a
+	// crash, putting back what it had set aside. It returns ErrNotFound if nothing
+	// was set aside: the change either hadn't started replacing anything or finished.
+	Restore(ctx context.Context, deploymentID string) (*Result, error)
+	// List reports every deployment the backend has resources for, found by their
+	// ownership labels, whether or not the store still knows about it.
+	List(ctx context.Context) ([]*Status, error)
+	// Adopt brings an existing workload under management. One this backend created keeps
+	// its deployment and app IDs; anything else becomes a new deployment of appID.
+	Adopt(ctx context.Context, ref, appID string) (*Result, error)
+	// Logs streams the output of a deployment's containers.
+	Logs(ctx context.Context, deploymentID string, opts LogOptions) (*LogStream, error)
+	// Health checks whether a deployment's app actually works, using the probes in its manifest.
+	Health(ctx context.Context, deploymentID string) (*Health, error)
+}
+
+// ManagedBy is the value of the managed-by label on everything this backend creates.
+const ManagedBy = "being"
+
+// Result describes a finished deployment.
+type Result struct {
+	DeploymentID  string   `json:"deployment_id"`
+	AppID         string   `json:"app_id,omitempty"`
+	ContainerID   string   `json:"container_id,omitempty"`
+	ContainerName string   `json:"container_name,omitempty"`
+	Release       string   `json:"release,omitempty"`
+	Image         string   `json:"image"`
+	Status        string   `json:"status"`
+	NetworkID     string   `json:"network_id,omitempty"`
+	Volumes       []string `json:"volumes,omitempty"`
+	Ports         []string `json:"ports,omitempty"`
+	CreatedAt     string   `json:"created_at"`
+	// Services names the containers or workloads started alongside the app, such as its database.
+	Services []string `json:"services,omitempty"`
+	// Steps lists what the deployer did, in order.
+	Steps []StepResult `json:"steps,omitempty"`
+}
+
+// DestroyOptions controls how much of a deployment is torn down.
+type DestroyOptions struct {
+	// RemoveData also deletes the deployment's volumes and the host directories it writes to.
+	// Without it, user data is left in place so the app can be redeployed on top of it.
+	RemoveData bool
+}
+
+// Step outcomes reported in a DestroyReport or a deployer's step log.
+const (
+	StepOK      = "ok"
+	StepSkipped = "skipped"
+	StepFailed  = "failed"
+	// StepRolledBack marks a completed step that was undone after a later one failed.
+	StepRolledBack = "rolled back"
+	// StepRollbackFailed marks a completed step that could not be undone.
+	StepRollbackFailed = "rollback failed"
+)
+
+// StepResult records the outcome of a single deploy or teardown step.
+type StepResult struct {
+	Step    string `json:"step"`
+	Target  string `json:"target"`
+	Status  string `json:"status"`
+	Message string `json:"message,omitempty"`
+}
+
+// DestroyReport lists every step taken while tearing a deployment down.
+type DestroyReport struct {
+	DeploymentID string       `json:"deployment_id"`
+	Steps        []StepResult `json:"steps"`
+}
+
+// record appends a step to the report, marking it failed if err is set.
+func (r *DestroyReport) record(step, target string, err error) {
+	result := StepResult{Step: step, Target: target, Status: StepOK}
+	if err != nil {
+		result.Status = StepFailed
+		result.Message = err.Error()
+	}
+	r.Steps = append(r.Steps, result)
+}
+
+// skip appends a step that was deliberately not performed.
+func (r *DestroyReport) skip(step, target, reason string) {
+	r.Steps = append(r.Steps, StepResult{Step: step, Target: target, Status: StepSkipped, Message: reason})
+}
+
+// Err returns an error if any step failed.
+func (r *DestroyReport) Err() error {
+	var failed []string
+	for _, step := range r.Steps {
+		if step.Status == StepFailed {
+			failed = append(failed, step.Step+" "+step.Target)
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("teardown of %s incomplete: %s failed", r.DeploymentID, strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+// Status describes the live state of a deployment.
+type Status struct {
+	DeploymentID string   `json:"deployment_id"`
+	AppID        string   `json:"app_id"`
+	State        string   `json:"state"`
+	Message      string   `json:"message,omitempty"`
+	Image        string   `json:"image,omitempty"`
+	Ports        []string `json:"ports,omitempty"`
+	// CatalogVersion is the version of the app manifest the deployment was made from,
+	// when the backend recorded it.
+	CatalogVersion string `json:"catalog_version,omitempty"`
+	// ImageDigest is the registry digest of the running image, when the backend knows it.
+	ImageDigest string `json:"image_digest,omitempty"`
+}
+
+// NewDeploymentID generates a unique, Docker- and DNS-safe ID for a deployment of an app.
+func NewDeploymentID(appID string) (string, error) {
+	buf := make([]byte, 4)
+	if _, err := rand.Read(buf); err != nil {
+		return "", fmt.Errorf("failed to generate deployment ID: %w", err)
+	}
+	return appID + "-" + hex.EncodeToString(buf), nil
+}
+
+// AppIDOf returns the app ID a deployment ID made by NewDeploymentID belongs to,
+// or "" if deploymentID isn't in that format.
+func AppIDOf(deploymentID string) string {
+	i := strings.LastIndex(deploymentID, "-")
+	if i <= 0 {
+		return ""
+	}
+	return deploymentID[:i]
+}
+
+// appForDeployment recovers the app manifest from a deployment ID made by NewDeploymentID.
+func appForDeployment(cat *catalog.Catalog, deploymentID string) (*catalog.App, error) {
+	app, ok := cat.Get(AppIDOf(deploymentID))
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrNotFound, deploymentID)
+	}
+	return app, nil
+}
+
+// configString converts a decoded JSON configuration value to a string.
+func configString(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case bool:
+		return strconv.FormatBool(v)
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case int:
+		return strconv.Itoa(v)
+	default:
+		return ""
+	}
+}
+
+// envValue renders the value for an env mapping: a configuration field, or the host
+// name in hosts of the service it names. It's "" if the field isn't set or the
+// service isn't part of the stack.
+func envValue(mapping catalog.EnvVar, config map[string]interface{}, hosts map[string]string) string {
+	value := configString(config[mapping.Field])
+	if mapping.Service != "" {
+		value = hosts[mapping.Service]
+	}
+	if value == "" {
+		return ""
+	}
+	if mapping.Format != "" {
+		value = fmt.Sprintf(mapping.Format, value)
+	}
+	return value
+}
+
+// hostPort returns the host port to publish for an app, preferring the one the user asked for.
+func hostPort(app *catalog.App, config map[string]interface{}) string {
+	if port := configString(config["port"]); port != "" {
+		return port
+	}
+	return app.DefaultHostPort
+}
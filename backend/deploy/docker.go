@@ -0,0 +1,1556 @@
+package deploy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	cerrdefs "github.com/containerd/errdefs"
+	"github.com/distribution/reference"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/api/types/image"
+	"github.com/docker/docker/api/types/mount"
+	"github.com/docker/docker/api/types/network"
+	"github.com/docker/docker/api/types/volume"
+	"github.com/docker/docker/client"
+	"github.com/docker/docker/pkg/jsonmessage"
+	"github.com/docker/docker/pkg/stdcopy"
+	"github.com/docker/go-connections/nat"
+
+	"example.com/m/v2/catalog"
+	"example.com/m/v2/logging"
+)
+
+const (
+	// resourcePrefix is prepended to every container, network and volume we create.
+	resourcePrefix = "being-"
+	// healthTimeout bounds how long we wait for a started container to become healthy,
+	// unless its app sets a startup timeout of its own.
+	healthTimeout = 2 * time.Minute
+	// settleTime is how long a container without a HEALTHCHECK must stay up to count as started.
+	settleTime = 5 * time.Second
+)
+
+// Labels stamped on every container, network and volume a deployment creates.
+// Everything that lists or removes resources filters on them, so the user's own
+// containers are never touched.
+const (
+	labelManagedBy      = "software.being.managed-by"
+	labelDeploymentID   = "software.being.deployment-id"
+	labelAppID          = "software.being.app-id"
+	labelCatalogVersion = "software.being.catalog-version"
+	// labelService names the stack service a container runs; the app's own has none.
+	labelService = "software.being.service"
+	// labelAdopted marks a container Adopt re-created from one it didn't deploy. Its
+	// mounts came with it, so Destroy never deletes their host directories.
+	labelAdopted = "software.being.adopted"
+)
+
+// DockerDeployer deploys applications as containers on a Docker daemon.
+// Point the client at a fake daemon (client.WithHost) to exercise it in tests.
+type DockerDeployer struct {
+	cli     *client.Client
+	catalog *catalog.Catalog
+
+	// self is the container the backend itself runs in, if any; see selfContainer.
+	selfMu    sync.Mutex
+	self      string
+	selfKnown bool
+}
+
+// NewDockerDeployer creates a deployer backed by the given Docker client
+// that deploys the apps described in cat.
+func NewDockerDeployer(cli *client.Client, cat *catalog.Catalog) *DockerDeployer {
+	return &DockerDeployer{cli: cli, catalog: cat}
+}
+
+// Deploy pulls the images of the app's stack, creates its network and volumes, and
+// starts its containers in dependency order. Each step is undone again if a later
+// one fails, so a failed deploy leaves nothing behind but the pulled images and
+// volumes that already held data.
+func (d *DockerDeployer) Deploy(ctx context.Context, deploymentID, appID string, config map[string]interface{}) (*Result, error) {
+	app, ok := d.catalog.Get(appID)
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownApp, appID)
+	}
+
+	name := resourcePrefix + deploymentID
+	p := newPipeline("deploy")
+
+	// Pull the images first; this is the slowest step and the most likely to fail.
+	if err := d.pullStack(ctx, p, app, app.Image, config); err != nil {
+		return nil, p.fail(ctx, err)
+	}
+
+	// Give each deployment a private bridge network.
+	report(ctx, "network", fmt.Sprintf("Creating network %s", name), 0)
+	var nw network.CreateResponse
+	err := p.do("create network", name, func() (err error) {
+		nw, err = d.cli.NetworkCreate(ctx, name, network.CreateOptions{Driver: "bridge", Labels: resourceLabels(deploymentID, app)})
+		if err != nil {
+			return fmt.Errorf("failed to create network %s: %w", name, err)
+		}
+		return nil
+	}, func(ctx context.Context) error {
+		return d.removeNetwork(ctx, nw.ID)
+	})
+	if err != nil {
+		return nil, p.fail(ctx, err)
+	}
+
+	result, err := d.runStack(ctx, p, name, app, app.Image, config)
+	if err != nil {
+		return nil, p.fail(ctx, err)
+	}
+	result.DeploymentID = deploymentID
+	result.AppID = app.ID
+	result.NetworkID = nw.ID
+	result.Steps = p.steps
+	return result, nil
+}
+
+// Destroy stops and removes a deployment's container and network.
+// Volumes and writable host directories are only deleted when opts.RemoveData is set,
+// and of the host directories only those the app's manifest binds: read-only binds
+// (such as an existing media library) and the mounts of an adopted container, which
+// could be any directory on the host, are never touched.
+func (d *DockerDeployer) Destroy(ctx context.Context, deploymentID string, opts DestroyOptions) (*DestroyReport, error) {
+	app, err := appForDeployment(d.catalog, deploymentID)
+	if err != nil {
+		return nil, err
+	}
+	name := resourcePrefix + deploymentID
+	report := &DestroyReport{DeploymentID: deploymentID}
+	found := false
+
+	// Inspect each container first so we know which host directories it wrote to.
+	var dataDirs []string
+	foreignDirs := map[string]string{}
+	containers, err := d.ownedContainers(ctx, deploymentID)
+	if err != nil {
+		report.record("list containers", name, err)
+	} else if len(containers) == 0 {
+		report.skip("remove container", name, "container does not exist")
+	}
+	for _, id := range containers {
+		found = true
+		info, err := d.cli.ContainerInspect(ctx, id)
+		if err != nil {
+			report.record("inspect container", id, err)
+			continue
+		}
+		owned, foreign := hostDirs(app, info)
+		dataDirs = append(dataDirs, owned...)
+		for dir, reason := range foreign {
+			foreignDirs[dir] = reason
+		}
+		target := strings.TrimPrefix(info.Name, "/")
+		report.record("stop container", target, d.cli.ContainerStop(ctx, id, container.StopOptions{}))
+		report.record("remove container", target, d.cli.ContainerRemove(ctx, id, container.RemoveOptions{Force: true}))
+	}
+
+	networks, err := d.ownedNetworks(ctx, deploymentID)
+	if err != nil {
+		report.record("list networks", name, err)
+	} else if len(networks) == 0 {
+		report.skip("remove network", name, "network does not exist")
+	}
+	for _, nw := range networks {
+		found = true
+		report.record("remove network", nw, d.removeNetwork(ctx, nw))
+	}
+
+	// Volumes are found by label, so they're cleaned up even if the container is already gone.
+	volumes, err := d.ownedVolumes(ctx, deploymentID)
+	if err != nil {
+		report.record("list volumes", name, err)
+	}
+	for _, vol := range volumes {
+		found = true
+		if !opts.RemoveData {
+			report.skip("remove volume", vol, "data is kept unless remove_data is set")
+			continue
+		}
+		report.record("remove volume", vol, d.cli.VolumeRemove(ctx, vol, false))
+	}
+
+	for _, dir := range dataDirs {
+		if !opts.RemoveData {
+			report.skip("remove host directory", dir, "data is kept unless remove_data is set")
+			continue
+		}
+		report.record("remove host directory", dir, os.RemoveAll(dir))
+	}
+	if opts.RemoveData {
+		dirs := make([]string, 0, len(foreignDirs))
+		for dir := range foreignDirs {
+			dirs = append(dirs, dir)
+		}
+		sort.Strings(dirs)
+		for _, dir := range dirs {
+			report.skip("remove host directory", dir, foreignDirs[dir])
+		}
+	}
+
+	if !found {
+		return nil, fmt.Errorf("%w: %s", ErrNotFound, deploymentID)
+	}
+	return report, report.Err()
+}
+
+// hostDirs sorts the writable bind mounts of a container into the directories it
+// was given by the app's manifest, which Destroy may delete, and the rest, with the
+// reason each is left alone.
+func hostDirs(app *catalog.App, info container.InspectResponse) (owned []string, foreign map[string]string) {
+	foreign = map[string]string{}
+	adopted := info.Config != nil && info.Config.Labels[labelAdopted] == "true"
+
+	// Only the app's own container binds host directories; services use volumes
+	declared := map[string]bool{}
+	if svc, ok := app.Service(serviceOf(info)); ok {
+		for _, bind := range svc.Binds {
+			if !bind.ReadOnly {
+				declared[bind.Target] = true
+			}
+		}
+	}
+
+	for _, m := range info.Mounts {
+		if m.Type != mount.TypeBind || !m.RW {
+			continue
+		}
+		switch {
+		case adopted:
+			foreign[m.Source] = "not created by us: the container was adopted"
+		case !declared[m.Destination]:
+			foreign[m.Source] = "not created by us: the app's manifest doesn't bind " + m.Destination
+		default:
+			owned = append(owned, m.Source)
+		}
+	}
+	return owned, foreign
+}
+
+// Status inspects a deployment's container and reports its state.
+func (d *DockerDeployer) Status(ctx context.Context, deploymentID string) (*Status, error) {
+	app, err := appForDeployment(d.catalog, deploymentID)
+	if err != nil {
+		return nil, err
+	}
+
+	containers, err := d.ownedContainers(ctx, deploymentID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find container for %s: %w", deploymentID, err)
+	}
+	// The app's own container speaks for the deployment; its services have health checks
+	var info container.InspectResponse
+	found := false
+	for _, id := range containers {
+		info, err = d.cli.ContainerInspect(ctx, id)
+		if err != nil {
+			return nil, fmt.Errorf("failed to inspect container for %s: %w", deploymentID, err)
+		}
+		if found = serviceOf(info) == ""; found {
+			break
+		}
+	}
+	if !found {
+		return nil, fmt.Errorf("%w: %s", ErrNotFound, deploymentID)
+	}
+
+	status := containerStatus(info)
+	status.DeploymentID = deploymentID
+	status.AppID = app.ID
+	// The digest the image was pulled by, to compare with what the registry has now
+	if img, err := d.cli.ImageInspect(ctx, info.Image); err == nil {
+		status.ImageDigest = repoDigest(status.Image, img.RepoDigests)
+	}
+	return status, nil
+}
+
+// repoDigest picks the digest of image out of the repository digests of a local
+// image, which lists one for every repository it was pulled from.
+func repoDigest(image string, repoDigests []string) string {
+	named, err := reference.ParseNormalizedNamed(image)
+	if err != nil {
+		return ""
+	}
+	if digested, ok := named.(reference.Digested); ok {
+		return digested.Digest().String()
+	}
+	for _, rd := range repoDigests {
+		if repo, err := reference.ParseNormalizedNamed(rd); err == nil && repo.Name() == named.Name() {
+			if digested, ok := repo.(reference.Digested); ok {
+				return digested.Digest().String()
+			}
+		}
+	}
+	return ""
+}
+
+// List finds every deployment with a container carrying this backend's labels.
+func (d *DockerDeployer) List(ctx context.Context) ([]*Status, error) {
+	containers, err := d.cli.ContainerList(ctx, container.ListOptions{All: true, Filters: ownedFilter("")})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list containers: %w", err)
+	}
+
+	var statuses []*Status
+	for _, c := range containers {
+		// The containers of a stack's services are part of the app's deployment
+		if c.Labels[labelService] != "" {
+			continue
+		}
+		info, err := d.cli.ContainerInspect(ctx, c.ID)
+		if cerrdefs.IsNotFound(err) {
+			continue // Removed while we were looking
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to inspect container %s: %w", c.ID, err)
+		}
+		status := containerStatus(info)
+		status.DeploymentID = c.Labels[labelDeploymentID]
+		status.AppID = c.Labels[labelAppID]
+		statuses = append(statuses, status)
+	}
+	return statuses, nil
+}
+
+// CollectStats reads the resource usage of every running container carrying this backend's labels.
+// Docker takes a moment to measure CPU use, so the containers are read in parallel.
+func (d *DockerDeployer) CollectStats(ctx context.Context) ([]ContainerStats, error) {
+	containers, err := d.cli.ContainerList(ctx, container.ListOptions{Filters: ownedFilter("")})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list containers: %w", err)
+	}
+
+	results := make([]*ContainerStats, len(containers))
+	var wg sync.WaitGroup
+	for i, c := range containers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := d.cli.ContainerStats(ctx, c.ID, false)
+			if err != nil {
+				logging.Errorf("Failed to read stats of container %s: %v", c.ID, err)
+				return
+			}
+			defer resp.Body.Close()
+			var raw container.StatsResponse
+			if err := json.NewDecoder(resp.Body).Decode(&raw); err != nil {
+				logging.Errorf("Failed to decode stats of container %s: %v", c.ID, err)
+				return
+			}
+			stats := statsFromDocker(raw)
+			stats.DeploymentID = c.Labels[labelDeploymentID]
+			stats.AppID = c.Labels[labelAppID]
+			results[i] = &stats
+		}()
+	}
+	wg.Wait()
+
+	var all []ContainerStats
+	for _, stats := range results {
+		if stats != nil {
+			all = append(all, *stats)
+		}
+	}
+	return all, nil
+}
+
+// containerStatus reads a container's live state.
+func containerStatus(info container.InspectResponse) *Status {
+	status := &Status{
+		State:          info.State.Status,
+		Message:        info.State.Error,
+		Image:          info.Config.Image,
+		CatalogVersion: info.Config.Labels[labelCatalogVersion],
+	}
+	if info.NetworkSettings != nil {
+		for port, bindings := range info.NetworkSettings.Ports {
+			for _, binding := range bindings {
+				status.Ports = append(status.Ports, binding.HostPort+":"+string(port))
+			}
+		}
+	}
+	return status
+}
+
+// Adopt brings an existing container under management.
+//
+// A container this backend labelled keeps its IDs, so a deployment whose record was
+// lost can be picked up again. Any other container is re-created under a new
+// deployment of appID with the same image, settings, mounts and networks, plus the
+// ownership labels, a label marking it adopted and a private network; Docker can't
+// relabel a live container.
+// Every step is undone if a later one fails, so if the replacement doesn't come up
+// healthy the original is put back untouched and the error is a *PipelineError.
+func (d *DockerDeployer) Adopt(ctx context.Context, ref, appID string) (*Result, error) {
+	info, err := d.cli.ContainerInspect(ctx, ref)
+	if cerrdefs.IsNotFound(err) {
+		return nil, fmt.Errorf("%w: no container named %s", ErrNotFound, ref)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to inspect container %s: %w", ref, err)
+	}
+	if info.Config == nil || info.HostConfig == nil {
+		return nil, fmt.Errorf("%w: container %s has no configuration", ErrNotAdoptable, ref)
+	}
+
+	// Already ours: nothing to change on the Docker side
+	if info.Config.Labels[labelManagedBy] == ManagedBy {
+		labelled := info.Config.Labels[labelAppID]
+		if appID != "" && appID != labelled {
+			return nil, fmt.Errorf("%w: container %s is a deployment of %s, not %s", ErrNotAdoptable, ref, labelled, appID)
+		}
+		result := adoptedResult(info)
+		result.DeploymentID = info.Config.Labels[labelDeploymentID]
+		result.AppID = labelled
+		return result, nil
+	}
+
+	if appID == "" {
+		return nil, fmt.Errorf("%w: an app ID is needed to adopt %s", ErrNotAdoptable, ref)
+	}
+	app, ok := d.catalog.Get(appID)
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownApp, appID)
+	}
+	deploymentID, err := NewDeploymentID(app.ID)
+	if err != nil {
+		return nil, err
+	}
+	oldName := strings.TrimPrefix(info.Name, "/")
+	name := resourcePrefix + deploymentID
+	labels := resourceLabels(deploymentID, app)
+
+	p := newPipeline("adopt")
+
+	// Containers sharing the host's or another container's network stack can't join ours
+	mode := info.HostConfig.NetworkMode
+	ownNetwork := !mode.IsHost() && !mode.IsNone() && !mode.IsContainer()
+	if ownNetwork {
+		networks, err := d.ownedNetworks(ctx, deploymentID)
+		if err != nil {
+			err = fmt.Errorf("failed to look up network %s: %w", name, err)
+			p.record("look up network", name, err)
+			return nil, p.fail(ctx, err)
+		}
+		if len(networks) == 0 {
+			report(ctx, "network", fmt.Sprintf("Creating network %s", name), 0)
+			err := p.do("create network", name, func() error {
+				if _, err := d.cli.NetworkCreate(ctx, name, network.CreateOptions{Driver: "bridge", Labels: labels}); err != nil {
+					return fmt.Errorf("failed to create network %s: %w", name, err)
+				}
+				return nil
+			}, func(ctx context.Context) error {
+				return d.removeNetwork(ctx, name)
+			})
+			if err != nil {
+				return nil, p.fail(ctx, err)
+			}
+		} else {
+			p.skip("create network", name, "network already exists")
+		}
+	}
+
+	containerConfig := *info.Config
+	containerConfig.Labels = make(map[string]string, len(info.Config.Labels)+len(labels))
+	for key, value := range info.Config.Labels {
+		containerConfig.Labels[key] = value
+	}
+	for key, value := range labels {
+		containerConfig.Labels[key] = value
+	}
+	containerConfig.Labels[labelAdopted] = "true"
+	if strings.HasPrefix(info.ID, containerConfig.Hostname) {
+		containerConfig.Hostname = "" // Docker's default, derived from the old container's ID
+	}
+	hostConfig := *info.HostConfig
+	hostConfig.Mounts = append(keptVolumes(info), hostConfig.Mounts...)
+
+	// Join the same networks as before, under the same aliases
+	networkConfig := &network.NetworkingConfig{EndpointsConfig: map[string]*network.EndpointSettings{}}
+	if info.NetworkSettings != nil {
+		for nwName, endpoint := range info.NetworkSettings.Networks {
+			networkConfig.EndpointsConfig[nwName] = &network.EndpointSettings{
+				Aliases:    endpoint.Aliases,
+				IPAMConfig: endpoint.IPAMConfig,
+				Links:      endpoint.Links,
+			}
+		}
+	}
+	if ownNetwork {
+		networkConfig.EndpointsConfig[name] = &network.EndpointSettings{}
+	}
+
+	// Move the original aside so the replacement can take the deployment's name
+	wasRunning := info.State != nil && info.State.Running
+	report(ctx, "stop", fmt.Sprintf("Stopping container %s", oldName), 0)
+	err = p.do("stop container", oldName, func() error {
+		if err := d.cli.ContainerStop(ctx, info.ID, container.StopOptions{}); err != nil {
+			return fmt.Errorf("failed to stop container %s: %w", oldName, err)
+		}
+		return nil
+	}, func(ctx context.Context) error {
+		if !wasRunning {
+			return nil
+		}
+		return d.cli.ContainerStart(ctx, info.ID, container.StartOptions{})
+	})
+	if err != nil {
+		return nil, p.fail(ctx, err)
+	}
+	err = p.do("rename container", oldName+"-adopting", func() error {
+		if err := d.cli.ContainerRename(ctx, info.ID, oldName+"-adopting"); err != nil {
+			return fmt.Errorf("failed to rename container %s: %w", oldName, err)
+		}
+		return nil
+	}, func(ctx context.Context) error {
+		return d.cli.ContainerRename(ctx, info.ID, oldName)
+	})
+	if err != nil {
+		return nil, p.fail(ctx, err)
+	}
+
+	report(ctx, "create", fmt.Sprintf("Creating container %s", name), 0)
+	var created container.CreateResponse
+	err = p.do("create container", name, func() error {
+		created, err = d.cli.ContainerCreate(ctx, &containerConfig, &hostConfig, networkConfig, nil, name)
+		if err != nil {
+			return fmt.Errorf("failed to create container %s: %w", name, err)
+		}
+		return nil
+	}, func(ctx context.Context) error {
+		return d.cli.ContainerRemove(ctx, created.ID, container.RemoveOptions{Force: true})
+	})
+	if err != nil {
+		return nil, p.fail(ctx, err)
+	}
+	for _, warning := range created.Warnings {
+		logging.Warnf("Docker warning for %s: %s", name, warning)
+	}
+
+	report(ctx, "start", fmt.Sprintf("Starting container %s", name), 0)
+	err = p.do("start container", name, func() error {
+		if err := d.cli.ContainerStart(ctx, created.ID, container.StartOptions{}); err != nil {
+			return fmt.Errorf("failed to start container %s: %w", name, err)
+		}
+		return nil
+	}, nil)
+	if err != nil {
+		return nil, p.fail(ctx, err)
+	}
+	var adopted container.InspectResponse
+	err = p.do("health check", name, func() (err error) {
+		adopted, err = d.waitHealthy(ctx, created.ID, app.Self())
+		return err
+	}, nil)
+	if err != nil {
+		return nil, p.fail(ctx, fmt.Errorf("replacement for %s did not start: %w", oldName, err))
+	}
+
+	// The replacement works; the original's volumes now belong to it, so keep them
+	report(ctx, "remove", fmt.Sprintf("Removing original container %s", oldName), 0)
+	err = d.cli.ContainerRemove(ctx, info.ID, container.RemoveOptions{})
+	if err != nil {
+		logging.Warnf("Adopted %s as %s but could not remove the original: %v", oldName, name, err)
+	}
+	p.record("remove container", oldName+"-adopting", err)
+
+	result := adoptedResult(adopted)
+	result.DeploymentID = deploymentID
+	result.AppID = app.ID
+	result.Steps = p.steps
+	return result, nil
+}
+
+// keptVolumes returns mounts for a container's anonymous volumes, which a re-created
+// container would otherwise replace with new, empty ones.
+func keptVolumes(info container.InspectResponse) []mount.Mount {
+	explicit := map[string]bool{}
+	for _, m := range info.HostConfig.Mounts {
+		explicit[m.Target] = true
+	}
+	for _, bind := range info.HostConfig.Binds {
+		if parts := strings.Split(bind, ":"); len(parts) >= 2 {
+			explicit[parts[1]] = true
+		}
+	}
+
+	var mounts []mount.Mount
+	for _, m := range info.Mounts {
+		if m.Type == mount.TypeVolume && m.Name != "" && !explicit[m.Destination] {
+			mounts = append(mounts, mount.Mount{Type: mount.TypeVolume, Source: m.Name, Target: m.Destination})
+		}
+	}
+	return mounts
+}
+
+// adoptedResult describes an adopted container.
+func adoptedResult(info container.InspectResponse) *Result {
+	status := containerStatus(info)
+	return &Result{
+		ContainerID:   info.ID,
+		ContainerName: strings.TrimPrefix(info.Name, "/"),
+		Image:         status.Image,
+		Status:        status.State,
+		Ports:         status.Ports,
+		CreatedAt:     time.Now().UTC().Format(time.RFC3339),
+	}
+}
+
+// Logs streams the output of a deployment's containers, stdout and stderr kept apart.
+func (d *DockerDeployer) Logs(ctx context.Context, deploymentID string, opts LogOptions) (*LogStream, error) {
+	if _, err := appForDeployment(d.catalog, deploymentID); err != nil {
+		return nil, err
+	}
+	containers, err := d.ownedContainers(ctx, deploymentID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find containers for %s: %w", deploymentID, err)
+	}
+
+	logOpts := container.LogsOptions{
+		ShowStdout: true,
+		ShowStderr: true,
+		Follow:     opts.Follow,
+		Timestamps: true,
+		Tail:       "all",
+	}
+	if opts.Tail >= 0 {
+		logOpts.Tail = strconv.Itoa(opts.Tail)
+	}
+	if !opts.Since.IsZero() {
+		logOpts.Since = opts.Since.Format(time.RFC3339Nano)
+	}
+
+	var sources []logSource
+	for _, id := range containers {
+		info, err := d.cli.ContainerInspect(ctx, id)
+		if err != nil {
+			return nil, fmt.Errorf("failed to inspect container %s: %w", id, err)
+		}
+		name := strings.TrimPrefix(info.Name, "/")
+		if opts.Container != "" && opts.Container != name {
+			continue
+		}
+		tty := info.Config != nil && info.Config.Tty
+		sources = append(sources, func(ctx context.Context, emit func(LogLine)) error {
+			return d.containerLogs(ctx, id, name, tty, logOpts, emit)
+		})
+	}
+	if len(sources) == 0 {
+		if opts.Container != "" {
+			return nil, fmt.Errorf("%w: no container %s in %s", ErrNotFound, opts.Container, deploymentID)
+		}
+		return nil, fmt.Errorf("%w: %s", ErrNotFound, deploymentID)
+	}
+	return newLogStream(ctx, sources), nil
+}
+
+// containerLogs reads one container's output until it ends or ctx is cancelled.
+func (d *DockerDeployer) containerLogs(ctx context.Context, id, name string, tty bool, opts container.LogsOptions, emit func(LogLine)) error {
+	reader, err := d.cli.ContainerLogs(ctx, id, opts)
+	if err != nil {
+		return fmt.Errorf("failed to read logs of %s: %w", name, err)
+	}
+	defer reader.Close()
+
+	stdout := &lineWriter{container: name, stream: StreamStdout, emit: emit}
+	stderr := &lineWriter{container: name, stream: StreamStderr, emit: emit}
+	// Without a TTY, Docker multiplexes both streams into one and they must be split apart
+	if tty {
+		_, err = io.Copy(stdout, reader)
+	} else {
+		_, err = stdcopy.StdCopy(stdout, stderr, reader)
+	}
+	stdout.Flush()
+	stderr.Flush()
+	if err != nil {
+		return fmt.Errorf("failed to read logs of %s: %w", name, err)
+	}
+	return nil
+}
+
+// Health runs the app's probes against the deployment's containers. A container
+// that isn't running fails outright, and one of an app without probes passes as
+// long as it runs.
+func (d *DockerDeployer) Health(ctx context.Context, deploymentID string) (*Health, error) {
+	app, err := appForDeployment(d.catalog, deploymentID)
+	if err != nil {
+		return nil, err
+	}
+	containers, err := d.ownedContainers(ctx, deploymentID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find containers for %s: %w", deploymentID, err)
+	}
+	if len(containers) == 0 {
+		return nil, fmt.Errorf("%w: %s", ErrNotFound, deploymentID)
+	}
+
+	var checks []CheckResult
+	for _, id := range containers {
+		info, err := d.cli.ContainerInspect(ctx, id)
+		if err != nil {
+			return nil, fmt.Errorf("failed to inspect container %s: %w", id, err)
+		}
+		// A service the manifest no longer has is only checked for running
+		svc, _ := app.Service(serviceOf(info))
+		svc.Name = serviceOf(info)
+		checks = append(checks, d.checkContainer(ctx, info, svc)...)
+	}
+	return newHealth(deploymentID, checks), nil
+}
+
+// checkContainer runs the probes of the stack service it runs against one container.
+// Checks of a service are named after it, to tell them from the app's own.
+func (d *DockerDeployer) checkContainer(ctx context.Context, info container.InspectResponse, svc catalog.Service) []CheckResult {
+	name := strings.TrimPrefix(info.Name, "/")
+	if info.State == nil || !info.State.Running {
+		status := "gone"
+		if info.State != nil {
+			status = string(info.State.Status)
+		}
+		return []CheckResult{{Name: name, Message: "container is " + status}}
+	}
+
+	probes := svc.Probes()
+	if len(probes) == 0 {
+		return []CheckResult{{Name: name, Passed: true, Message: "running"}}
+	}
+	checks := make([]CheckResult, 0, len(probes))
+	for _, probe := range probes {
+		check := CheckResult{Name: probe.String(), Passed: true}
+		if svc.Name != "" {
+			check.Name = svc.Name + ": " + check.Name
+		}
+		if err := d.runProbe(ctx, info, probe); err != nil {
+			check.Passed = false
+			check.Message = err.Error()
+		}
+		checks = append(checks, check)
+	}
+	return checks
+}
+
+// runProbe runs one probe against a container. Network probes connect to the
+// container's address on its deployment network, so they reach ports that aren't
+// published; a backend that runs in a container joins that network first.
+func (d *DockerDeployer) runProbe(ctx context.Context, info container.InspectResponse, probe catalog.Probe) error {
+	if probe.Type == catalog.ProbeExec {
+		return d.execProbe(ctx, info.ID, probe.Command)
+	}
+
+	var host, nwName string
+	if info.NetworkSettings != nil {
+		for name, endpoint := range info.NetworkSettings.Networks {
+			if endpoint == nil || endpoint.IPAddress == "" {
+				continue
+			}
+			host, nwName = endpoint.IPAddress, name
+			if info.Config != nil && name == resourcePrefix+info.Config.Labels[labelDeploymentID] {
+				break
+			}
+		}
+	}
+	if host == "" {
+		return errors.New("container has no IP address")
+	}
+	if err := d.joinNetwork(ctx, nwName); err != nil {
+		return fmt.Errorf("failed to join network %s to probe the container: %w", nwName, err)
+	}
+	return probeNetwork(ctx, host, probe)
+}
+
+// selfContainer returns the ID of the container the backend runs in when that's on
+// the daemon it deploys to, or "" when it runs on the host. Docker names a container's
+// host after the start of its ID unless told otherwise, which is how it's recognised.
+func (d *DockerDeployer) selfContainer(ctx context.Context) string {
+	d.selfMu.Lock()
+	defer d.selfMu.Unlock()
+	if d.selfKnown {
+		return d.self
+	}
+
+	hostname, err := os.Hostname()
+	if err != nil || hostname == "" {
+		d.selfKnown = true
+		return ""
+	}
+	info, err := d.cli.ContainerInspect(ctx, hostname)
+	switch {
+	case err == nil && strings.HasPrefix(info.ID, hostname):
+		log.Printf("Running in container %s; deployment networks are joined to probe apps", hostname)
+		d.self = info.ID
+	case err != nil && !cerrdefs.IsNotFound(err):
+		// Ask again next time rather than remember a daemon hiccup
+		logging.Errorf("Failed to check whether the backend runs in a container: %v", err)
+		return ""
+	}
+	d.selfKnown = true
+	return d.self
+}
+
+// joinNetwork connects the backend's own container to a network, so it can reach
+// the containers on it. Containers are only reachable from the networks they share,
+// and a backend in a container shares none with a deployment until it joins.
+func (d *DockerDeployer) joinNetwork(ctx context.Context, nw string) error {
+	self := d.selfContainer(ctx)
+	if self == "" {
+		return nil
+	}
+	info, err := d.cli.ContainerInspect(ctx, self)
+	if err != nil {
+		return err
+	}
+	if onNetwork(info, nw) {
+		return nil
+	}
+	return d.cli.NetworkConnect(ctx, nw, self, nil)
+}
+
+// removeNetwork removes a deployment network, first disconnecting the backend's own
+// container if it joined it to probe, since Docker won't remove a network in use.
+func (d *DockerDeployer) removeNetwork(ctx context.Context, nw string) error {
+	if self := d.selfContainer(ctx); self != "" {
+		info, err := d.cli.ContainerInspect(ctx, self)
+		if err == nil && onNetwork(info, nw) {
+			err = d.cli.NetworkDisconnect(ctx, nw, self, true)
+		}
+		if err != nil {
+			logging.Errorf("Failed to leave network %s: %v", nw, err)
+		}
+	}
+	return d.cli.NetworkRemove(ctx, nw)
+}
+
+// onNetwork reports whether a container is attached to the network with the name or ID nw.
+func onNetwork(info container.InspectResponse, nw string) bool {
+	if info.NetworkSettings == nil {
+		return false
+	}
+	for name, endpoint := range info.NetworkSettings.Networks {
+		if name == nw || (endpoint != nil && endpoint.NetworkID == nw) {
+			return true
+		}
+	}
+	return false
+}
+
+// execProbe runs a command in a container, failing with its output unless it exits 0.
+func (d *DockerDeployer) execProbe(ctx context.Context, id string, command []string) error {
+	ctx, cancel := context.WithTimeout(ctx, probeTimeout)
+	defer cancel()
+
+	created, err := d.cli.ContainerExecCreate(ctx, id, container.ExecOptions{Cmd: command, AttachStdout: true, AttachStderr: true})
+	if err != nil {
+		return fmt.Errorf("failed to run %s: %w", command[0], err)
+	}
+	attached, err := d.cli.ContainerExecAttach(ctx, created.ID, container.ExecAttachOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to run %s: %w", command[0], err)
+	}
+	defer attached.Close()
+
+	// Only the start of the output is worth reporting, but all of it has to be read
+	// for the command to finish
+	output := &headWriter{limit: 512}
+	if _, err := stdcopy.StdCopy(output, output, attached.Reader); err != nil {
+		return fmt.Errorf("failed to read output of %s: %w", command[0], err)
+	}
+	result, err := d.cli.ContainerExecInspect(ctx, created.ID)
+	if err != nil {
+		return fmt.Errorf("failed to inspect %s: %w", command[0], err)
+	}
+	if result.ExitCode != 0 {
+		msg := fmt.Sprintf("%s exited with code %d", command[0], result.ExitCode)
+		if out := strings.TrimSpace(output.String()); out != "" {
+			msg += ": " + out
+		}
+		return errors.New(msg)
+	}
+	return nil
+}
+
+// headWriter keeps the first limit bytes written to it and discards the rest.
+type headWriter struct {
+	bytes.Buffer
+	limit int
+}
+
+// Write keeps what still fits and reports everything as written.
+func (w *headWriter) Write(p []byte) (int, error) {
+	if room := w.limit - w.Len(); room > 0 {
+		w.Buffer.Write(p[:min(room, len(p))])
+	}
+	return len(p), nil
+}
+
+// Update recreates a deployment's stack with a new configuration, keeping the image
+// its app runs so an update doesn't undo an upgrade. The network and named volumes
+// are reused, so the app keeps its data, and the previous containers are kept aside
+// until the new ones are healthy, as for Upgrade.
+func (d *DockerDeployer) Update(ctx context.Context, deploymentID string, config map[string]interface{}) (*Result, error) {
+	app, err := appForDeployment(d.catalog, deploymentID)
+	if err != nil {
+		return nil, err
+	}
+	return d.replaceContainers(ctx, newPipeline("update"), deploymentID, app, d.runningImage(ctx, deploymentID, app), config, true)
+}
+
+// runningImage returns the image a deployment's app container was created from, or
+// the catalog's if there's no such container to ask.
+func (d *DockerDeployer) runningImage(ctx context.Context, deploymentID string, app *catalog.App) string {
+	containers, err := d.ownedContainers(ctx, deploymentID)
+	if err != nil {
+		return app.Image
+	}
+	for _, id := range containers {
+		info, err := d.cli.ContainerInspect(ctx, id)
+		if err == nil && serviceOf(info) == "" && info.Config != nil && info.Config.Image != "" {
+			return info.Config.Image
+		}
+	}
+	return app.Image
+}
+
+// Upgrade recreates a deployment's app container from another image; the services
+// of its stack keep running. The old container is stopped and moved aside rather
+// than removed, so if the new one doesn't come up healthy it's put back and started
+// again as it was. Volumes and host directories are shared by both, so nothing is copied.
+func (d *DockerDeployer) Upgrade(ctx context.Context, deploymentID string, config map[string]interface{}, image string) (*Result, error) {
+	app, err := appForDeployment(d.catalog, deploymentID)
+	if err != nil {
+		return nil, err
+	}
+	return d.replaceContainers(ctx, newPipeline("upgrade"), deploymentID, app, image, config, false)
+}
+
+// replaceContainers swaps a deployment's app container for one run from image, or
+// with stack set, every container for a fresh run of its whole stack. Stopping and
+// renaming the old containers are steps like any other, so a failure anywhere
+// unwinds back to them running under their own names.
+func (d *DockerDeployer) replaceContainers(ctx context.Context, p *pipeline, deploymentID string, app *catalog.App, image string, config map[string]interface{}, stack bool) (*Result, error) {
+	name := resourcePrefix + deploymentID
+
+	// Nothing is touched until the new images are here
+	var pull error
+	if stack {
+		pull = d.pullStack(ctx, p, app, image, config)
+	} else {
+		pull = p.do("pull image", image, func() error { return d.pullImage(ctx, image) }, nil)
+	}
+	if pull != nil {
+		return nil, p.fail(ctx, pull)
+	}
+
+	containers, err := d.ownedContainers(ctx, deploymentID)
+	if err != nil {
+		return nil, p.fail(ctx, fmt.Errorf("failed to find container for %s: %w", deploymentID, err))
+	}
+	var replaced []container.InspectResponse
+	for _, id := range containers {
+		info, err := d.cli.ContainerInspect(ctx, id)
+		if err != nil {
+			return nil, p.fail(ctx, fmt.Errorf("failed to inspect container %s: %w", id, err))
+		}
+		if stack || serviceOf(info) == "" {
+			replaced = append(replaced, info)
+		}
+	}
+	if len(replaced) == 0 {
+		// There's nothing to restore, so this isn't rolled back but plainly missing
+		return nil, fmt.Errorf("%w: %s", ErrNotFound, deploymentID)
+	}
+
+	// Stop the app before the services it uses, the reverse of starting them
+	order := map[string]int{}
+	for i, svc := range app.Stack(config) {
+		order[svc.Name] = i + 1
+	}
+	sort.SliceStable(replaced, func(i, j int) bool {
+		return order[serviceOf(replaced[i])] > order[serviceOf(replaced[j])]
+	})
+
+	// The old containers give up their names, which the new ones need
+	type setAside struct{ id, name string }
+	var previous []setAside
+	for _, info := range replaced {
+		id := info.ID
+		oldName := strings.TrimPrefix(info.Name, "/")
+		running := info.State != nil && info.State.Running
+
+		report(ctx, "stop", fmt.Sprintf("Stopping container %s", oldName), 0)
+		err = p.do("stop container", oldName, func() error {
+			if err := d.cli.ContainerStop(ctx, id, container.StopOptions{}); err != nil {
+				return fmt.Errorf("failed to stop container %s: %w", oldName, err)
+			}
+			return nil
+		}, func(ctx context.Context) error {
+			if !running {
+				return nil
+			}
+			return d.cli.ContainerStart(ctx, id, container.StartOptions{})
+		})
+		if err != nil {
+			return nil, p.fail(ctx, err)
+		}
+
+		err = p.do("rename container", oldName+"-previous", func() error {
+			if err := d.cli.ContainerRename(ctx, id, oldName+"-previous"); err != nil {
+				return fmt.Errorf("failed to rename container %s: %w", oldName, err)
+			}
+			return nil
+		}, func(ctx context.Context) error {
+			return d.cli.ContainerRename(ctx, id, oldName)
+		})
+		if err != nil {
+			return nil, p.fail(ctx, err)
+		}
+		previous = append(previous, setAside{id: id, name: oldName + "-previous"})
+	}
+
+	var result *Result
+	if stack {
+		result, err = d.runStack(ctx, p, name, app, image, config)
+	} else {
+		result, err = d.runContainer(ctx, p, name, app, app.Self(), image, config, stackHosts(app.Stack(config)))
+	}
+	if err != nil {
+		return nil, p.fail(ctx, err)
+	}
+
+	// Past this point the new containers are in; an old one left over is only untidy
+	for _, old := range previous {
+		report(ctx, "remove", fmt.Sprintf("Removing previous container %s", old.name), 0)
+		err := d.cli.ContainerRemove(ctx, old.id, container.RemoveOptions{})
+		if err != nil {
+			logging.Warnf("Replaced %s but could not remove its previous container: %v", name, err)
+		}
+		p.record("remove container", old.name, err)
+	}
+	result.DeploymentID = deploymentID
+	result.AppID = app.ID
+	result.Steps = p.steps
+	return result, nil
+}
+
+// Restore puts back containers an interrupted Upgrade or Update moved aside. Whatever
+// took over a container's name is removed, and the container gets its name back and
+// is started again, services before the app that uses them.
+func (d *DockerDeployer) Restore(ctx context.Context, deploymentID string) (*Result, error) {
+	app, err := appForDeployment(d.catalog, deploymentID)
+	if err != nil {
+		return nil, err
+	}
+	containers, err := d.ownedContainers(ctx, deploymentID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find containers for %s: %w", deploymentID, err)
+	}
+	byName := map[string]string{}
+	var previous []container.InspectResponse
+	for _, id := range containers {
+		info, err := d.cli.ContainerInspect(ctx, id)
+		if err != nil {
+			return nil, fmt.Errorf("failed to inspect container %s: %w", id, err)
+		}
+		name := strings.TrimPrefix(info.Name, "/")
+		byName[name] = info.ID
+		if strings.HasSuffix(name, "-previous") {
+			previous = append(previous, info)
+		}
+	}
+	if len(previous) == 0 {
+		return nil, fmt.Errorf("%w: nothing of %s was set aside", ErrNotFound, deploymentID)
+	}
+
+	order := map[string]int{}
+	for i, svc := range app.Stack(nil) {
+		order[svc.Name] = i
+	}
+	sort.SliceStable(previous, func(i, j int) bool {
+		return order[serviceOf(previous[i])] < order[serviceOf(previous[j])]
+	})
+
+	result := &Result{DeploymentID: deploymentID, AppID: app.ID, Status: "running", CreatedAt: time.Now().UTC().Format(time.RFC3339)}
+	for _, info := range previous {
+		name := strings.TrimSuffix(strings.TrimPrefix(info.Name, "/"), "-previous")
+		report(ctx, "restore", fmt.Sprintf("Restoring container %s", name), 0)
+		if replacement, ok := byName[name]; ok {
+			if err := d.cli.ContainerRemove(ctx, replacement, container.RemoveOptions{Force: true}); err != nil && !cerrdefs.IsNotFound(err) {
+				return nil, fmt.Errorf("failed to remove replacement container %s: %w", name, err)
+			}
+		}
+		if err := d.cli.ContainerRename(ctx, info.ID, name); err != nil {
+			return nil, fmt.Errorf("failed to restore the name of container %s: %w", name, err)
+		}
+		if err := d.cli.ContainerStart(ctx, info.ID, container.StartOptions{}); err != nil {
+			return nil, fmt.Errorf("failed to restart container %s: %w", name, err)
+		}
+		if serviceOf(info) == "" {
+			result.ContainerID, result.ContainerName = info.ID, name
+			if info.Config != nil {
+				result.Image = info.Config.Image
+			}
+		} else {
+			result.Services = append(result.Services, name)
+		}
+	}
+	return result, nil
+}
+
+// pullStack pulls the images of every service config enables, with image for the app's own.
+func (d *DockerDeployer) pullStack(ctx context.Context, p *pipeline, app *catalog.App, image string, config map[string]interface{}) error {
+	for _, svc := range app.Stack(config) {
+		ref := svc.Image
+		if svc.Name == "" {
+			ref = image
+		}
+		if err := p.do("pull image", ref, func() error { return d.pullImage(ctx, ref) }, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// runStack starts the services config enables and then the app itself, each once
+// the services it depends on are healthy, since runContainer waits for that before
+// it returns. The result describes the app's container.
+func (d *DockerDeployer) runStack(ctx context.Context, p *pipeline, name string, app *catalog.App, image string, config map[string]interface{}) (*Result, error) {
+	stack := app.Stack(config)
+	hosts := stackHosts(stack)
+	var services, volumes []string
+	for _, svc := range stack {
+		if svc.Name == "" {
+			break
+		}
+		result, err := d.runContainer(ctx, p, name, app, svc, svc.Image, config, hosts)
+		if err != nil {
+			return nil, err
+		}
+		services = append(services, result.ContainerName)
+		volumes = append(volumes, result.Volumes...)
+	}
+
+	result, err := d.runContainer(ctx, p, name, app, app.Self(), image, config, hosts)
+	if err != nil {
+		return nil, err
+	}
+	result.Services = services
+	result.Volumes = append(volumes, result.Volumes...)
+	return result, nil
+}
+
+// stackHosts maps each service of a stack to its host name on the deployment's
+// network, where Docker answers to the alias every service container is given.
+func stackHosts(stack []catalog.Service) map[string]string {
+	hosts := map[string]string{}
+	for _, svc := range stack {
+		if svc.Name != "" {
+			hosts[svc.Name] = svc.Name
+		}
+	}
+	return hosts
+}
+
+// serviceOf returns the stack service a container runs, or "" for the app's own.
+func serviceOf(info container.InspectResponse) string {
+	if info.Config == nil {
+		return ""
+	}
+	return info.Config.Labels[labelService]
+}
+
+// runContainer creates the volumes and host directories of one service of the app's
+// stack, then creates and starts its container from image, attached to the network
+// called stack, and waits for it to become healthy. The app's own container is
+// called stack too, and a service's is suffixed with the service's name. Every step
+// is recorded in p with how to undo it; volumes and directories that already
+// existed hold data, so they're left alone either way.
+func (d *DockerDeployer) runContainer(ctx context.Context, p *pipeline, stack string, app *catalog.App, svc catalog.Service, image string, config map[string]interface{}, hosts map[string]string) (*Result, error) {
+	labels := resourceLabels(strings.TrimPrefix(stack, resourcePrefix), app)
+	name := stack
+	if svc.Name != "" {
+		name += "-" + svc.Name
+		labels[labelService] = svc.Name
+	}
+
+	// Create the named volumes and collect the mounts for the container.
+	var mounts []mount.Mount
+	var volumes []string
+	for suffix, target := range svc.Volumes {
+		volName := name + "-" + suffix
+		volumes = append(volumes, volName)
+		mounts = append(mounts, mount.Mount{
+			Type:   mount.TypeVolume,
+			Source: volName,
+			Target: target,
+		})
+
+		_, err := d.cli.VolumeInspect(ctx, volName)
+		if err == nil {
+			p.skip("create volume", volName, "volume already exists")
+			continue
+		}
+		if !cerrdefs.IsNotFound(err) {
+			err = fmt.Errorf("failed to inspect volume %s: %w", volName, err)
+			p.record("create volume", volName, err)
+			return nil, err
+		}
+		report(ctx, "volume", fmt.Sprintf("Creating volume %s", volName), 0)
+		err = p.do("create volume", volName, func() error {
+			if _, err := d.cli.VolumeCreate(ctx, volume.CreateOptions{Name: volName, Labels: labels}); err != nil {
+				return fmt.Errorf("failed to create volume %s: %w", volName, err)
+			}
+			return nil
+		}, func(ctx context.Context) error {
+			return d.cli.VolumeRemove(ctx, volName, false)
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Host directories come from the user's configuration.
+	for _, bind := range svc.Binds {
+		hostPath, ok := config[bind.Field].(string)
+		if !ok || hostPath == "" {
+			continue
+		}
+		mounts = append(mounts, mount.Mount{
+			Type:     mount.TypeBind,
+			Source:   hostPath,
+			Target:   bind.Target,
+			ReadOnly: bind.ReadOnly,
+		})
+
+		created := missingAncestor(hostPath)
+		if created == "" {
+			p.skip("create host directory", hostPath, "directory already exists")
+			continue
+		}
+		err := p.do("create host directory", hostPath, func() error {
+			if err := os.MkdirAll(hostPath, 0755); err != nil {
+				return fmt.Errorf("failed to create host directory %s: %w", hostPath, err)
+			}
+			return nil
+		}, func(ctx context.Context) error {
+			// Nothing but the failed container can have written to a directory made just for it
+			return os.RemoveAll(created)
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	containerConfig := &container.Config{
+		Image:  image,
+		Env:    buildEnv(svc, config, hosts),
+		Labels: labels,
+	}
+	hostConfig := &container.HostConfig{
+		Mounts:        mounts,
+		RestartPolicy: container.RestartPolicy{Name: container.RestartPolicyUnlessStopped},
+	}
+	// Services are reached by name from the rest of the stack
+	endpoint := &network.EndpointSettings{}
+	if svc.Name != "" {
+		endpoint.Aliases = []string{svc.Name}
+	}
+	networkConfig := &network.NetworkingConfig{
+		EndpointsConfig: map[string]*network.EndpointSettings{
+			stack: endpoint,
+		},
+	}
+
+	// Only the app itself is published on the host
+	var ports []string
+	if svc.Port != "" {
+		containerPort, err := nat.NewPort("tcp", svc.Port)
+		if err != nil {
+			return nil, fmt.Errorf("invalid container port %s: %w", svc.Port, err)
+		}
+		containerConfig.ExposedPorts = nat.PortSet{containerPort: struct{}{}}
+		if svc.Name == "" {
+			published := hostPort(app, config)
+			hostConfig.PortBindings = nat.PortMap{containerPort: []nat.PortBinding{{HostPort: published}}}
+			ports = append(ports, published+":"+string(containerPort))
+		}
+	}
+
+	report(ctx, "create", fmt.Sprintf("Creating container %s", name), 0)
+	var created container.CreateResponse
+	err := p.do("create container", name, func() (err error) {
+		created, err = d.cli.ContainerCreate(ctx, containerConfig, hostConfig, networkConfig, nil, name)
+		if err != nil {
+			return fmt.Errorf("failed to create container %s: %w", name, err)
+		}
+		return nil
+	}, func(ctx context.Context) error {
+		return d.cli.ContainerRemove(ctx, created.ID, container.RemoveOptions{Force: true})
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, warning := range created.Warnings {
+		logging.Warnf("Docker warning for %s: %s", name, warning)
+	}
+
+	report(ctx, "start", fmt.Sprintf("Starting container %s", name), 0)
+	err = p.do("start container", name, func() error {
+		if err := d.cli.ContainerStart(ctx, created.ID, container.StartOptions{}); err != nil {
+			return fmt.Errorf("failed to start container %s: %w", name, err)
+		}
+		return nil
+	}, func(ctx context.Context) error {
+		return d.cli.ContainerStop(ctx, created.ID, container.StopOptions{})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Wait for the container to settle so we report its real state rather than assuming it's running.
+	var info container.InspectResponse
+	err = p.do("health check", name, func() (err error) {
+		info, err = d.waitHealthy(ctx, name, svc)
+		return err
+	}, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Result{
+		ContainerID:   created.ID,
+		ContainerName: name,
+		Image:         image,
+		Status:        info.State.Status,
+		Volumes:       volumes,
+		Ports:         ports,
+		CreatedAt:     time.Now().UTC().Format(time.RFC3339),
+	}, nil
+}
+
+// missingAncestor returns the outermost directory of path that doesn't exist yet,
+// which is what creating path makes, or "" if path already exists.
+func missingAncestor(path string) string {
+	missing := ""
+	for dir := filepath.Clean(path); ; dir = filepath.Dir(dir) {
+		// Anything but a clear "doesn't exist" counts as there, so it's never removed
+		if _, err := os.Stat(dir); !errors.Is(err, fs.ErrNotExist) {
+			return missing
+		}
+		missing = dir
+		if filepath.Dir(dir) == dir {
+			return missing
+		}
+	}
+}
+
+// pullImage pulls an image, reporting download progress as it goes.
+func (d *DockerDeployer) pullImage(ctx context.Context, ref string) error {
+	report(ctx, "pull", fmt.Sprintf("Pulling image %s", ref), 0)
+
+	reader, err := d.cli.ImagePull(ctx, ref, image.PullOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to pull image %s: %w", ref, err)
+	}
+	defer reader.Close()
+
+	// The pull only completes once the progress stream is drained.
+	// Errors reported by the registry arrive inside the stream, not from ImagePull.
+	type layerProgress struct{ current, total int64 }
+	layers := map[string]*layerProgress{}
+	lastPercent := 0
+	decoder := json.NewDecoder(reader)
+	for {
+		var msg jsonmessage.JSONMessage
+		if err := decoder.Decode(&msg); err == io.EOF {
+			break
+		} else if err != nil {
+			return fmt.Errorf("failed to read pull progress for %s: %w", ref, err)
+		}
+		if msg.Error != nil {
+			return fmt.Errorf("failed to pull image %s: %w", ref, msg.Error)
+		}
+
+		// Track download progress per layer; layers that already exist locally never report it.
+		switch msg.Status {
+		case "Downloading":
+			if msg.Progress != nil && msg.Progress.Total > 0 {
+				layers[msg.ID] = &layerProgress{current: msg.Progress.Current, total: msg.Progress.Total}
+			}
+		case "Download complete", "Pull complete":
+			if layer, ok := layers[msg.ID]; ok {
+				layer.current = layer.total
+			}
+		default:
+			continue
+		}
+
+		var current, total int64
+		for _, layer := range layers {
+			current += layer.current
+			total += layer.total
+		}
+		if total == 0 {
+			continue
+		}
+		// Only report whole-percent changes so a big pull doesn't flood listeners.
+		if percent := int(current * 100 / total); percent > lastPercent {
+			lastPercent = percent
+			report(ctx, "pull", fmt.Sprintf("Downloading %s", ref), float64(percent))
+		}
+	}
+
+	report(ctx, "pull", fmt.Sprintf("Pulled image %s", ref), 100)
+	return nil
+}
+
+// waitHealthy waits for a started container to settle and the app's probes to pass,
+// for as long as the app's startup timeout allows. Containers with a Docker
+// HEALTHCHECK must also report healthy; others must stay running for settleTime.
+func (d *DockerDeployer) waitHealthy(ctx context.Context, name string, svc catalog.Service) (container.InspectResponse, error) {
+	report(ctx, "health", fmt.Sprintf("Waiting for %s to become healthy", name), 0)
+
+	ctx, cancel := context.WithTimeout(ctx, startupTimeout(svc))
+	defer cancel()
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	lastFailure := ""
+	for {
+		info, err := d.cli.ContainerInspect(ctx, name)
+		if err != nil {
+			return info, fmt.Errorf("failed to inspect container %s: %w", name, err)
+		}
+
+		state := info.State
+		settled := false
+		switch {
+		case state.Status == container.StateExited || state.Status == container.StateDead:
+			return info, fmt.Errorf("container %s exited with code %d", name, state.ExitCode)
+		case state.Restarting:
+			return info, fmt.Errorf("container %s keeps restarting (last exit code %d)", name, state.ExitCode)
+		case state.Health != nil && state.Health.Status == container.Unhealthy:
+			return info, fmt.Errorf("container %s reported unhealthy", name)
+		case state.Health != nil && state.Health.Status == container.Healthy:
+			settled = true
+		case state.Health == nil && state.Running:
+			started, _ := time.Parse(time.RFC3339Nano, state.StartedAt)
+			settled = time.Since(started) >= settleTime
+		}
+
+		// Only a settled container is worth probing; apps often refuse connections while starting
+		if settled {
+			health := newHealth(name, d.checkContainer(ctx, info, svc))
+			if health.State == HealthHealthy {
+				if state.Health == nil && len(svc.Probes()) == 0 {
+					report(ctx, "health", fmt.Sprintf("%s is running", name), 100)
+				} else {
+					report(ctx, "health", fmt.Sprintf("%s is healthy", name), 100)
+				}
+				return info, nil
+			}
+			if health.Reason != lastFailure {
+				lastFailure = health.Reason
+				report(ctx, "health", fmt.Sprintf("Waiting for %s: %s", name, lastFailure), 0)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			if lastFailure != "" {
+				return info, fmt.Errorf("timed out waiting for %s to become healthy: %s", name, lastFailure)
+			}
+			return info, fmt.Errorf("timed out waiting for %s to become healthy", name)
+		case <-ticker.C:
+		}
+	}
+}
+
+// resourceLabels returns the labels for the Docker resources of a deployment.
+func resourceLabels(deploymentID string, app *catalog.App) map[string]string {
+	return map[string]string{
+		labelManagedBy:      ManagedBy,
+		labelDeploymentID:   deploymentID,
+		labelAppID:          app.ID,
+		labelCatalogVersion: app.Version,
+	}
+}
+
+// ownedFilter matches resources this backend created, for one deployment or, with
+// an empty deploymentID, for all of them.
+func ownedFilter(deploymentID string) filters.Args {
+	args := filters.NewArgs(filters.Arg("label", labelManagedBy+"="+ManagedBy))
+	if deploymentID != "" {
+		args.Add("label", labelDeploymentID+"="+deploymentID)
+	}
+	return args
+}
+
+// ownedContainers returns the IDs of a deployment's containers.
+func (d *DockerDeployer) ownedContainers(ctx context.Context, deploymentID string) ([]string, error) {
+	containers, err := d.cli.ContainerList(ctx, container.ListOptions{All: true, Filters: ownedFilter(deploymentID)})
+	if err != nil {
+		return nil, err
+	}
+	var ids []string
+	for _, c := range containers {
+		ids = append(ids, c.ID)
+	}
+	return ids, nil
+}
+
+// ownedNetworks returns the names of a deployment's networks.
+func (d *DockerDeployer) ownedNetworks(ctx context.Context, deploymentID string) ([]string, error) {
+	networks, err := d.cli.NetworkList(ctx, network.ListOptions{Filters: ownedFilter(deploymentID)})
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, nw := range networks {
+		names = append(names, nw.Name)
+	}
+	return names, nil
+}
+
+// ownedVolumes returns the names of a deployment's volumes.
+func (d *DockerDeployer) ownedVolumes(ctx context.Context, deploymentID string) ([]string, error) {
+	volumes, err := d.cli.VolumeList(ctx, volume.ListOptions{Filters: ownedFilter(deploymentID)})
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, vol := range volumes.Volumes {
+		names = append(names, vol.Name)
+	}
+	return names, nil
+}
+
+// buildEnv turns the user's configuration into the environment variables of one
+// service of a stack, given the host names of the others.
+func buildEnv(svc catalog.Service, config map[string]interface{}, hosts map[string]string) []string {
+	var env []string
+	for name, value := range svc.StaticEnv {
+		env = append(env, name+"="+value)
+	}
+	for _, mapping := range svc.Env {
+		if value := envValue(mapping, config, hosts); value != "" {
+			env = append(env, mapping.Name+"="+value)
+		}
+	}
+	return env
+}
@@ -0,0 +1,467 @@
+package deploy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"example.com/m/v2/catalog"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/mount"
+)
+
+func TestHostDirs(t *testing.T) {
+	app := &catalog.App{
+		ID: "immich",
+		Binds: []catalog.Bind{
+			{Field: "uploadPath", Target: "/usr/src/app/upload"},
+			{Field: "libraryPath", Target: "/library", ReadOnly: true},
+		},
+		Services: []catalog.Service{{Name: "database", Image: "postgres:16"}},
+	}
+	upload := container.MountPoint{Type: mount.TypeBind, Source: "/srv/photos", Destination: "/usr/src/app/upload", RW: true}
+	library := container.MountPoint{Type: mount.TypeBind, Source: "/srv/library", Destination: "/library"}
+	extra := container.MountPoint{Type: mount.TypeBind, Source: "/home", Destination: "/home", RW: true}
+	vol := container.MountPoint{Type: mount.TypeVolume, Name: "being-immich-1-data", Destination: "/data", RW: true}
+
+	tests := []struct {
+		name        string
+		labels      map[string]string
+		mounts      []container.MountPoint
+		wantOwned   []string
+		wantForeign []string
+	}{
+		{
+			name:      "declared writable bind",
+			mounts:    []container.MountPoint{upload, library, vol},
+			wantOwned: []string{"/srv/photos"},
+		},
+		{
+			name:        "bind the manifest doesn't declare",
+			mounts:      []container.MountPoint{upload, extra},
+			wantOwned:   []string{"/srv/photos"},
+			wantForeign: []string{"/home"},
+		},
+		{
+			name:        "adopted container",
+			labels:      map[string]string{labelAdopted: "true"},
+			mounts:      []container.MountPoint{upload, extra},
+			wantForeign: []string{"/srv/photos", "/home"},
+		},
+		{
+			name:        "service container",
+			labels:      map[string]string{labelService: "database"},
+			mounts:      []container.MountPoint{upload},
+			wantForeign: []string{"/srv/photos"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			info := container.InspectResponse{
+				Config: &container.Config{Labels: tt.labels},
+				Mounts: tt.mounts,
+			}
+			owned, foreign := hostDirs(app, info)
+			if !reflect.DeepEqual(owned, tt.wantOwned) {
+				t.Errorf("owned = %v, want %v", owned, tt.wantOwned)
+			}
+			if len(foreign) != len(tt.wantForeign) {
+				t.Errorf("foreign = %v, want %v", foreign, tt.wantForeign)
+			}
+			for _, dir := range tt.wantForeign {
+				if foreign[dir] == "" {
+					t.Errorf("%s should be left alone, got %v", dir, foreign)
+				}
+			}
+		})
+	}
+}
+
+func TestProbeFromContainerJoinsNetwork(t *testing.T) {
+	app := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/health" {
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer app.Close()
+	_, port, _ := net.SplitHostPort(strings.TrimPrefix(app.URL, "http://"))
+
+	fake, cli := newFakeDocker(t)
+	hostname, err := os.Hostname()
+	if err != nil {
+		t.Skip("no hostname")
+	}
+	// The backend runs in a container of its own, on no network of the deployment's
+	fake.addContainer(&fakeContainer{ID: hostname + strings.Repeat("0", 12), Name: "being-backend", Running: true})
+
+	cat := newTestCatalog(t, map[string]string{"web": `{
+		"id": "web", "image": "web:1", "containerPort": "` + port + `", "defaultHostPort": "8080",
+		"health": {"probes": [{"type": "http", "path": "/health"}], "startupTimeout": "5s"}
+	}`})
+	d := NewDockerDeployer(cli, cat)
+
+	if _, err := d.Deploy(context.Background(), "web-1", "web", map[string]interface{}{}); err != nil {
+		t.Fatalf("Deploy: %v", err)
+	}
+	calls := strings.Join(fake.Calls(), "\n")
+	if !strings.Contains(calls, "POST /networks/being-web-1/connect") {
+		t.Errorf("backend did not join the deployment network to probe it; calls:\n%s", calls)
+	}
+
+	// Docker won't remove a network the backend is still on
+	report, err := d.Destroy(context.Background(), "web-1", DestroyOptions{})
+	if err != nil {
+		t.Fatalf("Destroy: %v (%+v)", err, report.Steps)
+	}
+	if names := fake.containerNames(); !reflect.DeepEqual(names, []string{"being-backend"}) {
+		t.Errorf("containers left after destroy: %v", names)
+	}
+	if len(fake.networks) != 0 {
+		t.Errorf("networks left after destroy: %v", fake.networks)
+	}
+}
+
+func TestUpdatePullsEachImageOnce(t *testing.T) {
+	fake, cli := newFakeDocker(t)
+	cat := newTestCatalog(t, map[string]string{"notes": `{
+		"id": "notes", "image": "notes:1", "containerPort": "22300", "defaultHostPort": "22300",
+		"dependsOn": ["database"],
+		"services": [{"name": "database", "image": "postgres:16", "volumes": {"data": "/var/lib/postgresql/data"}}]
+	}`})
+	d := NewDockerDeployer(cli, cat)
+	if _, err := d.Deploy(context.Background(), "notes-1", "notes", map[string]interface{}{}); err != nil {
+		t.Fatalf("Deploy: %v", err)
+	}
+
+	result, err := d.Update(context.Background(), "notes-1", map[string]interface{}{})
+	if err != nil {
+		t.Fatalf("Update: %v", err)
+	}
+	var pulled []string
+	for _, step := range result.Steps {
+		if step.Step == "pull image" {
+			pulled = append(pulled, step.Target)
+		}
+	}
+	if want := []string{"postgres:16", "notes:1"}; !reflect.DeepEqual(pulled, want) {
+		t.Errorf("pulled %v, want %v", pulled, want)
+	}
+	if names := fake.containerNames(); !reflect.DeepEqual(names, []string{"being-notes-1", "being-notes-1-database"}) {
+		t.Errorf("containers after update: %v", names)
+	}
+}
+
+// notesManifest is an app with a database service, a volume and a writable bind.
+const notesManifest = `{
+	"id": "notes", "image": "notes:1", "containerPort": "22300", "defaultHostPort": "22300",
+	"fields": [{"id": "uploadPath", "label": "Uploads", "type": "text"}],
+	"binds": [{"field": "uploadPath", "target": "/uploads"}],
+	"dependsOn": ["database"],
+	"services": [{"name": "database", "image": "postgres:16", "volumes": {"data": "/var/lib/postgresql/data"}}]
+}`
+
+func TestDockerDeploy(t *testing.T) {
+	fake, cli := newFakeDocker(t)
+	d := NewDockerDeployer(cli, newTestCatalog(t, map[string]string{"notes": notesManifest}))
+	uploads := filepath.Join(t.TempDir(), "notes", "uploads")
+
+	result, err := d.Deploy(context.Background(), "notes-1", "notes", map[string]interface{}{"uploadPath": uploads})
+	if err != nil {
+		t.Fatalf("Deploy: %v", err)
+	}
+	if result.DeploymentID != "notes-1" || result.AppID != "notes" || result.Status != "running" {
+		t.Errorf("result %+v", result)
+	}
+	if names := fake.containerNames(); !reflect.DeepEqual(names, []string{"being-notes-1", "being-notes-1-database"}) {
+		t.Errorf("containers %v", names)
+	}
+	if _, ok := fake.networks["being-notes-1"]; !ok {
+		t.Errorf("no deployment network, networks %v", fake.networks)
+	}
+	vol, ok := fake.volumes["being-notes-1-database-data"]
+	if !ok || vol.Labels[labelDeploymentID] != "notes-1" {
+		t.Errorf("database volume missing or unlabelled: %+v", vol)
+	}
+	if _, err := os.Stat(uploads); err != nil {
+		t.Errorf("upload directory was not created: %v", err)
+	}
+
+	// The database has to be up before the app that depends on it
+	var created []string
+	for _, step := range result.Steps {
+		if step.Step == "create container" {
+			created = append(created, step.Target)
+		}
+	}
+	if want := []string{"being-notes-1-database", "being-notes-1"}; !reflect.DeepEqual(created, want) {
+		t.Errorf("created %v, want %v", created, want)
+	}
+}
+
+func TestDockerDeployRollsBack(t *testing.T) {
+	fake, cli := newFakeDocker(t)
+	d := NewDockerDeployer(cli, newTestCatalog(t, map[string]string{"notes": notesManifest}))
+	fake.fail["POST /containers/create"] = http.StatusInternalServerError
+
+	_, err := d.Deploy(context.Background(), "notes-1", "notes", map[string]interface{}{})
+	var pe *PipelineError
+	if !errors.As(err, &pe) {
+		t.Fatalf("Deploy: %v, want a *PipelineError", err)
+	}
+	if !pe.RolledBack || !errors.Is(err, ErrRolledBack) {
+		t.Errorf("deploy was not rolled back: %+v", pe.Steps)
+	}
+	if len(fake.containers) != 0 || len(fake.networks) != 0 || len(fake.volumes) != 0 {
+		t.Errorf("left behind containers %v, networks %v, volumes %v", fake.containerNames(), fake.networks, fake.volumes)
+	}
+	statuses := map[string]string{}
+	for _, step := range pe.Steps {
+		statuses[step.Step] = step.Status
+	}
+	want := map[string]string{
+		"pull image":       StepOK,
+		"create network":   StepRolledBack,
+		"create volume":    StepRolledBack,
+		"create container": StepFailed,
+	}
+	if !reflect.DeepEqual(statuses, want) {
+		t.Errorf("steps %v, want %v", statuses, want)
+	}
+}
+
+func TestDockerDestroy(t *testing.T) {
+	tests := []struct {
+		name        string
+		opts        DestroyOptions
+		wantVolumes int
+		wantUploads bool
+	}{
+		{name: "keep data", wantVolumes: 1, wantUploads: true},
+		{name: "remove data", opts: DestroyOptions{RemoveData: true}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake, cli := newFakeDocker(t)
+			d := NewDockerDeployer(cli, newTestCatalog(t, map[string]string{"notes": notesManifest}))
+			uploads := filepath.Join(t.TempDir(), "uploads")
+			if _, err := d.Deploy(context.Background(), "notes-1", "notes", map[string]interface{}{"uploadPath": uploads}); err != nil {
+				t.Fatalf("Deploy: %v", err)
+			}
+
+			report, err := d.Destroy(context.Background(), "notes-1", tt.opts)
+			if err != nil {
+				t.Fatalf("Destroy: %v (%+v)", err, report.Steps)
+			}
+			if len(fake.containers) != 0 || len(fake.networks) != 0 {
+				t.Errorf("left behind containers %v, networks %v", fake.containerNames(), fake.networks)
+			}
+			if len(fake.volumes) != tt.wantVolumes {
+				t.Errorf("%d volumes left, want %d", len(fake.volumes), tt.wantVolumes)
+			}
+			if _, err := os.Stat(uploads); (err == nil) != tt.wantUploads {
+				t.Errorf("upload directory: %v, want kept %v", err, tt.wantUploads)
+			}
+		})
+	}
+}
+
+func TestDockerNotFound(t *testing.T) {
+	fake, cli := newFakeDocker(t)
+	d := NewDockerDeployer(cli, newTestCatalog(t, map[string]string{"notes": notesManifest}))
+	ctx := context.Background()
+	// Only labels make a container ours, not a name that looks like one of ours
+	fake.addContainer(&fakeContainer{Name: "being-notes-7", Config: container.Config{Image: "notes:1"}, Running: true})
+
+	calls := map[string]func(id string) error{
+		"Destroy": func(id string) error { _, err := d.Destroy(ctx, id, DestroyOptions{}); return err },
+		"Status":  func(id string) error { _, err := d.Status(ctx, id); return err },
+		"Update":  func(id string) error { _, err := d.Update(ctx, id, map[string]interface{}{}); return err },
+		"Upgrade": func(id string) error { _, err := d.Upgrade(ctx, id, map[string]interface{}{}, "notes:2"); return err },
+		"Logs":    func(id string) error { _, err := d.Logs(ctx, id, LogOptions{Tail: -1}); return err },
+		"Health":  func(id string) error { _, err := d.Health(ctx, id); return err },
+	}
+	for name, call := range calls {
+		// A deployment of a known app that was never made, one of an app not in the
+		// catalog, and one whose name is taken by an unlabelled container
+		for _, id := range []string{"notes-9", "wiki-1", "notes-7"} {
+			if err := call(id); !errors.Is(err, ErrNotFound) {
+				t.Errorf("%s(%s) = %v, want ErrNotFound", name, id, err)
+			}
+		}
+	}
+	if _, err := d.Deploy(ctx, "wiki-1", "wiki", map[string]interface{}{}); !errors.Is(err, ErrUnknownApp) {
+		t.Errorf("Deploy of an app not in the catalog = %v, want ErrUnknownApp", err)
+	}
+}
+
+func TestUpgradeRollsBackToPreviousImage(t *testing.T) {
+	var broken atomic.Bool
+	app := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if broken.Load() {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer app.Close()
+	_, port, _ := net.SplitHostPort(strings.TrimPrefix(app.URL, "http://"))
+
+	fake, cli := newFakeDocker(t)
+	d := NewDockerDeployer(cli, newTestCatalog(t, map[string]string{"web": `{
+		"id": "web", "image": "web:1", "containerPort": "` + port + `", "defaultHostPort": "8080",
+		"health": {"probes": [{"type": "http", "path": "/"}], "startupTimeout": "2s"}
+	}`}))
+	const pinned = "web:1@sha256:1111111111111111111111111111111111111111111111111111111111111111"
+	if _, err := d.Deploy(context.Background(), "web-1", "web", map[string]interface{}{}); err != nil {
+		t.Fatalf("Deploy: %v", err)
+	}
+	// Upgraded once already, the app runs an image pinned to a digest rather than the catalog's
+	if _, err := d.Upgrade(context.Background(), "web-1", map[string]interface{}{}, pinned); err != nil {
+		t.Fatalf("Upgrade to %s: %v", pinned, err)
+	}
+
+	broken.Store(true)
+	_, err := d.Upgrade(context.Background(), "web-1", map[string]interface{}{}, "web:2@sha256:2222222222222222222222222222222222222222222222222222222222222222")
+	var pe *PipelineError
+	if !errors.As(err, &pe) || !pe.RolledBack {
+		t.Fatalf("Upgrade: %v, want a rolled back *PipelineError", err)
+	}
+	if names := fake.containerNames(); !reflect.DeepEqual(names, []string{"being-web-1"}) {
+		t.Fatalf("containers after rollback: %v", names)
+	}
+	info, err := cli.ContainerInspect(context.Background(), "being-web-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Config.Image != pinned || !info.State.Running {
+		t.Errorf("after rollback the app runs %s (running %v), want %s", info.Config.Image, info.State.Running, pinned)
+	}
+}
+
+func TestDockerRestore(t *testing.T) {
+	fake, cli := newFakeDocker(t)
+	d := NewDockerDeployer(cli, newTestCatalog(t, map[string]string{"notes": notesManifest}))
+	ctx := context.Background()
+	if _, err := d.Deploy(ctx, "notes-1", "notes", map[string]interface{}{}); err != nil {
+		t.Fatalf("Deploy: %v", err)
+	}
+	if _, err := d.Restore(ctx, "notes-1"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Restore with nothing set aside = %v, want ErrNotFound", err)
+	}
+
+	// An update cut off after moving both containers aside and creating one replacement
+	original := map[string]string{}
+	for _, name := range []string{"being-notes-1", "being-notes-1-database"} {
+		info, err := cli.ContainerInspect(ctx, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		original[name] = info.ID
+		if err := cli.ContainerStop(ctx, info.ID, container.StopOptions{}); err != nil {
+			t.Fatal(err)
+		}
+		if err := cli.ContainerRename(ctx, info.ID, name+"-previous"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fake.addContainer(&fakeContainer{
+		Name:    "being-notes-1-database",
+		Config:  container.Config{Image: "postgres:17", Labels: map[string]string{labelManagedBy: ManagedBy, labelDeploymentID: "notes-1", labelService: "database"}},
+		Running: true,
+	})
+
+	result, err := d.Restore(ctx, "notes-1")
+	if err != nil {
+		t.Fatalf("Restore: %v", err)
+	}
+	if names := fake.containerNames(); !reflect.DeepEqual(names, []string{"being-notes-1", "being-notes-1-database"}) {
+		t.Fatalf("containers after Restore: %v", names)
+	}
+	for name, id := range original {
+		info, err := cli.ContainerInspect(ctx, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.ID != id || !info.State.Running {
+			t.Errorf("%s is %s (running %v), want the original %s running", name, info.ID, info.State.Running, id)
+		}
+	}
+	if result.ContainerID != original["being-notes-1"] || !reflect.DeepEqual(result.Services, []string{"being-notes-1-database"}) {
+		t.Errorf("result %+v", result)
+	}
+}
+
+func TestDockerAdoptRollsBack(t *testing.T) {
+	tests := []struct {
+		name string
+		// fail lists the requests that fail, with {id} for the original container's ID.
+		fail         []string
+		wantRolled   bool
+		wantStatuses map[string]string
+	}{
+		{
+			name:       "create fails",
+			fail:       []string{"POST /containers/create"},
+			wantRolled: true,
+			wantStatuses: map[string]string{
+				"create network":   StepRolledBack,
+				"stop container":   StepRolledBack,
+				"rename container": StepRolledBack,
+				"create container": StepFailed,
+			},
+		},
+		{
+			// The original can't be started again, which the error has to say
+			name: "restarting the original fails",
+			fail: []string{"POST /containers/create", "POST /containers/{id}/start"},
+			wantStatuses: map[string]string{
+				"create network":   StepRolledBack,
+				"stop container":   StepRollbackFailed,
+				"rename container": StepRolledBack,
+				"create container": StepFailed,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake, cli := newFakeDocker(t)
+			d := NewDockerDeployer(cli, newTestCatalog(t, map[string]string{"notes": notesManifest}))
+			original := &fakeContainer{Name: "my-notes", Config: container.Config{Image: "notes:1"}, Running: true}
+			fake.addContainer(original)
+			for _, call := range tt.fail {
+				fake.fail[strings.ReplaceAll(call, "{id}", original.ID)] = http.StatusInternalServerError
+			}
+
+			_, err := d.Adopt(context.Background(), "my-notes", "notes")
+			var pe *PipelineError
+			if !errors.As(err, &pe) {
+				t.Fatalf("Adopt: %v, want a *PipelineError", err)
+			}
+			if pe.RolledBack != tt.wantRolled || errors.Is(err, ErrRolledBack) != tt.wantRolled {
+				t.Errorf("rolled back %v, want %v", pe.RolledBack, tt.wantRolled)
+			}
+			statuses := map[string]string{}
+			for _, step := range pe.Steps {
+				statuses[step.Step] = step.Status
+			}
+			if !reflect.DeepEqual(statuses, tt.wantStatuses) {
+				t.Errorf("steps %v, want %v", statuses, tt.wantStatuses)
+			}
+			if names := fake.containerNames(); !reflect.DeepEqual(names, []string{"my-notes"}) {
+				t.Errorf("containers %v, want only the original under its own name", names)
+			}
+			if len(fake.networks) != 0 {
+				t.Errorf("left behind networks %v", fake.networks)
+			}
+			if tt.wantRolled && !original.Running {
+				t.Error("the original was not started again")
+			}
+		})
+	}
+}
@@ -0,0 +1,386 @@
+package deploy
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"example.com/m/v2/catalog"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/mount"
+	"github.com/docker/docker/api/types/network"
+	"github.com/docker/docker/api/types/volume"
+	"github.com/docker/docker/client"
+)
+
+// fakeDocker is a Docker daemon that keeps containers, networks and volumes in
+// memory and answers the parts of the Engine API the deployer uses. Every
+// container it runs is reachable at 127.0.0.1, so network probes can be pointed
+// at an httptest server.
+type fakeDocker struct {
+	t *testing.T
+
+	mu         sync.Mutex
+	calls      []string
+	containers map[string]*fakeContainer
+	networks   map[string]*network.Inspect
+	volumes    map[string]*volume.Volume
+	// fail makes requests matching "METHOD /path" answer with the given status.
+	fail   map[string]int
+	nextID int
+}
+
+type fakeContainer struct {
+	ID       string
+	Name     string
+	Config   container.Config
+	Host     container.HostConfig
+	Running  bool
+	Networks map[string]*network.EndpointSettings
+}
+
+// newFakeDocker starts a fake daemon and returns a client talking to it.
+func newFakeDocker(t *testing.T) (*fakeDocker, *client.Client) {
+	t.Helper()
+	f := &fakeDocker{
+		t:          t,
+		containers: map[string]*fakeContainer{},
+		networks:   map[string]*network.Inspect{},
+		volumes:    map[string]*volume.Volume{},
+		fail:       map[string]int{},
+	}
+	srv := httptest.NewServer(http.HandlerFunc(f.serve))
+	t.Cleanup(srv.Close)
+	cli, err := client.NewClientWithOpts(client.WithHost("tcp://"+strings.TrimPrefix(srv.URL, "http://")), client.WithVersion("1.47"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { cli.Close() })
+	return f, cli
+}
+
+// newTestCatalog loads a catalog made of the given manifests, keyed by app ID.
+func newTestCatalog(t *testing.T, manifests map[string]string) *catalog.Catalog {
+	t.Helper()
+	dir := t.TempDir()
+	for id, manifest := range manifests {
+		if err := os.WriteFile(filepath.Join(dir, id+".json"), []byte(manifest), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cat, err := catalog.Load(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cat
+}
+
+// Calls returns the requests made so far as "METHOD /path", without the API version.
+func (f *fakeDocker) Calls() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.calls...)
+}
+
+// containerNames returns the names of the containers that exist, sorted.
+func (f *fakeDocker) containerNames() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var names []string
+	for _, c := range f.containers {
+		names = append(names, c.Name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// addContainer puts a running container on the daemon, as if started by someone else.
+func (f *fakeDocker) addContainer(c *fakeContainer) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if c.ID == "" {
+		f.nextID++
+		c.ID = fmt.Sprintf("%064d", f.nextID)
+	}
+	if c.Networks == nil {
+		c.Networks = map[string]*network.EndpointSettings{}
+	}
+	f.containers[c.ID] = c
+}
+
+var versionPrefix = regexp.MustCompile(`^/v[0-9.]+`)
+
+func (f *fakeDocker) serve(w http.ResponseWriter, r *http.Request) {
+	path := versionPrefix.ReplaceAllString(r.URL.Path, "")
+	call := r.Method + " " + path
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls = append(f.calls, call)
+	if status, ok := f.fail[call]; ok {
+		writeError(w, status, "injected failure")
+		return
+	}
+
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+	switch {
+	case path == "/_ping":
+		w.WriteHeader(http.StatusOK)
+	case call == "POST /images/create":
+		writeBody(w, http.StatusOK, map[string]string{"status": "Pull complete"})
+
+	case call == "POST /networks/create":
+		var req network.CreateRequest
+		decode(r, &req)
+		if _, ok := f.networks[req.Name]; ok {
+			writeError(w, http.StatusConflict, "network exists")
+			return
+		}
+		f.nextID++
+		id := fmt.Sprintf("net%d", f.nextID)
+		f.networks[req.Name] = &network.Inspect{ID: id, Name: req.Name, Labels: req.Labels}
+		writeBody(w, http.StatusCreated, network.CreateResponse{ID: id})
+	case call == "GET /networks":
+		var list []network.Summary
+		for _, nw := range f.networks {
+			if matchesFilters(r, nw.Name, nw.Labels) {
+				list = append(list, *nw)
+			}
+		}
+		writeBody(w, http.StatusOK, list)
+	case r.Method == http.MethodGet && parts[0] == "networks" && len(parts) == 2:
+		nw := f.network(parts[1])
+		if nw == nil {
+			writeError(w, http.StatusNotFound, "no such network")
+			return
+		}
+		writeBody(w, http.StatusOK, nw)
+	case r.Method == http.MethodDelete && parts[0] == "networks":
+		nw := f.network(parts[1])
+		if nw == nil {
+			writeError(w, http.StatusNotFound, "no such network")
+			return
+		}
+		for _, c := range f.containers {
+			if _, ok := c.Networks[nw.Name]; ok {
+				writeError(w, http.StatusForbidden, "network has active endpoints")
+				return
+			}
+		}
+		delete(f.networks, nw.Name)
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodPost && parts[0] == "networks" && len(parts) == 3:
+		nw := f.network(parts[1])
+		var req struct{ Container string }
+		decode(r, &req)
+		c := f.container(req.Container)
+		if nw == nil || c == nil {
+			writeError(w, http.StatusNotFound, "no such network or container")
+			return
+		}
+		if parts[2] == "connect" {
+			c.Networks[nw.Name] = &network.EndpointSettings{NetworkID: nw.ID, IPAddress: "127.0.0.1"}
+		} else {
+			delete(c.Networks, nw.Name)
+		}
+		w.WriteHeader(http.StatusOK)
+
+	case call == "POST /volumes/create":
+		var req volume.CreateOptions
+		decode(r, &req)
+		f.volumes[req.Name] = &volume.Volume{Name: req.Name, Labels: req.Labels}
+		writeBody(w, http.StatusCreated, f.volumes[req.Name])
+	case call == "GET /volumes":
+		list := volume.ListResponse{}
+		for _, vol := range f.volumes {
+			if matchesFilters(r, vol.Name, vol.Labels) {
+				list.Volumes = append(list.Volumes, vol)
+			}
+		}
+		writeBody(w, http.StatusOK, list)
+	case parts[0] == "volumes" && len(parts) == 2:
+		vol, ok := f.volumes[parts[1]]
+		if !ok {
+			writeError(w, http.StatusNotFound, "no such volume")
+			return
+		}
+		if r.Method == http.MethodDelete {
+			delete(f.volumes, vol.Name)
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		writeBody(w, http.StatusOK, vol)
+
+	case call == "POST /containers/create":
+		var req container.CreateRequest
+		decode(r, &req)
+		name := r.URL.Query().Get("name")
+		if f.container(name) != nil {
+			writeError(w, http.StatusConflict, "name in use")
+			return
+		}
+		f.nextID++
+		c := &fakeContainer{ID: fmt.Sprintf("%064d", f.nextID), Name: name, Config: *req.Config, Networks: map[string]*network.EndpointSettings{}}
+		if req.HostConfig != nil {
+			c.Host = *req.HostConfig
+		}
+		if req.NetworkingConfig != nil {
+			for nwName, endpoint := range req.NetworkingConfig.EndpointsConfig {
+				settings := &network.EndpointSettings{IPAddress: "127.0.0.1"}
+				if endpoint != nil {
+					settings.Aliases = endpoint.Aliases
+				}
+				if nw := f.network(nwName); nw != nil {
+					settings.NetworkID = nw.ID
+				}
+				c.Networks[nwName] = settings
+			}
+		}
+		f.containers[c.ID] = c
+		writeBody(w, http.StatusCreated, container.CreateResponse{ID: c.ID})
+	case call == "GET /containers/json":
+		var list []container.Summary
+		for _, c := range f.containers {
+			if matchesFilters(r, c.Name, c.Config.Labels) {
+				list = append(list, container.Summary{ID: c.ID, Names: []string{"/" + c.Name}, Labels: c.Config.Labels, Image: c.Config.Image})
+			}
+		}
+		writeBody(w, http.StatusOK, list)
+	case parts[0] == "containers" && len(parts) >= 2:
+		c := f.container(parts[1])
+		if c == nil {
+			writeError(w, http.StatusNotFound, "no such container: "+parts[1])
+			return
+		}
+		switch {
+		case r.Method == http.MethodGet && len(parts) == 3 && parts[2] == "json":
+			writeBody(w, http.StatusOK, c.inspect())
+		case r.Method == http.MethodDelete:
+			if c.Running && r.URL.Query().Get("force") != "1" {
+				writeError(w, http.StatusConflict, "container is running")
+				return
+			}
+			delete(f.containers, c.ID)
+			w.WriteHeader(http.StatusNoContent)
+		case parts[2] == "start":
+			c.Running = true
+			w.WriteHeader(http.StatusNoContent)
+		case parts[2] == "stop":
+			c.Running = false
+			w.WriteHeader(http.StatusNoContent)
+		case parts[2] == "rename":
+			c.Name = r.URL.Query().Get("name")
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			writeError(w, http.StatusNotFound, "unexpected request "+call)
+		}
+
+	default:
+		f.t.Logf("fake docker: unexpected request %s", call)
+		writeError(w, http.StatusNotFound, "unexpected request "+call)
+	}
+}
+
+// container finds a container by ID, ID prefix or name. f.mu must be held.
+func (f *fakeDocker) container(ref string) *fakeContainer {
+	for _, c := range f.containers {
+		if c.Name == ref || strings.HasPrefix(c.ID, ref) {
+			return c
+		}
+	}
+	return nil
+}
+
+// network finds a network by name or ID. f.mu must be held.
+func (f *fakeDocker) network(ref string) *network.Inspect {
+	for _, nw := range f.networks {
+		if nw.Name == ref || nw.ID == ref {
+			return nw
+		}
+	}
+	return nil
+}
+
+func (c *fakeContainer) inspect() container.InspectResponse {
+	status := container.StateExited
+	if c.Running {
+		status = container.StateRunning
+	}
+	var mounts []container.MountPoint
+	for _, m := range c.Host.Mounts {
+		mounts = append(mounts, container.MountPoint{Type: m.Type, Name: volumeName(m), Source: m.Source, Destination: m.Target, RW: !m.ReadOnly})
+	}
+	config := c.Config
+	host := c.Host
+	return container.InspectResponse{
+		ContainerJSONBase: &container.ContainerJSONBase{
+			ID:   c.ID,
+			Name: "/" + c.Name,
+			State: &container.State{
+				Status:  status,
+				Running: c.Running,
+				// Long enough ago to count as settled
+				StartedAt: time.Now().Add(-time.Minute).Format(time.RFC3339Nano),
+			},
+			HostConfig: &host,
+		},
+		Config:          &config,
+		Mounts:          mounts,
+		NetworkSettings: &container.NetworkSettings{Networks: c.Networks},
+	}
+}
+
+func volumeName(m mount.Mount) string {
+	if m.Type == mount.TypeVolume {
+		return m.Source
+	}
+	return ""
+}
+
+// matchesFilters applies the label and name filters of a list request.
+func matchesFilters(r *http.Request, name string, labels map[string]string) bool {
+	var args map[string]map[string]bool
+	if raw := r.URL.Query().Get("filters"); raw != "" {
+		if err := json.Unmarshal([]byte(raw), &args); err != nil {
+			return false
+		}
+	}
+	for label := range args["label"] {
+		key, value, hasValue := strings.Cut(label, "=")
+		got, ok := labels[key]
+		if !ok || (hasValue && got != value) {
+			return false
+		}
+	}
+	for substr := range args["name"] {
+		if !strings.Contains(name, substr) {
+			return false
+		}
+	}
+	return true
+}
+
+func decode(r *http.Request, v interface{}) {
+	body, _ := io.ReadAll(r.Body)
+	json.Unmarshal(body, v)
+}
+
+func writeBody(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeBody(w, status, map[string]string{"message": message})
+}
@@ -0,0 +1,111 @@
+package deploy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"example.com/m/v2/catalog"
+)
+
+// Health states.
+const (
+	// HealthHealthy means the app is running and every check passes.
+	HealthHealthy = "healthy"
+	// HealthDegraded means some checks pass and some fail.
+	HealthDegraded = "degraded"
+	// HealthDown means the app isn't running or no check passes.
+	HealthDown = "down"
+)
+
+// probeTimeout bounds a single run of a probe.
+const probeTimeout = 5 * time.Second
+
+// Health is the result of checking whether a deployment actually works.
+type Health struct {
+	DeploymentID string        `json:"deployment_id"`
+	State        string        `json:"state"`
+	Checks       []CheckResult `json:"checks"`
+	// Reason explains the first failing check, when there is one.
+	Reason    string    `json:"reason,omitempty"`
+	CheckedAt time.Time `json:"checked_at"`
+}
+
+// CheckResult is the outcome of one check: a probe on Docker, a pod on Kubernetes.
+type CheckResult struct {
+	Name    string `json:"name"`
+	Passed  bool   `json:"passed"`
+	Message string `json:"message,omitempty"`
+}
+
+// newHealth sums up the checks of a deployment into its health state.
+func newHealth(deploymentID string, checks []CheckResult) *Health {
+	health := &Health{DeploymentID: deploymentID, Checks: checks, CheckedAt: time.Now().UTC()}
+	passed := 0
+	for _, check := range checks {
+		if check.Passed {
+			passed++
+		} else if health.Reason == "" {
+			health.Reason = check.Name + ": " + check.Message
+		}
+	}
+	switch {
+	case len(checks) > 0 && passed == len(checks):
+		health.State = HealthHealthy
+	case passed > 0:
+		health.State = HealthDegraded
+	default:
+		health.State = HealthDown
+	}
+	return health
+}
+
+// startupTimeout is how long a deploy waits for a service of a stack to become healthy.
+func startupTimeout(svc catalog.Service) time.Duration {
+	if timeout := svc.StartupTimeout(); timeout > 0 {
+		return timeout
+	}
+	return healthTimeout
+}
+
+// probeNetwork runs an http or tcp probe against a container reachable at host.
+func probeNetwork(ctx context.Context, host string, probe catalog.Probe) error {
+	ctx, cancel := context.WithTimeout(ctx, probeTimeout)
+	defer cancel()
+	addr := net.JoinHostPort(host, probe.Port)
+
+	if probe.Type == catalog.ProbeTCP {
+		var dialer net.Dialer
+		conn, err := dialer.DialContext(ctx, "tcp", addr)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+
+	path := probe.Path
+	if path == "" {
+		path = "/"
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://"+addr+path, nil)
+	if err != nil {
+		return err
+	}
+	// A redirect to the login page still means the app is answering, so don't follow it
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if probe.ExpectStatus != 0 && resp.StatusCode != probe.ExpectStatus {
+		return fmt.Errorf("got status %d, want %d", resp.StatusCode, probe.ExpectStatus)
+	}
+	if probe.ExpectStatus == 0 && resp.StatusCode >= 400 {
+		return fmt.Errorf("got status %d", resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,798 @@
+package deploy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/kubernetes"
+
+	"example.com/m/v2/catalog"
+)
+
+// HelmOptions configures how the Helm deployer reaches the cluster.
+type HelmOptions struct {
+	// HelmBinary is the helm executable; defaults to "helm" on the PATH.
+	HelmBinary string
+	// ChartPath is the chart every app is installed from.
+	ChartPath string
+	// Namespace is where releases are installed.
+	Namespace string
+	// KubeConfig and KubeContext select the cluster; both are optional.
+	KubeConfig  string
+	KubeContext string
+}
+
+// HelmDeployer installs apps as Helm releases on a Kubernetes cluster.
+// Releases are driven through the helm CLI, and their state is read back through
+// the Kubernetes API, so tests can swap in a fake clientset or API server.
+type HelmDeployer struct {
+	opts    HelmOptions
+	kube    kubernetes.Interface
+	catalog *catalog.Catalog
+}
+
+// NewHelmDeployer creates a deployer that manages Helm releases for the apps in cat.
+func NewHelmDeployer(opts HelmOptions, kube kubernetes.Interface, cat *catalog.Catalog) *HelmDeployer {
+	if opts.HelmBinary == "" {
+		opts.HelmBinary = "helm"
+	}
+	if opts.Namespace == "" {
+		opts.Namespace = "default"
+	}
+	return &HelmDeployer{opts: opts, kube: kube, catalog: cat}
+}
+
+// Labels the chart puts on every Kubernetes object of a release, from the labels value.
+const (
+	kubeLabelManagedBy      = "being.software/managed-by"
+	kubeLabelDeploymentID   = "being.software/deployment-id"
+	kubeLabelAppID          = "being.software/app-id"
+	kubeLabelCatalogVersion = "being.software/catalog-version"
+	// kubeLabelStack and kubeLabelService are on the workloads of a stack's services,
+	// whose pods go without the release's instance label so the app's Service
+	// doesn't send them traffic.
+	kubeLabelStack   = "being.software/stack"
+	kubeLabelService = "being.software/service"
+)
+
+// chartValues is the values file handed to the chart.
+// JSON is valid YAML, so helm reads it directly.
+type chartValues struct {
+	Image         string            `json:"image"`
+	Labels        map[string]string `json:"labels"`
+	ContainerPort int               `json:"containerPort"`
+	Env           map[string]string `json:"env"`
+	SecretEnv     map[string]string `json:"secretEnv"`
+	Persistence   []persistentValue `json:"persistence"`
+	HostPaths     []hostPathValue   `json:"hostPaths"`
+	Ingress       ingressValue      `json:"ingress"`
+	// ReadinessProbe is the app's first health probe, run by the kubelet.
+	ReadinessProbe *corev1.Probe `json:"readinessProbe,omitempty"`
+	// WaitFor holds the app's pod back until the services it depends on are ready.
+	WaitFor []waitValue `json:"waitFor,omitempty"`
+	// Services are the other workloads of the app's stack, such as its database.
+	Services []serviceValue `json:"services,omitempty"`
+}
+
+type serviceValue struct {
+	Name           string            `json:"name"`
+	Image          string            `json:"image"`
+	Port           int               `json:"port,omitempty"`
+	Env            map[string]string `json:"env"`
+	SecretEnv      map[string]string `json:"secretEnv"`
+	Persistence    []persistentValue `json:"persistence"`
+	ReadinessProbe *corev1.Probe     `json:"readinessProbe,omitempty"`
+	WaitFor        []waitValue       `json:"waitFor,omitempty"`
+}
+
+// waitValue is a service to wait for. A Kubernetes Service only takes connections
+// once a pod behind it is ready, so a port that answers means it passed its probe.
+type waitValue struct {
+	Name string `json:"name"`
+	Host string `json:"host"`
+	Port int    `json:"port"`
+}
+
+type persistentValue struct {
+	Name      string `json:"name"`
+	MountPath string `json:"mountPath"`
+}
+
+type hostPathValue struct {
+	Name      string `json:"name"`
+	Path      string `json:"path"`
+	MountPath string `json:"mountPath"`
+	ReadOnly  bool   `json:"readOnly"`
+}
+
+type ingressValue struct {
+	Enabled bool   `json:"enabled"`
+	Host    string `json:"host"`
+}
+
+// Deploy installs a new release of the app's chart. If the install fails, whatever
+// it left behind is uninstalled, along with volume claims it made that no earlier
+// deployment's data lives in.
+func (h *HelmDeployer) Deploy(ctx context.Context, deploymentID, appID string, config map[string]interface{}) (*Result, error) {
+	app, ok := h.catalog.Get(appID)
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownApp, appID)
+	}
+	p := newPipeline("deploy")
+
+	claims, err := h.kube.CoreV1().PersistentVolumeClaims(h.opts.Namespace).List(ctx, metav1.ListOptions{
+		LabelSelector: "app.kubernetes.io/instance=" + deploymentID,
+	})
+	if err != nil {
+		err = fmt.Errorf("failed to list volume claims of %s: %w", deploymentID, err)
+		p.record("list volume claims", deploymentID, err)
+		return nil, p.fail(ctx, err)
+	}
+	keepClaims := len(claims.Items) > 0
+	uninstall := func(ctx context.Context) error {
+		// The install may have failed before there was a release to uninstall
+		if _, err := h.revision(ctx, deploymentID); err == nil {
+			if _, err := h.helm(ctx, "uninstall", deploymentID); err != nil {
+				return err
+			}
+		} else if !errors.Is(err, ErrNotFound) {
+			return err
+		}
+		if keepClaims {
+			return nil
+		}
+		return h.kube.CoreV1().PersistentVolumeClaims(h.opts.Namespace).DeleteCollection(ctx, metav1.DeleteOptions{}, metav1.ListOptions{
+			LabelSelector: "app.kubernetes.io/instance=" + deploymentID,
+		})
+	}
+
+	err = p.do("install release", deploymentID, func() error {
+		return h.applyRelease(ctx, "install", deploymentID, app, app.Image, config)
+	}, uninstall)
+	if err != nil {
+		// A failed install can still leave a release holding resources
+		p.compensate(uninstall)
+		return nil, p.fail(ctx, err)
+	}
+	result := h.result(deploymentID, app)
+	result.Steps = p.steps
+	return result, nil
+}
+
+// Destroy uninstalls a deployment's release.
+// The chart keeps its PersistentVolumeClaims on uninstall, so they're only deleted
+// when opts.RemoveData is set.
+func (h *HelmDeployer) Destroy(ctx context.Context, deploymentID string, opts DestroyOptions) (*DestroyReport, error) {
+	if _, err := appForDeployment(h.catalog, deploymentID); err != nil {
+		return nil, err
+	}
+	report := &DestroyReport{DeploymentID: deploymentID}
+
+	if _, err := h.revision(ctx, deploymentID); err != nil {
+		return nil, err
+	}
+	_, err := h.helm(ctx, "uninstall", deploymentID)
+	report.record("uninstall release", deploymentID, err)
+
+	if !opts.RemoveData {
+		report.skip("remove volume claims", deploymentID, "data is kept unless remove_data is set")
+		return report, report.Err()
+	}
+	err = h.kube.CoreV1().PersistentVolumeClaims(h.opts.Namespace).DeleteCollection(ctx, metav1.DeleteOptions{}, metav1.ListOptions{
+		LabelSelector: "app.kubernetes.io/instance=" + deploymentID,
+	})
+	report.record("remove volume claims", deploymentID, err)
+
+	// Host paths live on whichever node ran the pod, which we can't reach from here.
+	report.skip("remove host directories", deploymentID, "host paths on cluster nodes must be removed manually")
+	return report, report.Err()
+}
+
+// Status reads the release's Deployment and pods from the Kubernetes API.
+func (h *HelmDeployer) Status(ctx context.Context, deploymentID string) (*Status, error) {
+	app, err := appForDeployment(h.catalog, deploymentID)
+	if err != nil {
+		return nil, err
+	}
+
+	dep, err := h.kube.AppsV1().Deployments(h.opts.Namespace).Get(ctx, deploymentID, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil, fmt.Errorf("%w: %s", ErrNotFound, deploymentID)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get deployment %s: %w", deploymentID, err)
+	}
+
+	status := &Status{
+		DeploymentID:   deploymentID,
+		AppID:          app.ID,
+		State:          "running",
+		CatalogVersion: dep.Labels[kubeLabelCatalogVersion],
+	}
+	if containers := dep.Spec.Template.Spec.Containers; len(containers) > 0 {
+		status.Image = containers[0].Image
+		for _, port := range containers[0].Ports {
+			status.Ports = append(status.Ports, strconv.Itoa(int(port.ContainerPort)))
+		}
+	}
+	pods, err := h.kube.CoreV1().Pods(h.opts.Namespace).List(ctx, metav1.ListOptions{
+		LabelSelector: "app.kubernetes.io/instance=" + deploymentID,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list pods for %s: %w", deploymentID, err)
+	}
+	// The kubelet reports the image a container runs as repository@digest
+	for _, pod := range pods.Items {
+		for _, cs := range pod.Status.ContainerStatuses {
+			if _, digest, ok := strings.Cut(cs.ImageID, "@"); ok && status.ImageDigest == "" {
+				status.ImageDigest = digest
+			}
+		}
+	}
+	if dep.Status.ReadyReplicas >= 1 {
+		return status, nil
+	}
+
+	// Not ready yet: look at the pods to tell a slow start from a broken one.
+	status.State = "pending"
+	for _, pod := range pods.Items {
+		for _, cs := range pod.Status.ContainerStatuses {
+			if waiting := cs.State.Waiting; waiting != nil && waiting.Reason != "ContainerCreating" {
+				status.State = "failed"
+				status.Message = waiting.Reason + ": " + waiting.Message
+			}
+		}
+	}
+	return status, nil
+}
+
+// List finds the releases carrying this backend's labels through their Kubernetes Deployments.
+func (h *HelmDeployer) List(ctx context.Context) ([]*Status, error) {
+	deployments, err := h.kube.AppsV1().Deployments(h.opts.Namespace).List(ctx, metav1.ListOptions{
+		LabelSelector: kubeLabelManagedBy + "=" + ManagedBy,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list deployments: %w", err)
+	}
+
+	var statuses []*Status
+	for _, dep := range deployments.Items {
+		// The workloads of a stack's services are part of the app's deployment
+		if dep.Labels[kubeLabelService] != "" {
+			continue
+		}
+		status := &Status{
+			DeploymentID:   dep.Labels[kubeLabelDeploymentID],
+			AppID:          dep.Labels[kubeLabelAppID],
+			State:          "pending",
+			CatalogVersion: dep.Labels[kubeLabelCatalogVersion],
+		}
+		if dep.Status.ReadyReplicas >= 1 {
+			status.State = "running"
+		}
+		if containers := dep.Spec.Template.Spec.Containers; len(containers) > 0 {
+			status.Image = containers[0].Image
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses, nil
+}
+
+// Adopt is only supported for releases this backend installed; workloads applied by
+// hand have no release for helm to take over.
+func (h *HelmDeployer) Adopt(ctx context.Context, ref, appID string) (*Result, error) {
+	dep, err := h.kube.AppsV1().Deployments(h.opts.Namespace).Get(ctx, ref, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil, fmt.Errorf("%w: no deployment named %s", ErrNotFound, ref)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get deployment %s: %w", ref, err)
+	}
+	if dep.Labels[kubeLabelManagedBy] != ManagedBy {
+		return nil, fmt.Errorf("%w: %s was not installed by this backend; the helm backend can only adopt its own releases", ErrNotAdoptable, ref)
+	}
+
+	deploymentID, labelled := dep.Labels[kubeLabelDeploymentID], dep.Labels[kubeLabelAppID]
+	if appID != "" && appID != labelled {
+		return nil, fmt.Errorf("%w: %s is a deployment of %s, not %s", ErrNotAdoptable, ref, labelled, appID)
+	}
+	app, ok := h.catalog.Get(labelled)
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownApp, labelled)
+	}
+	result := h.result(deploymentID, app)
+	if containers := dep.Spec.Template.Spec.Containers; len(containers) > 0 {
+		result.Image = containers[0].Image
+	}
+	return result, nil
+}
+
+// Logs streams the output of every container in the release's pods. Kubernetes
+// doesn't keep stdout and stderr apart, so lines carry no stream.
+func (h *HelmDeployer) Logs(ctx context.Context, deploymentID string, opts LogOptions) (*LogStream, error) {
+	if _, err := appForDeployment(h.catalog, deploymentID); err != nil {
+		return nil, err
+	}
+	pods, err := h.releasePods(ctx, deploymentID)
+	if err != nil {
+		return nil, err
+	}
+
+	var sources []logSource
+	for _, pod := range pods {
+		for _, c := range pod.Spec.Containers {
+			// Pods of one release share container names, so lines name the pod too
+			name := pod.Name + "/" + c.Name
+			if opts.Container != "" && opts.Container != c.Name && opts.Container != name {
+				continue
+			}
+			logOpts := &corev1.PodLogOptions{Container: c.Name, Follow: opts.Follow, Timestamps: true}
+			if opts.Tail >= 0 {
+				tail := int64(opts.Tail)
+				logOpts.TailLines = &tail
+			}
+			if !opts.Since.IsZero() {
+				logOpts.SinceTime = &metav1.Time{Time: opts.Since}
+			}
+			podName := pod.Name
+			sources = append(sources, func(ctx context.Context, emit func(LogLine)) error {
+				reader, err := h.kube.CoreV1().Pods(h.opts.Namespace).GetLogs(podName, logOpts).Stream(ctx)
+				if err != nil {
+					return fmt.Errorf("failed to read logs of %s: %w", name, err)
+				}
+				defer reader.Close()
+				out := &lineWriter{container: name, emit: emit}
+				_, err = io.Copy(out, reader)
+				out.Flush()
+				if err != nil {
+					return fmt.Errorf("failed to read logs of %s: %w", name, err)
+				}
+				return nil
+			})
+		}
+	}
+	if len(sources) == 0 {
+		if opts.Container != "" {
+			return nil, fmt.Errorf("%w: no container %s in %s", ErrNotFound, opts.Container, deploymentID)
+		}
+		return nil, fmt.Errorf("%w: %s", ErrNotFound, deploymentID)
+	}
+	return newLogStream(ctx, sources), nil
+}
+
+// Health reports the readiness of the release's pods. A container only has one
+// readiness probe, so the kubelet runs the app's first probe and the backend reads
+// the outcome back, explaining a pod that isn't ready from its container states
+// and the kubelet's latest probe failure.
+func (h *HelmDeployer) Health(ctx context.Context, deploymentID string) (*Health, error) {
+	if _, err := appForDeployment(h.catalog, deploymentID); err != nil {
+		return nil, err
+	}
+	pods, err := h.releasePods(ctx, deploymentID)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(pods) == 0 {
+		_, err := h.kube.AppsV1().Deployments(h.opts.Namespace).Get(ctx, deploymentID, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			return nil, fmt.Errorf("%w: %s", ErrNotFound, deploymentID)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to get deployment %s: %w", deploymentID, err)
+		}
+		return newHealth(deploymentID, []CheckResult{{Name: deploymentID, Message: "no pods are running"}}), nil
+	}
+
+	checks := make([]CheckResult, 0, len(pods))
+	for _, pod := range pods {
+		check := CheckResult{Name: pod.Name, Passed: podReady(&pod)}
+		if !check.Passed {
+			check.Message = h.notReadyReason(ctx, &pod)
+		}
+		checks = append(checks, check)
+	}
+	return newHealth(deploymentID, checks), nil
+}
+
+// releasePods lists the pods of a release: the app's, then those of its stack's services.
+func (h *HelmDeployer) releasePods(ctx context.Context, release string) ([]corev1.Pod, error) {
+	var all []corev1.Pod
+	for _, selector := range []string{"app.kubernetes.io/instance=" + release, kubeLabelStack + "=" + release} {
+		pods, err := h.kube.CoreV1().Pods(h.opts.Namespace).List(ctx, metav1.ListOptions{LabelSelector: selector})
+		if err != nil {
+			return nil, fmt.Errorf("failed to list pods for %s: %w", release, err)
+		}
+		all = append(all, pods.Items...)
+	}
+	return all, nil
+}
+
+// podReady reports whether a pod's Ready condition is true.
+func podReady(pod *corev1.Pod) bool {
+	for _, cond := range pod.Status.Conditions {
+		if cond.Type == corev1.PodReady {
+			return cond.Status == corev1.ConditionTrue
+		}
+	}
+	return false
+}
+
+// notReadyReason explains why a pod isn't ready, most specific reason first.
+func (h *HelmDeployer) notReadyReason(ctx context.Context, pod *corev1.Pod) string {
+	for _, cs := range pod.Status.ContainerStatuses {
+		if waiting := cs.State.Waiting; waiting != nil {
+			return strings.TrimSuffix(waiting.Reason+": "+waiting.Message, ": ")
+		}
+		if terminated := cs.State.Terminated; terminated != nil {
+			return fmt.Sprintf("container %s exited with code %d", cs.Name, terminated.ExitCode)
+		}
+	}
+
+	// A running container that isn't ready is failing its probe; the kubelet says why in an event
+	events, err := h.kube.CoreV1().Events(h.opts.Namespace).List(ctx, metav1.ListOptions{
+		FieldSelector: "involvedObject.name=" + pod.Name + ",reason=Unhealthy",
+	})
+	if err == nil {
+		var latest *corev1.Event
+		for i, event := range events.Items {
+			if event.Reason == "Unhealthy" && (latest == nil || event.LastTimestamp.After(latest.LastTimestamp.Time)) {
+				latest = &events.Items[i]
+			}
+		}
+		if latest != nil {
+			return latest.Message
+		}
+	}
+
+	for _, cond := range pod.Status.Conditions {
+		if cond.Type == corev1.PodReady && cond.Message != "" {
+			return cond.Message
+		}
+	}
+	return "pod is " + strings.ToLower(string(pod.Status.Phase))
+}
+
+// Update upgrades a deployment's release with values rendered from the new configuration,
+// keeping the image it runs. If the upgrade fails the release is rolled back to the
+// revision it was on.
+func (h *HelmDeployer) Update(ctx context.Context, deploymentID string, config map[string]interface{}) (*Result, error) {
+	app, err := appForDeployment(h.catalog, deploymentID)
+	if err != nil {
+		return nil, err
+	}
+	return h.upgradeRelease(ctx, newPipeline("update"), deploymentID, app, h.releaseImage(ctx, deploymentID, app), config)
+}
+
+// releaseImage returns the image a release was last installed or upgraded with, or
+// the catalog's if helm can't say.
+func (h *HelmDeployer) releaseImage(ctx context.Context, release string, app *catalog.App) string {
+	out, err := h.helm(ctx, "get", "values", release, "--output", "json")
+	if err != nil {
+		return app.Image
+	}
+	var values struct {
+		Image string `json:"image"`
+	}
+	if err := json.Unmarshal(out, &values); err != nil || values.Image == "" {
+		return app.Image
+	}
+	return values.Image
+}
+
+// Upgrade moves a release to another image. Helm waits for the new pod to become
+// ready, and if it doesn't the release is rolled back to the revision it was on.
+func (h *HelmDeployer) Upgrade(ctx context.Context, deploymentID string, config map[string]interface{}, image string) (*Result, error) {
+	app, err := appForDeployment(h.catalog, deploymentID)
+	if err != nil {
+		return nil, err
+	}
+	return h.upgradeRelease(ctx, newPipeline("upgrade"), deploymentID, app, image, config)
+}
+
+// Restore rolls back a release that an interrupted Upgrade or Update left pending
+// or failed to the revision before it.
+func (h *HelmDeployer) Restore(ctx context.Context, deploymentID string) (*Result, error) {
+	app, err := appForDeployment(h.catalog, deploymentID)
+	if err != nil {
+		return nil, err
+	}
+	revision, status, err := h.releaseInfo(ctx, deploymentID)
+	if err != nil {
+		return nil, err
+	}
+	if revision < 2 || (status != "failed" && !strings.HasPrefix(status, "pending-")) {
+		return nil, fmt.Errorf("%w: release %s is %s at revision %d", ErrNotFound, deploymentID, status, revision)
+	}
+	report(ctx, "rollback", fmt.Sprintf("Rolling %s back to revision %d", deploymentID, revision-1), 0)
+	if _, err := h.helm(ctx, "rollback", deploymentID, strconv.Itoa(revision-1), "--wait"); err != nil {
+		return nil, err
+	}
+	result := h.result(deploymentID, app)
+	result.Image = h.releaseImage(ctx, deploymentID, app)
+	return result, nil
+}
+
+// upgradeRelease runs helm upgrade for image, with helm rollback to the current
+// revision as its compensating action.
+func (h *HelmDeployer) upgradeRelease(ctx context.Context, p *pipeline, release string, app *catalog.App, image string, config map[string]interface{}) (*Result, error) {
+	var revision int
+	err := p.do("read release", release, func() (err error) {
+		revision, err = h.revision(ctx, release)
+		return err
+	}, nil)
+	if errors.Is(err, ErrNotFound) {
+		return nil, err
+	}
+	if err != nil {
+		return nil, p.fail(ctx, err)
+	}
+
+	rollback := func(ctx context.Context) error {
+		report(ctx, "rollback", fmt.Sprintf("Rolling %s back to revision %d", release, revision), 0)
+		_, err := h.helm(ctx, "rollback", release, strconv.Itoa(revision), "--wait")
+		return err
+	}
+	err = p.do("upgrade release", release, func() error {
+		return h.applyRelease(ctx, "upgrade", release, app, image, config, "--wait")
+	}, rollback)
+	if err != nil {
+		// A failed upgrade is still a new revision, and may have replaced the pods
+		p.compensate(rollback)
+		return nil, p.fail(ctx, err)
+	}
+	result := h.result(release, app)
+	result.Image = image
+	result.Steps = p.steps
+	return result, nil
+}
+
+// revision returns the revision a release is on, or ErrNotFound if there's no such
+// release in the namespace.
+func (h *HelmDeployer) revision(ctx context.Context, release string) (int, error) {
+	revision, _, err := h.releaseInfo(ctx, release)
+	return revision, err
+}
+
+// releaseInfo returns a release's revision and status, such as "deployed" or
+// "pending-upgrade". Helm's errors don't tell a missing release apart from a missing
+// chart or kube context, so the release is looked up by name instead.
+func (h *HelmDeployer) releaseInfo(ctx context.Context, release string) (int, string, error) {
+	// --all includes releases whose last install or upgrade failed
+	out, err := h.helm(ctx, "list", "--all", "--filter", "^"+regexp.QuoteMeta(release)+"$", "--output", "json")
+	if err != nil {
+		return 0, "", err
+	}
+	var releases []struct {
+		Name     string `json:"name"`
+		Revision string `json:"revision"`
+		Status   string `json:"status"`
+	}
+	if err := json.Unmarshal(out, &releases); err != nil {
+		return 0, "", fmt.Errorf("failed to read release %s: %w", release, err)
+	}
+	for _, r := range releases {
+		if r.Name != release {
+			continue
+		}
+		revision, err := strconv.Atoi(r.Revision)
+		if err != nil {
+			return 0, "", fmt.Errorf("release %s has revision %q: %w", release, r.Revision, err)
+		}
+		return revision, r.Status, nil
+	}
+	return 0, "", fmt.Errorf("%w: %s", ErrNotFound, release)
+}
+
+// applyRelease renders the values file for image and runs helm install or upgrade
+// with it, adding any extra flags.
+func (h *HelmDeployer) applyRelease(ctx context.Context, action, release string, app *catalog.App, image string, config map[string]interface{}, extra ...string) error {
+	rendered := renderValues(release, app, config)
+	rendered.Image = image
+	values, err := json.Marshal(rendered)
+	if err != nil {
+		return fmt.Errorf("failed to render chart values: %w", err)
+	}
+
+	// The values file holds secrets, so keep it private and short-lived.
+	dir, err := os.MkdirTemp("", "being-values-")
+	if err != nil {
+		return fmt.Errorf("failed to create values directory: %w", err)
+	}
+	defer os.RemoveAll(dir)
+	valuesFile := filepath.Join(dir, "values.json")
+	if err := os.WriteFile(valuesFile, values, 0600); err != nil {
+		return fmt.Errorf("failed to write values file: %w", err)
+	}
+
+	args := []string{action, release, h.opts.ChartPath, "--values", valuesFile}
+	if action == "install" {
+		args = append(args, "--create-namespace")
+	}
+	args = append(args, extra...)
+	// An app with probes isn't deployed until its pod is ready, which is when they pass
+	if len(app.Probes()) > 0 {
+		args = append(args, "--wait")
+		if timeout := app.StartupTimeout(); timeout > 0 {
+			args = append(args, "--timeout", timeout.String())
+		}
+	}
+	report(ctx, "release", fmt.Sprintf("Running helm %s for %s", action, release), 0)
+	if _, err := h.helm(ctx, args...); err != nil {
+		return err
+	}
+	report(ctx, "release", fmt.Sprintf("Release %s applied", release), 100)
+	return nil
+}
+
+// helm runs the helm CLI against the configured cluster and namespace.
+func (h *HelmDeployer) helm(ctx context.Context, args ...string) ([]byte, error) {
+	args = append(args, "--namespace", h.opts.Namespace)
+	if h.opts.KubeConfig != "" {
+		args = append(args, "--kubeconfig", h.opts.KubeConfig)
+	}
+	if h.opts.KubeContext != "" {
+		args = append(args, "--kube-context", h.opts.KubeContext)
+	}
+
+	cmd := exec.CommandContext(ctx, h.opts.HelmBinary, args...)
+	// Don't wait on output from processes helm left behind once it has been killed,
+	// or a cancelled deploy would hold up a shutdown.
+	cmd.WaitDelay = 5 * time.Second
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("helm %s failed: %s: %w", args[0], strings.TrimSpace(string(out)), err)
+	}
+	return out, nil
+}
+
+// result builds the deployment result for a release.
+func (h *HelmDeployer) result(release string, app *catalog.App) *Result {
+	return &Result{
+		DeploymentID: release,
+		AppID:        app.ID,
+		Release:      release,
+		Image:        app.Image,
+		Status:       "deployed",
+		Ports:        []string{app.ContainerPort},
+		CreatedAt:    time.Now().UTC().Format(time.RFC3339),
+	}
+}
+
+// renderValues maps an app manifest and the user's configuration onto chart values,
+// with a workload for each service of the stack the configuration enables.
+func renderValues(release string, app *catalog.App, config map[string]interface{}) chartValues {
+	port, _ := strconv.Atoi(app.ContainerPort)
+	values := chartValues{
+		Image: app.Image,
+		Labels: map[string]string{
+			kubeLabelManagedBy:      ManagedBy,
+			kubeLabelDeploymentID:   release,
+			kubeLabelAppID:          app.ID,
+			kubeLabelCatalogVersion: app.Version,
+		},
+		ContainerPort: port,
+	}
+
+	stack := app.Stack(config)
+	hosts := map[string]string{}
+	for _, svc := range stack {
+		if svc.Name != "" {
+			hosts[svc.Name] = release + "-" + svc.Name
+		}
+	}
+	values.Env, values.SecretEnv = renderEnv(app, app.Self(), config, hosts)
+	values.WaitFor = waitFor(app.Self(), stack, hosts)
+	for _, svc := range stack {
+		if svc.Name == "" {
+			continue
+		}
+		service := serviceValue{Name: svc.Name, Image: svc.Image, WaitFor: waitFor(svc, stack, hosts)}
+		service.Port, _ = strconv.Atoi(svc.Port)
+		service.Env, service.SecretEnv = renderEnv(app, svc, config, hosts)
+		for suffix, target := range svc.Volumes {
+			service.Persistence = append(service.Persistence, persistentValue{Name: suffix, MountPath: target})
+		}
+		if probes := svc.Probes(); len(probes) > 0 {
+			service.ReadinessProbe = kubeProbe(probes[0])
+		}
+		values.Services = append(values.Services, service)
+	}
+
+	for suffix, target := range app.Volumes {
+		values.Persistence = append(values.Persistence, persistentValue{Name: suffix, MountPath: target})
+	}
+	for _, bind := range app.Binds {
+		if hostPath, ok := config[bind.Field].(string); ok && hostPath != "" {
+			values.HostPaths = append(values.HostPaths, hostPathValue{
+				Name:      strings.ToLower(bind.Field),
+				Path:      hostPath,
+				MountPath: bind.Target,
+				ReadOnly:  bind.ReadOnly,
+			})
+		}
+	}
+
+	if domain := configString(config["domain"]); domain != "" {
+		values.Ingress = ingressValue{Enabled: true, Host: domain}
+	}
+	if probes := app.Probes(); len(probes) > 0 {
+		values.ReadinessProbe = kubeProbe(probes[0])
+	}
+	return values
+}
+
+// renderEnv renders the environment of one service of a stack. Fields the manifest
+// marks sensitive go into a Kubernetes Secret.
+func renderEnv(app *catalog.App, svc catalog.Service, config map[string]interface{}, hosts map[string]string) (env, secretEnv map[string]string) {
+	env, secretEnv = map[string]string{}, map[string]string{}
+	for name, value := range svc.StaticEnv {
+		env[name] = value
+	}
+	for _, mapping := range svc.Env {
+		value := envValue(mapping, config, hosts)
+		if value == "" {
+			continue
+		}
+		if mapping.Field != "" && app.SensitiveField(mapping.Field) {
+			secretEnv[mapping.Name] = value
+		} else {
+			env[mapping.Name] = value
+		}
+	}
+	return env, secretEnv
+}
+
+// waitFor lists the services svc depends on that it can wait for. One without a
+// port can't be waited for, so it's started alongside.
+func waitFor(svc catalog.Service, stack []catalog.Service, hosts map[string]string) []waitValue {
+	var waits []waitValue
+	for _, dep := range svc.DependsOn {
+		for _, other := range stack {
+			if other.Name != dep || other.Port == "" {
+				continue
+			}
+			port, _ := strconv.Atoi(other.Port)
+			waits = append(waits, waitValue{Name: dep, Host: hosts[dep], Port: port})
+		}
+	}
+	return waits
+}
+
+// kubeProbe converts a manifest probe into a Kubernetes one. The kubelet accepts
+// any 2xx or 3xx from an http probe, so an expected status can't be enforced.
+func kubeProbe(probe catalog.Probe) *corev1.Probe {
+	port, _ := strconv.Atoi(probe.Port)
+	kube := &corev1.Probe{
+		PeriodSeconds:    10,
+		TimeoutSeconds:   int32(probeTimeout / time.Second),
+		FailureThreshold: 3,
+	}
+	switch probe.Type {
+	case catalog.ProbeHTTP:
+		path := probe.Path
+		if path == "" {
+			path = "/"
+		}
+		kube.HTTPGet = &corev1.HTTPGetAction{Path: path, Port: intstr.FromInt32(int32(port))}
+	case catalog.ProbeTCP:
+		kube.TCPSocket = &corev1.TCPSocketAction{Port: intstr.FromInt32(int32(port))}
+	case catalog.ProbeExec:
+		kube.Exec = &corev1.ExecAction{Command: probe.Command}
+	}
+	return kube
+}
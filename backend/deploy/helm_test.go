@@ -0,0 +1,453 @@
+package deploy
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+// fakeHelm is a helm stand-in: a script that records its arguments and answers
+// helm list from a file, failing any command with a canned error if one is set.
+type fakeHelm struct {
+	dir string
+}
+
+const fakeHelmScript = `#!/bin/sh
+dir=$(dirname "$0")
+echo "$*" >> "$dir/calls"
+if [ -f "$dir/fail-$1" ]; then
+	cat "$dir/fail-$1" >&2
+	exit 1
+fi
+if [ "$1" = list ]; then
+	cat "$dir/releases.json"
+fi
+`
+
+func newFakeHelm(t *testing.T) *fakeHelm {
+	t.Helper()
+	f := &fakeHelm{dir: t.TempDir()}
+	if err := os.WriteFile(filepath.Join(f.dir, "helm"), []byte(fakeHelmScript), 0700); err != nil {
+		t.Fatal(err)
+	}
+	f.setReleases(t, "[]")
+	return f
+}
+
+func (f *fakeHelm) binary() string { return filepath.Join(f.dir, "helm") }
+
+// setReleases sets what helm list prints.
+func (f *fakeHelm) setReleases(t *testing.T, releases string) {
+	t.Helper()
+	if err := os.WriteFile(filepath.Join(f.dir, "releases.json"), []byte(releases), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// failWith makes every run of the helm command exit with message on stderr.
+func (f *fakeHelm) failWith(t *testing.T, command, message string) {
+	t.Helper()
+	if err := os.WriteFile(filepath.Join(f.dir, "fail-"+command), []byte(message), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// calls returns the argument lists helm was run with.
+func (f *fakeHelm) calls(t *testing.T) []string {
+	t.Helper()
+	out, err := os.ReadFile(filepath.Join(f.dir, "calls"))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.Split(strings.TrimSpace(string(out)), "\n")
+}
+
+func newTestHelmDeployer(t *testing.T, helm *fakeHelm, kube *fake.Clientset) *HelmDeployer {
+	t.Helper()
+	cat := newTestCatalog(t, map[string]string{"notes": `{
+		"id": "notes", "image": "notes:1", "containerPort": "22300", "defaultHostPort": "22300"
+	}`})
+	return NewHelmDeployer(HelmOptions{HelmBinary: helm.binary(), ChartPath: "charts/being-app", Namespace: "being"}, kube, cat)
+}
+
+func TestHelmRevision(t *testing.T) {
+	tests := []struct {
+		name         string
+		releases     string
+		fail         string
+		want         int
+		wantNotFound bool
+		wantErr      bool
+	}{
+		{
+			name:     "installed release",
+			releases: `[{"name": "notes-1", "namespace": "being", "revision": "3", "status": "deployed"}]`,
+			want:     3,
+		},
+		{
+			name:     "failed release",
+			releases: `[{"name": "notes-1", "namespace": "being", "revision": "1", "status": "failed"}]`,
+			want:     1,
+		},
+		{
+			name:         "no release",
+			releases:     `[]`,
+			wantNotFound: true,
+		},
+		{
+			name:         "only a release with a longer name",
+			releases:     `[{"name": "notes-10", "namespace": "being", "revision": "2", "status": "deployed"}]`,
+			wantNotFound: true,
+		},
+		{
+			// A missing kube context reads "not found" too, but says nothing about the release
+			name:    "helm fails",
+			fail:    `Error: kubernetes cluster unreachable: context "staging" not found`,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			helm := newFakeHelm(t)
+			helm.setReleases(t, tt.releases)
+			if tt.fail != "" {
+				helm.failWith(t, "list", tt.fail)
+			}
+			h := newTestHelmDeployer(t, helm, fake.NewClientset())
+
+			got, err := h.revision(context.Background(), "notes-1")
+			if errors.Is(err, ErrNotFound) != tt.wantNotFound {
+				t.Fatalf("revision: %v, want ErrNotFound %v", err, tt.wantNotFound)
+			}
+			if (err != nil) != (tt.wantErr || tt.wantNotFound) {
+				t.Fatalf("revision: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("revision = %d, want %d", got, tt.want)
+			}
+			calls := helm.calls(t)
+			if len(calls) != 1 || !strings.HasPrefix(calls[0], "list --all --filter ^notes-1$ --output json --namespace being") {
+				t.Errorf("helm calls %q", calls)
+			}
+		})
+	}
+}
+
+func TestHelmDestroy(t *testing.T) {
+	t.Run("release", func(t *testing.T) {
+		helm := newFakeHelm(t)
+		helm.setReleases(t, `[{"name": "notes-1", "revision": "2"}]`)
+		kube := fake.NewClientset()
+		h := newTestHelmDeployer(t, helm, kube)
+
+		report, err := h.Destroy(context.Background(), "notes-1", DestroyOptions{RemoveData: true})
+		if err != nil {
+			t.Fatalf("Destroy: %v (%+v)", err, report.Steps)
+		}
+		if calls := helm.calls(t); len(calls) != 2 || !strings.HasPrefix(calls[1], "uninstall notes-1 ") {
+			t.Errorf("helm calls %q", calls)
+		}
+		var deleted bool
+		for _, action := range kube.Actions() {
+			if dc, ok := action.(k8stesting.DeleteCollectionAction); ok && dc.GetResource().Resource == "persistentvolumeclaims" {
+				deleted = dc.GetListRestrictions().Labels.String() == "app.kubernetes.io/instance=notes-1"
+			}
+		}
+		if !deleted {
+			t.Errorf("volume claims of notes-1 were not removed; actions %v", kube.Actions())
+		}
+	})
+
+	t.Run("no release", func(t *testing.T) {
+		helm := newFakeHelm(t)
+		h := newTestHelmDeployer(t, helm, fake.NewClientset())
+		if _, err := h.Destroy(context.Background(), "notes-1", DestroyOptions{}); !errors.Is(err, ErrNotFound) {
+			t.Fatalf("Destroy: %v, want ErrNotFound", err)
+		}
+		if calls := helm.calls(t); len(calls) != 1 {
+			t.Errorf("helm ran more than the lookup: %q", calls)
+		}
+	})
+
+	t.Run("uninstall fails", func(t *testing.T) {
+		helm := newFakeHelm(t)
+		helm.setReleases(t, `[{"name": "notes-1", "revision": "2"}]`)
+		// An unrelated failure that happens to say "not found" must not read as a missing release
+		helm.failWith(t, "uninstall", `Error: uninstall: Release not loaded: notes-1: hook not found`)
+		h := newTestHelmDeployer(t, helm, fake.NewClientset())
+		report, err := h.Destroy(context.Background(), "notes-1", DestroyOptions{})
+		if err == nil || errors.Is(err, ErrNotFound) {
+			t.Fatalf("Destroy: %v, want a failed uninstall", err)
+		}
+		if report == nil || len(report.Steps) == 0 || report.Steps[0].Status != StepFailed {
+			t.Errorf("report %+v does not record the failed uninstall", report)
+		}
+	})
+}
+
+// kubeDeployment is the Deployment the chart makes for a release, or for one of its
+// stack's services if service is set.
+func kubeDeployment(release, service, image string, ready int32) *appsv1.Deployment {
+	name, labels := release, map[string]string{
+		kubeLabelManagedBy:           ManagedBy,
+		kubeLabelDeploymentID:        release,
+		kubeLabelAppID:               AppIDOf(release),
+		kubeLabelCatalogVersion:      "1.0.0",
+		"app.kubernetes.io/instance": release,
+	}
+	if service != "" {
+		name += "-" + service
+		labels[kubeLabelService] = service
+	}
+	return &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "being", Labels: labels},
+		Spec: appsv1.DeploymentSpec{Template: corev1.PodTemplateSpec{Spec: corev1.PodSpec{
+			Containers: []corev1.Container{{Name: "app", Image: image, Ports: []corev1.ContainerPort{{ContainerPort: 22300}}}},
+		}}},
+		Status: appsv1.DeploymentStatus{ReadyReplicas: ready},
+	}
+}
+
+// kubePod is a pod of a release; a nil waiting state means it's running and ready.
+func kubePod(release, name string, waiting *corev1.ContainerStateWaiting) *corev1.Pod {
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "being", Labels: map[string]string{"app.kubernetes.io/instance": release}},
+		Spec:       corev1.PodSpec{Containers: []corev1.Container{{Name: "app"}}},
+		Status: corev1.PodStatus{
+			Phase:             corev1.PodRunning,
+			ContainerStatuses: []corev1.ContainerStatus{{Name: "app", ImageID: "docker.io/library/notes@sha256:abc"}},
+			Conditions:        []corev1.PodCondition{{Type: corev1.PodReady, Status: corev1.ConditionTrue}},
+		},
+	}
+	if waiting != nil {
+		pod.Status.Phase = corev1.PodPending
+		pod.Status.ContainerStatuses[0].State.Waiting = waiting
+		pod.Status.Conditions[0].Status = corev1.ConditionFalse
+	}
+	return pod
+}
+
+func TestHelmStatus(t *testing.T) {
+	tests := []struct {
+		name        string
+		objects     []runtime.Object
+		wantState   string
+		wantMessage string
+		wantErr     error
+	}{
+		{
+			name:      "running",
+			objects:   []runtime.Object{kubeDeployment("notes-1", "", "notes:1", 1), kubePod("notes-1", "notes-1-a", nil)},
+			wantState: "running",
+		},
+		{
+			name:      "starting",
+			objects:   []runtime.Object{kubeDeployment("notes-1", "", "notes:1", 0), kubePod("notes-1", "notes-1-a", &corev1.ContainerStateWaiting{Reason: "ContainerCreating"})},
+			wantState: "pending",
+		},
+		{
+			name: "crashing",
+			objects: []runtime.Object{
+				kubeDeployment("notes-1", "", "notes:1", 0),
+				kubePod("notes-1", "notes-1-a", &corev1.ContainerStateWaiting{Reason: "CrashLoopBackOff", Message: "back-off restarting"}),
+			},
+			wantState:   "failed",
+			wantMessage: "CrashLoopBackOff: back-off restarting",
+		},
+		{
+			name:    "no deployment",
+			wantErr: ErrNotFound,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newTestHelmDeployer(t, newFakeHelm(t), fake.NewClientset(tt.objects...))
+			status, err := h.Status(context.Background(), "notes-1")
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("Status: %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Status: %v", err)
+			}
+			if status.State != tt.wantState || status.Message != tt.wantMessage {
+				t.Errorf("state %q (%q), want %q (%q)", status.State, status.Message, tt.wantState, tt.wantMessage)
+			}
+			if status.Image != "notes:1" || status.ImageDigest != "sha256:abc" || !reflect.DeepEqual(status.Ports, []string{"22300"}) {
+				t.Errorf("status %+v", status)
+			}
+		})
+	}
+}
+
+func TestHelmList(t *testing.T) {
+	unmanaged := kubeDeployment("wiki-1", "", "wiki:1", 1)
+	unmanaged.Labels = map[string]string{"app": "wiki"}
+	kube := fake.NewClientset(
+		kubeDeployment("notes-1", "", "notes:1", 1),
+		kubeDeployment("notes-1", "database", "postgres:16", 1),
+		kubeDeployment("notes-2", "", "notes:2", 0),
+		unmanaged,
+	)
+	h := newTestHelmDeployer(t, newFakeHelm(t), kube)
+
+	statuses, err := h.List(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := map[string]string{}
+	for _, status := range statuses {
+		got[status.DeploymentID] = status.State + " " + status.Image
+	}
+	want := map[string]string{"notes-1": "running notes:1", "notes-2": "pending notes:2"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("List = %v, want %v", got, want)
+	}
+}
+
+func TestHelmHealth(t *testing.T) {
+	tests := []struct {
+		name       string
+		objects    []runtime.Object
+		wantState  string
+		wantReason string
+		wantErr    error
+	}{
+		{
+			name:      "ready",
+			objects:   []runtime.Object{kubeDeployment("notes-1", "", "notes:1", 1), kubePod("notes-1", "notes-1-a", nil)},
+			wantState: HealthHealthy,
+		},
+		{
+			name: "one pod pulling",
+			objects: []runtime.Object{
+				kubeDeployment("notes-1", "", "notes:1", 1),
+				kubePod("notes-1", "notes-1-a", nil),
+				kubePod("notes-1", "notes-1-b", &corev1.ContainerStateWaiting{Reason: "ImagePullBackOff"}),
+			},
+			wantState:  HealthDegraded,
+			wantReason: "notes-1-b: ImagePullBackOff",
+		},
+		{
+			name:       "scaled to zero",
+			objects:    []runtime.Object{kubeDeployment("notes-1", "", "notes:1", 0)},
+			wantState:  HealthDown,
+			wantReason: "notes-1: no pods are running",
+		},
+		{
+			name:    "no deployment",
+			wantErr: ErrNotFound,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newTestHelmDeployer(t, newFakeHelm(t), fake.NewClientset(tt.objects...))
+			health, err := h.Health(context.Background(), "notes-1")
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("Health: %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Health: %v", err)
+			}
+			if health.State != tt.wantState || health.Reason != tt.wantReason {
+				t.Errorf("health %s (%q), want %s (%q)", health.State, health.Reason, tt.wantState, tt.wantReason)
+			}
+		})
+	}
+}
+
+func TestHelmNotFound(t *testing.T) {
+	h := newTestHelmDeployer(t, newFakeHelm(t), fake.NewClientset())
+	ctx := context.Background()
+
+	if _, err := h.Logs(ctx, "notes-1", LogOptions{Tail: -1}); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Logs = %v, want ErrNotFound", err)
+	}
+	if _, err := h.Upgrade(ctx, "notes-1", map[string]interface{}{}, "notes:2"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Upgrade = %v, want ErrNotFound", err)
+	}
+	if _, err := h.Adopt(ctx, "notes-1", ""); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Adopt = %v, want ErrNotFound", err)
+	}
+	if _, err := h.Status(ctx, "wiki-1"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Status of an app not in the catalog = %v, want ErrNotFound", err)
+	}
+	if _, err := h.Deploy(ctx, "wiki-1", "wiki", map[string]interface{}{}); !errors.Is(err, ErrUnknownApp) {
+		t.Errorf("Deploy of an app not in the catalog = %v, want ErrUnknownApp", err)
+	}
+}
+
+func TestHelmRestore(t *testing.T) {
+	tests := []struct {
+		name         string
+		releases     string
+		wantRollback string
+	}{
+		{
+			name:         "upgrade cut off",
+			releases:     `[{"name": "notes-1", "namespace": "being", "revision": "3", "status": "pending-upgrade"}]`,
+			wantRollback: "rollback notes-1 2 --wait",
+		},
+		{
+			name:         "upgrade failed before its rollback",
+			releases:     `[{"name": "notes-1", "namespace": "being", "revision": "3", "status": "failed"}]`,
+			wantRollback: "rollback notes-1 2 --wait",
+		},
+		{
+			name:     "upgrade finished",
+			releases: `[{"name": "notes-1", "namespace": "being", "revision": "3", "status": "deployed"}]`,
+		},
+		{
+			// There's no earlier revision to go back to
+			name:     "install failed",
+			releases: `[{"name": "notes-1", "namespace": "being", "revision": "1", "status": "failed"}]`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			helm := newFakeHelm(t)
+			helm.setReleases(t, tt.releases)
+			h := newTestHelmDeployer(t, helm, fake.NewClientset())
+
+			_, err := h.Restore(context.Background(), "notes-1")
+			if tt.wantRollback == "" {
+				if !errors.Is(err, ErrNotFound) {
+					t.Errorf("Restore = %v, want ErrNotFound", err)
+				}
+			} else if err != nil {
+				t.Fatalf("Restore: %v", err)
+			}
+			var rollbacks []string
+			for _, call := range helm.calls(t) {
+				if strings.HasPrefix(call, "rollback ") {
+					rollbacks = append(rollbacks, call)
+				}
+			}
+			if tt.wantRollback == "" && len(rollbacks) > 0 {
+				t.Errorf("rolled back with %q", rollbacks)
+			}
+			if tt.wantRollback != "" && (len(rollbacks) != 1 || !strings.HasPrefix(rollbacks[0], tt.wantRollback)) {
+				t.Errorf("rollbacks %q, want %q", rollbacks, tt.wantRollback)
+			}
+		})
+	}
+}
@@ -0,0 +1,134 @@
+package deploy
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Log streams a line came from.
+const (
+	StreamStdout = "stdout"
+	StreamStderr = "stderr"
+)
+
+// LogOptions selects which of a deployment's logs to read.
+type LogOptions struct {
+	// Follow keeps the stream open for new output until the context is cancelled.
+	Follow bool
+	// Tail is how many recent lines of each container to start with; negative means all.
+	Tail int
+	// Since skips output written before it, if set.
+	Since time.Time
+	// Container limits the stream to one container of a multi-container deployment.
+	Container string
+}
+
+// LogLine is one line of a container's output.
+type LogLine struct {
+	Container string    `json:"container"`
+	Stream    string    `json:"stream,omitempty"` // stdout or stderr, when the backend keeps them apart
+	Time      time.Time `json:"time,omitzero"`
+	Line      string    `json:"line"`
+}
+
+// LogStream delivers the lines of one or more containers as they are read.
+type LogStream struct {
+	lines chan LogLine
+	mu    sync.Mutex
+	err   error
+}
+
+// Lines returns the channel lines arrive on. It is closed once every container's
+// output has ended, or the stream's context is cancelled.
+func (s *LogStream) Lines() <-chan LogLine {
+	return s.lines
+}
+
+// Err returns the first error that cut a container's output short.
+// It is only meaningful once Lines is closed.
+func (s *LogStream) Err() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
+
+// logSource reads one container's output, passing each line to emit.
+type logSource func(ctx context.Context, emit func(LogLine)) error
+
+// newLogStream starts reading every source at once, merging their lines.
+func newLogStream(ctx context.Context, sources []logSource) *LogStream {
+	s := &LogStream{lines: make(chan LogLine, 64)}
+
+	emit := func(line LogLine) {
+		select {
+		case s.lines <- line:
+		case <-ctx.Done():
+		}
+	}
+
+	var wg sync.WaitGroup
+	for _, source := range sources {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := source(ctx, emit); err != nil && ctx.Err() == nil {
+				s.mu.Lock()
+				if s.err == nil {
+					s.err = err
+				}
+				s.mu.Unlock()
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(s.lines)
+	}()
+	return s
+}
+
+// lineWriter splits written output into timestamped lines. Backends are asked to
+// prefix every line with an RFC 3339 timestamp, which is split off here.
+type lineWriter struct {
+	container string
+	stream    string
+	emit      func(LogLine)
+	buf       []byte
+}
+
+// Write emits every complete line in p, keeping any partial line for the next write.
+func (w *lineWriter) Write(p []byte) (int, error) {
+	w.buf = append(w.buf, p...)
+	for {
+		i := bytes.IndexByte(w.buf, '\n')
+		if i < 0 {
+			break
+		}
+		w.send(string(w.buf[:i]))
+		w.buf = w.buf[i+1:]
+	}
+	return len(p), nil
+}
+
+// Flush emits a final line that wasn't terminated by a newline.
+func (w *lineWriter) Flush() {
+	if len(w.buf) > 0 {
+		w.send(string(w.buf))
+		w.buf = nil
+	}
+}
+
+// send emits one line.
+func (w *lineWriter) send(line string) {
+	line = strings.TrimSuffix(line, "\r")
+	entry := LogLine{Container: w.container, Stream: w.stream, Line: line}
+	if stamp, rest, ok := strings.Cut(line, " "); ok {
+		if t, err := time.Parse(time.RFC3339Nano, stamp); err == nil {
+			entry.Time, entry.Line = t, rest
+		}
+	}
+	w.emit(entry)
+}
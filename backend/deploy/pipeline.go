@@ -0,0 +1,124 @@
+package deploy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"example.com/m/v2/logging"
+)
+
+// PipelineError is returned when a step of a deploy, update or upgrade fails. It
+// lists every step that ran, which of them were rolled back, and whether the
+// rollback left things as they were before the operation started.
+type PipelineError struct {
+	Operation  string       `json:"operation"`
+	Steps      []StepResult `json:"steps"`
+	RolledBack bool         `json:"rolled_back"`
+	// Cause is the failure that stopped the operation.
+	Cause error `json:"-"`
+
+	rollbackErr error
+}
+
+// Error describes the failure and how the rollback went.
+func (e *PipelineError) Error() string {
+	if e.RolledBack {
+		return fmt.Sprintf("%s failed and was rolled back: %v", e.Operation, e.Cause)
+	}
+	return fmt.Sprintf("%s failed (%v), and so did rolling it back: %v", e.Operation, e.Cause, e.rollbackErr)
+}
+
+// Unwrap returns the cause, and ErrRolledBack when everything was undone.
+func (e *PipelineError) Unwrap() []error {
+	if e.RolledBack {
+		return []error{ErrRolledBack, e.Cause}
+	}
+	return []error{e.Cause}
+}
+
+// pipeline runs the steps of an operation as a transaction. Every step that changes
+// something registers a compensating action, and when a later step fails the
+// completed ones are undone newest first, so a failed deploy leaves nothing behind
+// and a failed upgrade is put back on its previous containers.
+type pipeline struct {
+	operation string
+	steps     []StepResult
+	undo      []compensation
+}
+
+// compensation reverses one completed step.
+type compensation struct {
+	step int
+	fn   func(ctx context.Context) error
+}
+
+// newPipeline starts the step log of an operation such as "deploy".
+func newPipeline(operation string) *pipeline {
+	return &pipeline{operation: operation}
+}
+
+// do runs one step and records its outcome. If it succeeds and undo is set, undo
+// is kept to reverse it should a later step fail.
+func (p *pipeline) do(step, target string, fn func() error, undo func(ctx context.Context) error) error {
+	err := fn()
+	p.record(step, target, err)
+	if err == nil && undo != nil {
+		p.undo = append(p.undo, compensation{step: len(p.steps) - 1, fn: undo})
+	}
+	return err
+}
+
+// compensate registers undo for the last step even though it failed, for steps
+// such as a helm release that can fail after changing things.
+func (p *pipeline) compensate(undo func(ctx context.Context) error) {
+	p.undo = append(p.undo, compensation{step: len(p.steps) - 1, fn: undo})
+}
+
+// record appends a step that needs no undoing, marking it failed if err is set.
+func (p *pipeline) record(step, target string, err error) {
+	result := StepResult{Step: step, Target: target, Status: StepOK}
+	if err != nil {
+		result.Status = StepFailed
+		result.Message = err.Error()
+	}
+	p.steps = append(p.steps, result)
+}
+
+// skip appends a step that had nothing to do.
+func (p *pipeline) skip(step, target, reason string) {
+	p.steps = append(p.steps, StepResult{Step: step, Target: target, Status: StepSkipped, Message: reason})
+}
+
+// fail undoes every completed step, newest first, and returns the error for cause.
+// Undoing runs even if ctx was cancelled: an operation cut off by a shutdown
+// shouldn't leave its half-made resources behind either.
+func (p *pipeline) fail(ctx context.Context, cause error) error {
+	ctx = context.WithoutCancel(ctx)
+	if len(p.undo) > 0 {
+		report(ctx, "rollback", fmt.Sprintf("Rolling back %d steps of the %s", len(p.undo), p.operation), 0)
+	}
+
+	var failed []error
+	for i := len(p.undo) - 1; i >= 0; i-- {
+		undo := p.undo[i]
+		step := &p.steps[undo.step]
+		report(ctx, "rollback", fmt.Sprintf("Undoing %s %s", step.Step, step.Target), 0)
+		if err := undo.fn(ctx); err != nil {
+			logging.Errorf("Failed to undo %s %s: %v", step.Step, step.Target, err)
+			step.Status, step.Message = StepRollbackFailed, err.Error()
+			failed = append(failed, fmt.Errorf("undo %s %s: %w", step.Step, step.Target, err))
+			continue
+		}
+		step.Status = StepRolledBack
+	}
+	p.undo = nil
+
+	return &PipelineError{
+		Operation:   p.operation,
+		Steps:       p.steps,
+		RolledBack:  len(failed) == 0,
+		Cause:       cause,
+		rollbackErr: errors.Join(failed...),
+	}
+}
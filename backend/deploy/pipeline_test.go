@@ -0,0 +1,147 @@
+package deploy
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestPipelineFail(t *testing.T) {
+	errBroken := errors.New("broken")
+	tests := []struct {
+		name string
+		// undoErr makes undoing the named step fail.
+		undoErr      map[string]error
+		wantUndone   []string
+		wantStatuses []string
+		wantRolled   bool
+	}{
+		{
+			name:         "everything undone",
+			wantUndone:   []string{"start", "create", "pull"},
+			wantStatuses: []string{StepRolledBack, StepSkipped, StepRolledBack, StepOK, StepRolledBack, StepFailed},
+			wantRolled:   true,
+		},
+		{
+			// One undo failing doesn't stop the ones before it
+			name:         "an undo fails",
+			undoErr:      map[string]error{"create": errBroken},
+			wantUndone:   []string{"start", "create", "pull"},
+			wantStatuses: []string{StepRolledBack, StepSkipped, StepRollbackFailed, StepOK, StepRolledBack, StepFailed},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var undone []string
+			undo := func(step string) func(ctx context.Context) error {
+				return func(ctx context.Context) error {
+					undone = append(undone, step)
+					return tt.undoErr[step]
+				}
+			}
+			ok := func() error { return nil }
+
+			p := newPipeline("deploy")
+			p.do("pull", "app:1", ok, undo("pull"))
+			p.skip("volume", "data", "volume already exists")
+			p.do("create", "app", ok, undo("create"))
+			p.do("inspect", "app", ok, nil)
+			p.do("start", "app", ok, undo("start"))
+			cause := errors.New("unhealthy")
+			if err := p.do("health check", "app", func() error { return cause }, undo("health check")); err != cause {
+				t.Fatalf("do returned %v, want the step's error", err)
+			}
+			err := p.fail(context.Background(), cause)
+
+			if !reflect.DeepEqual(undone, tt.wantUndone) {
+				t.Errorf("undone %v, want newest first %v", undone, tt.wantUndone)
+			}
+			var pe *PipelineError
+			if !errors.As(err, &pe) {
+				t.Fatalf("fail returned %T, want *PipelineError", err)
+			}
+			var statuses []string
+			for _, step := range pe.Steps {
+				statuses = append(statuses, step.Status)
+			}
+			if !reflect.DeepEqual(statuses, tt.wantStatuses) {
+				t.Errorf("statuses %v, want %v", statuses, tt.wantStatuses)
+			}
+			if pe.RolledBack != tt.wantRolled || errors.Is(err, ErrRolledBack) != tt.wantRolled {
+				t.Errorf("RolledBack %v, wraps ErrRolledBack %v, want %v", pe.RolledBack, errors.Is(err, ErrRolledBack), tt.wantRolled)
+			}
+			if !errors.Is(err, cause) {
+				t.Errorf("%v does not wrap its cause", err)
+			}
+			if tt.undoErr != nil && pe.Steps[2].Message != errBroken.Error() {
+				t.Errorf("failed undo message %q", pe.Steps[2].Message)
+			}
+		})
+	}
+}
+
+func TestPipelineCompensate(t *testing.T) {
+	var undone []string
+	p := newPipeline("upgrade")
+	p.do("stop container", "app", func() error { return nil }, func(ctx context.Context) error {
+		undone = append(undone, "stop container")
+		return nil
+	})
+	// A release that failed part way still has to be rolled back
+	cause := errors.New("timed out")
+	p.do("upgrade release", "app", func() error { return cause }, nil)
+	p.compensate(func(ctx context.Context) error {
+		undone = append(undone, "upgrade release")
+		return nil
+	})
+	err := p.fail(context.Background(), cause)
+
+	if want := []string{"upgrade release", "stop container"}; !reflect.DeepEqual(undone, want) {
+		t.Errorf("undone %v, want %v", undone, want)
+	}
+	if !errors.Is(err, ErrRolledBack) {
+		t.Errorf("fail = %v, want it rolled back", err)
+	}
+}
+
+func TestPipelineFailCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	var undoCtxErr error
+	undid := false
+	p := newPipeline("deploy")
+	p.do("create network", "net", func() error { return nil }, func(ctx context.Context) error {
+		undid = true
+		undoCtxErr = ctx.Err()
+		return nil
+	})
+
+	// Shutting down cancels the deploy part way through
+	cancel()
+	err := p.do("pull image", "app:1", func() error { return ctx.Err() }, nil)
+	err = p.fail(ctx, err)
+
+	if !undid {
+		t.Fatal("a cancelled operation was not rolled back")
+	}
+	if undoCtxErr != nil {
+		t.Errorf("undo ran with a cancelled context: %v", undoCtxErr)
+	}
+	if !errors.Is(err, context.Canceled) || !errors.Is(err, ErrRolledBack) {
+		t.Errorf("fail = %v, want it rolled back after being cancelled", err)
+	}
+}
+
+func TestPipelineFailWithoutSteps(t *testing.T) {
+	p := newPipeline("deploy")
+	cause := errors.New("pull failed")
+	p.record("pull image", "app:1", cause)
+	err := p.fail(context.Background(), cause)
+	var pe *PipelineError
+	if !errors.As(err, &pe) || !pe.RolledBack || len(pe.Steps) != 1 {
+		t.Errorf("fail = %#v, want a rolled back error with one step", err)
+	}
+	if got, want := err.Error(), "deploy failed and was rolled back: pull failed"; got != want {
+		t.Errorf("Error() = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,30 @@
+package deploy
+
+import "context"
+
+// Progress is a single step-by-step update emitted while a deployer works.
+type Progress struct {
+	// Step names the phase, e.g. "pull", "volume", "start" or "health".
+	Step    string `json:"step"`
+	Message string `json:"message"`
+	// Percent is set for steps that can measure their progress, such as image pulls.
+	Percent float64 `json:"percent,omitempty"`
+}
+
+// ProgressFunc receives progress updates from a deployer.
+type ProgressFunc func(Progress)
+
+type progressKey struct{}
+
+// WithProgress returns a context whose deployer calls report to fn.
+// Deployers work the same without one; updates are simply dropped.
+func WithProgress(ctx context.Context, fn ProgressFunc) context.Context {
+	return context.WithValue(ctx, progressKey{}, fn)
+}
+
+// report sends a progress update to the context's ProgressFunc, if any.
+func report(ctx context.Context, step, message string, percent float64) {
+	if fn, ok := ctx.Value(progressKey{}).(ProgressFunc); ok && fn != nil {
+		fn(Progress{Step: step, Message: message, Percent: percent})
+	}
+}
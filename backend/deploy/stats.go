@@ -0,0 +1,78 @@
+package deploy
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types/container"
+)
+
+// ContainerStats is one reading of a managed container's resource usage.
+// Network and block I/O are running totals since the container started.
+type ContainerStats struct {
+	DeploymentID     string    `json:"deployment_id"`
+	AppID            string    `json:"app_id"`
+	Container        string    `json:"container"`
+	Time             time.Time `json:"time"`
+	CPUPercent       float64   `json:"cpu_percent"`
+	MemoryBytes      uint64    `json:"memory_bytes"`
+	MemoryLimitBytes uint64    `json:"memory_limit_bytes"`
+	NetworkRxBytes   uint64    `json:"network_rx_bytes"`
+	NetworkTxBytes   uint64    `json:"network_tx_bytes"`
+	BlockReadBytes   uint64    `json:"block_read_bytes"`
+	BlockWriteBytes  uint64    `json:"block_write_bytes"`
+}
+
+// StatsSource is implemented by backends that can report the resource usage of the
+// containers they manage. Only the Docker backend can; a cluster's usage belongs to
+// its own metrics stack.
+type StatsSource interface {
+	// CollectStats reads the current usage of every running managed container.
+	CollectStats(ctx context.Context) ([]ContainerStats, error)
+}
+
+// statsFromDocker converts a Docker stats reading, the way `docker stats` does.
+func statsFromDocker(resp container.StatsResponse) ContainerStats {
+	stats := ContainerStats{
+		Container:        strings.TrimPrefix(resp.Name, "/"),
+		Time:             resp.Read,
+		MemoryBytes:      resp.MemoryStats.Usage,
+		MemoryLimitBytes: resp.MemoryStats.Limit,
+	}
+
+	// CPU is the share of the whole host used since the previous reading, scaled so
+	// one busy core reads 100%
+	cpuDelta := float64(resp.CPUStats.CPUUsage.TotalUsage) - float64(resp.PreCPUStats.CPUUsage.TotalUsage)
+	systemDelta := float64(resp.CPUStats.SystemUsage) - float64(resp.PreCPUStats.SystemUsage)
+	cpus := float64(resp.CPUStats.OnlineCPUs)
+	if cpus == 0 {
+		cpus = float64(len(resp.CPUStats.CPUUsage.PercpuUsage))
+	}
+	if cpuDelta > 0 && systemDelta > 0 {
+		stats.CPUPercent = cpuDelta / systemDelta * cpus * 100
+	}
+
+	// Page cache the kernel can reclaim at will isn't counted, as in `docker stats`;
+	// the key differs between cgroup v1 and v2
+	for _, key := range []string{"total_inactive_file", "inactive_file"} {
+		if inactive, ok := resp.MemoryStats.Stats[key]; ok && inactive < stats.MemoryBytes {
+			stats.MemoryBytes -= inactive
+			break
+		}
+	}
+
+	for _, nw := range resp.Networks {
+		stats.NetworkRxBytes += nw.RxBytes
+		stats.NetworkTxBytes += nw.TxBytes
+	}
+	for _, entry := range resp.BlkioStats.IoServiceBytesRecursive {
+		switch strings.ToLower(entry.Op) {
+		case "read":
+			stats.BlockReadBytes += entry.Value
+		case "write":
+			stats.BlockWriteBytes += entry.Value
+		}
+	}
+	return stats
+}
@@ -0,0 +1,649 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"example.com/m/v2/auth"
+	"example.com/m/v2/catalog"
+	"example.com/m/v2/deploy"
+	"example.com/m/v2/jobs"
+	"example.com/m/v2/keyexchange"
+	"example.com/m/v2/logging"
+	"example.com/m/v2/metrics"
+	"example.com/m/v2/store"
+	"example.com/m/v2/vault"
+	"github.com/go-chi/chi/v5"
+)
+
+// DeploymentView is a deployment as returned by the list and inspect endpoints:
+// the stored desired state merged with what the deployment backend reports live.
+type DeploymentView struct {
+	ID          string                 `json:"id"`
+	AppID       string                 `json:"app_id"`
+	RequestID   string                 `json:"request_id"`
+	State       string                 `json:"state"`
+	LiveState   string                 `json:"live_state"`
+	LiveMessage string                 `json:"live_message,omitempty"`
+	Config      map[string]interface{} `json:"config"`
+	SecretIDs   map[string]string      `json:"secret_ids,omitempty"`
+	Domain      string                 `json:"domain,omitempty"`
+	Image       string                 `json:"image,omitempty"`
+	ImageTag    string                 `json:"image_tag,omitempty"`
+	Ports       []string               `json:"ports"`
+	CreatedAt   time.Time              `json:"created_at"`
+	UpdatedAt   time.Time              `json:"updated_at"`
+	History     []store.Transition     `json:"history,omitempty"`
+	// UpdateAvailable is set once the update checker has found a newer image.
+	UpdateAvailable bool `json:"update_available"`
+}
+
+// handleListDeployments is the HTTP handler for GET /api/deployments.
+// Destroyed deployments are left out unless ?all=true is passed.
+func handleListDeployments(deployer deploy.Deployer, db *store.DB, updates *updateChecker) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		includeAll, _ := strconv.ParseBool(r.URL.Query().Get("all"))
+
+		deployments, err := db.ListDeployments()
+		if err != nil {
+			http.Error(w, "Failed to load deployments", http.StatusInternalServerError)
+			logging.Errorf("Error listing deployments: %v", err)
+			return
+		}
+
+		views := []DeploymentView{}
+		for _, d := range deployments {
+			if d.State == store.StateDestroyed && !includeAll {
+				continue
+			}
+			view := buildDeploymentView(r.Context(), deployer, d)
+			if status := updates.get(d.ID); status != nil {
+				view.UpdateAvailable = status.UpdateAvailable
+			}
+			views = append(views, view)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(map[string]interface{}{"deployments": views}); err != nil {
+			http.Error(w, "Failed to write response", http.StatusInternalServerError)
+			logging.Errorf("Error encoding deployments response: %v", err)
+		}
+	}
+}
+
+// handleGetDeployment is the HTTP handler for GET /api/deployments/{id}.
+// Unlike the list endpoint, it includes the deployment's full state history.
+func handleGetDeployment(deployer deploy.Deployer, db *store.DB, updates *updateChecker) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		deploymentID := chi.URLParam(r, "id")
+
+		d, err := db.GetDeployment(deploymentID)
+		if errors.Is(err, store.ErrNotFound) {
+			http.Error(w, "Deployment not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Failed to load deployment", http.StatusInternalServerError)
+			logging.Errorf("Error loading deployment %s: %v", deploymentID, err)
+			return
+		}
+
+		view := buildDeploymentView(r.Context(), deployer, d)
+		view.History = d.History
+		if status := updates.get(d.ID); status != nil {
+			view.UpdateAvailable = status.UpdateAvailable
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(view); err != nil {
+			http.Error(w, "Failed to write response", http.StatusInternalServerError)
+			logging.Errorf("Error encoding deployment response: %v", err)
+		}
+	}
+}
+
+// buildDeploymentView merges a stored deployment with its live state.
+// A backend error is reported in the view rather than failing the whole request.
+func buildDeploymentView(ctx context.Context, deployer deploy.Deployer, d *store.Deployment) DeploymentView {
+	view := DeploymentView{
+		ID:        d.ID,
+		AppID:     d.AppID,
+		RequestID: d.RequestID,
+		State:     d.State,
+		LiveState: "unknown",
+		// Stored configs are already redacted; redact again in case the field list has grown since.
+		Config:    redactConfiguration(d.Config),
+		SecretIDs: d.Secrets,
+		Image:     d.Image,
+		Ports:     []string{},
+		CreatedAt: d.CreatedAt,
+		UpdatedAt: d.UpdatedAt,
+	}
+	if domain, ok := d.Config["domain"].(string); ok {
+		view.Domain = domain
+	}
+
+	if d.State == store.StateDestroyed {
+		view.LiveState = "removed"
+	} else {
+		status, err := deployer.Status(ctx, d.ID)
+		switch {
+		case errors.Is(err, deploy.ErrNotFound):
+			view.LiveState = "missing"
+		case err != nil:
+			view.LiveMessage = err.Error()
+		default:
+			view.LiveState = status.State
+			view.LiveMessage = status.Message
+			if status.Image != "" {
+				view.Image = status.Image
+			}
+			if status.Ports != nil {
+				view.Ports = status.Ports
+			}
+		}
+	}
+
+	view.ImageTag = imageTag(view.Image)
+	return view
+}
+
+// imageTag returns the tag of an image reference, defaulting to "latest" like Docker does.
+func imageTag(ref string) string {
+	if ref == "" {
+		return ""
+	}
+	if i := strings.Index(ref, "@"); i >= 0 {
+		ref = ref[:i]
+	}
+	// A colon before the last slash belongs to a registry port, not a tag.
+	if i := strings.LastIndex(ref, ":"); i > strings.LastIndex(ref, "/") {
+		return ref[i+1:]
+	}
+	return "latest"
+}
+
+// deploymentAppID returns a function giving the app a deployment route acts on, for
+// authorization. It's the app in the deployment's record; deployments made before the
+// store existed have none, and fall back to the app their ID was made for.
+func deploymentAppID(db *store.DB) func(r *http.Request) string {
+	return func(r *http.Request) string {
+		deploymentID := chi.URLParam(r, "id")
+		if d, err := db.GetDeployment(deploymentID); err == nil {
+			return d.AppID
+		}
+		return deploy.AppIDOf(deploymentID)
+	}
+}
+
+// handleDestroyDeployment is the HTTP handler for DELETE /api/deployments/{id}.
+// It starts a job that tears the deployment down and returns its ID right away.
+// Volumes, host data directories and stored credentials are only removed when
+// ?remove_data=true is passed. A deployment still being deployed, upgraded or
+// updated can't be destroyed until that has finished.
+func handleDestroyDeployment(deployer deploy.Deployer, db *store.DB, secrets *vault.Vault, jobManager *jobs.Manager, checker *updateChecker) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		deploymentID := chi.URLParam(r, "id")
+
+		removeData := false
+		if value := r.URL.Query().Get("remove_data"); value != "" {
+			parsed, err := strconv.ParseBool(value)
+			if err != nil {
+				http.Error(w, "remove_data must be true or false", http.StatusBadRequest)
+				return
+			}
+			removeData = parsed
+		}
+
+		// Deployments made before the store existed have no record, and can still be torn down
+		d, err := db.GetDeployment(deploymentID)
+		if err != nil && !errors.Is(err, store.ErrNotFound) {
+			http.Error(w, "Failed to load deployment", http.StatusInternalServerError)
+			logging.Errorf("Error loading deployment %s: %v", deploymentID, err)
+			return
+		}
+		if d != nil && (d.State == store.StateDeploying || d.State == store.StateUpgrading || d.State == store.StateUpdating) {
+			http.Error(w, fmt.Sprintf("Deployment is %s; wait for it to finish before destroying it", d.State), http.StatusConflict)
+			return
+		}
+		if !checker.claim(deploymentID) {
+			http.Error(w, "Deployment is already being changed", http.StatusConflict)
+			return
+		}
+
+		log.Printf("Received destroy request for deployment: %s (remove data: %t)", deploymentID, removeData)
+		event := newAuditEvent(r, auditDestroy)
+		// Only a stored record says which app this is; the ID is whatever the URL held
+		if d != nil {
+			event.AppID = d.AppID
+		}
+		event.DeploymentID = deploymentID
+		event.Target = fmt.Sprintf("remove_data=%t", removeData)
+
+		job := jobManager.Start("destroy", deploymentID, func(ctx context.Context, progress func(step, message string, percent float64)) (interface{}, error) {
+			defer checker.release(deploymentID)
+			ctx = deploy.WithProgress(ctx, func(p deploy.Progress) {
+				progress(p.Step, p.Message, p.Percent)
+			})
+			report, err := runDestroy(ctx, deployer, db, secrets, deploymentID, removeData, event)
+			if report == nil {
+				// A nil report would still be a non-nil result
+				return nil, err
+			}
+			return report, err
+		})
+
+		writeJSON(w, http.StatusAccepted, map[string]interface{}{
+			"status":        "accepted",
+			"message":       fmt.Sprintf("Destroy of %s started", deploymentID),
+			"deployment_id": deploymentID,
+			"job_id":        job.Info().ID,
+			"events_url":    "/api/jobs/" + job.Info().ID + "/events",
+		})
+	}
+}
+
+// runDestroy tears a deployment down and records the outcome. A partial teardown
+// still returns the report, so the user can see what's left behind.
+func runDestroy(ctx context.Context, deployer deploy.Deployer, db *store.DB, secrets *vault.Vault, deploymentID string, removeData bool, event store.AuditEvent) (*deploy.DestroyReport, error) {
+	report, err := deployer.Destroy(ctx, deploymentID, deploy.DestroyOptions{RemoveData: removeData})
+	if errors.Is(err, deploy.ErrNotFound) {
+		recordAudit(db, event, store.OutcomeFailure, "deployment not found")
+		metrics.RecordOperation("destroy", event.AppID, metrics.OutcomeFailure)
+		return nil, err
+	}
+	if err != nil {
+		logging.Errorf("Destroy of %s incomplete: %v", deploymentID, err)
+		recordAudit(db, event, store.OutcomeFailure, err.Error())
+		metrics.RecordOperation("destroy", event.AppID, metrics.OutcomeFailure)
+	} else {
+		log.Printf("Destroyed %s", deploymentID)
+		recordAudit(db, event, store.OutcomeSuccess, "")
+		metrics.RecordOperation("destroy", event.AppID, metrics.OutcomeSuccess)
+	}
+
+	// Keep the record, now marked destroyed, so the history survives the teardown.
+	// Deployments made before the store existed have no record to update.
+	state, message := store.StateDestroyed, ""
+	if err != nil {
+		state, message = store.StateFailed, err.Error()
+	}
+	if err := db.SetDeploymentState(deploymentID, state, message); err != nil && !errors.Is(err, store.ErrNotFound) {
+		logging.Errorf("Error saving deployment %s: %v", deploymentID, err)
+	}
+
+	// Credentials are useless once the data they unlock is gone
+	if removeData && err == nil {
+		// The vault writes to the store itself, so this can't run inside UpdateDeployment.
+		if d, err := db.GetDeployment(deploymentID); err == nil && len(d.Secrets) > 0 {
+			deleteSecrets(secrets, d.Secrets)
+			removed := event
+			removed.Action, removed.Target = auditSecretsDelete, ""
+			recordAudit(db, removed, store.OutcomeSuccess, fmt.Sprintf("%d credentials deleted with the deployment's data", len(d.Secrets)))
+			err := db.UpdateDeployment(deploymentID, func(d *store.Deployment) error {
+				d.Secrets = nil
+				return nil
+			})
+			if err != nil {
+				logging.Errorf("Error saving deployment %s: %v", deploymentID, err)
+			}
+		}
+	}
+	return report, err
+}
+
+// AdoptRequest is the body of POST /api/deployments/adopt.
+type AdoptRequest struct {
+	// Container names or IDs the workload to adopt: a container for Docker, a
+	// Kubernetes Deployment for Helm.
+	Container string `json:"container"`
+	AppID     string `json:"app_id"`
+}
+
+// handleAdoptDeployment is the HTTP handler for POST /api/deployments/adopt.
+// It starts a job that brings an existing workload under management and records it
+// as deployed. A workload this server labelled keeps its deployment ID, so one whose
+// record was lost can be recovered; anything else is re-created as a new deployment
+// of the app.
+func handleAdoptDeployment(deployer deploy.Deployer, cat *catalog.Catalog, db *store.DB, jobManager *jobs.Manager, checker *updateChecker) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req AdoptRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			logging.Errorf("Error parsing adopt request: %v", err)
+			return
+		}
+		if req.Container == "" || req.AppID == "" {
+			http.Error(w, "container and app_id are required", http.StatusBadRequest)
+			return
+		}
+
+		log.Printf("Received adoption request for %s as app %s", req.Container, req.AppID)
+		event := newAuditEvent(r, auditDeployAdopt)
+		event.AppID = req.AppID
+		event.Target = req.Container
+
+		// Adopting puts a workload under the app's grants, so it needs the same permission as deploying it
+		if user, _ := auth.UserFromContext(r.Context()); !auth.Check(user, auth.ActionDeploy, req.AppID) {
+			recordAudit(db, event, store.OutcomeDenied, "role does not allow deploying this app")
+			auth.WriteForbidden(w, user, auth.ActionDeploy, req.AppID)
+			return
+		}
+		if _, ok := cat.Get(req.AppID); !ok {
+			recordAudit(db, event, store.OutcomeFailure, "unknown app")
+			http.Error(w, fmt.Sprintf("App %s is not in the catalog", req.AppID), http.StatusBadRequest)
+			return
+		}
+		// The deployment ID isn't known until the workload is inspected, so the claim is on the workload
+		if !checker.claim(req.Container) {
+			http.Error(w, fmt.Sprintf("%s is already being adopted", req.Container), http.StatusConflict)
+			return
+		}
+
+		// The job isn't tied to a deployment ID, which the adoption itself decides
+		job := jobManager.Start("adopt", "", func(ctx context.Context, progress func(step, message string, percent float64)) (interface{}, error) {
+			defer checker.release(req.Container)
+			ctx = deploy.WithProgress(ctx, func(p deploy.Progress) {
+				progress(p.Step, p.Message, p.Percent)
+			})
+			result, err := runAdopt(ctx, deployer, db, req, event)
+			if err != nil {
+				return failureReport(err), err
+			}
+			return result, nil
+		})
+
+		writeJSON(w, http.StatusAccepted, map[string]interface{}{
+			"status":     "accepted",
+			"message":    fmt.Sprintf("Adoption of %s started", req.Container),
+			"job_id":     job.Info().ID,
+			"events_url": "/api/jobs/" + job.Info().ID + "/events",
+		})
+	}
+}
+
+// runAdopt adopts the workload req names and records it as deployed.
+func runAdopt(ctx context.Context, deployer deploy.Deployer, db *store.DB, req AdoptRequest, event store.AuditEvent) (*deploy.Result, error) {
+	result, err := deployer.Adopt(ctx, req.Container, req.AppID)
+	if err != nil {
+		recordAudit(db, event, store.OutcomeFailure, err.Error())
+		logging.Errorf("Adoption of %s failed: %v", req.Container, err)
+		return nil, err
+	}
+	event.DeploymentID = result.DeploymentID
+
+	// A labelled workload may still have a record; only one that's gone from the backend can be replaced
+	message := fmt.Sprintf("Adopted from %s", req.Container)
+	existing, err := db.GetDeployment(result.DeploymentID)
+	switch {
+	case errors.Is(err, store.ErrNotFound):
+		err = db.CreateDeployment(&store.Deployment{
+			ID:          result.DeploymentID,
+			AppID:       result.AppID,
+			Config:      map[string]interface{}{},
+			ContainerID: result.ContainerID,
+			Release:     result.Release,
+			Image:       result.Image,
+			State:       store.StateDeployed,
+		})
+	case err != nil:
+	case existing.State != store.StateFailed && existing.State != store.StateDestroyed:
+		recordAudit(db, event, store.OutcomeFailure, "deployment is already managed")
+		return nil, fmt.Errorf("%s is already managed as deployment %s", req.Container, result.DeploymentID)
+	default:
+		err = db.UpdateDeployment(result.DeploymentID, func(d *store.Deployment) error {
+			d.ContainerID = result.ContainerID
+			d.Release = result.Release
+			d.Image = result.Image
+			d.Transition(store.StateDeployed, message)
+			return nil
+		})
+	}
+	if err != nil {
+		recordAudit(db, event, store.OutcomeFailure, "failed to record adopted deployment: "+err.Error())
+		logging.Errorf("Error saving adopted deployment %s: %v", result.DeploymentID, err)
+		return nil, fmt.Errorf("failed to record deployment %s: %w", result.DeploymentID, err)
+	}
+
+	recordAudit(db, event, store.OutcomeSuccess, "")
+	log.Printf("Adopted %s as deployment %s", req.Container, result.DeploymentID)
+	return result, nil
+}
+
+// ConfigUpdateRequest is the body of PUT /api/deployments/{id}/config.
+type ConfigUpdateRequest struct {
+	// Configuration replaces the deployment's configuration. It may carry encrypted
+	// fields like a deploy request; sensitive fields left out or empty keep the
+	// credential already stored, so the dashboard needn't ask for passwords again.
+	Configuration map[string]interface{} `json:"configuration"`
+}
+
+// handleUpdateDeploymentConfig is the HTTP handler for PUT /api/deployments/{id}/config.
+// It validates the new configuration like /validate, then starts a job that recreates
+// the deployment with it, keeping its data. If the new containers don't come up
+// healthy the previous ones are put back and the configuration stays as it was.
+func handleUpdateDeploymentConfig(deployer deploy.Deployer, cat *catalog.Catalog, db *store.DB, secrets *vault.Vault, jobManager *jobs.Manager, keyring *keyexchange.Keyring, checker *updateChecker) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		deploymentID := chi.URLParam(r, "id")
+
+		var req ConfigUpdateRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Configuration == nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+
+		d, err := db.GetDeployment(deploymentID)
+		if errors.Is(err, store.ErrNotFound) {
+			http.Error(w, "Deployment not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Failed to load deployment", http.StatusInternalServerError)
+			logging.Errorf("Error loading deployment %s: %v", deploymentID, err)
+			return
+		}
+		if d.State != store.StateDeployed {
+			http.Error(w, fmt.Sprintf("Only a deployed app can be reconfigured; this one is %s", d.State), http.StatusConflict)
+			return
+		}
+		app, ok := cat.Get(d.AppID)
+		if !ok {
+			http.Error(w, fmt.Sprintf("App %s is no longer in the catalog", d.AppID), http.StatusConflict)
+			return
+		}
+
+		event := newAuditEvent(r, auditDeployUpdate)
+		event.AppID = d.AppID
+		event.DeploymentID = deploymentID
+
+		config := req.Configuration
+		if encryptionData, hasEncryption := config["_encryption"]; hasEncryption {
+			config, err = decryptConfiguration(keyring, config, encryptionData)
+			if err != nil {
+				recordAudit(db, event, store.OutcomeFailure, "configuration could not be decrypted")
+				metrics.RecordOperation("update", d.AppID, metrics.OutcomeFailure)
+				http.Error(w, "Failed to decrypt configuration", http.StatusBadRequest)
+				logging.Errorf("Decryption failed: %v", err)
+				return
+			}
+		}
+
+		// Credentials that weren't resent keep their stored values; the others replace them
+		kept := map[string]string{}
+		changed := map[string]interface{}{}
+		for field, id := range d.Secrets {
+			if value, ok := config[field].(string); ok && value != "" {
+				changed[field] = value
+				continue
+			}
+			plaintext, err := secrets.Reveal(id)
+			if err != nil {
+				http.Error(w, "Failed to read stored credentials", http.StatusInternalServerError)
+				logging.Errorf("Error revealing secret %s of %s: %v", id, deploymentID, err)
+				return
+			}
+			config[field] = plaintext
+			kept[field] = id
+		}
+		for field, value := range config {
+			if _, stored := d.Secrets[field]; !stored {
+				changed[field] = value
+			}
+		}
+		if len(kept) > 0 {
+			reveal := event
+			reveal.Action = auditSecretsReveal
+			recordAudit(db, reveal, store.OutcomeSuccess, fmt.Sprintf("%d credentials read for update", len(kept)))
+		}
+
+		// Refuse what /validate would call an error before anything is touched
+		results := validateConfiguration(app, config)
+		for _, result := range results {
+			if !result.Valid && result.Type == "error" {
+				recordAudit(db, event, store.OutcomeDenied, "configuration is invalid: "+result.Message)
+				metrics.RecordOperation("update", d.AppID, metrics.OutcomeDenied)
+				writeJSON(w, http.StatusBadRequest, ValidationResponse{
+					Valid:   false,
+					Results: results,
+					Summary: "Configuration is invalid; the deployment was not changed",
+				})
+				return
+			}
+		}
+
+		if !checker.claim(deploymentID) {
+			http.Error(w, "Deployment is already being changed", http.StatusConflict)
+			return
+		}
+
+		// New credentials go into the vault now; they replace the old ones once the update succeeds
+		added, err := storeSecrets(secrets, app, deploymentID, changed)
+		if err != nil {
+			checker.release(deploymentID)
+			http.Error(w, "Failed to store credentials", http.StatusInternalServerError)
+			logging.Errorf("Error storing secrets for %s: %v", deploymentID, err)
+			return
+		}
+		refs := make(map[string]string, len(kept)+len(added))
+		for field, id := range kept {
+			refs[field] = id
+		}
+		for field, id := range added {
+			refs[field] = id
+		}
+
+		safeConfig := redactConfiguration(config)
+		for field := range refs {
+			safeConfig[field] = "[REDACTED]"
+		}
+		event.Diff = configDiff(d.Config, safeConfig)
+		for field := range added {
+			if _, existed := d.Secrets[field]; existed {
+				event.Diff[field] = store.Change{From: "[REDACTED]", To: "[REDACTED]"}
+			}
+		}
+		log.Printf("Updating %s with configuration: %+v", deploymentID, safeConfig)
+
+		job := jobManager.Start("update", deploymentID, func(ctx context.Context, progress func(step, message string, percent float64)) (interface{}, error) {
+			defer checker.release(deploymentID)
+			ctx = deploy.WithProgress(ctx, func(p deploy.Progress) {
+				progress(p.Step, p.Message, p.Percent)
+			})
+			result, err := runUpdate(ctx, deployer, db, secrets, d, config, safeConfig, refs, added, event)
+			if err != nil {
+				return failureReport(err), err
+			}
+			return result, nil
+		})
+
+		writeJSON(w, http.StatusAccepted, map[string]interface{}{
+			"status":        "accepted",
+			"message":       fmt.Sprintf("Update of %s started", deploymentID),
+			"deployment_id": deploymentID,
+			"job_id":        job.Info().ID,
+			"events_url":    "/api/jobs/" + job.Info().ID + "/events",
+		})
+	}
+}
+
+// runUpdate recreates a deployment with config and records the outcome. The stored
+// configuration and credentials only change once the deployer has succeeded; until
+// then the credentials in added are new and unused, and are deleted if it fails.
+func runUpdate(ctx context.Context, deployer deploy.Deployer, db *store.DB, secrets *vault.Vault, d *store.Deployment, config, safeConfig map[string]interface{}, refs, added map[string]string, event store.AuditEvent) (*deploy.Result, error) {
+	// Checkpoint the update, so a restart part way through can finish or undo it; see recovery.go
+	err := db.UpdateDeployment(d.ID, func(d *store.Deployment) error {
+		if d.State == store.StateDeployed {
+			d.Resumes = 0 // a fresh change, rather than one resumed after a restart
+		}
+		d.Pending = &store.PendingChange{PreviousImage: d.Image, Config: safeConfig, Secrets: refs}
+		d.Transition(store.StateUpdating, "Updating the configuration")
+		return nil
+	})
+	if err != nil {
+		deleteSecrets(secrets, added)
+		recordAudit(db, event, store.OutcomeFailure, "failed to save deployment: "+err.Error())
+		metrics.RecordOperation("update", d.AppID, metrics.OutcomeFailure)
+		return nil, fmt.Errorf("failed to save deployment %s: %w", d.ID, err)
+	}
+
+	log.Printf("Updating the configuration of %s", d.ID)
+	result, err := deployer.Update(ctx, d.ID, config)
+	if err != nil {
+		deleteSecrets(secrets, added)
+		// Rolled back, the deployment is still running as it was before
+		state, message := store.StateFailed, "Configuration update failed: "+err.Error()
+		var failed *deploy.PipelineError
+		if errors.As(err, &failed) && failed.RolledBack {
+			state, message = store.StateDeployed, "Configuration update failed and was rolled back: "+failed.Cause.Error()
+		}
+		logging.Errorf("Update of %s failed: %v", d.ID, err)
+		saveErr := db.UpdateDeployment(d.ID, func(d *store.Deployment) error {
+			d.Pending = nil
+			d.Transition(state, message)
+			return nil
+		})
+		if saveErr != nil {
+			logging.Errorf("Error saving deployment %s: %v", d.ID, saveErr)
+		}
+		recordAudit(db, event, store.OutcomeFailure, err.Error())
+		metrics.RecordOperation("update", d.AppID, metrics.OutcomeFailure)
+		return nil, err
+	}
+
+	// Credentials that were replaced unlock nothing any more
+	replaced := map[string]string{}
+	for field, id := range d.Secrets {
+		if refs[field] != id {
+			replaced[field] = id
+		}
+	}
+	err = db.UpdateDeployment(d.ID, func(d *store.Deployment) error {
+		d.Config = safeConfig
+		d.Secrets = refs
+		d.ContainerID = result.ContainerID
+		d.Release = result.Release
+		d.Image = result.Image
+		d.Pending = nil
+		d.Transition(store.StateDeployed, "Configuration updated")
+		return nil
+	})
+	if err != nil {
+		logging.Errorf("Error saving deployment %s: %v", d.ID, err)
+	} else if len(replaced) > 0 {
+		deleteSecrets(secrets, replaced)
+		removed := event
+		removed.Action, removed.Diff = auditSecretsDelete, nil
+		recordAudit(db, removed, store.OutcomeSuccess, fmt.Sprintf("%d replaced credentials deleted", len(replaced)))
+	}
+	log.Printf("Update of %s finished", d.ID)
+	recordAudit(db, event, store.OutcomeSuccess, result.Status)
+	metrics.RecordOperation("update", d.AppID, metrics.OutcomeSuccess)
+	return result, nil
+}
@@ -0,0 +1,453 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"example.com/m/v2/auth"
+	"example.com/m/v2/catalog"
+	"example.com/m/v2/deploy"
+	"example.com/m/v2/jobs"
+	"example.com/m/v2/keyexchange"
+	"example.com/m/v2/registry"
+	"example.com/m/v2/store"
+	"example.com/m/v2/vault"
+	"github.com/go-chi/chi/v5"
+)
+
+// fakeDeployer records what it's asked to deploy, destroy, and move deployments to.
+// Methods the tests don't use panic through the nil embedded interface.
+type fakeDeployer struct {
+	deploy.Deployer
+	deploys    []string
+	destroys   []string
+	destroyErr error
+	updates    []map[string]interface{}
+	updateErr  error
+	upgrades   []string
+	upgradeErr error
+	// restores records Restore calls, which fail with restoreErr if it is set.
+	restores   []string
+	restoreErr error
+	// adopted is the deployment Adopt reports, failing with adoptErr if it is set.
+	adopted  *deploy.Result
+	adoptErr error
+	// status is what Status reports; without one the deployment isn't found.
+	status *deploy.Status
+}
+
+func (f *fakeDeployer) Deploy(ctx context.Context, deploymentID, appID string, config map[string]interface{}) (*deploy.Result, error) {
+	f.deploys = append(f.deploys, deploymentID)
+	return &deploy.Result{DeploymentID: deploymentID, AppID: appID, Image: "joplin/server:3.0", Status: "running"}, nil
+}
+
+func (f *fakeDeployer) Destroy(ctx context.Context, deploymentID string, opts deploy.DestroyOptions) (*deploy.DestroyReport, error) {
+	f.destroys = append(f.destroys, deploymentID)
+	if f.destroyErr != nil {
+		return nil, f.destroyErr
+	}
+	return &deploy.DestroyReport{DeploymentID: deploymentID}, nil
+}
+
+func (f *fakeDeployer) List(ctx context.Context) ([]*deploy.Status, error) {
+	if f.status == nil {
+		return nil, nil
+	}
+	return []*deploy.Status{f.status}, nil
+}
+
+func (f *fakeDeployer) Update(ctx context.Context, deploymentID string, config map[string]interface{}) (*deploy.Result, error) {
+	f.updates = append(f.updates, config)
+	if f.updateErr != nil {
+		return nil, f.updateErr
+	}
+	return &deploy.Result{DeploymentID: deploymentID, Image: "joplin/server:3.0", Status: "running"}, nil
+}
+
+func (f *fakeDeployer) Upgrade(ctx context.Context, deploymentID string, config map[string]interface{}, image string) (*deploy.Result, error) {
+	f.upgrades = append(f.upgrades, image)
+	if f.upgradeErr != nil {
+		return nil, f.upgradeErr
+	}
+	return &deploy.Result{DeploymentID: deploymentID, Image: image, Status: "running"}, nil
+}
+
+func (f *fakeDeployer) Restore(ctx context.Context, deploymentID string) (*deploy.Result, error) {
+	f.restores = append(f.restores, deploymentID)
+	if f.restoreErr != nil {
+		return nil, f.restoreErr
+	}
+	return &deploy.Result{DeploymentID: deploymentID, Image: "joplin/server:3.0", Status: "running"}, nil
+}
+
+func (f *fakeDeployer) Adopt(ctx context.Context, ref, appID string) (*deploy.Result, error) {
+	if f.adoptErr != nil {
+		return nil, f.adoptErr
+	}
+	return f.adopted, nil
+}
+
+func (f *fakeDeployer) Status(ctx context.Context, deploymentID string) (*deploy.Status, error) {
+	if f.status == nil {
+		return nil, deploy.ErrNotFound
+	}
+	return f.status, nil
+}
+
+// configFixture is a deployed joplin-server with a stored database password.
+type configFixture struct {
+	db       *store.DB
+	secrets  *vault.Vault
+	deployer *fakeDeployer
+	jobs     *jobs.Manager
+	checker  *updateChecker
+	handler  http.Handler
+	secretID string
+}
+
+func newConfigFixture(t *testing.T) *configFixture {
+	t.Helper()
+	db, err := store.Open(filepath.Join(t.TempDir(), "being.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	secrets, err := vault.Open(db, bytes.Repeat([]byte{7}, vault.KeySize))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.SetAuditKey(bytes.Repeat([]byte{8}, vault.KeySize)); err != nil {
+		t.Fatal(err)
+	}
+	cat, err := catalog.Load(filepath.Join("catalog", "apps"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	secretID, err := secrets.Store("joplin-server-1", "dbPassword", "Old-passw0rd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.CreateDeployment(&store.Deployment{
+		ID:      "joplin-server-1",
+		AppID:   "joplin-server",
+		Config:  map[string]interface{}{"domain": "notes.example.com", "dbPassword": "[REDACTED]"},
+		Secrets: map[string]string{"dbPassword": secretID},
+		Image:   "joplin/server:3.0",
+		State:   store.StateDeployed,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f := &configFixture{db: db, secrets: secrets, deployer: &fakeDeployer{}, jobs: jobs.NewManager(context.Background()), secretID: secretID}
+	f.checker = newUpdateChecker(f.deployer, cat, registry.New(http.DefaultClient))
+	r := chi.NewRouter()
+	r.Put("/api/deployments/{id}/config", handleUpdateDeploymentConfig(f.deployer, cat, db, secrets, f.jobs, keyexchange.NewKeyring(0), f.checker))
+	r.Delete("/api/deployments/{id}", handleDestroyDeployment(f.deployer, db, secrets, f.jobs, f.checker))
+	r.Post("/api/deployments/adopt", handleAdoptDeployment(f.deployer, cat, db, f.jobs, f.checker))
+	f.handler = r
+	return f
+}
+
+// put sends a configuration update and waits for the job it starts, if any.
+func (f *configFixture) put(t *testing.T, config map[string]interface{}) *httptest.ResponseRecorder {
+	t.Helper()
+	body, _ := json.Marshal(ConfigUpdateRequest{Configuration: config})
+	return f.serve(t, httptest.NewRequest(http.MethodPut, "/api/deployments/joplin-server-1/config", bytes.NewReader(body)))
+}
+
+// serve sends req and waits for the job it starts, if any.
+func (f *configFixture) serve(t *testing.T, req *http.Request) *httptest.ResponseRecorder {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	f.handler.ServeHTTP(rec, req)
+
+	var accepted struct {
+		JobID string `json:"job_id"`
+	}
+	if rec.Code == http.StatusAccepted && json.Unmarshal(rec.Body.Bytes(), &accepted) == nil {
+		job, ok := f.jobs.Get(accepted.JobID)
+		if !ok {
+			t.Fatalf("job %s not found", accepted.JobID)
+		}
+		_, events, _ := job.Subscribe()
+		for range events {
+		}
+	}
+	return rec
+}
+
+// lastAudit returns the newest audit event with the given action.
+func lastAudit(t *testing.T, db *store.DB, action string) *store.AuditEvent {
+	t.Helper()
+	events, err := db.ListAudit(store.AuditFilter{Action: action})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) == 0 {
+		t.Fatalf("no %s audit event", action)
+	}
+	return events[0]
+}
+
+func TestUpdateConfigKeepsStoredCredentials(t *testing.T) {
+	f := newConfigFixture(t)
+	rec := f.put(t, map[string]interface{}{"domain": "joplin.example.com"})
+	if rec.Code != http.StatusAccepted {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body)
+	}
+
+	if len(f.deployer.updates) != 1 {
+		t.Fatalf("Update called %d times", len(f.deployer.updates))
+	}
+	if got := f.deployer.updates[0]["dbPassword"]; got != "Old-passw0rd" {
+		t.Errorf("deployer got dbPassword %v, want the stored one", got)
+	}
+	d, err := f.db.GetDeployment("joplin-server-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.Config["domain"] != "joplin.example.com" || d.Secrets["dbPassword"] != f.secretID {
+		t.Errorf("record not updated as expected: config %v, secrets %v", d.Config, d.Secrets)
+	}
+
+	event := lastAudit(t, f.db, auditDeployUpdate)
+	if event.Outcome != store.OutcomeSuccess {
+		t.Errorf("audit outcome %s, want success", event.Outcome)
+	}
+	if change, ok := event.Diff["domain"]; !ok || change.To != "joplin.example.com" {
+		t.Errorf("audit diff %v does not record the domain change", event.Diff)
+	}
+}
+
+func TestUpdateConfigReplacesCredentials(t *testing.T) {
+	f := newConfigFixture(t)
+	rec := f.put(t, map[string]interface{}{"domain": "notes.example.com", "dbPassword": "New-passw0rd!"})
+	if rec.Code != http.StatusAccepted {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body)
+	}
+
+	d, err := f.db.GetDeployment("joplin-server-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.Secrets["dbPassword"] == f.secretID {
+		t.Fatal("credential was not replaced")
+	}
+	if plaintext, err := f.secrets.Reveal(d.Secrets["dbPassword"]); err != nil || plaintext != "New-passw0rd!" {
+		t.Errorf("stored credential is %q (%v)", plaintext, err)
+	}
+	if _, err := f.secrets.Reveal(f.secretID); err == nil {
+		t.Error("replaced credential was not deleted")
+	}
+	if d.Config["dbPassword"] != "[REDACTED]" {
+		t.Errorf("credential leaked into the record: %v", d.Config["dbPassword"])
+	}
+	if _, ok := lastAudit(t, f.db, auditDeployUpdate).Diff["dbPassword"]; !ok {
+		t.Error("audit diff does not record the changed credential")
+	}
+}
+
+func TestUpdateConfigRejectsInvalidConfiguration(t *testing.T) {
+	f := newConfigFixture(t)
+	rec := f.put(t, map[string]interface{}{"domain": "notes.example.com", "dbPassword": "short"})
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("status %d, want 400: %s", rec.Code, rec.Body)
+	}
+	if len(f.deployer.updates) != 0 {
+		t.Error("an invalid configuration reached the deployer")
+	}
+	if event := lastAudit(t, f.db, auditDeployUpdate); event.Outcome != store.OutcomeDenied {
+		t.Errorf("audit outcome %s, want denied", event.Outcome)
+	}
+}
+
+func TestUpdateConfigRolledBack(t *testing.T) {
+	f := newConfigFixture(t)
+	f.deployer.updateErr = &deploy.PipelineError{Operation: "update", RolledBack: true, Cause: errors.New("unhealthy")}
+	rec := f.put(t, map[string]interface{}{"domain": "joplin.example.com", "dbPassword": "New-passw0rd!"})
+	if rec.Code != http.StatusAccepted {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body)
+	}
+
+	d, err := f.db.GetDeployment("joplin-server-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.State != store.StateDeployed || d.Config["domain"] != "notes.example.com" || d.Secrets["dbPassword"] != f.secretID {
+		t.Errorf("a rolled back update changed the record: state %s, config %v, secrets %v", d.State, d.Config, d.Secrets)
+	}
+	list, err := f.secrets.List("joplin-server-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 {
+		t.Errorf("the new credential was not cleaned up: %d secrets stored", len(list))
+	}
+	if event := lastAudit(t, f.db, auditDeployUpdate); event.Outcome != store.OutcomeFailure {
+		t.Errorf("audit outcome %s, want failure", event.Outcome)
+	}
+}
+
+func TestUpdateConfigNeedsDeployedDeployment(t *testing.T) {
+	f := newConfigFixture(t)
+	if err := f.db.SetDeploymentState("joplin-server-1", store.StateFailed, "broken"); err != nil {
+		t.Fatal(err)
+	}
+	if rec := f.put(t, map[string]interface{}{"domain": "joplin.example.com"}); rec.Code != http.StatusConflict {
+		t.Errorf("status %d, want 409", rec.Code)
+	}
+}
+
+func TestDestroyDeployment(t *testing.T) {
+	tests := []struct {
+		name       string
+		query      string
+		state      string
+		claimed    bool
+		destroyErr error
+		wantStatus int
+		wantState  string
+		// wantSecret means the stored credential is still there afterwards.
+		wantSecret bool
+	}{
+		{name: "keeps data", state: store.StateDeployed, wantStatus: http.StatusAccepted, wantState: store.StateDestroyed, wantSecret: true},
+		{name: "removes data", query: "?remove_data=true", state: store.StateDeployed, wantStatus: http.StatusAccepted, wantState: store.StateDestroyed},
+		{name: "failed deployment", state: store.StateFailed, wantStatus: http.StatusAccepted, wantState: store.StateDestroyed, wantSecret: true},
+		{
+			name:       "teardown fails",
+			query:      "?remove_data=true",
+			state:      store.StateDeployed,
+			destroyErr: errors.New("daemon unreachable"),
+			wantStatus: http.StatusAccepted,
+			wantState:  store.StateFailed,
+			wantSecret: true,
+		},
+		{name: "still deploying", state: store.StateDeploying, wantStatus: http.StatusConflict, wantState: store.StateDeploying, wantSecret: true},
+		{name: "being upgraded", state: store.StateUpgrading, wantStatus: http.StatusConflict, wantState: store.StateUpgrading, wantSecret: true},
+		{name: "claimed", state: store.StateDeployed, claimed: true, wantStatus: http.StatusConflict, wantState: store.StateDeployed, wantSecret: true},
+		{name: "bad remove_data", query: "?remove_data=maybe", state: store.StateDeployed, wantStatus: http.StatusBadRequest, wantState: store.StateDeployed, wantSecret: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newConfigFixture(t)
+			if err := f.db.SetDeploymentState("joplin-server-1", tt.state, ""); err != nil {
+				t.Fatal(err)
+			}
+			if tt.claimed {
+				f.checker.claim("joplin-server-1")
+			}
+			f.deployer.destroyErr = tt.destroyErr
+
+			rec := f.serve(t, httptest.NewRequest(http.MethodDelete, "/api/deployments/joplin-server-1"+tt.query, nil))
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status %d (%s), want %d", rec.Code, rec.Body, tt.wantStatus)
+			}
+			var wantDestroys []string
+			if tt.wantStatus == http.StatusAccepted {
+				wantDestroys = []string{"joplin-server-1"}
+			}
+			if !reflect.DeepEqual(f.deployer.destroys, wantDestroys) {
+				t.Errorf("destroyed %v, want %v", f.deployer.destroys, wantDestroys)
+			}
+			d, err := f.db.GetDeployment("joplin-server-1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if d.State != tt.wantState {
+				t.Errorf("record is %s, want %s", d.State, tt.wantState)
+			}
+			if _, err := f.secrets.Reveal(f.secretID); (err == nil) != tt.wantSecret {
+				t.Errorf("credential kept %v, want %v", err == nil, tt.wantSecret)
+			}
+			// The job gives the deployment back when it's done
+			if !tt.claimed && !f.checker.claim("joplin-server-1") {
+				t.Error("deployment still claimed after the destroy")
+			}
+		})
+	}
+}
+
+func TestAdoptDeployment(t *testing.T) {
+	tests := []struct {
+		name    string
+		appID   string
+		adopted string
+		// claimed means another adoption of the container is running.
+		claimed    bool
+		adoptErr   error
+		wantStatus int
+		wantJob    string
+		// wantState is the state of the adopted deployment's record, "" for none.
+		wantState string
+	}{
+		{name: "new deployment", appID: "joplin-server", adopted: "joplin-server-2", wantStatus: http.StatusAccepted, wantJob: jobs.StateSucceeded, wantState: store.StateDeployed},
+		{name: "adopt fails", appID: "joplin-server", adoptErr: errors.New("replacement did not start"), wantStatus: http.StatusAccepted, wantJob: jobs.StateFailed},
+		// The labelled workload of a deployment that's still running can't take over its record
+		{name: "already managed", appID: "joplin-server", adopted: "joplin-server-1", wantStatus: http.StatusAccepted, wantJob: jobs.StateFailed, wantState: store.StateDeployed},
+		{name: "unknown app", appID: "no-such-app", wantStatus: http.StatusBadRequest},
+		{name: "claimed", appID: "joplin-server", claimed: true, wantStatus: http.StatusConflict},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newConfigFixture(t)
+			f.deployer.adoptErr = tt.adoptErr
+			if tt.adopted != "" {
+				f.deployer.adopted = &deploy.Result{DeploymentID: tt.adopted, AppID: tt.appID, Image: "joplin/server:3.0"}
+			}
+			if tt.claimed {
+				f.checker.claim("old-joplin")
+			}
+
+			body, _ := json.Marshal(AdoptRequest{Container: "old-joplin", AppID: tt.appID})
+			req := httptest.NewRequest(http.MethodPost, "/api/deployments/adopt", bytes.NewReader(body))
+			req = req.WithContext(auth.WithUser(req.Context(), &store.User{ID: "u1", Role: auth.RoleAdmin}))
+			rec := f.serve(t, req)
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status %d (%s), want %d", rec.Code, rec.Body, tt.wantStatus)
+			}
+			if tt.wantJob != "" {
+				var accepted struct {
+					JobID string `json:"job_id"`
+				}
+				json.Unmarshal(rec.Body.Bytes(), &accepted)
+				job, _ := f.jobs.Get(accepted.JobID)
+				if info := job.Info(); info.State != tt.wantJob {
+					t.Errorf("job %s (%s), want %s", info.State, info.Error, tt.wantJob)
+				}
+			}
+			if tt.adopted != "" {
+				d, err := f.db.GetDeployment(tt.adopted)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if d.State != tt.wantState {
+					t.Errorf("record is %s, want %s", d.State, tt.wantState)
+				}
+			}
+			if !tt.claimed && !f.checker.claim("old-joplin") {
+				t.Error("container still claimed after the adoption")
+			}
+		})
+	}
+}
+
+func TestDestroyUnrecordedDeployment(t *testing.T) {
+	f := newConfigFixture(t)
+	rec := f.serve(t, httptest.NewRequest(http.MethodDelete, "/api/deployments/made-up-app-1", nil))
+	if rec.Code != http.StatusAccepted {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body)
+	}
+	// Without a record nothing says which app this is, whatever the ID looks like
+	if event := lastAudit(t, f.db, auditDestroy); event.AppID != "" {
+		t.Errorf("audited as app %q, want none", event.AppID)
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"example.com/m/v2/deploy"
+	"example.com/m/v2/logging"
+	"example.com/m/v2/store"
+	"github.com/go-chi/chi/v5"
+)
+
+// healthReport is a deployment's latest health, with when it entered its current
+// state and the last check that failed.
+type healthReport struct {
+	*deploy.Health
+	Since       time.Time      `json:"since"`
+	LastFailure *healthFailure `json:"last_failure,omitempty"`
+}
+
+// healthFailure is why a check failed, and when.
+type healthFailure struct {
+	Reason string    `json:"reason"`
+	At     time.Time `json:"at"`
+}
+
+// healthMonitor keeps the latest health of every deployment, so the API answers
+// from the last round of probes instead of probing on every request.
+type healthMonitor struct {
+	deployer deploy.Deployer
+
+	mu      sync.Mutex
+	reports map[string]*healthReport
+}
+
+// newHealthMonitor creates a monitor that checks deployments through deployer.
+func newHealthMonitor(deployer deploy.Deployer) *healthMonitor {
+	return &healthMonitor{deployer: deployer, reports: map[string]*healthReport{}}
+}
+
+// check probes a deployment now and records the outcome. A deployment whose
+// containers or pods are gone is down rather than an error.
+func (m *healthMonitor) check(ctx context.Context, deploymentID string) (*healthReport, error) {
+	health, err := m.deployer.Health(ctx, deploymentID)
+	if errors.Is(err, deploy.ErrNotFound) {
+		health = &deploy.Health{
+			DeploymentID: deploymentID,
+			State:        deploy.HealthDown,
+			Checks:       []deploy.CheckResult{},
+			Reason:       "the deployment's workload is missing",
+			CheckedAt:    time.Now().UTC(),
+		}
+	} else if err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	prev := m.reports[deploymentID]
+	report := &healthReport{Health: health, Since: health.CheckedAt}
+	if prev != nil {
+		report.LastFailure = prev.LastFailure
+		if prev.State == health.State {
+			report.Since = prev.Since
+		}
+	}
+	if health.Reason != "" {
+		report.LastFailure = &healthFailure{Reason: health.Reason, At: health.CheckedAt}
+	}
+	m.reports[deploymentID] = report
+
+	// Log changes rather than every check, so a broken app doesn't flood the log
+	if (prev == nil && health.State != deploy.HealthHealthy) || (prev != nil && prev.State != health.State) {
+		if health.Reason != "" {
+			log.Printf("Deployment %s is %s: %s", deploymentID, health.State, health.Reason)
+		} else {
+			log.Printf("Deployment %s is %s", deploymentID, health.State)
+		}
+	}
+	return report, nil
+}
+
+// get returns the latest health of a deployment, or nil if it hasn't been checked.
+func (m *healthMonitor) get(deploymentID string) *healthReport {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.reports[deploymentID]
+}
+
+// retain forgets every deployment not in live, such as destroyed ones.
+func (m *healthMonitor) retain(live map[string]bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for id := range m.reports {
+		if !live[id] {
+			delete(m.reports, id)
+		}
+	}
+}
+
+// checkHealthEvery probes every deployed deployment each interval until ctx is
+// cancelled. Deployments still deploying are left to their job, which waits for
+// the probes itself.
+func checkHealthEvery(ctx context.Context, monitor *healthMonitor, db *store.DB, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		deployments, err := db.ListDeployments()
+		if err != nil {
+			logging.Errorf("Error listing deployments for health checks: %v", err)
+		}
+		live := map[string]bool{}
+		for _, d := range deployments {
+			if d.State != store.StateDeployed {
+				continue
+			}
+			live[d.ID] = true
+			checkCtx, cancel := context.WithTimeout(ctx, interval)
+			_, err := monitor.check(checkCtx, d.ID)
+			cancel()
+			if err != nil && ctx.Err() == nil {
+				logging.Errorf("Error checking health of %s: %v", d.ID, err)
+			}
+		}
+		if err == nil {
+			monitor.retain(live)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// handleDeploymentHealth is the HTTP handler for GET /api/deployments/{id}/health.
+// It reports whether the deployment's app actually works: healthy, degraded or down,
+// with the outcome of every check and the last failure seen. Answers come from the
+// latest periodic check unless ?refresh=true asks for the probes to run now.
+func handleDeploymentHealth(db *store.DB, monitor *healthMonitor) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		deploymentID := chi.URLParam(r, "id")
+
+		d, err := db.GetDeployment(deploymentID)
+		if errors.Is(err, store.ErrNotFound) {
+			http.Error(w, "Deployment not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Failed to load deployment", http.StatusInternalServerError)
+			logging.Errorf("Error loading deployment %s: %v", deploymentID, err)
+			return
+		}
+		if d.State == store.StateDestroyed {
+			http.Error(w, "Deployment has been destroyed", http.StatusGone)
+			return
+		}
+
+		report := monitor.get(deploymentID)
+		if report == nil || r.URL.Query().Get("refresh") == "true" {
+			report, err = monitor.check(r.Context(), deploymentID)
+			if err != nil {
+				http.Error(w, "Failed to check deployment health", http.StatusInternalServerError)
+				logging.Errorf("Error checking health of %s: %v", deploymentID, err)
+				return
+			}
+		}
+		writeJSON(w, http.StatusOK, report)
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"example.com/m/v2/jobs"
+	"example.com/m/v2/logging"
+	"github.com/go-chi/chi/v5"
+)
+
+// sseHeartbeat keeps idle event streams from being closed by proxies.
+const sseHeartbeat = 15 * time.Second
+
+// handleGetJob is the HTTP handler for GET /api/jobs/{id}.
+func handleGetJob(jobManager *jobs.Manager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		job, ok := jobManager.Get(chi.URLParam(r, "id"))
+		if !ok {
+			http.Error(w, "Job not found", http.StatusNotFound)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(job.Info()); err != nil {
+			http.Error(w, "Failed to write response", http.StatusInternalServerError)
+			logging.Errorf("Error encoding job response: %v", err)
+		}
+	}
+}
+
+// handleJobEvents is the HTTP handler for GET /api/jobs/{id}/events.
+// It streams a job's progress as Server-Sent Events, replaying what happened before
+// the client connected. Reconnecting clients resume after their Last-Event-ID.
+func handleJobEvents(jobManager *jobs.Manager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		job, ok := jobManager.Get(chi.URLParam(r, "id"))
+		if !ok {
+			http.Error(w, "Job not found", http.StatusNotFound)
+			return
+		}
+
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			http.Error(w, "Streaming is not supported", http.StatusInternalServerError)
+			return
+		}
+
+		lastSeq, _ := strconv.Atoi(r.Header.Get("Last-Event-ID"))
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("Connection", "keep-alive")
+		w.Header().Set("X-Accel-Buffering", "no") // Stop nginx from buffering the stream
+		w.WriteHeader(http.StatusOK)
+		flusher.Flush()
+
+		// send writes one event, skipping any the client has already seen.
+		send := func(event jobs.Event) {
+			if event.Seq <= lastSeq {
+				return
+			}
+			data, err := json.Marshal(event)
+			if err != nil {
+				logging.Errorf("Error encoding job event: %v", err)
+				return
+			}
+			fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", event.Seq, event.Type, data)
+			flusher.Flush()
+			lastSeq = event.Seq
+		}
+
+		history, events, cancel := job.Subscribe()
+		defer cancel()
+		for _, event := range history {
+			send(event)
+		}
+
+		heartbeat := time.NewTicker(sseHeartbeat)
+		defer heartbeat.Stop()
+		for {
+			select {
+			case <-r.Context().Done():
+				return
+			case <-jobManager.Closing():
+				// The server is shutting down; the client reconnects with its Last-Event-ID
+				return
+			case event, open := <-events:
+				if !open {
+					// The job finished. Replay anything we dropped while the client was slow,
+					// which always includes the final done or error event.
+					history, _, _ := job.Subscribe()
+					for _, event := range history {
+						send(event)
+					}
+					return
+				}
+				send(event)
+			case <-heartbeat.C:
+				fmt.Fprint(w, ": keep-alive\n\n")
+				flusher.Flush()
+			}
+		}
+	}
+}
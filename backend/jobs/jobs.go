@@ -0,0 +1,281 @@
+// Package jobs runs long operations such as deployments in the background
+// and fans their progress out to any number of listeners.
+package jobs
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"sync"
+	"time"
+)
+
+// Job states.
+const (
+	StateRunning   = "running"
+	StateSucceeded = "succeeded"
+	StateFailed    = "failed"
+)
+
+// retention is how long finished jobs stay around for late listeners.
+const retention = time.Hour
+
+// Event types sent to listeners.
+const (
+	EventProgress = "progress"
+	EventDone     = "done"
+	EventError    = "error"
+)
+
+// Event is one entry in a job's progress stream.
+type Event struct {
+	Seq     int         `json:"seq"`
+	Type    string      `json:"type"`
+	Step    string      `json:"step,omitempty"`
+	Message string      `json:"message"`
+	Percent float64     `json:"percent,omitempty"`
+	Result  interface{} `json:"result,omitempty"`
+	Time    time.Time   `json:"time"`
+}
+
+// Func is the work a job performs. It reports progress through the supplied function
+// and returns the job's result. A failed job may return a result too, such as a
+// report of what it undid.
+type Func func(ctx context.Context, progress func(step, message string, percent float64)) (interface{}, error)
+
+// Info describes a job's identity and outcome.
+type Info struct {
+	ID           string      `json:"id"`
+	Kind         string      `json:"kind"`
+	DeploymentID string      `json:"deployment_id,omitempty"`
+	State        string      `json:"state"`
+	Result       interface{} `json:"result,omitempty"`
+	Error        string      `json:"error,omitempty"`
+	CreatedAt    time.Time   `json:"created_at"`
+	FinishedAt   *time.Time  `json:"finished_at,omitempty"`
+}
+
+// Job is a background operation and the history of its progress.
+type Job struct {
+	mu          sync.Mutex
+	info        Info
+	events      []Event
+	subscribers map[chan Event]struct{}
+}
+
+// Manager starts jobs and keeps them around so their progress can be replayed.
+type Manager struct {
+	mu      sync.Mutex
+	jobs    map[string]*Job
+	ctx     context.Context
+	cancel  context.CancelFunc
+	running sync.WaitGroup
+	closing chan struct{}
+	// onFinish, if set, is told about every job that finishes.
+	onFinish func(Info)
+}
+
+// NewManager creates a job manager. Jobs run under ctx rather than the request
+// that started them, so they outlive the HTTP request and its timeout.
+func NewManager(ctx context.Context) *Manager {
+	ctx, cancel := context.WithCancel(ctx)
+	return &Manager{jobs: make(map[string]*Job), ctx: ctx, cancel: cancel, closing: make(chan struct{})}
+}
+
+// OnFinish registers fn to be called with the final state of every job that finishes,
+// for instance to record how long jobs take. Call it before starting any jobs.
+func (m *Manager) OnFinish(fn func(Info)) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.onFinish = fn
+}
+
+// Closing is closed once Shutdown has been called, so long-lived listeners
+// such as event streams can let go instead of holding up the shutdown.
+func (m *Manager) Closing() <-chan struct{} {
+	return m.closing
+}
+
+// Shutdown gives running jobs until ctx is done to finish, then cancels the rest
+// and waits for them to stop. It returns how many jobs had to be cancelled.
+// Jobs started after Shutdown begins run with an already-cancelled context.
+func (m *Manager) Shutdown(ctx context.Context) int {
+	m.mu.Lock()
+	select {
+	case <-m.closing:
+	default:
+		close(m.closing)
+	}
+	m.mu.Unlock()
+
+	finished := make(chan struct{})
+	go func() {
+		m.running.Wait()
+		close(finished)
+	}()
+
+	select {
+	case <-finished:
+		m.cancel()
+		return 0
+	case <-ctx.Done():
+	}
+
+	interrupted := 0
+	m.mu.Lock()
+	for _, job := range m.jobs {
+		if job.Info().State == StateRunning {
+			interrupted++
+		}
+	}
+	m.mu.Unlock()
+
+	m.cancel()
+	<-finished
+	return interrupted
+}
+
+// Start runs fn in the background and returns its job immediately.
+func (m *Manager) Start(kind, deploymentID string, fn Func) *Job {
+	job := &Job{
+		info: Info{
+			ID:           newJobID(),
+			Kind:         kind,
+			DeploymentID: deploymentID,
+			State:        StateRunning,
+			CreatedAt:    time.Now().UTC(),
+		},
+		subscribers: make(map[chan Event]struct{}),
+	}
+
+	// Once shutting down, Shutdown may already be waiting on the running jobs,
+	// so the job isn't counted and runs cancelled; it fails fast and can be retried.
+	m.mu.Lock()
+	m.prune()
+	m.jobs[job.info.ID] = job
+	ctx, counted, onFinish := m.ctx, true, m.onFinish
+	select {
+	case <-m.closing:
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithCancel(m.ctx)
+		cancel()
+		counted = false
+	default:
+		m.running.Add(1)
+	}
+	m.mu.Unlock()
+
+	go func() {
+		result, err := fn(ctx, func(step, message string, percent float64) {
+			job.publish(Event{Type: EventProgress, Step: step, Message: message, Percent: percent})
+		})
+		job.finish(result, err)
+		if onFinish != nil {
+			onFinish(job.Info())
+		}
+		if counted {
+			m.running.Done()
+		}
+	}()
+	return job
+}
+
+// Get returns a job by ID.
+func (m *Manager) Get(id string) (*Job, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	job, ok := m.jobs[id]
+	return job, ok
+}
+
+// prune forgets jobs that finished more than retention ago. m.mu must be held.
+func (m *Manager) prune() {
+	cutoff := time.Now().Add(-retention)
+	for id, job := range m.jobs {
+		job.mu.Lock()
+		expired := job.info.FinishedAt != nil && job.info.FinishedAt.Before(cutoff)
+		job.mu.Unlock()
+		if expired {
+			delete(m.jobs, id)
+		}
+	}
+}
+
+// Info returns a snapshot of the job's identity and outcome.
+func (j *Job) Info() Info {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.info
+}
+
+// Subscribe returns the events published so far and a channel carrying the rest.
+// The channel is closed once the job finishes; call cancel to stop listening early.
+func (j *Job) Subscribe() (history []Event, events <-chan Event, cancel func()) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	history = append([]Event(nil), j.events...)
+	ch := make(chan Event, 64)
+	if j.info.State != StateRunning {
+		close(ch)
+		return history, ch, func() {}
+	}
+
+	j.subscribers[ch] = struct{}{}
+	return history, ch, func() {
+		j.mu.Lock()
+		defer j.mu.Unlock()
+		if _, ok := j.subscribers[ch]; ok {
+			delete(j.subscribers, ch)
+			close(ch)
+		}
+	}
+}
+
+// publish records an event and sends it to every listener.
+// A listener that can't keep up misses live events but can replay them from history.
+func (j *Job) publish(event Event) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	event.Seq = len(j.events) + 1
+	event.Time = time.Now().UTC()
+	j.events = append(j.events, event)
+	for ch := range j.subscribers {
+		select {
+		case ch <- event:
+		default:
+		}
+	}
+}
+
+// finish records the job's outcome, publishes the final event and closes all listeners.
+func (j *Job) finish(result interface{}, err error) {
+	final := Event{Type: EventDone, Message: "Completed", Result: result}
+	if err != nil {
+		final = Event{Type: EventError, Message: err.Error(), Result: result}
+	}
+	j.publish(final)
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	now := time.Now().UTC()
+	j.info.FinishedAt = &now
+	j.info.Result = result
+	j.info.State = StateSucceeded
+	if err != nil {
+		j.info.State = StateFailed
+		j.info.Error = err.Error()
+	}
+	for ch := range j.subscribers {
+		delete(j.subscribers, ch)
+		close(ch)
+	}
+}
+
+// newJobID returns a random job ID.
+func newJobID() string {
+	buf := make([]byte, 8)
+	rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
@@ -0,0 +1,145 @@
+// Package keyexchange hands out short-lived server key pairs for the credential handoff.
+//
+// The frontend encrypts sensitive configuration fields with a random AES-GCM session key,
+// then wraps that session key with one of these public keys. Only the backend holds the
+// matching private key, so the session key never travels in the clear next to the ciphertext.
+package keyexchange
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Algorithm names the wrapping scheme: RSA-OAEP with SHA-256, as in WebCrypto's RSA-OAEP.
+const Algorithm = "RSA-OAEP-256"
+
+const (
+	// keyBits is the RSA modulus size of every issued key.
+	keyBits = 2048
+	// maxOutstanding caps how many unused keys are kept, so clients can't exhaust memory.
+	maxOutstanding = 1024
+)
+
+var (
+	// ErrUnknownKey is returned when a key ID was never issued, has expired or was already used.
+	ErrUnknownKey = errors.New("unknown or expired key")
+	// ErrTooManyKeys is returned when too many keys are outstanding to issue another.
+	ErrTooManyKeys = errors.New("too many outstanding keys")
+)
+
+// PublicKey is what clients receive: the key to wrap their session key with.
+type PublicKey struct {
+	KeyID     string `json:"key_id"`
+	Algorithm string `json:"algorithm"`
+	// PublicKey is the base64 DER SubjectPublicKeyInfo, ready for WebCrypto's importKey("spki").
+	PublicKey string    `json:"public_key"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+type issuedKey struct {
+	private *rsa.PrivateKey
+	expires time.Time
+}
+
+// Keyring issues ephemeral key pairs and unwraps session keys sent back with them.
+// Every key can be used once; it is forgotten after use or when it expires.
+type Keyring struct {
+	mu   sync.Mutex
+	ttl  time.Duration
+	keys map[string]issuedKey
+}
+
+// NewKeyring creates a keyring whose keys are valid for ttl.
+func NewKeyring(ttl time.Duration) *Keyring {
+	return &Keyring{ttl: ttl, keys: make(map[string]issuedKey)}
+}
+
+// Issue generates a new key pair and returns its public half.
+func (k *Keyring) Issue() (*PublicKey, error) {
+	// Check the cap before doing the expensive key generation, so a full keyring
+	// turns requests away cheaply.
+	k.mu.Lock()
+	k.prune(time.Now())
+	full := len(k.keys) >= maxOutstanding
+	k.mu.Unlock()
+	if full {
+		return nil, ErrTooManyKeys
+	}
+
+	private, err := rsa.GenerateKey(rand.Reader, keyBits)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate key: %w", err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(&private.PublicKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode public key: %w", err)
+	}
+	id, err := newKeyID()
+	if err != nil {
+		return nil, err
+	}
+
+	// Other keys may have been issued while this one was generated, so the cap is
+	// checked again in the same critical section as the insert.
+	expires := time.Now().Add(k.ttl).UTC()
+	k.mu.Lock()
+	k.prune(time.Now())
+	if len(k.keys) >= maxOutstanding {
+		k.mu.Unlock()
+		return nil, ErrTooManyKeys
+	}
+	k.keys[id] = issuedKey{private: private, expires: expires}
+	k.mu.Unlock()
+
+	return &PublicKey{
+		KeyID:     id,
+		Algorithm: Algorithm,
+		PublicKey: base64.StdEncoding.EncodeToString(der),
+		ExpiresAt: expires,
+	}, nil
+}
+
+// Unwrap decrypts a session key wrapped with the public key keyID.
+// The key is consumed even if unwrapping fails, so a wrapped key can't be probed repeatedly.
+func (k *Keyring) Unwrap(keyID string, wrapped []byte) ([]byte, error) {
+	k.mu.Lock()
+	key, ok := k.keys[keyID]
+	delete(k.keys, keyID)
+	k.mu.Unlock()
+
+	if !ok || time.Now().After(key.expires) {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownKey, keyID)
+	}
+
+	sessionKey, err := rsa.DecryptOAEP(sha256.New(), nil, key.private, wrapped, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unwrap session key: %w", err)
+	}
+	return sessionKey, nil
+}
+
+// prune forgets expired keys. k.mu must be held.
+func (k *Keyring) prune(now time.Time) {
+	for id, key := range k.keys {
+		if now.After(key.expires) {
+			delete(k.keys, id)
+		}
+	}
+}
+
+// newKeyID returns a random key ID.
+func newKeyID() (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", fmt.Errorf("failed to generate key ID: %w", err)
+	}
+	return hex.EncodeToString(buf), nil
+}
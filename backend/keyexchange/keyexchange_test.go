@@ -0,0 +1,115 @@
+package keyexchange
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// wrap encrypts sessionKey with an issued public key, as the frontend does.
+func wrap(t *testing.T, pub *PublicKey, sessionKey []byte) []byte {
+	t.Helper()
+	der, err := base64.StdEncoding.DecodeString(pub.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := x509.ParsePKIXPublicKey(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wrapped, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, key.(*rsa.PublicKey), sessionKey, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return wrapped
+}
+
+func TestUnwrapOnce(t *testing.T) {
+	k := NewKeyring(time.Minute)
+	pub, err := k.Issue()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pub.Algorithm != Algorithm {
+		t.Errorf("Algorithm = %q, want %q", pub.Algorithm, Algorithm)
+	}
+	sessionKey := bytes.Repeat([]byte{5}, 32)
+	wrapped := wrap(t, pub, sessionKey)
+
+	got, err := k.Unwrap(pub.KeyID, wrapped)
+	if err != nil || !bytes.Equal(got, sessionKey) {
+		t.Fatalf("Unwrap = %x, %v", got, err)
+	}
+	// Replaying the same wrapped key fails
+	if _, err := k.Unwrap(pub.KeyID, wrapped); !errors.Is(err, ErrUnknownKey) {
+		t.Errorf("second Unwrap = %v, want ErrUnknownKey", err)
+	}
+}
+
+func TestUnwrapFailureConsumesKey(t *testing.T) {
+	k := NewKeyring(time.Minute)
+	pub, err := k.Issue()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := k.Unwrap(pub.KeyID, []byte("garbage")); err == nil || errors.Is(err, ErrUnknownKey) {
+		t.Fatalf("Unwrap of garbage = %v, want a decryption error", err)
+	}
+	if _, err := k.Unwrap(pub.KeyID, wrap(t, pub, []byte("session"))); !errors.Is(err, ErrUnknownKey) {
+		t.Errorf("Unwrap after a failed attempt = %v, want ErrUnknownKey", err)
+	}
+	if _, err := k.Unwrap("never-issued", []byte("x")); !errors.Is(err, ErrUnknownKey) {
+		t.Errorf("Unwrap with an unknown key ID = %v, want ErrUnknownKey", err)
+	}
+}
+
+func TestKeyExpires(t *testing.T) {
+	k := NewKeyring(time.Minute)
+	pub, err := k.Issue()
+	if err != nil {
+		t.Fatal(err)
+	}
+	wrapped := wrap(t, pub, []byte("session"))
+
+	k.mu.Lock()
+	key := k.keys[pub.KeyID]
+	key.expires = time.Now().Add(-time.Second)
+	k.keys[pub.KeyID] = key
+	k.mu.Unlock()
+
+	if _, err := k.Unwrap(pub.KeyID, wrapped); !errors.Is(err, ErrUnknownKey) {
+		t.Errorf("Unwrap with an expired key = %v, want ErrUnknownKey", err)
+	}
+}
+
+func TestIssueCap(t *testing.T) {
+	k := NewKeyring(time.Minute)
+	// Generating maxOutstanding RSA keys would take a while, so the keyring is filled directly
+	k.mu.Lock()
+	for i := 0; i < maxOutstanding; i++ {
+		k.keys[strconv.Itoa(i)] = issuedKey{expires: time.Now().Add(time.Minute)}
+	}
+	k.mu.Unlock()
+
+	if _, err := k.Issue(); !errors.Is(err, ErrTooManyKeys) {
+		t.Fatalf("Issue on a full keyring = %v, want ErrTooManyKeys", err)
+	}
+
+	// Expired keys don't count towards the cap
+	k.mu.Lock()
+	k.keys["0"] = issuedKey{expires: time.Now().Add(-time.Second)}
+	k.mu.Unlock()
+	if _, err := k.Issue(); err != nil {
+		t.Fatalf("Issue after a key expired = %v", err)
+	}
+	if _, err := k.Issue(); !errors.Is(err, ErrTooManyKeys) {
+		t.Errorf("Issue on a refilled keyring = %v, want ErrTooManyKeys", err)
+	}
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"example.com/m/v2/keyexchange"
+	"example.com/m/v2/logging"
+)
+
+// handleIssueEncryptionKey is the HTTP handler for POST /api/encryption/keys.
+// It issues a single-use public key the frontend wraps its session key with
+// before sending encrypted configuration to /api/deploy.
+func handleIssueEncryptionKey(keyring *keyexchange.Keyring) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key, err := keyring.Issue()
+		if errors.Is(err, keyexchange.ErrTooManyKeys) {
+			http.Error(w, "Too many pending encryption keys, try again later", http.StatusServiceUnavailable)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Failed to issue encryption key", http.StatusInternalServerError)
+			logging.Errorf("Error issuing encryption key: %v", err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		// Keys are single use; caches must never hand one to a second client.
+		w.Header().Set("Cache-Control", "no-store")
+		w.WriteHeader(http.StatusCreated)
+		if err := json.NewEncoder(w).Encode(key); err != nil {
+			logging.Errorf("Error encoding encryption key: %v", err)
+		}
+	}
+}
@@ -0,0 +1,53 @@
+// Package logging gives the backend's log lines an explicit level.
+//
+// Records go through log/slog. Informational lines are still written with the
+// standard log package, which slog routes at info once Setup has run; debug output,
+// warnings and errors use Debugf, Warnf and Errorf so the level never has to be
+// guessed from how a message is worded.
+package logging
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+)
+
+// Levels maps the log_level setting to the least level that is written.
+var Levels = map[string]slog.Level{
+	"debug": slog.LevelDebug,
+	"info":  slog.LevelInfo,
+	"warn":  slog.LevelWarn,
+	"error": slog.LevelError,
+}
+
+// Setup makes slog's default logger, and with it the standard log package, write
+// records at level or above to w.
+func Setup(w io.Writer, level slog.Level) {
+	slog.SetDefault(slog.New(slog.NewTextHandler(w, &slog.HandlerOptions{Level: level})))
+}
+
+// Debugf logs a formatted message at debug level.
+func Debugf(format string, args ...any) {
+	logf(slog.LevelDebug, format, args...)
+}
+
+// Warnf logs a formatted message at warn level.
+func Warnf(format string, args ...any) {
+	logf(slog.LevelWarn, format, args...)
+}
+
+// Errorf logs a formatted message at error level.
+func Errorf(format string, args ...any) {
+	logf(slog.LevelError, format, args...)
+}
+
+// logf formats the message only if its level is enabled.
+func logf(level slog.Level, format string, args ...any) {
+	ctx := context.Background()
+	logger := slog.Default()
+	if !logger.Enabled(ctx, level) {
+		return
+	}
+	logger.Log(ctx, level, fmt.Sprintf(format, args...))
+}
@@ -0,0 +1,46 @@
+package logging
+
+import (
+	"bytes"
+	"log"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+func TestSetup(t *testing.T) {
+	defer slog.SetDefault(slog.Default())
+	defer log.SetFlags(log.Flags())
+
+	tests := []struct {
+		level string
+		want  []string
+	}{
+		{level: "debug", want: []string{"level=DEBUG", "level=INFO", "level=WARN", "level=ERROR"}},
+		{level: "info", want: []string{"level=INFO", "level=WARN", "level=ERROR"}},
+		{level: "warn", want: []string{"level=WARN", "level=ERROR"}},
+		{level: "error", want: []string{"level=ERROR"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.level, func(t *testing.T) {
+			var out bytes.Buffer
+			Setup(&out, Levels[tt.level])
+
+			Debugf("probe %d", 1)
+			log.Printf("Deployed %s", "notes-1")
+			// Wording no longer decides the level
+			Warnf("Upgrade of %s failed", "notes-1")
+			Errorf("Audit log hash chain is broken at event %d", 7)
+
+			var got []string
+			for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+				if line != "" {
+					got = append(got, strings.Fields(line)[1])
+				}
+			}
+			if strings.Join(got, " ") != strings.Join(tt.want, " ") {
+				t.Errorf("wrote %v, want %v\n%s", got, tt.want, out.String())
+			}
+		})
+	}
+}
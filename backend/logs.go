@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"example.com/m/v2/deploy"
+	"example.com/m/v2/jobs"
+	"example.com/m/v2/logging"
+	"example.com/m/v2/store"
+	"example.com/m/v2/vault"
+	"github.com/go-chi/chi/v5"
+)
+
+// defaultLogTail is how many recent lines a log stream starts with unless ?tail= says otherwise.
+const defaultLogTail = 100
+
+// minMaskedLength is the shortest credential masked in logs. Masking every "1" or "on"
+// would make the output unreadable, and values that short are no secret anyway.
+const minMaskedLength = 4
+
+// handleDeploymentLogs is the HTTP handler for GET /api/deployments/{id}/logs.
+// It streams the output of a deployment's containers as Server-Sent Events, with
+// the deployment's stored credentials masked wherever they appear.
+//
+// ?follow=false returns what's there and ends the stream; ?tail= sets how many recent
+// lines to start with (or "all"); ?since= skips older output, as an RFC 3339 time or a
+// duration such as 10m; ?container= picks one container of a multi-container app.
+func handleDeploymentLogs(deployer deploy.Deployer, db *store.DB, secrets *vault.Vault, jobManager *jobs.Manager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		deploymentID := chi.URLParam(r, "id")
+
+		opts, err := parseLogOptions(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		d, err := db.GetDeployment(deploymentID)
+		if errors.Is(err, store.ErrNotFound) {
+			http.Error(w, "Deployment not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Failed to load deployment", http.StatusInternalServerError)
+			logging.Errorf("Error loading deployment %s: %v", deploymentID, err)
+			return
+		}
+		mask, err := credentialMask(secrets, d)
+		if err != nil {
+			// Streaming without the mask could leak the very values it exists to hide
+			http.Error(w, "Failed to load deployment credentials", http.StatusInternalServerError)
+			logging.Errorf("Error loading credentials of %s to mask its logs: %v", deploymentID, err)
+			return
+		}
+
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			http.Error(w, "Streaming is not supported", http.StatusInternalServerError)
+			return
+		}
+
+		// Stop reading from the backend when the client goes away or the server shuts down
+		ctx, cancel := context.WithCancel(r.Context())
+		defer cancel()
+		go func() {
+			select {
+			case <-jobManager.Closing():
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+
+		stream, err := deployer.Logs(ctx, deploymentID, opts)
+		if errors.Is(err, deploy.ErrNotFound) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Failed to read logs", http.StatusInternalServerError)
+			logging.Errorf("Error reading logs of %s: %v", deploymentID, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("Connection", "keep-alive")
+		w.Header().Set("X-Accel-Buffering", "no") // Stop nginx from buffering the stream
+		w.WriteHeader(http.StatusOK)
+		flusher.Flush()
+
+		heartbeat := time.NewTicker(sseHeartbeat)
+		defer heartbeat.Stop()
+		for {
+			select {
+			case line, open := <-stream.Lines():
+				if !open {
+					if ctx.Err() != nil {
+						// The client left, or the server is shutting down and the client should reconnect
+						return
+					}
+					// Without follow, or once the containers have stopped, tell the client it's the end
+					// so it doesn't reconnect and replay the tail
+					if err := stream.Err(); err != nil {
+						logging.Errorf("Error streaming logs of %s: %v", deploymentID, err)
+						writeLogEvent(w, "error", map[string]string{"message": err.Error()})
+					} else {
+						writeLogEvent(w, "end", map[string]string{})
+					}
+					flusher.Flush()
+					return
+				}
+				if mask != nil {
+					line.Line = mask.Replace(line.Line)
+				}
+				writeLogEvent(w, "log", line)
+				flusher.Flush()
+			case <-heartbeat.C:
+				fmt.Fprint(w, ": keep-alive\n\n")
+				flusher.Flush()
+			}
+		}
+	}
+}
+
+// parseLogOptions reads the log stream's query parameters.
+func parseLogOptions(r *http.Request) (deploy.LogOptions, error) {
+	query := r.URL.Query()
+	opts := deploy.LogOptions{Follow: true, Tail: defaultLogTail, Container: query.Get("container")}
+
+	if value := query.Get("follow"); value != "" {
+		follow, err := strconv.ParseBool(value)
+		if err != nil {
+			return opts, errors.New("follow must be true or false")
+		}
+		opts.Follow = follow
+	}
+	if value := query.Get("tail"); value == "all" {
+		opts.Tail = -1
+	} else if value != "" {
+		tail, err := strconv.Atoi(value)
+		if err != nil || tail < 0 {
+			return opts, errors.New("tail must be a number of lines or \"all\"")
+		}
+		opts.Tail = tail
+	}
+	if value := query.Get("since"); value != "" {
+		since, err := parseSince(value, time.Now())
+		if err != nil {
+			return opts, err
+		}
+		opts.Since = since
+	}
+	return opts, nil
+}
+
+// credentialMask returns a replacer that masks a deployment's stored credentials,
+// or nil if it has none worth masking.
+func credentialMask(secrets *vault.Vault, d *store.Deployment) (*strings.Replacer, error) {
+	var values []string
+	for _, id := range d.Secrets {
+		plaintext, err := secrets.Reveal(id)
+		if err != nil {
+			return nil, err
+		}
+		if len(plaintext) >= minMaskedLength {
+			values = append(values, plaintext)
+		}
+	}
+	if len(values) == 0 {
+		return nil, nil
+	}
+
+	// Longest first, so a password containing another is masked whole
+	sort.Slice(values, func(i, j int) bool { return len(values[i]) > len(values[j]) })
+	pairs := make([]string, 0, 2*len(values))
+	for _, value := range values {
+		pairs = append(pairs, value, "[REDACTED]")
+	}
+	return strings.NewReplacer(pairs...), nil
+}
+
+// writeLogEvent writes one Server-Sent Event of a log stream.
+func writeLogEvent(w http.ResponseWriter, event string, v interface{}) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		logging.Errorf("Error encoding log event: %v", err)
+		return
+	}
+	fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, data)
+}
@@ -5,58 +5,192 @@ import (
 	"crypto/aes"
 	"crypto/cipher"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"log"
 	"net"
 	"net/http"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"regexp"
 	"strconv"
+	"strings"
+	"syscall"
 	"time"
 
+	"example.com/m/v2/auth"
+	"example.com/m/v2/catalog"
+	"example.com/m/v2/deploy"
+	"example.com/m/v2/jobs"
+	"example.com/m/v2/keyexchange"
+	"example.com/m/v2/logging"
+	"example.com/m/v2/metrics"
+	"example.com/m/v2/registry"
+	"example.com/m/v2/store"
+	"example.com/m/v2/vault"
+	"example.com/m/v2/web"
 	"github.com/docker/docker/client"
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/clientcmd"
 )
 
 // main is the entry point for the application.
 func main() {
 	// --- Initialization ---
 
+	// Load the server config from the config file, environment and flags; see config.go.
+	cfg, err := loadConfig(os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	logging.Setup(os.Stderr, logging.Levels[cfg.LogLevel])
+
 	// Create a new context for the application.
 	// This context will be used for all background operations, including Docker client calls.
-	ctx := context.Background()
+	// It is cancelled by SIGINT or SIGTERM, which starts a graceful shutdown.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
 	// Initialize the Docker client.
-	// client.FromEnv is a helper that reads environment variables (like DOCKER_HOST)
-	// to configure the client. This is the standard way to connect to a local Docker daemon.
-	cli, err := client.NewClientWithOpts(client.FromEnv)
+	// client.FromEnv reads the TLS settings (DOCKER_CERT_PATH and friends) from the environment;
+	// the configured Docker host, if any, takes precedence over DOCKER_HOST.
+	dockerOpts := []client.Opt{client.FromEnv}
+	if cfg.DockerHost != "" {
+		dockerOpts = append(dockerOpts, client.WithHost(cfg.DockerHost))
+	}
+	if cfg.MetricsEnabled {
+		dockerOpts = append(dockerOpts, instrumentDockerClient)
+	}
+	cli, err := client.NewClientWithOpts(dockerOpts...)
 	if err != nil {
 		// If we can't connect to Docker, the application is useless.
 		// We log a fatal error and exit.
 		log.Fatalf("Failed to create Docker client: %v", err)
 	}
 
+	// Pick the deployment backend. Docker is the default; Helm deploys to Kubernetes instead.
+	backend := cfg.DeployBackend
+
 	// Ping the Docker daemon to confirm a successful connection.
-	// This is a crucial health check on startup.
+	// This is a crucial health check on startup when Docker runs the apps.
 	ping, err := cli.Ping(ctx)
-	if err != nil {
+	if err != nil && backend == "docker" {
 		log.Fatalf("Failed to ping Docker daemon: %v", err)
+	} else if err != nil {
+		logging.Warnf("Docker daemon is not reachable, status checks will fail: %v", err)
+	} else {
+		log.Printf("Successfully connected to Docker daemon. API Version: %s", ping.APIVersion)
+	}
+
+	// Load the app catalog. Manifests in the catalog directory add to or override the built-in ones.
+	cat, err := catalog.Load(cfg.CatalogDir)
+	if err != nil {
+		log.Fatalf("Failed to load app catalog: %v", err)
+	}
+	log.Printf("Loaded %d apps from the catalog", len(cat.List()))
+
+	deployer, err := newDeployer(backend, cfg.Helm, cli, cat)
+	if err != nil {
+		log.Fatalf("Failed to set up %s deployer: %v", backend, err)
+	}
+	log.Printf("Using %s deployment backend", backend)
+
+	// Open the persistent store; it is the source of truth for every deployment.
+	db, err := store.Open(filepath.Join(cfg.DataDir, "being.db"))
+	if err != nil {
+		log.Fatalf("Failed to open store: %v", err)
+	}
+	defer db.Close()
+
+	// Credentials are kept encrypted at rest under a master key from VAULT_KEY or the vault key file.
+	// Without either, a key is generated in the data directory on first run.
+	keyFile := cfg.VaultKeyFile
+	generateKey := keyFile == ""
+	if generateKey {
+		keyFile = filepath.Join(cfg.DataDir, "vault.key")
+	}
+	masterKey, err := vault.LoadKey(os.Getenv("VAULT_KEY"), keyFile, generateKey)
+	if err != nil {
+		log.Fatalf("Failed to load vault master key: %v", err)
+	}
+	secrets, err := vault.Open(db, masterKey)
+	if err != nil {
+		log.Fatalf("Failed to open secret vault: %v", err)
+	}
+
+	// The audit log's hashes are keyed with a secret from the master key, so they can't be
+	// recomputed by someone who can only write to the database.
+	auditKey, err := vault.DeriveKey(masterKey, "being audit log")
+	if err != nil {
+		log.Fatalf("Failed to derive audit key: %v", err)
+	}
+	if err := db.SetAuditKey(auditKey); errors.Is(err, store.ErrAuditBroken) {
+		logging.Errorf("Audit log could not be re-keyed: %v", err)
+	} else if err != nil {
+		log.Fatalf("Failed to set up audit log: %v", err)
+	}
+
+	// Deploy requests carry a timestamp and request ID; see replay.go.
+	replay := newReplayPolicy(time.Duration(cfg.ReplayWindow), time.Duration(cfg.RequestRetention))
+	go pruneEvery(ctx, time.Hour, "deploy requests", func() (int, error) {
+		return db.PruneDeployRequests(time.Now().Add(-replay.retention))
+	})
+
+	// Every API route except health needs a signed-in user or an API token.
+	// cookie_secure=false allows session cookies over plain HTTP during development.
+	sessions := auth.NewSessions(db, cfg.CookieSecure)
+	go pruneEvery(ctx, time.Hour, "sessions", db.PruneSessions)
+
+	// Resource usage history for the dashboard, where the backend can measure it
+	statsSource, _ := deployer.(deploy.StatsSource)
+	if statsSource != nil {
+		go collectStatsEvery(ctx, statsSource, db, time.Duration(cfg.StatsInterval))
+		go pruneEvery(ctx, time.Hour, "metric points", func() (int, error) {
+			return db.PruneMetrics(time.Now())
+		})
+	}
+
+	// Each app's health probes run periodically, so the dashboard can tell a running
+	// container from a working app
+	healthChecks := newHealthMonitor(deployer)
+	go checkHealthEvery(ctx, healthChecks, db, time.Duration(cfg.HealthInterval))
+
+	// Registries are asked now and then whether a deployment's image has a newer build
+	updates := newUpdateChecker(deployer, cat, registry.New(&http.Client{}))
+	go checkUpdatesEvery(ctx, updates, db, time.Duration(cfg.UpdateCheckInterval))
+
+	if hasUsers, err := db.HasUsers(); err == nil && !hasUsers {
+		log.Println("No users exist yet; create the first admin through POST /api/auth/setup")
 	}
-	log.Printf("Successfully connected to Docker daemon. API Version: %s", ping.APIVersion)
 
 	// --- API Router Setup ---
 
 	// Create a new chi router.
 	r := chi.NewRouter()
 
-	// Add CORS middleware for development (allow all origins).
+	// Add CORS middleware for browsers on other origins, such as the Vite dev server.
+	// Session cookies rule out a wildcard origin, so only the configured origins
+	// may make credentialed requests.
+	allowedOrigins := map[string]bool{}
+	for _, origin := range cfg.CORSOrigins {
+		allowedOrigins[strings.TrimSuffix(origin, "/")] = true
+	}
 	r.Use(func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			w.Header().Set("Access-Control-Allow-Origin", "*") // TODO: Restrict in production
+			if origin := r.Header.Get("Origin"); allowedOrigins[origin] {
+				w.Header().Set("Access-Control-Allow-Origin", origin)
+				w.Header().Set("Access-Control-Allow-Credentials", "true")
+			}
+			w.Header().Add("Vary", "Origin")
 			w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
-			w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+			w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, X-Requested-With")
 			if r.Method == "OPTIONS" {
 				w.WriteHeader(http.StatusOK)
 				return
@@ -68,34 +202,251 @@ func main() {
 	// Add some standard middleware.
 	// Logger prints a log line for each request.
 	// Recoverer catches panics and returns a 500 error.
-	r.Use(middleware.Logger)
+	r.Use(middleware.RequestLogger(&middleware.DefaultLogFormatter{Logger: log.Default(), NoColor: true}))
 	r.Use(middleware.Recoverer)
-	r.Use(middleware.Timeout(60 * time.Second)) // Set a reasonable request timeout.
+	if cfg.MetricsEnabled {
+		r.Use(metrics.Middleware)
+	}
+	// Deployments run as background jobs so they aren't cut off by the request timeout.
+	// They aren't tied to ctx either: a shutdown gives them time to finish first.
+	jobManager := jobs.NewManager(context.Background())
+	jobManager.OnFinish(func(info jobs.Info) {
+		if info.FinishedAt != nil {
+			metrics.ObserveJob(info.Kind, info.State, info.FinishedAt.Sub(info.CreatedAt))
+		}
+	})
+
+	// Pick up deployments a crash or restart left half done; see recovery.go.
+	recoverDeployments(ctx, deployer, db, secrets, jobManager, updates)
+	// Keys for the credential handoff live in memory only and expire quickly.
+	keyring := keyexchange.NewKeyring(10 * time.Minute)
 
 	// Define the API routes.
 	// We'll create a sub-router for all /api endpoints.
 	r.Route("/api", func(r chi.Router) {
-		// The /status endpoint is our basic health check.
-		// It confirms that the server is running and can talk to Docker.
-		r.Get("/status", handleGetStatus(cli))
+		// Health and login are the only routes open to anonymous callers.
+		r.Group(func(r chi.Router) {
+			r.Use(middleware.Timeout(time.Duration(cfg.RequestTimeout)))
+
+			// The /status endpoint is our basic health check.
+			// It confirms that the server is running and can talk to Docker.
+			r.Get("/status", handleGetStatus(cli))
+
+			// First-run setup creates the initial admin; after that, users log in
+			r.Get("/auth/setup", handleSetupStatus(db))
+			r.Post("/auth/setup", handleSetup(db, sessions))
+			r.Post("/auth/login", handleLogin(db, sessions))
+			r.Post("/auth/logout", handleLogout(db, sessions))
+		})
+
+		r.Group(func(r chi.Router) {
+			r.Use(sessions.Require)
+
+			// Job event and log streams stay open for as long as there's output, so they skip the timeout below.
+			r.With(auth.Authorize(auth.ActionView, nil)).Get("/jobs/{id}/events", handleJobEvents(jobManager))
+			r.With(auth.Authorize(auth.ActionView, deploymentAppID(db))).
+				Get("/deployments/{id}/logs", handleDeploymentLogs(deployer, db, secrets, jobManager))
+
+			r.Group(func(r chi.Router) {
+				r.Use(middleware.Timeout(time.Duration(cfg.RequestTimeout))) // Set a reasonable request timeout.
+
+				// The signed-in user, for the dashboard header
+				r.Get("/auth/me", handleCurrentUser())
+
+				// Personal API tokens for scripts; managed from the dashboard only
+				r.Group(func(r chi.Router) {
+					r.Use(requireSession)
+
+					r.Get("/tokens", handleListTokens(db))
+					r.Post("/tokens", handleCreateToken(db))
+					r.Delete("/tokens/{id}", handleRevokeToken(db))
+				})
+
+				// Viewers can browse the catalog and follow deployments
+				r.Group(func(r chi.Router) {
+					r.Use(auth.Authorize(auth.ActionView, nil))
+
+					// The /apps endpoint lists the app catalog, including each app's form fields
+					r.Get("/apps", handleListApps(cat))
+					r.Get("/apps/{id}", handleGetApp(cat))
+
+					// Deployments can be listed and inspected by the ID returned from /deploy
+					r.Get("/deployments", handleListDeployments(deployer, db, updates))
+					r.Get("/deployments/{id}", handleGetDeployment(deployer, db, updates))
+					r.Get("/deployments/{id}/metrics", handleDeploymentMetrics(statsSource, db, time.Duration(cfg.StatsInterval)))
+					r.Get("/deployments/{id}/health", handleDeploymentHealth(db, healthChecks))
+					r.Get("/deployments/{id}/updates", handleDeploymentUpdates(db, updates))
+
+					// Job status can be polled by clients that can't use the event stream
+					r.Get("/jobs/{id}", handleGetJob(jobManager))
+				})
+
+				// Operators, and viewers with an app grant, can deploy.
+				// The app is in the request body, so /deploy checks grants itself.
+				r.Group(func(r chi.Router) {
+					r.Use(auth.Authorize(auth.ActionDeploy, nil))
 
-		// The /deploy endpoint handles application deployment requests
-		r.Post("/deploy", handleDeploy(cli))
+					// The /deploy endpoint starts a deployment job and returns its ID right away
+					r.Post("/deploy", handleDeploy(deployer, cat, db, secrets, jobManager, keyring, replay))
 
-		// The /validate endpoint validates deployment configurations
-		r.Post("/validate", handleValidateConfig())
+					// Existing containers can be brought under management
+					r.Post("/deployments/adopt", handleAdoptDeployment(deployer, cat, db, jobManager, updates))
+
+					// The frontend wraps the key protecting sensitive fields with a key issued here
+					r.Post("/encryption/keys", handleIssueEncryptionKey(keyring))
+
+					// The /validate endpoint validates deployment configurations
+					r.Post("/validate", handleValidateConfig(cat))
+				})
+
+				// Upgrading or reconfiguring a deployment is checked against the app it belongs to
+				r.With(auth.Authorize(auth.ActionDeploy, deploymentAppID(db))).
+					Post("/deployments/{id}/upgrade", handleUpgradeDeployment(deployer, db, secrets, jobManager, updates))
+				r.With(auth.Authorize(auth.ActionDeploy, deploymentAppID(db))).
+					Put("/deployments/{id}/config", handleUpdateDeploymentConfig(deployer, cat, db, secrets, jobManager, keyring, updates))
+
+				// Tearing down a deployment is checked against the app it belongs to
+				r.With(auth.Authorize(auth.ActionDestroy, deploymentAppID(db))).
+					Delete("/deployments/{id}", handleDestroyDeployment(deployer, db, secrets, jobManager, updates))
+
+				// Admins manage users and can see which credentials are stored
+				r.Group(func(r chi.Router) {
+					r.Use(auth.Authorize(auth.ActionAdmin, nil))
+
+					r.Get("/users", handleListUsers(db))
+					r.Post("/users", handleCreateUser(db, cat))
+					r.Put("/users/{id}", handleUpdateUser(db, cat))
+					r.Delete("/users/{id}", handleDeleteUser(db))
+
+					// Secret metadata only; values never leave the vault through the API
+					r.Get("/secrets", handleListSecrets(db, secrets))
+
+					// Who did what, with a hash chain that shows whether the log was tampered with
+					r.Get("/audit", handleListAudit(db))
+				})
+			})
+		})
 	})
 
-	// --- Frontend File Server (Placeholder) ---
+	// Prometheus scrapes /metrics, where it looks by default, with an API token that
+	// can be restricted to that path alone
+	if cfg.MetricsEnabled {
+		if err := metrics.Register(&deploymentCollector{deployer: deployer, db: db}); err != nil {
+			log.Fatalf("Failed to register deployment metrics: %v", err)
+		}
+		r.With(sessions.Require, auth.Authorize(auth.ActionView, nil)).Get(auth.MetricsPath, metrics.Handler().ServeHTTP)
+		log.Printf("Serving Prometheus metrics at %s", auth.MetricsPath)
+	}
+
+	// --- Frontend File Server ---
 
-	// TODO: Add code to serve the static files from the ./web directory.
-	// We'll use http.FileServer for this later.
+	// Everything outside /api is the dashboard. It is built into the binary;
+	// web_dir serves a build from disk instead while working on the frontend.
+	frontend := web.Embedded()
+	if cfg.WebDir != "" {
+		frontend = os.DirFS(cfg.WebDir)
+		log.Printf("Serving the frontend from %s", cfg.WebDir)
+	}
+	if !web.HasIndex(frontend) {
+		logging.Warnf("No frontend build found; run npm run build in frontend/ to serve the dashboard")
+	}
+	r.Handle("/*", web.Handler(frontend))
 
 	// --- Start Server ---
 
-	log.Println("Starting server on :8081...")
-	if err := http.ListenAndServe(":8081", r); err != nil {
-		log.Fatalf("Failed to start server: %v", err)
+	server := &http.Server{
+		Addr:              cfg.Listen,
+		Handler:           r,
+		ReadHeaderTimeout: time.Duration(cfg.ReadHeaderTimeout),
+		IdleTimeout:       time.Duration(cfg.IdleTimeout),
+	}
+	go func() {
+		var err error
+		if cfg.TLSCert != "" {
+			log.Printf("Starting server on %s with TLS...", cfg.Listen)
+			err = server.ListenAndServeTLS(cfg.TLSCert, cfg.TLSKey)
+		} else {
+			log.Printf("Starting server on %s...", cfg.Listen)
+			err = server.ListenAndServe()
+		}
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Fatalf("Failed to start server: %v", err)
+		}
+	}()
+
+	// --- Graceful Shutdown ---
+
+	<-ctx.Done()
+	stop() // A second signal kills the process straight away
+	log.Printf("Shutting down; waiting up to %s for requests and deployments to finish", cfg.ShutdownTimeout)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), time.Duration(cfg.ShutdownTimeout))
+	defer cancel()
+
+	// Let running deployments carry on while requests drain. Event streams end
+	// as soon as the job manager starts closing, so they don't hold up the server.
+	interrupted := make(chan int, 1)
+	go func() { interrupted <- jobManager.Shutdown(shutdownCtx) }()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		logging.Errorf("Error draining requests: %v", err)
+	}
+	if n := <-interrupted; n > 0 {
+		logging.Warnf("%d deployments were interrupted and will be reconciled on the next start", n)
+	}
+	log.Println("Shutdown complete")
+}
+
+// pruneEvery calls prune now and then every interval until ctx is cancelled,
+// logging how many expired records of the named kind it removed.
+func pruneEvery(ctx context.Context, interval time.Duration, what string, prune func() (int, error)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		removed, err := prune()
+		if err != nil {
+			logging.Errorf("Error pruning %s: %v", what, err)
+		} else if removed > 0 {
+			log.Printf("Pruned %d expired %s", removed, what)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// newDeployer creates the deployment backend selected by name.
+// The Helm backend is configured by the helm section of the server config.
+func newDeployer(backend string, helm helmConfig, cli *client.Client, cat *catalog.Catalog) (deploy.Deployer, error) {
+	switch backend {
+	case "docker":
+		return deploy.NewDockerDeployer(cli, cat), nil
+	case "helm":
+		opts := deploy.HelmOptions{
+			HelmBinary:  helm.Binary,
+			ChartPath:   helm.Chart,
+			Namespace:   helm.Namespace,
+			KubeConfig:  helm.KubeConfig,
+			KubeContext: helm.KubeContext,
+		}
+
+		// Load the cluster config the same way kubectl does, falling back to in-cluster config.
+		loadingRules := clientcmd.NewDefaultClientConfigLoadingRules()
+		loadingRules.ExplicitPath = opts.KubeConfig
+		overrides := &clientcmd.ConfigOverrides{CurrentContext: opts.KubeContext}
+		restConfig, err := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(loadingRules, overrides).ClientConfig()
+		if err != nil {
+			return nil, fmt.Errorf("failed to load Kubernetes config: %w", err)
+		}
+		kube, err := kubernetes.NewForConfig(restConfig)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create Kubernetes client: %w", err)
+		}
+		return deploy.NewHelmDeployer(opts, kube, cat), nil
+	default:
+		return nil, fmt.Errorf("unknown deployment backend %q (want docker or helm)", backend)
 	}
 }
 
@@ -108,7 +459,7 @@ func handleGetStatus(cli *client.Client) http.HandlerFunc {
 		if err != nil {
 			// If we can't ping Docker, something is wrong. Return a 500 error.
 			http.Error(w, "Failed to connect to Docker daemon", http.StatusInternalServerError)
-			log.Printf("Error pinging Docker for status: %v", err)
+			logging.Errorf("Error pinging Docker for status: %v", err)
 			return
 		}
 
@@ -129,7 +480,7 @@ func handleGetStatus(cli *client.Client) http.HandlerFunc {
 		// Encode the struct to JSON and write it to the response.
 		if err := json.NewEncoder(w).Encode(status); err != nil {
 			http.Error(w, "Failed to write response", http.StatusInternalServerError)
-			log.Printf("Error encoding status response: %v", err)
+			logging.Errorf("Error encoding status response: %v", err)
 		}
 	}
 }
@@ -142,14 +493,20 @@ type DeploymentRequest struct {
 	RequestID     string                 `json:"request_id"`
 }
 
-// EncryptionMetadata represents encrypted field information
+// EncryptionMetadata represents encrypted field information.
+// Since version 2.0 the session key is wrapped with a key issued by /api/encryption/keys.
 type EncryptionMetadata struct {
-	SessionKey      []byte                        `json:"sessionKey"`
+	KeyID           string                        `json:"keyId"`
+	WrappedKey      []byte                        `json:"wrappedKey"`
 	EncryptedFields map[string]EncryptedFieldData `json:"encryptedFields"`
 	Algorithm       string                        `json:"algorithm"`
 	Version         string                        `json:"version"`
 }
 
+// encryptionVersion is the only EncryptionMetadata version the backend accepts.
+// Version 1.0 sent the session key in the clear and is rejected.
+const encryptionVersion = "2.0"
+
 // EncryptedFieldData represents an encrypted field value
 type EncryptedFieldData struct {
 	Encrypted []byte `json:"encrypted"`
@@ -157,13 +514,16 @@ type EncryptedFieldData struct {
 }
 
 // handleDeploy is the HTTP handler for the /api/deploy endpoint.
-func handleDeploy(cli *client.Client) http.HandlerFunc {
+// It takes the deployer, the app catalog, the store, the secret vault, the job manager,
+// the keyring used to unwrap encrypted fields and the replay policy as dependencies.
+// Resubmitting a request ID returns the original deployment instead of starting another.
+func handleDeploy(deployer deploy.Deployer, cat *catalog.Catalog, db *store.DB, secrets *vault.Vault, jobManager *jobs.Manager, keyring *keyexchange.Keyring, replay replayPolicy) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		// Parse the request body
 		var req DeploymentRequest
 		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 			http.Error(w, "Invalid request body", http.StatusBadRequest)
-			log.Printf("Error parsing deploy request: %v", err)
+			logging.Errorf("Error parsing deploy request: %v", err)
 			return
 		}
 
@@ -174,42 +534,243 @@ func handleDeploy(cli *client.Client) http.HandlerFunc {
 		}
 
 		log.Printf("Received deployment request for app: %s (request ID: %s)", req.AppID, req.RequestID)
+		event := newAuditEvent(r, auditDeploy)
+		event.AppID = req.AppID
+		event.RequestID = req.RequestID
+		// Requests are counted under the app only once it's known to be in the catalog
+		appLabel := ""
+		if _, known := cat.Get(req.AppID); known {
+			appLabel = req.AppID
+		}
+
+		// The route only checks the user may deploy something; app grants are checked here
+		user, _ := auth.UserFromContext(r.Context())
+		if !auth.Check(user, auth.ActionDeploy, req.AppID) {
+			recordAudit(db, event, store.OutcomeDenied, "role does not allow deploying this app")
+			metrics.RecordOperation("deploy", appLabel, metrics.OutcomeDenied)
+			auth.WriteForbidden(w, user, auth.ActionDeploy, req.AppID)
+			return
+		}
+
+		// Reject requests that are stale or can't be told apart from a replay
+		if err := replay.checkRequest(req.RequestID, req.Timestamp); err != nil {
+			recordAudit(db, event, store.OutcomeDenied, err.Error())
+			metrics.RecordOperation("deploy", appLabel, metrics.OutcomeDenied)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		// A request ID this user has sent before is a resubmission; answer it before the
+		// single-use encryption key is spent a second time.
+		userID := ""
+		if user != nil {
+			userID = user.ID
+		}
+		prior, err := db.GetDeployRequest(userID, req.RequestID)
+		if err == nil {
+			writeReplayedDeploy(w, prior, req.AppID)
+			return
+		}
+		if !errors.Is(err, store.ErrNotFound) {
+			http.Error(w, "Failed to check request", http.StatusInternalServerError)
+			logging.Errorf("Error loading request %s: %v", req.RequestID, err)
+			return
+		}
 
 		// Check if the request contains encrypted fields
 		if encryptionData, hasEncryption := req.Configuration["_encryption"]; hasEncryption {
 			// Decrypt sensitive fields
-			decryptedConfig, err := decryptConfiguration(req.Configuration, encryptionData)
+			decryptedConfig, err := decryptConfiguration(keyring, req.Configuration, encryptionData)
 			if err != nil {
+				recordAudit(db, event, store.OutcomeFailure, "configuration could not be decrypted")
+				metrics.RecordOperation("deploy", appLabel, metrics.OutcomeFailure)
 				http.Error(w, "Failed to decrypt configuration", http.StatusBadRequest)
-				log.Printf("Decryption failed: %v", err)
+				logging.Errorf("Decryption failed: %v", err)
 				return
 			}
 			req.Configuration = decryptedConfig
 			log.Printf("Successfully decrypted sensitive fields")
 		}
 
-		// TODO: Implement actual Docker deployment logic here
-		// For now, we'll simulate the deployment process
-		deploymentResult := simulateDeployment(req.AppID, req.Configuration)
+		app, known := cat.Get(req.AppID)
+		if !known {
+			http.Error(w, "Unknown app_id", http.StatusBadRequest)
+			return
+		}
 
-		// Create response
-		response := map[string]interface{}{
-			"status":     "success",
-			"message":    fmt.Sprintf("Successfully initiated deployment of %s", req.AppID),
-			"request_id": req.RequestID,
-			"deployment": deploymentResult,
+		deploymentID, err := deploy.NewDeploymentID(req.AppID)
+		if err != nil {
+			http.Error(w, "Deployment failed", http.StatusInternalServerError)
+			logging.Errorf("Error creating deployment ID: %v", err)
+			return
+		}
+
+		// Claim the request ID; if a concurrent duplicate got there first, answer with its result.
+		prior, err = db.ClaimDeployRequest(&store.DeployRequest{
+			ID:           req.RequestID,
+			UserID:       userID,
+			AppID:        req.AppID,
+			DeploymentID: deploymentID,
+		})
+		if err != nil {
+			http.Error(w, "Failed to record request", http.StatusInternalServerError)
+			logging.Errorf("Error claiming request %s: %v", req.RequestID, err)
+			return
+		}
+		if prior != nil {
+			writeReplayedDeploy(w, prior, req.AppID)
+			return
+		}
+
+		// Keep credentials in the vault so the deployment can be redeployed or upgraded later
+		secretRefs, err := storeSecrets(secrets, app, deploymentID, req.Configuration)
+		if err != nil {
+			http.Error(w, "Failed to store credentials", http.StatusInternalServerError)
+			logging.Errorf("Error storing secrets for %s: %v", deploymentID, err)
+			if err := db.ReleaseDeployRequest(userID, req.RequestID); err != nil {
+				logging.Errorf("Error releasing request %s: %v", req.RequestID, err)
+			}
+			return
+		}
+
+		// Record the deployment before touching Docker so a crash mid-deploy leaves a trace.
+		safeConfig := redactConfiguration(req.Configuration)
+		for field := range secretRefs {
+			safeConfig[field] = "[REDACTED]"
+		}
+		log.Printf("Deploying %s as %s with configuration: %+v", req.AppID, deploymentID, safeConfig)
+		event.DeploymentID = deploymentID
+		event.Diff = configDiff(nil, safeConfig)
+		err = db.CreateDeployment(&store.Deployment{
+			ID:        deploymentID,
+			AppID:     req.AppID,
+			RequestID: req.RequestID,
+			UserID:    userID,
+			Config:    safeConfig,
+			Secrets:   secretRefs,
+			State:     store.StateDeploying,
+		})
+		if err != nil {
+			http.Error(w, "Failed to record deployment", http.StatusInternalServerError)
+			logging.Errorf("Error saving deployment %s: %v", deploymentID, err)
+			// Nothing was deployed, so let the client retry with the same request ID
+			deleteSecrets(secrets, secretRefs)
+			if err := db.ReleaseDeployRequest(userID, req.RequestID); err != nil {
+				logging.Errorf("Error releasing request %s: %v", req.RequestID, err)
+			}
+			return
+		}
+
+		// Record the accepted request before the job can record how it ends
+		recordAudit(db, event, store.OutcomeSuccess, "deployment started")
+
+		// Deploying can take far longer than a request should stay open (multi-GB image pulls),
+		// so it runs as a background job whose progress is streamed from /api/jobs/{id}/events.
+		job := startDeployJob(jobManager, deployer, db, secrets, deploymentID, len(secretRefs), event)
+		jobID := job.Info().ID
+		if err := db.SetDeployRequestJob(userID, req.RequestID, jobID); err != nil {
+			logging.Errorf("Error saving job for request %s: %v", req.RequestID, err)
 		}
 
+		// Create response
+		response := deployResponse(req.AppID, req.RequestID, deploymentID, jobID)
+
 		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
 		if err := json.NewEncoder(w).Encode(response); err != nil {
-			http.Error(w, "Failed to write response", http.StatusInternalServerError)
-			log.Printf("Error encoding deploy response: %v", err)
+			logging.Errorf("Error encoding deploy response: %v", err)
 		}
 	}
 }
 
+// startDeployJob runs a recorded deployment as a background job.
+// The credentials it reads and how it ends are audited as the actor in event.
+func startDeployJob(jobManager *jobs.Manager, deployer deploy.Deployer, db *store.DB, secrets *vault.Vault, deploymentID string, secretCount int, event store.AuditEvent) *jobs.Job {
+	return jobManager.Start("deploy", deploymentID, func(ctx context.Context, progress func(step, message string, percent float64)) (interface{}, error) {
+		ctx = deploy.WithProgress(ctx, func(p deploy.Progress) {
+			progress(p.Step, p.Message, p.Percent)
+		})
+		// The job reads the credentials back out of the vault to hand them to the deployer
+		if secretCount > 0 {
+			reveal := event
+			reveal.Action, reveal.Diff = auditSecretsReveal, nil
+			recordAudit(db, reveal, store.OutcomeSuccess, fmt.Sprintf("%d credentials read for deployment", secretCount))
+		}
+
+		finish := event
+		finish.Action, finish.Diff = auditDeployFinish, nil
+		result, err := runDeploy(ctx, deployer, db, secrets, deploymentID)
+		if err != nil {
+			recordAudit(db, finish, store.OutcomeFailure, err.Error())
+			metrics.RecordOperation("deploy", event.AppID, metrics.OutcomeFailure)
+			return failureReport(err), err
+		}
+		recordAudit(db, finish, store.OutcomeSuccess, result.Status)
+		metrics.RecordOperation("deploy", event.AppID, metrics.OutcomeSuccess)
+		return result, nil
+	})
+}
+
+// failureReport returns the steps a failed deploy or upgrade ran and rolled back,
+// for the job's result, or nil if it failed before running any.
+func failureReport(err error) interface{} {
+	var failed *deploy.PipelineError
+	if errors.As(err, &failed) {
+		return failed
+	}
+	return nil
+}
+
+// runDeploy runs a deployment from its stored record and records its outcome in the store.
+func runDeploy(ctx context.Context, deployer deploy.Deployer, db *store.DB, secrets *vault.Vault, deploymentID string) (*deploy.Result, error) {
+	result, err := deployFromRecord(ctx, deployer, db, secrets, deploymentID)
+	if err != nil && ctx.Err() != nil {
+		// Cut off by a shutdown rather than failed: leave it in flight so the next
+		// start reconciles it with whatever was half created.
+		logging.Warnf("Deployment of %s interrupted: %v", deploymentID, err)
+		if err := db.SetDeploymentState(deploymentID, store.StateDeploying, "Interrupted by shutdown; resumed on restart"); err != nil {
+			logging.Errorf("Error saving deployment %s: %v", deploymentID, err)
+		}
+		return nil, err
+	}
+	if err != nil {
+		logging.Errorf("Deployment of %s failed: %v", deploymentID, err)
+		if err := db.SetDeploymentState(deploymentID, store.StateFailed, err.Error()); err != nil {
+			logging.Errorf("Error saving deployment %s: %v", deploymentID, err)
+		}
+		return nil, err
+	}
+
+	err = db.UpdateDeployment(deploymentID, func(d *store.Deployment) error {
+		d.ContainerID = result.ContainerID
+		d.Release = result.Release
+		d.Image = result.Image
+		d.Transition(store.StateDeployed, result.Status)
+		return nil
+	})
+	if err != nil {
+		logging.Errorf("Error saving deployment %s: %v", deploymentID, err)
+	}
+	log.Printf("Deployment of %s finished: %s", deploymentID, result.Status)
+	return result, nil
+}
+
+// deployFromRecord hands a stored deployment to the deployer. Credentials are read
+// back from the vault and only exist in memory while the deployer runs.
+func deployFromRecord(ctx context.Context, deployer deploy.Deployer, db *store.DB, secrets *vault.Vault, deploymentID string) (*deploy.Result, error) {
+	d, err := db.GetDeployment(deploymentID)
+	if err != nil {
+		return nil, err
+	}
+	config, err := resolveConfig(secrets, d)
+	if err != nil {
+		return nil, err
+	}
+	return deployer.Deploy(ctx, deploymentID, d.AppID, config)
+}
+
 // decryptConfiguration decrypts sensitive fields in the configuration
-func decryptConfiguration(config map[string]interface{}, encryptionData interface{}) (map[string]interface{}, error) {
+func decryptConfiguration(keyring *keyexchange.Keyring, config map[string]interface{}, encryptionData interface{}) (map[string]interface{}, error) {
 	// Convert encryption metadata
 	encBytes, err := json.Marshal(encryptionData)
 	if err != nil {
@@ -222,12 +783,18 @@ func decryptConfiguration(config map[string]interface{}, encryptionData interfac
 	}
 
 	// Validate encryption version and algorithm
-	if encMeta.Version != "1.0" || encMeta.Algorithm != "AES-GCM" {
-		return nil, fmt.Errorf("unsupported encryption version or algorithm")
+	if encMeta.Version != encryptionVersion || encMeta.Algorithm != "AES-GCM" {
+		return nil, fmt.Errorf("unsupported encryption version %q or algorithm %q", encMeta.Version, encMeta.Algorithm)
+	}
+
+	// Unwrap the session key with the private half of the key the client was issued
+	sessionKey, err := keyring.Unwrap(encMeta.KeyID, encMeta.WrappedKey)
+	if err != nil {
+		return nil, err
 	}
 
 	// Create AES cipher
-	block, err := aes.NewCipher(encMeta.SessionKey)
+	block, err := aes.NewCipher(sessionKey)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create AES cipher: %w", err)
 	}
@@ -252,15 +819,14 @@ func decryptConfiguration(config map[string]interface{}, encryptionData interfac
 			return nil, fmt.Errorf("failed to decrypt field %s: %w", fieldName, err)
 		}
 		result[fieldName] = string(plaintext)
-		log.Printf("Decrypted field: %s", fieldName)
+		logging.Debugf("Decrypted field: %s", fieldName)
 	}
 
 	return result, nil
 }
 
-// simulateDeployment simulates the deployment process (replace with actual Docker logic)
-func simulateDeployment(appID string, config map[string]interface{}) map[string]interface{} {
-	// Log configuration (excluding sensitive fields for security)
+// redactConfiguration returns a copy of the configuration that is safe to log.
+func redactConfiguration(config map[string]interface{}) map[string]interface{} {
 	safeConfig := make(map[string]interface{})
 	for k, v := range config {
 		if isSensitiveField(k) {
@@ -269,14 +835,7 @@ func simulateDeployment(appID string, config map[string]interface{}) map[string]
 			safeConfig[k] = v
 		}
 	}
-	log.Printf("Deploying %s with configuration: %+v", appID, safeConfig)
-
-	// Return mock deployment result
-	return map[string]interface{}{
-		"container_id": fmt.Sprintf("%s-container-123", appID),
-		"status":       "deploying",
-		"created_at":   time.Now().UTC().Format(time.RFC3339),
-	}
+	return safeConfig
 }
 
 // isSensitiveField checks if a field name indicates sensitive data
@@ -285,10 +844,10 @@ func isSensitiveField(fieldName string) bool {
 		"password", "token", "secret", "key", "apikey",
 	}
 
-	fieldLower := fmt.Sprintf("%v", fieldName)
+	// Match anywhere in the name so fields like adminPassword and dbPassword are caught.
+	fieldLower := strings.ToLower(fieldName)
 	for _, pattern := range sensitivePatterns {
-		if fmt.Sprintf("%v", fieldLower) == pattern ||
-			fmt.Sprintf("%v", fieldName) == pattern {
+		if strings.Contains(fieldLower, pattern) {
 			return true
 		}
 	}
@@ -317,7 +876,7 @@ type ValidationResponse struct {
 }
 
 // handleValidateConfig validates deployment configuration without deploying
-func handleValidateConfig() http.HandlerFunc {
+func handleValidateConfig(cat *catalog.Catalog) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		var req ValidationRequest
 		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
@@ -330,10 +889,16 @@ func handleValidateConfig() http.HandlerFunc {
 			return
 		}
 
+		app, known := cat.Get(req.AppID)
+		if !known {
+			http.Error(w, "Unknown app_id", http.StatusBadRequest)
+			return
+		}
+
 		log.Printf("Validating configuration for app: %s", req.AppID)
 
 		// Validate the configuration
-		results := validateConfiguration(req.AppID, req.Configuration)
+		results := validateConfiguration(app, req.Configuration)
 
 		// Determine overall validity
 		valid := true
@@ -343,6 +908,11 @@ func handleValidateConfig() http.HandlerFunc {
 				break
 			}
 		}
+		outcome := metrics.OutcomeSuccess
+		if !valid {
+			outcome = metrics.OutcomeFailure
+		}
+		metrics.RecordOperation("validate", req.AppID, outcome)
 
 		// Create summary
 		errorCount := 0
@@ -371,13 +941,13 @@ func handleValidateConfig() http.HandlerFunc {
 		w.Header().Set("Content-Type", "application/json")
 		if err := json.NewEncoder(w).Encode(response); err != nil {
 			http.Error(w, "Failed to write response", http.StatusInternalServerError)
-			log.Printf("Error encoding validation response: %v", err)
+			logging.Errorf("Error encoding validation response: %v", err)
 		}
 	}
 }
 
 // validateConfiguration validates all configuration fields for an app
-func validateConfiguration(appID string, config map[string]interface{}) []ValidationResult {
+func validateConfiguration(app *catalog.App, config map[string]interface{}) []ValidationResult {
 	var results []ValidationResult
 
 	// Common validations for all apps
@@ -387,21 +957,8 @@ func validateConfiguration(appID string, config map[string]interface{}) []Valida
 	results = append(results, validatePasswords(config)...)
 	results = append(results, validateEmails(config)...)
 
-	// App-specific validations
-	switch appID {
-	case "nextcloud":
-		results = append(results, validateNextcloudConfig(config)...)
-	case "immich":
-		results = append(results, validateImmichConfig(config)...)
-	case "vaultwarden":
-		results = append(results, validateVaultwardenConfig(config)...)
-	case "jellyfin":
-		results = append(results, validateJellyfinConfig(config)...)
-	case "navidrome":
-		results = append(results, validateNavidromeConfig(config)...)
-	case "joplin-server":
-		results = append(results, validateJoplinConfig(config)...)
-	}
+	// App-specific validations come from the manifest
+	results = append(results, validateRules(app, config)...)
 
 	return results
 }
@@ -666,140 +1223,94 @@ func validateEmails(config map[string]interface{}) []ValidationResult {
 	return results
 }
 
-// App-specific validation functions
-func validateNextcloudConfig(config map[string]interface{}) []ValidationResult {
+// validateRules runs the app-specific checks declared in the app's manifest
+func validateRules(app *catalog.App, config map[string]interface{}) []ValidationResult {
 	var results []ValidationResult
 
-	// Validate storage path specifically for Nextcloud
-	if storage, exists := config["storage"].(string); exists {
-		// Nextcloud needs significant disk space
-		result := checkDiskSpace(storage, 1024*1024*1024) // 1GB minimum
-		results = append(results, ValidationResult{
-			Field:   "storage",
-			Valid:   result.Valid,
-			Message: result.Message,
-			Type:    result.Type,
-		})
+	for _, rule := range app.Rules {
+		value, exists := config[rule.Field]
+		if !exists {
+			continue
+		}
+		if result, flagged := checkRule(rule, value); flagged {
+			results = append(results, result)
+		}
 	}
 
 	return results
 }
 
-func validateImmichConfig(config map[string]interface{}) []ValidationResult {
-	var results []ValidationResult
-
-	// Check if machine learning is enabled and warn about resources
-	if ml, exists := config["machinelearning"].(bool); exists && ml {
-		results = append(results, ValidationResult{
-			Field:   "machinelearning",
-			Valid:   true,
-			Message: "Machine learning enabled - ensure adequate RAM (8GB+) and CPU resources",
-			Type:    "warning",
-		})
+// checkRule evaluates a single manifest rule against a configuration value.
+// It reports whether the rule produced a result worth showing to the user.
+func checkRule(rule catalog.Rule, value interface{}) (ValidationResult, bool) {
+	// Rules flag things to look at rather than reject them, unless the manifest says otherwise
+	result := ValidationResult{
+		Field:   rule.Field,
+		Valid:   rule.Severity != "error",
+		Message: rule.Message,
+		Type:    rule.Severity,
 	}
 
-	return results
-}
+	switch rule.Check {
+	case catalog.CheckMin:
+		number, ok := numericValue(value)
+		return result, ok && number > 0 && number < rule.Value
 
-func validateVaultwardenConfig(config map[string]interface{}) []ValidationResult {
-	var results []ValidationResult
+	case catalog.CheckMax:
+		number, ok := numericValue(value)
+		return result, ok && number > rule.Value
 
-	// Check SMTP configuration if provided
-	if smtpHost, exists := config["smtpHost"].(string); exists && smtpHost != "" {
-		// Try to resolve SMTP host
-		if _, err := net.LookupHost(smtpHost); err != nil {
-			results = append(results, ValidationResult{
-				Field:   "smtpHost",
-				Valid:   false,
-				Message: fmt.Sprintf("SMTP host does not resolve: %s", err.Error()),
-				Type:    "warning",
-			})
-		}
-	}
+	case catalog.CheckEnabled:
+		enabled, ok := value.(bool)
+		return result, ok && enabled
 
-	return results
-}
-
-func validateJellyfinConfig(config map[string]interface{}) []ValidationResult {
-	var results []ValidationResult
-
-	// Validate media path exists and has content
-	if mediaPath, exists := config["mediaPath"].(string); exists {
-		if _, err := os.Stat(mediaPath); err == nil {
-			// Check if directory has media files
-			entries, err := os.ReadDir(mediaPath)
-			if err == nil && len(entries) == 0 {
-				results = append(results, ValidationResult{
-					Field:   "mediaPath",
-					Valid:   true,
-					Message: "Media directory exists but appears empty",
-					Type:    "warning",
-				})
-			}
+	case catalog.CheckResolves:
+		host, ok := value.(string)
+		if !ok || host == "" {
+			return result, false
 		}
-	}
-
-	return results
-}
-
-func validateNavidromeConfig(config map[string]interface{}) []ValidationResult {
-	var results []ValidationResult
+		// Try to resolve the host
+		if _, err := net.LookupHost(host); err != nil {
+			result.Valid = false
+			result.Message = fmt.Sprintf("%s: %s", rule.Message, err.Error())
+			return result, true
+		}
+		return result, false
 
-	// Validate scan interval
-	if interval, exists := config["scanInterval"]; exists {
-		var minutes int
-		switch v := interval.(type) {
-		case string:
-			if parsed, err := strconv.Atoi(v); err == nil {
-				minutes = parsed
-			}
-		case float64:
-			minutes = int(v)
-		case int:
-			minutes = v
-		}
-
-		if minutes > 0 && minutes < 5 {
-			results = append(results, ValidationResult{
-				Field:   "scanInterval",
-				Valid:   true,
-				Message: "Very frequent scanning may impact performance",
-				Type:    "warning",
-			})
+	case catalog.CheckNonEmptyDir:
+		dir, ok := value.(string)
+		if !ok || dir == "" {
+			return result, false
 		}
+		// Only an existing directory with nothing in it is flagged
+		entries, err := os.ReadDir(dir)
+		return result, err == nil && len(entries) == 0
+
+	case catalog.CheckDiskSpace:
+		path, ok := value.(string)
+		if !ok || path == "" {
+			return result, false
+		}
+		space := checkDiskSpace(path, int64(rule.Value))
+		space.Field = rule.Field
+		return space, true
 	}
 
-	return results
+	return result, false
 }
 
-func validateJoplinConfig(config map[string]interface{}) []ValidationResult {
-	var results []ValidationResult
-
-	// Validate max item size
-	if maxSize, exists := config["maxItemSize"]; exists {
-		var sizeMB int
-		switch v := maxSize.(type) {
-		case string:
-			if parsed, err := strconv.Atoi(v); err == nil {
-				sizeMB = parsed
-			}
-		case float64:
-			sizeMB = int(v)
-		case int:
-			sizeMB = v
-		}
-
-		if sizeMB > 100 {
-			results = append(results, ValidationResult{
-				Field:   "maxItemSize",
-				Valid:   true,
-				Message: "Large item size may impact sync performance",
-				Type:    "warning",
-			})
-		}
+// numericValue converts a number or numeric string from the configuration to a float
+func numericValue(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case string:
+		parsed, err := strconv.ParseFloat(v, 64)
+		return parsed, err == nil
+	case float64:
+		return v, true
+	case int:
+		return float64(v), true
 	}
-
-	return results
+	return 0, false
 }
 
 // checkDiskSpace checks available disk space at a path
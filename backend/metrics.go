@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"example.com/m/v2/deploy"
+	"example.com/m/v2/logging"
+	"example.com/m/v2/metrics"
+	"example.com/m/v2/store"
+	"github.com/docker/docker/client"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// deploymentScrapeTimeout bounds how long a scrape waits on the deployment backend.
+const deploymentScrapeTimeout = 5 * time.Second
+
+var (
+	deploymentUpDesc = prometheus.NewDesc("being_deployment_up",
+		"Whether a deployment is running (1) or not (0), for every deployment that hasn't been destroyed.",
+		[]string{"deployment", "app"}, nil)
+	backendUpDesc = prometheus.NewDesc("being_deployment_backend_up",
+		"Whether the deployment backend answered when deployments were last checked.",
+		nil, nil)
+)
+
+// deploymentCollector reports the live state of every deployment at scrape time,
+// so the numbers are never older than the scrape itself.
+type deploymentCollector struct {
+	deployer deploy.Deployer
+	db       *store.DB
+}
+
+// Describe sends the descriptors of the metrics Collect reports.
+func (c *deploymentCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- deploymentUpDesc
+	ch <- backendUpDesc
+}
+
+// Collect asks the backend for every labelled deployment in one call and compares
+// it with the store.
+func (c *deploymentCollector) Collect(ch chan<- prometheus.Metric) {
+	deployments, err := c.db.ListDeployments()
+	if err != nil {
+		logging.Errorf("Error listing deployments for metrics: %v", err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), deploymentScrapeTimeout)
+	defer cancel()
+	live, err := c.deployer.List(ctx)
+	if err != nil {
+		// Reporting every deployment as down would page someone for the wrong thing
+		logging.Errorf("Error listing live deployments for metrics: %v", err)
+		ch <- prometheus.MustNewConstMetric(backendUpDesc, prometheus.GaugeValue, 0)
+		return
+	}
+	ch <- prometheus.MustNewConstMetric(backendUpDesc, prometheus.GaugeValue, 1)
+
+	running := make(map[string]bool, len(live))
+	for _, status := range live {
+		running[status.DeploymentID] = status.State == "running"
+	}
+	for _, d := range deployments {
+		if d.State == store.StateDestroyed {
+			continue
+		}
+		up := 0.0
+		if running[d.ID] {
+			up = 1
+		}
+		ch <- prometheus.MustNewConstMetric(deploymentUpDesc, prometheus.GaugeValue, up, d.ID, d.AppID)
+	}
+}
+
+// instrumentDockerClient is a Docker client option that counts failed API calls.
+// It has to come after every option that configures the transport, since those
+// expect Docker's own *http.Transport.
+func instrumentDockerClient(c *client.Client) error {
+	httpClient := c.HTTPClient()
+	// The client decides between http and https by looking at its own transport,
+	// which it can't see through the wrapper, so settle the scheme first
+	scheme := "http"
+	if transport, ok := httpClient.Transport.(*http.Transport); ok && transport.TLSClientConfig != nil {
+		scheme = "https"
+	}
+	httpClient.Transport = metrics.InstrumentDocker(httpClient.Transport)
+	if err := client.WithScheme(scheme)(c); err != nil {
+		return err
+	}
+	return client.WithHTTPClient(httpClient)(c)
+}
@@ -0,0 +1,150 @@
+// Package metrics exposes the backend's own health to Prometheus: API traffic,
+// deploy, upgrade, validate and destroy outcomes, job durations and Docker API errors.
+//
+// Everything is registered on a private registry served by Handler, so nothing
+// is collected into the process-wide default one.
+package metrics
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// namespace prefixes every metric name.
+const namespace = "being"
+
+// Operation outcomes, for RecordOperation.
+const (
+	OutcomeSuccess = "success"
+	OutcomeFailure = "failure"
+	OutcomeDenied  = "denied"
+)
+
+// UnknownApp is the app label of operations on an app that isn't in the catalog,
+// or on a deployment the store has no record of. Labelling them with whatever the
+// request named would let anyone add series.
+const UnknownApp = "unknown"
+
+var registry = prometheus.NewRegistry()
+
+var (
+	httpRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "http_requests_total",
+		Help:      "API requests handled, by route pattern, method and status code.",
+	}, []string{"route", "method", "code"})
+
+	httpDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "Time taken to handle API requests, by route pattern and method.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"route", "method"})
+
+	operations = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "operations_total",
+		Help:      "Deploy, upgrade, validate and destroy operations, by app and outcome.",
+	}, []string{"operation", "app", "outcome"})
+
+	jobDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "job_duration_seconds",
+		Help:      "Time background jobs ran for, by kind and final state.",
+		// Deployments pull images, so they run for anything from seconds to many minutes
+		Buckets: []float64{1, 5, 15, 30, 60, 120, 300, 600, 1800},
+	}, []string{"kind", "state"})
+
+	dockerErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "docker_api_errors_total",
+		Help:      "Docker API calls that failed, by status code, or \"connection\" when the daemon couldn't be reached.",
+	}, []string{"code"})
+)
+
+func init() {
+	registry.MustRegister(
+		httpRequests, httpDuration, operations, jobDuration, dockerErrors,
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+}
+
+// Handler serves the metrics in the Prometheus exposition format.
+func Handler() http.Handler {
+	return promhttp.HandlerFor(registry, promhttp.HandlerOpts{})
+}
+
+// Register adds a collector, such as one reporting live deployment state, to the metrics served.
+func Register(c prometheus.Collector) error {
+	return registry.Register(c)
+}
+
+// Middleware counts and times every request by the route pattern it matched, so
+// /api/deployments/{id} is one series however many deployments there are.
+func Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		next.ServeHTTP(ww, r)
+
+		// The pattern is only known once the router has matched the request
+		route := "unmatched"
+		if rctx := chi.RouteContext(r.Context()); rctx != nil && rctx.RoutePattern() != "" {
+			route = rctx.RoutePattern()
+		}
+		status := ww.Status()
+		if status == 0 {
+			status = http.StatusOK
+		}
+		httpRequests.WithLabelValues(route, r.Method, strconv.Itoa(status)).Inc()
+		httpDuration.WithLabelValues(route, r.Method).Observe(time.Since(start).Seconds())
+	})
+}
+
+// RecordOperation counts a deploy, upgrade, validate or destroy of an app.
+// appID must come from the catalog or a stored deployment; pass "" for UnknownApp.
+func RecordOperation(operation, appID, outcome string) {
+	if appID == "" {
+		appID = UnknownApp
+	}
+	operations.WithLabelValues(operation, appID, outcome).Inc()
+}
+
+// ObserveJob records how long a finished job ran.
+func ObserveJob(kind, state string, took time.Duration) {
+	jobDuration.WithLabelValues(kind, state).Observe(took.Seconds())
+}
+
+// dockerTransport counts failed calls to the Docker API.
+type dockerTransport struct {
+	next http.RoundTripper
+}
+
+// InstrumentDocker wraps the transport of a Docker client so its failed calls are counted.
+// A 404 is how the API answers "no such container", so it doesn't count as an error.
+func InstrumentDocker(next http.RoundTripper) http.RoundTripper {
+	return &dockerTransport{next: next}
+}
+
+// RoundTrip makes the call and counts it if it failed.
+func (t *dockerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.next.RoundTrip(req)
+	switch {
+	case err != nil:
+		// A cancelled request is the caller giving up, not Docker failing
+		if req.Context().Err() == nil {
+			dockerErrors.WithLabelValues("connection").Inc()
+		}
+	case resp.StatusCode >= 400 && resp.StatusCode != http.StatusNotFound:
+		dockerErrors.WithLabelValues(strconv.Itoa(resp.StatusCode)).Inc()
+	}
+	return resp, err
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+
+	"example.com/m/v2/deploy"
+	"example.com/m/v2/jobs"
+	"example.com/m/v2/logging"
+	"example.com/m/v2/registry"
+	"example.com/m/v2/store"
+	"example.com/m/v2/vault"
+)
+
+// maxResumes is how many times an interrupted deployment is restarted before it is given up on.
+// A deployment that dies with the server every time is more likely the cause than the victim.
+const maxResumes = 2
+
+// recoverDeployments reconciles deployments left in flight by a crash or shutdown
+// with what actually exists on the deployment backend.
+//
+// A deployment that made it all the way is marked deployed. Anything else is rolled
+// back, keeping its data, and started again from its stored configuration; one that
+// has already been resumed maxResumes times is marked failed instead. Upgrades and
+// configuration updates are finished or undone; see recoverChange.
+func recoverDeployments(ctx context.Context, deployer deploy.Deployer, db *store.DB, secrets *vault.Vault, jobManager *jobs.Manager, checker *updateChecker) {
+	deployments, err := db.ListDeployments()
+	if err != nil {
+		logging.Errorf("Error listing deployments to recover: %v", err)
+		return
+	}
+
+	for _, d := range deployments {
+		var err error
+		switch d.State {
+		case store.StateDeploying:
+			err = recoverDeployment(ctx, deployer, db, secrets, jobManager, d)
+		case store.StateUpgrading, store.StateUpdating:
+			err = recoverChange(ctx, deployer, db, secrets, jobManager, checker, d)
+		default:
+			continue
+		}
+		if err != nil {
+			logging.Errorf("Error recovering deployment %s: %v", d.ID, err)
+		}
+	}
+
+	reportUnrecorded(ctx, deployer, deployments)
+}
+
+// reportUnrecorded warns about workloads carrying this server's labels that the store
+// has no live record of, such as those left by a lost data directory. They are never
+// removed automatically; the user decides whether to adopt or destroy them.
+func reportUnrecorded(ctx context.Context, deployer deploy.Deployer, deployments []*store.Deployment) {
+	live, err := deployer.List(ctx)
+	if err != nil {
+		logging.Warnf("Could not list deployments on the backend to reconcile: %v", err)
+		return
+	}
+
+	recorded := make(map[string]bool, len(deployments))
+	for _, d := range deployments {
+		recorded[d.ID] = d.State != store.StateDestroyed
+	}
+	for _, status := range live {
+		if !recorded[status.DeploymentID] {
+			logging.Warnf("Deployment %s of %s is running without a record; adopt or destroy it", status.DeploymentID, status.AppID)
+		}
+	}
+}
+
+// recoverDeployment reconciles one in-flight deployment.
+func recoverDeployment(ctx context.Context, deployer deploy.Deployer, db *store.DB, secrets *vault.Vault, jobManager *jobs.Manager, d *store.Deployment) error {
+	event := store.AuditEvent{
+		Actor:        "system",
+		Action:       auditDeployRecover,
+		AppID:        d.AppID,
+		DeploymentID: d.ID,
+		RequestID:    d.RequestID,
+	}
+
+	// The deployment may have finished after its last checkpoint
+	status, err := deployer.Status(ctx, d.ID)
+	switch {
+	case err == nil && status.State == "running":
+		log.Printf("Deployment %s finished before the restart; marking it deployed", d.ID)
+		err := db.UpdateDeployment(d.ID, func(d *store.Deployment) error {
+			if status.Image != "" {
+				d.Image = status.Image
+			}
+			d.Transition(store.StateDeployed, "Found running after a restart")
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		recordAudit(db, event, store.OutcomeSuccess, "found running after a restart")
+		return nil
+	case err != nil && !errors.Is(err, deploy.ErrNotFound):
+		// Without a backend to compare against, leave it for the next start
+		return fmt.Errorf("failed to check live state: %w", err)
+	}
+
+	// Roll back whatever was half created. Data is kept, as for any destroy without remove_data.
+	log.Printf("Rolling back interrupted deployment %s", d.ID)
+	if _, err := deployer.Destroy(ctx, d.ID, deploy.DestroyOptions{}); err != nil && !errors.Is(err, deploy.ErrNotFound) {
+		if err := db.SetDeploymentState(d.ID, store.StateFailed, "Interrupted, and rolling back failed: "+err.Error()); err != nil {
+			return err
+		}
+		recordAudit(db, event, store.OutcomeFailure, "rollback failed: "+err.Error())
+		return fmt.Errorf("failed to roll back: %w", err)
+	}
+
+	if d.Resumes >= maxResumes {
+		logging.Errorf("Deployment %s was interrupted %d times; giving up", d.ID, d.Resumes+1)
+		message := fmt.Sprintf("Interrupted %d times; rolled back", d.Resumes+1)
+		if err := db.SetDeploymentState(d.ID, store.StateFailed, message); err != nil {
+			return err
+		}
+		recordAudit(db, event, store.OutcomeFailure, message)
+		return nil
+	}
+
+	err = db.UpdateDeployment(d.ID, func(d *store.Deployment) error {
+		d.Resumes++
+		d.Transition(store.StateDeploying, "Rolled back after an interruption; deploying again")
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	job := startDeployJob(jobManager, deployer, db, secrets, d.ID, len(d.Secrets), event)
+	log.Printf("Resuming deployment %s as job %s", d.ID, job.Info().ID)
+	recordAudit(db, event, store.OutcomeSuccess, "rolled back and resumed as job "+job.Info().ID)
+
+	// Point the original request at the new job, so a client retrying it can follow along
+	if err := db.SetDeployRequestJob(d.UserID, d.RequestID, job.Info().ID); err != nil && !errors.Is(err, store.ErrNotFound) {
+		logging.Errorf("Error saving job for request %s: %v", d.RequestID, err)
+	}
+	return nil
+}
+
+// recoverChange finishes or undoes an upgrade or configuration update cut off by a
+// restart, using the checkpoint saved before it started.
+//
+// Containers the deployer had set aside mean it was part way through swapping them:
+// the new ones never passed their health checks, so the previous ones are put back
+// and the change is dropped. Otherwise it either hadn't replaced anything yet or had
+// finished, and running it again from the checkpoint brings it to the same end.
+func recoverChange(ctx context.Context, deployer deploy.Deployer, db *store.DB, secrets *vault.Vault, jobManager *jobs.Manager, checker *updateChecker, d *store.Deployment) error {
+	operation, action := "upgrade", auditDeployUpgrade
+	if d.State == store.StateUpdating {
+		operation, action = "update", auditDeployUpdate
+	}
+	event := store.AuditEvent{
+		Actor:        "system",
+		Action:       action,
+		AppID:        d.AppID,
+		DeploymentID: d.ID,
+	}
+	pending := d.Pending
+	if pending == nil {
+		pending = &store.PendingChange{PreviousImage: d.Image}
+	}
+	// Credentials stored for an update only belong to the deployment once it succeeds
+	added := map[string]string{}
+	for field, id := range pending.Secrets {
+		if d.Secrets[field] != id {
+			added[field] = id
+		}
+	}
+	abandon := func(state, message string) error {
+		err := db.UpdateDeployment(d.ID, func(d *store.Deployment) error {
+			d.Pending = nil
+			d.Transition(state, message)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		deleteSecrets(secrets, added)
+		recordAudit(db, event, store.OutcomeFailure, message)
+		return nil
+	}
+
+	_, err := deployer.Restore(ctx, d.ID)
+	switch {
+	case err == nil:
+		log.Printf("Put back the previous version of %s after an interrupted %s", d.ID, operation)
+		return abandon(store.StateDeployed, fmt.Sprintf("Interrupted by a restart; the %s was rolled back", operation))
+	case !errors.Is(err, deploy.ErrNotFound):
+		if err := abandon(store.StateFailed, "Interrupted, and restoring the previous version failed: "+err.Error()); err != nil {
+			return err
+		}
+		return fmt.Errorf("failed to restore: %w", err)
+	}
+
+	if d.Resumes >= maxResumes || d.Pending == nil {
+		logging.Errorf("The %s of %s was interrupted %d times; giving up", operation, d.ID, d.Resumes+1)
+		return abandon(store.StateFailed, fmt.Sprintf("Interrupted %d times; the %s was given up", d.Resumes+1, operation))
+	}
+
+	// Everything the job needs is worked out up front, so a broken checkpoint fails here
+	var target string
+	var config map[string]interface{}
+	if operation == "upgrade" {
+		repo, tag, _, err := registry.Split(pending.Image)
+		if err != nil {
+			return abandon(store.StateFailed, "Interrupted, and the upgrade's image can't be read: "+err.Error())
+		}
+		target = repo + ":" + tag
+		event.Diff = map[string]store.Change{"image": {From: pending.PreviousImage, To: target}}
+	} else {
+		config, err = resolveConfig(secrets, &store.Deployment{Config: pending.Config, Secrets: pending.Secrets})
+		if err != nil {
+			return abandon(store.StateFailed, "Interrupted, and the update's credentials can't be read: "+err.Error())
+		}
+		event.Diff = configDiff(d.Config, pending.Config)
+	}
+
+	err = db.UpdateDeployment(d.ID, func(d *store.Deployment) error {
+		d.Resumes++
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if !checker.claim(d.ID) {
+		return fmt.Errorf("%s is already being changed", d.ID)
+	}
+	job := jobManager.Start(operation, d.ID, func(ctx context.Context, progress func(step, message string, percent float64)) (interface{}, error) {
+		defer checker.release(d.ID)
+		ctx = deploy.WithProgress(ctx, func(p deploy.Progress) {
+			progress(p.Step, p.Message, p.Percent)
+		})
+		var result *deploy.Result
+		var err error
+		if operation == "upgrade" {
+			result, err = runUpgrade(ctx, deployer, db, secrets, checker.registry, d, target, event)
+		} else {
+			result, err = runUpdate(ctx, deployer, db, secrets, d, config, pending.Config, pending.Secrets, added, event)
+		}
+		if err != nil {
+			return failureReport(err), err
+		}
+		return result, nil
+	})
+	log.Printf("Resuming the %s of %s as job %s", operation, d.ID, job.Info().ID)
+	return nil
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"example.com/m/v2/deploy"
+	"example.com/m/v2/store"
+)
+
+func TestRecoverDeployments(t *testing.T) {
+	tests := []struct {
+		name       string
+		resumes    int
+		live       *deploy.Status
+		destroyErr error
+		// wantResumed means the deployment was rolled back and deployed again.
+		wantResumed bool
+		wantDestroy bool
+		wantState   string
+		wantResumes int
+		wantOutcome string
+	}{
+		{
+			name:        "first interruption",
+			resumes:     0,
+			wantResumed: true,
+			wantDestroy: true,
+			wantState:   store.StateDeployed,
+			wantResumes: 1,
+			wantOutcome: store.OutcomeSuccess,
+		},
+		{
+			name:        "last resume allowed",
+			resumes:     maxResumes - 1,
+			wantResumed: true,
+			wantDestroy: true,
+			wantState:   store.StateDeployed,
+			wantResumes: maxResumes,
+			wantOutcome: store.OutcomeSuccess,
+		},
+		{
+			// Interrupted every time it was resumed, it's rolled back and given up on
+			name:        "resumed too often",
+			resumes:     maxResumes,
+			wantDestroy: true,
+			wantState:   store.StateFailed,
+			wantResumes: maxResumes,
+			wantOutcome: store.OutcomeFailure,
+		},
+		{
+			name:        "finished before the restart",
+			resumes:     maxResumes,
+			live:        &deploy.Status{DeploymentID: "joplin-server-1", State: "running", Image: "joplin/server:3.0"},
+			wantState:   store.StateDeployed,
+			wantResumes: maxResumes,
+			wantOutcome: store.OutcomeSuccess,
+		},
+		{
+			name:        "rollback fails",
+			destroyErr:  errors.New("daemon unreachable"),
+			wantDestroy: true,
+			wantState:   store.StateFailed,
+			wantOutcome: store.OutcomeFailure,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newConfigFixture(t)
+			err := f.db.UpdateDeployment("joplin-server-1", func(d *store.Deployment) error {
+				d.UserID, d.RequestID, d.Resumes = "user-1", "request-1", tt.resumes
+				d.Transition(store.StateDeploying, "Deploying")
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := f.db.ClaimDeployRequest(&store.DeployRequest{ID: "request-1", UserID: "user-1", AppID: "joplin-server", DeploymentID: "joplin-server-1"}); err != nil {
+				t.Fatal(err)
+			}
+			f.deployer.status = tt.live
+			f.deployer.destroyErr = tt.destroyErr
+
+			recoverDeployments(context.Background(), f.deployer, f.db, f.secrets, f.jobs, f.checker)
+
+			var wantDestroys, wantDeploys []string
+			if tt.wantDestroy {
+				wantDestroys = []string{"joplin-server-1"}
+			}
+			req, err := f.db.GetDeployRequest("user-1", "request-1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.wantResumed {
+				wantDeploys = []string{"joplin-server-1"}
+				job, ok := f.jobs.Get(req.JobID)
+				if !ok {
+					t.Fatalf("request does not point at the resumed job (job %q)", req.JobID)
+				}
+				_, events, _ := job.Subscribe()
+				for range events {
+				}
+			} else if req.JobID != "" {
+				t.Errorf("request points at job %s, but nothing was resumed", req.JobID)
+			}
+			if !reflect.DeepEqual(f.deployer.destroys, wantDestroys) {
+				t.Errorf("destroyed %v, want %v", f.deployer.destroys, wantDestroys)
+			}
+			if !reflect.DeepEqual(f.deployer.deploys, wantDeploys) {
+				t.Errorf("deployed %v, want %v", f.deployer.deploys, wantDeploys)
+			}
+
+			d, err := f.db.GetDeployment("joplin-server-1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if d.State != tt.wantState || d.Resumes != tt.wantResumes {
+				t.Errorf("record is %s after %d resumes (%v), want %s after %d", d.State, d.Resumes, d.History[len(d.History)-1].Message, tt.wantState, tt.wantResumes)
+			}
+			if event := lastAudit(t, f.db, auditDeployRecover); event.Outcome != tt.wantOutcome {
+				t.Errorf("audit outcome %s (%s), want %s", event.Outcome, event.Message, tt.wantOutcome)
+			}
+		})
+	}
+}
+
+func TestRecoverChange(t *testing.T) {
+	tests := []struct {
+		name       string
+		state      string
+		resumes    int
+		restoreErr error
+		// wantUpgrades and wantUpdates count the changes run again.
+		wantUpgrades int
+		wantUpdates  int
+		wantState    string
+		// wantImage is the image recorded afterwards, with HOST for the registry's.
+		wantImage   string
+		wantDomain  string
+		wantOutcome string
+	}{
+		{
+			// The new container never passed its health check, so the old one is back
+			name:        "upgrade part way through the swap",
+			state:       store.StateUpgrading,
+			wantState:   store.StateDeployed,
+			wantImage:   "HOST/joplin/server:3.0@" + oldDigest,
+			wantDomain:  "notes.example.com",
+			wantOutcome: store.OutcomeFailure,
+		},
+		{
+			name:         "upgrade before or after the swap",
+			state:        store.StateUpgrading,
+			restoreErr:   deploy.ErrNotFound,
+			wantUpgrades: 1,
+			wantState:    store.StateDeployed,
+			wantImage:    "HOST/joplin/server:3.1@" + newDigest,
+			wantDomain:   "notes.example.com",
+			wantOutcome:  store.OutcomeSuccess,
+		},
+		{
+			name:        "update part way through the swap",
+			state:       store.StateUpdating,
+			wantState:   store.StateDeployed,
+			wantImage:   "HOST/joplin/server:3.0@" + oldDigest,
+			wantDomain:  "notes.example.com",
+			wantOutcome: store.OutcomeFailure,
+		},
+		{
+			name:        "update before or after the swap",
+			state:       store.StateUpdating,
+			restoreErr:  deploy.ErrNotFound,
+			wantUpdates: 1,
+			wantState:   store.StateDeployed,
+			wantImage:   "joplin/server:3.0",
+			wantDomain:  "wiki.example.com",
+			wantOutcome: store.OutcomeSuccess,
+		},
+		{
+			name:        "resumed too often",
+			state:       store.StateUpgrading,
+			resumes:     maxResumes,
+			restoreErr:  deploy.ErrNotFound,
+			wantState:   store.StateFailed,
+			wantImage:   "HOST/joplin/server:3.0@" + oldDigest,
+			wantDomain:  "notes.example.com",
+			wantOutcome: store.OutcomeFailure,
+		},
+		{
+			name:        "restore fails",
+			state:       store.StateUpdating,
+			restoreErr:  errors.New("daemon unreachable"),
+			wantState:   store.StateFailed,
+			wantImage:   "HOST/joplin/server:3.0@" + oldDigest,
+			wantDomain:  "notes.example.com",
+			wantOutcome: store.OutcomeFailure,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newConfigFixture(t)
+			host := newTagRegistry(t, map[string]string{"3.1": newDigest})
+			newSecret, err := f.secrets.Store("joplin-server-1", "dbPassword", "New-passw0rd")
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = f.db.UpdateDeployment("joplin-server-1", func(d *store.Deployment) error {
+				d.Image, d.Resumes = host+"/joplin/server:3.0@"+oldDigest, tt.resumes
+				d.Pending = &store.PendingChange{PreviousImage: d.Image, Image: host + "/joplin/server:3.1@" + newDigest}
+				if tt.state == store.StateUpdating {
+					d.Pending = &store.PendingChange{
+						PreviousImage: d.Image,
+						Config:        map[string]interface{}{"domain": "wiki.example.com", "dbPassword": "[REDACTED]"},
+						Secrets:       map[string]string{"dbPassword": newSecret},
+					}
+				}
+				d.Transition(tt.state, "Changing")
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			f.deployer.restoreErr = tt.restoreErr
+
+			recoverDeployments(context.Background(), f.deployer, f.db, f.secrets, f.jobs, f.checker)
+			f.jobs.Shutdown(context.Background())
+
+			if !reflect.DeepEqual(f.deployer.restores, []string{"joplin-server-1"}) {
+				t.Errorf("restored %v, want the deployment once", f.deployer.restores)
+			}
+			if len(f.deployer.upgrades) != tt.wantUpgrades || len(f.deployer.updates) != tt.wantUpdates {
+				t.Errorf("ran %d upgrades and %d updates again, want %d and %d", len(f.deployer.upgrades), len(f.deployer.updates), tt.wantUpgrades, tt.wantUpdates)
+			}
+			if tt.wantUpdates > 0 && f.deployer.updates[0]["dbPassword"] != "New-passw0rd" {
+				t.Errorf("update ran again with %v, want the new credential", f.deployer.updates[0])
+			}
+
+			d, err := f.db.GetDeployment("joplin-server-1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if d.State != tt.wantState || d.Pending != nil {
+				t.Errorf("record is %s with pending %+v (%s), want %s with nothing pending", d.State, d.Pending, d.History[len(d.History)-1].Message, tt.wantState)
+			}
+			if want := strings.ReplaceAll(tt.wantImage, "HOST", host); d.Image != want {
+				t.Errorf("record runs %s, want %s", d.Image, want)
+			}
+			if d.Config["domain"] != tt.wantDomain {
+				t.Errorf("record has domain %v, want %s", d.Config["domain"], tt.wantDomain)
+			}
+			// The update's credential only stays if the update went through
+			_, err = f.secrets.Reveal(newSecret)
+			if kept := err == nil; kept != (tt.wantUpdates > 0 || tt.state == store.StateUpgrading) {
+				t.Errorf("update's credential kept %v: %v", kept, err)
+			}
+
+			action := auditDeployUpgrade
+			if tt.state == store.StateUpdating {
+				action = auditDeployUpdate
+			}
+			if event := lastAudit(t, f.db, action); event.Outcome != tt.wantOutcome {
+				t.Errorf("audit outcome %s (%s), want %s", event.Outcome, event.Message, tt.wantOutcome)
+			}
+		})
+	}
+}
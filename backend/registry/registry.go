@@ -0,0 +1,338 @@
+// Package registry reads image metadata from container registries through the
+// Registry HTTP API: which manifest a tag points to, and which tags a repository has.
+//
+// Only public images are supported. Registries that want a token, such as Docker
+// Hub and GHCR, are asked for an anonymous pull token.
+package registry
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/distribution/reference"
+)
+
+// ErrNotFound is returned when a registry has no such repository or tag.
+var ErrNotFound = errors.New("not found in registry")
+
+const (
+	// dockerHub is where images without a registry host are pulled from.
+	dockerHub = "registry-1.docker.io"
+	// maxTagPages bounds how many pages of tags are read from one repository.
+	maxTagPages = 20
+	// cacheTTL is how long a lookup is reused, so checking many deployments of one
+	// app doesn't ask the registry the same question many times.
+	cacheTTL = 10 * time.Minute
+)
+
+// manifestTypes are the manifest formats asked for, so multi-platform images are
+// answered with the digest of their index, which is what Docker records on pull.
+var manifestTypes = []string{
+	"application/vnd.oci.image.index.v1+json",
+	"application/vnd.docker.distribution.manifest.list.v2+json",
+	"application/vnd.oci.image.manifest.v1+json",
+	"application/vnd.docker.distribution.manifest.v2+json",
+}
+
+// Client talks to registries on behalf of the update checker.
+type Client struct {
+	http *http.Client
+
+	mu     sync.Mutex
+	cache  map[string]cached
+	tokens map[string]string
+}
+
+// cached is a remembered lookup.
+type cached struct {
+	value interface{}
+	err   error
+	at    time.Time
+}
+
+// New creates a registry client that makes its requests with httpClient.
+func New(httpClient *http.Client) *Client {
+	return &Client{http: httpClient, cache: map[string]cached{}, tokens: map[string]string{}}
+}
+
+// Split breaks an image reference into its repository, as Docker would print it,
+// its tag ("latest" if it has none) and its digest, if pinned to one.
+func Split(ref string) (repo, tag, digest string, err error) {
+	named, err := reference.ParseNormalizedNamed(ref)
+	if err != nil {
+		return "", "", "", fmt.Errorf("invalid image reference %q: %w", ref, err)
+	}
+	if digested, ok := named.(reference.Digested); ok {
+		digest = digested.Digest().String()
+	}
+	tag = "latest"
+	if tagged, ok := named.(reference.Tagged); ok {
+		tag = tagged.Tag()
+	}
+	return reference.FamiliarName(named), tag, digest, nil
+}
+
+// Digest returns the digest of the manifest an image's tag points to now.
+// A digest in ref is ignored; it's the tag that's looked up.
+func (c *Client) Digest(ctx context.Context, ref string) (string, error) {
+	host, repo, tag, err := locate(ref)
+	if err != nil {
+		return "", err
+	}
+	value, err := c.remember("digest "+host+"/"+repo+":"+tag, func() (interface{}, error) {
+		resp, err := c.get(ctx, http.MethodHead, host, repo, "/manifests/"+tag)
+		if err != nil {
+			return "", err
+		}
+		resp.Body.Close()
+		digest := resp.Header.Get("Docker-Content-Digest")
+		if digest == "" {
+			return "", fmt.Errorf("registry %s did not report a digest for %s:%s", host, repo, tag)
+		}
+		return digest, nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return value.(string), nil
+}
+
+// Tags lists the tags of an image's repository.
+func (c *Client) Tags(ctx context.Context, ref string) ([]string, error) {
+	host, repo, _, err := locate(ref)
+	if err != nil {
+		return nil, err
+	}
+	value, err := c.remember("tags "+host+"/"+repo, func() (interface{}, error) {
+		var tags []string
+		next := "/tags/list?n=1000"
+		for page := 0; next != "" && page < maxTagPages; page++ {
+			resp, err := c.get(ctx, http.MethodGet, host, repo, next)
+			if err != nil {
+				return nil, err
+			}
+			var body struct {
+				Tags []string `json:"tags"`
+			}
+			err = json.NewDecoder(resp.Body).Decode(&body)
+			resp.Body.Close()
+			if err != nil {
+				return nil, fmt.Errorf("failed to read tags of %s: %w", repo, err)
+			}
+			tags = append(tags, body.Tags...)
+			next = nextPage(resp.Header.Get("Link"), repo)
+		}
+		return tags, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return value.([]string), nil
+}
+
+// remember returns a recent answer to the same lookup, or makes it.
+func (c *Client) remember(key string, lookup func() (interface{}, error)) (interface{}, error) {
+	c.mu.Lock()
+	if hit, ok := c.cache[key]; ok && time.Since(hit.at) < cacheTTL {
+		c.mu.Unlock()
+		return hit.value, hit.err
+	}
+	c.mu.Unlock()
+
+	value, err := lookup()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for k, hit := range c.cache {
+		if time.Since(hit.at) >= cacheTTL {
+			delete(c.cache, k)
+		}
+	}
+	// A cancelled lookup says nothing about the registry, so it isn't remembered
+	if !errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded) {
+		c.cache[key] = cached{value: value, err: err, at: time.Now()}
+	}
+	return value, err
+}
+
+// get requests a path under a repository, fetching an anonymous token and trying
+// again if the registry asks for one. The caller closes the body of a 2xx response.
+func (c *Client) get(ctx context.Context, method, host, repo, path string) (*http.Response, error) {
+	target := scheme(host) + "://" + host + "/v2/" + repo + path
+	// Tokens last a few minutes, so one is reused until the registry turns it down
+	c.mu.Lock()
+	token := c.tokens[host+"/"+repo]
+	c.mu.Unlock()
+	resp, err := c.send(ctx, method, target, token)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusUnauthorized {
+		challenge := resp.Header.Get("WWW-Authenticate")
+		resp.Body.Close()
+		token, err := c.token(ctx, challenge, repo)
+		if err != nil {
+			return nil, fmt.Errorf("failed to authenticate with %s: %w", host, err)
+		}
+		c.mu.Lock()
+		c.tokens[host+"/"+repo] = token
+		c.mu.Unlock()
+		if resp, err = c.send(ctx, method, target, token); err != nil {
+			return nil, err
+		}
+	}
+
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		resp.Body.Close()
+		return nil, fmt.Errorf("%w: %s/%s", ErrNotFound, host, repo)
+	case resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden:
+		resp.Body.Close()
+		return nil, fmt.Errorf("registry %s refused access to %s; private images aren't supported", host, repo)
+	case resp.StatusCode >= 300:
+		resp.Body.Close()
+		return nil, fmt.Errorf("registry %s answered %s for %s", host, resp.Status, repo)
+	}
+	return resp, nil
+}
+
+// send makes one request to a registry.
+func (c *Client) send(ctx context.Context, method, target, token string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, target, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", strings.Join(manifestTypes, ", "))
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	return c.http.Do(req)
+}
+
+// token asks the realm named in a Bearer challenge for an anonymous pull token.
+func (c *Client) token(ctx context.Context, challenge, repo string) (string, error) {
+	authScheme, params := parseChallenge(challenge)
+	if !strings.EqualFold(authScheme, "bearer") || params["realm"] == "" {
+		return "", errors.New("registry requires credentials")
+	}
+
+	query := url.Values{}
+	if service := params["service"]; service != "" {
+		query.Set("service", service)
+	}
+	scope := params["scope"]
+	if scope == "" {
+		scope = "repository:" + repo + ":pull"
+	}
+	query.Set("scope", scope)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, params["realm"]+"?"+query.Encode(), nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("token service answered %s", resp.Status)
+	}
+
+	// Token services disagree on the field name
+	var body struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", fmt.Errorf("failed to read token: %w", err)
+	}
+	if body.Token != "" {
+		return body.Token, nil
+	}
+	if body.AccessToken != "" {
+		return body.AccessToken, nil
+	}
+	return "", errors.New("token service returned no token")
+}
+
+// locate finds the registry host, repository path and tag of an image reference.
+func locate(ref string) (host, repo, tag string, err error) {
+	named, err := reference.ParseNormalizedNamed(ref)
+	if err != nil {
+		return "", "", "", fmt.Errorf("invalid image reference %q: %w", ref, err)
+	}
+	tag = "latest"
+	if tagged, ok := named.(reference.Tagged); ok {
+		tag = tagged.Tag()
+	}
+	host = reference.Domain(named)
+	if host == "docker.io" {
+		host = dockerHub
+	}
+	return host, reference.Path(named), tag, nil
+}
+
+// scheme returns the protocol for a registry. Like Docker, only registries on the
+// loopback interface are spoken to over plain HTTP.
+func scheme(host string) string {
+	hostname := host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		hostname = h
+	}
+	if hostname == "localhost" {
+		return "http"
+	}
+	if ip := net.ParseIP(hostname); ip != nil && ip.IsLoopback() {
+		return "http"
+	}
+	return "https"
+}
+
+// parseChallenge splits a WWW-Authenticate header such as
+// Bearer realm="https://auth.docker.io/token",service="registry.docker.io".
+func parseChallenge(header string) (string, map[string]string) {
+	authScheme, rest, _ := strings.Cut(strings.TrimSpace(header), " ")
+	params := map[string]string{}
+	for rest != "" {
+		var key, value string
+		key, rest, _ = strings.Cut(strings.TrimLeft(rest, ", "), "=")
+		if strings.HasPrefix(rest, `"`) {
+			value, rest, _ = strings.Cut(rest[1:], `"`)
+		} else {
+			value, rest, _ = strings.Cut(rest, ",")
+		}
+		if key = strings.TrimSpace(key); key != "" {
+			params[strings.ToLower(key)] = value
+		}
+	}
+	return authScheme, params
+}
+
+// nextPage returns the path of the next page of tags from a Link header, relative
+// to the repository, or "" on the last page.
+func nextPage(link, repo string) string {
+	target, rest, ok := strings.Cut(link, ">")
+	if !ok || !strings.Contains(rest, `rel="next"`) {
+		return ""
+	}
+	u, err := url.Parse(strings.TrimPrefix(strings.TrimSpace(target), "<"))
+	if err != nil {
+		return ""
+	}
+	path := strings.TrimPrefix(u.Path, "/v2/"+repo)
+	if path == u.Path {
+		return ""
+	}
+	if u.RawQuery != "" {
+		path += "?" + u.RawQuery
+	}
+	return path
+}
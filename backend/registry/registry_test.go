@@ -0,0 +1,288 @@
+package registry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeRegistry serves one repository behind a token service, like Docker Hub does.
+type fakeRegistry struct {
+	srv  *httptest.Server
+	repo string
+	// digests maps the repository's tags to their manifest digests.
+	digests map[string]string
+	// tags is served a page of pageSize at a time.
+	tags     []string
+	pageSize int
+	// noDigest leaves Docker-Content-Digest out of manifest responses.
+	noDigest bool
+
+	mu       sync.Mutex
+	tokens   int
+	requests []string
+}
+
+func newFakeRegistry(t *testing.T, repo string) *fakeRegistry {
+	t.Helper()
+	r := &fakeRegistry{repo: repo, digests: map[string]string{}, pageSize: 1000}
+	r.srv = httptest.NewServer(http.HandlerFunc(r.serve))
+	t.Cleanup(r.srv.Close)
+	return r
+}
+
+// host is the registry's address, which image references start with.
+func (r *fakeRegistry) host() string {
+	return strings.TrimPrefix(r.srv.URL, "http://")
+}
+
+// ref is a reference to tag of the repository on this registry.
+func (r *fakeRegistry) ref(tag string) string {
+	return r.host() + "/" + r.repo + ":" + tag
+}
+
+func (r *fakeRegistry) serve(w http.ResponseWriter, req *http.Request) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.requests = append(r.requests, req.Method+" "+req.URL.RequestURI())
+
+	if req.URL.Path == "/token" {
+		if req.URL.Query().Get("scope") != "repository:"+r.repo+":pull" || req.URL.Query().Get("service") != "fake" {
+			http.Error(w, "bad scope", http.StatusBadRequest)
+			return
+		}
+		r.tokens++
+		fmt.Fprintf(w, `{"token": "token-%d"}`, r.tokens)
+		return
+	}
+	if req.Header.Get("Authorization") != "Bearer token-"+strconv.Itoa(r.tokens) {
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="%s/token",service="fake",scope="repository:%s:pull"`, r.srv.URL, r.repo))
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	prefix := "/v2/" + r.repo
+	switch path := strings.TrimPrefix(req.URL.Path, prefix); {
+	case path == req.URL.Path:
+		w.WriteHeader(http.StatusNotFound)
+	case strings.HasPrefix(path, "/manifests/"):
+		digest, ok := r.digests[strings.TrimPrefix(path, "/manifests/")]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if !r.noDigest {
+			w.Header().Set("Docker-Content-Digest", digest)
+		}
+	case path == "/tags/list":
+		start, _ := strconv.Atoi(req.URL.Query().Get("last"))
+		end := min(start+r.pageSize, len(r.tags))
+		if end < len(r.tags) {
+			w.Header().Set("Link", fmt.Sprintf(`<%s/tags/list?n=%d&last=%d>; rel="next"`, prefix, r.pageSize, end))
+		}
+		fmt.Fprintf(w, `{"name": %q, "tags": ["%s"]}`, r.repo, strings.Join(r.tags[start:end], `", "`))
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+// requestLog returns the requests answered so far as "METHOD /path?query".
+func (r *fakeRegistry) requestLog() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string(nil), r.requests...)
+}
+
+func TestDigest(t *testing.T) {
+	tests := []struct {
+		name         string
+		tag          string
+		noDigest     bool
+		want         string
+		wantNotFound bool
+		wantErr      bool
+	}{
+		{name: "tag", tag: "1.2", want: "sha256:aaa"},
+		{name: "unknown tag", tag: "9.9", wantNotFound: true},
+		{name: "no digest header", tag: "1.2", noDigest: true, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reg := newFakeRegistry(t, "library/notes")
+			reg.digests["1.2"] = "sha256:aaa"
+			reg.noDigest = tt.noDigest
+			c := New(http.DefaultClient)
+
+			got, err := c.Digest(context.Background(), reg.ref(tt.tag))
+			if errors.Is(err, ErrNotFound) != tt.wantNotFound {
+				t.Fatalf("Digest: %v, want ErrNotFound %v", err, tt.wantNotFound)
+			}
+			if (err != nil) != (tt.wantErr || tt.wantNotFound) {
+				t.Fatalf("Digest: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("Digest = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDigestAuthenticates(t *testing.T) {
+	reg := newFakeRegistry(t, "library/notes")
+	reg.digests["1.2"] = "sha256:aaa"
+	reg.digests["1.3"] = "sha256:bbb"
+	reg.digests["1.4"] = "sha256:ccc"
+	c := New(http.DefaultClient)
+	ctx := context.Background()
+
+	// A pinned digest in the reference is ignored; the tag is what's looked up
+	if digest, err := c.Digest(ctx, reg.ref("1.2")+"@sha256:0000000000000000000000000000000000000000000000000000000000000000"); err != nil || digest != "sha256:aaa" {
+		t.Fatalf("Digest = %q, %v", digest, err)
+	}
+	want := []string{
+		"HEAD /v2/library/notes/manifests/1.2",
+		"GET /token?scope=repository%3Alibrary%2Fnotes%3Apull&service=fake",
+		"HEAD /v2/library/notes/manifests/1.2",
+	}
+	if got := reg.requestLog(); !reflect.DeepEqual(got, want) {
+		t.Errorf("requests %q, want %q", got, want)
+	}
+
+	// The token is reused for the next lookup, and a repeated lookup is answered from the cache
+	if _, err := c.Digest(ctx, reg.ref("1.3")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Digest(ctx, reg.ref("1.2")); err != nil {
+		t.Fatal(err)
+	}
+	if got := reg.requestLog(); len(got) != 4 {
+		t.Errorf("%d requests after three lookups, want 4: %q", len(got), got)
+	}
+
+	// A token the registry no longer accepts is replaced
+	reg.mu.Lock()
+	reg.tokens++
+	reg.mu.Unlock()
+	if digest, err := c.Digest(ctx, reg.ref("1.4")); err != nil || digest != "sha256:ccc" {
+		t.Fatalf("Digest after the token expired = %q, %v", digest, err)
+	}
+}
+
+func TestTags(t *testing.T) {
+	reg := newFakeRegistry(t, "library/notes")
+	for i := 0; i < 7; i++ {
+		reg.tags = append(reg.tags, "1."+strconv.Itoa(i))
+	}
+	reg.pageSize = 3
+	c := New(http.DefaultClient)
+
+	tags, err := c.Tags(context.Background(), reg.ref("1.0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(tags, reg.tags) {
+		t.Errorf("Tags = %v, want %v", tags, reg.tags)
+	}
+	var pages []string
+	for _, req := range reg.requestLog() {
+		if strings.Contains(req, "/tags/list") {
+			pages = append(pages, req)
+		}
+	}
+	// The first page is asked for twice, before and after authenticating
+	want := []string{
+		"GET /v2/library/notes/tags/list?n=1000",
+		"GET /v2/library/notes/tags/list?n=1000",
+		"GET /v2/library/notes/tags/list?n=3&last=3",
+		"GET /v2/library/notes/tags/list?n=3&last=6",
+	}
+	if !reflect.DeepEqual(pages, want) {
+		t.Errorf("requested %q, want %q", pages, want)
+	}
+}
+
+func TestTagsUnknownRepository(t *testing.T) {
+	reg := newFakeRegistry(t, "library/notes")
+	_, err := New(http.DefaultClient).Tags(context.Background(), reg.host()+"/library/wiki:1")
+	if !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Tags of a repository the registry doesn't have = %v, want ErrNotFound", err)
+	}
+}
+
+func TestNextPage(t *testing.T) {
+	tests := []struct {
+		name string
+		link string
+		want string
+	}{
+		{name: "no link", link: "", want: ""},
+		{
+			name: "next page",
+			link: `</v2/library/notes/tags/list?n=100&last=1.9>; rel="next"`,
+			want: "/tags/list?n=100&last=1.9",
+		},
+		{
+			name: "absolute URL",
+			link: `<https://registry.example.com/v2/library/notes/tags/list?last=2.0>; rel="next"`,
+			want: "/tags/list?last=2.0",
+		},
+		{
+			name: "other relation",
+			link: `</v2/library/notes/tags/list?last=1.9>; rel="prev"`,
+			want: "",
+		},
+		{
+			// A link out of the repository isn't followed
+			name: "other repository",
+			link: `</v2/library/wiki/tags/list?last=1.9>; rel="next"`,
+			want: "",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := nextPage(tt.link, "library/notes"); got != tt.want {
+				t.Errorf("nextPage(%q) = %q, want %q", tt.link, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseChallenge(t *testing.T) {
+	scheme, params := parseChallenge(`Bearer realm="https://auth.docker.io/token",service="registry.docker.io",scope="repository:library/redis:pull"`)
+	want := map[string]string{
+		"realm":   "https://auth.docker.io/token",
+		"service": "registry.docker.io",
+		"scope":   "repository:library/redis:pull",
+	}
+	if scheme != "Bearer" || !reflect.DeepEqual(params, want) {
+		t.Errorf("parseChallenge = %q, %v", scheme, params)
+	}
+}
+
+func TestSplit(t *testing.T) {
+	tests := []struct {
+		ref                     string
+		wantRepo, wantTag, want string
+	}{
+		{ref: "redis", wantRepo: "redis", wantTag: "latest"},
+		{ref: "joplin/server:3.0", wantRepo: "joplin/server", wantTag: "3.0"},
+		{
+			ref:      "ghcr.io/immich-app/immich-server:v1.2@sha256:0000000000000000000000000000000000000000000000000000000000000000",
+			wantRepo: "ghcr.io/immich-app/immich-server", wantTag: "v1.2",
+			want: "sha256:0000000000000000000000000000000000000000000000000000000000000000",
+		},
+	}
+	for _, tt := range tests {
+		repo, tag, digest, err := Split(tt.ref)
+		if err != nil || repo != tt.wantRepo || tag != tt.wantTag || digest != tt.want {
+			t.Errorf("Split(%q) = %q, %q, %q, %v", tt.ref, repo, tag, digest, err)
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package registry
+
+import (
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// versionPattern reads tags such as 29, 1.2.3, v0.9.1 or 10.8.13-alpine.
+var versionPattern = regexp.MustCompile(`^(v?)(\d+(?:\.\d+)*)(-[0-9A-Za-z.-]+)?$`)
+
+// version is a tag read as a dotted version number.
+type version struct {
+	tag    string
+	prefix string
+	parts  []int
+	suffix string
+}
+
+// parseVersion reads a tag as a version, if it looks like one.
+func parseVersion(tag string) (version, bool) {
+	m := versionPattern.FindStringSubmatch(tag)
+	if m == nil {
+		return version{}, false
+	}
+	v := version{tag: tag, prefix: m[1], suffix: m[3]}
+	for _, part := range strings.Split(m[2], ".") {
+		n, err := strconv.Atoi(part)
+		if err != nil {
+			return version{}, false
+		}
+		v.parts = append(v.parts, n)
+	}
+	return v, true
+}
+
+// sameKind reports whether two versions can be compared: the same number of parts
+// and the same suffix, so 29 is only compared with other majors and 1.2-alpine
+// only with other alpine builds.
+func (v version) sameKind(other version) bool {
+	return v.prefix == other.prefix && v.suffix == other.suffix && len(v.parts) == len(other.parts)
+}
+
+// less reports whether v is an older version than other of the same kind.
+func (v version) less(other version) bool {
+	for i := range v.parts {
+		if v.parts[i] != other.parts[i] {
+			return v.parts[i] < other.parts[i]
+		}
+	}
+	return false
+}
+
+// NewerTags returns the tags in tags that are newer versions of the same kind as
+// current, newest first. A current tag that isn't a version, such as latest, has none.
+func NewerTags(current string, tags []string) []string {
+	base, ok := parseVersion(current)
+	if !ok {
+		return nil
+	}
+	var newer []version
+	for _, tag := range tags {
+		if v, ok := parseVersion(tag); ok && base.sameKind(v) && base.less(v) {
+			newer = append(newer, v)
+		}
+	}
+	sort.Slice(newer, func(i, j int) bool { return newer[j].less(newer[i]) })
+
+	result := make([]string, len(newer))
+	for i, v := range newer {
+		result[i] = v.tag
+	}
+	return result
+}
@@ -0,0 +1,60 @@
+package registry
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestNewerTags(t *testing.T) {
+	tests := []struct {
+		name    string
+		current string
+		tags    []string
+		want    []string
+	}{
+		{
+			name:    "newest first",
+			current: "1.2.3",
+			tags:    []string{"1.2.2", "1.10.0", "1.2.3", "1.2.10", "2.0.0", "1.3.0"},
+			want:    []string{"2.0.0", "1.10.0", "1.3.0", "1.2.10"},
+		},
+		{
+			name:    "same number of parts",
+			current: "29",
+			tags:    []string{"28", "30", "30.1", "31.0.0", "latest"},
+			want:    []string{"30"},
+		},
+		{
+			name:    "same suffix",
+			current: "10.8.13-alpine",
+			tags:    []string{"10.8.14", "10.8.14-alpine", "10.9.0-bookworm", "11.0.0-alpine", "10.8.12-alpine"},
+			want:    []string{"11.0.0-alpine", "10.8.14-alpine"},
+		},
+		{
+			name:    "same prefix",
+			current: "v1.2",
+			tags:    []string{"1.3", "v1.3", "v2.0"},
+			want:    []string{"v2.0", "v1.3"},
+		},
+		{
+			name:    "not a version",
+			current: "latest",
+			tags:    []string{"1.0", "2.0"},
+		},
+		{
+			name:    "already newest",
+			current: "3.0",
+			tags:    []string{"1.0", "2.0", "3.0", "nightly"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := NewerTags(tt.current, tt.tags)
+			if len(got) != 0 || len(tt.want) != 0 {
+				if !reflect.DeepEqual(got, tt.want) {
+					t.Errorf("NewerTags(%q) = %v, want %v", tt.current, got, tt.want)
+				}
+			}
+		})
+	}
+}
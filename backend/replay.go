@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"example.com/m/v2/logging"
+	"example.com/m/v2/store"
+)
+
+// maxRequestIDLength bounds the request IDs we are willing to store.
+const maxRequestIDLength = 128
+
+// replayPolicy controls how deploy requests are protected against replays.
+type replayPolicy struct {
+	// skew is how far a request's timestamp may be from the server clock, either way.
+	skew time.Duration
+	// retention is how long request IDs are remembered. It is never shorter than the
+	// skew window on both sides, so a request can't be replayed once its ID is forgotten.
+	retention time.Duration
+}
+
+// newReplayPolicy builds the policy from the replay_window and request_retention settings.
+func newReplayPolicy(skew, retention time.Duration) replayPolicy {
+	// Forgetting an ID while its timestamp is still accepted would let it be replayed
+	if retention < 2*skew {
+		retention = 2 * skew
+	}
+	return replayPolicy{skew: skew, retention: retention}
+}
+
+// checkRequest rejects deploy requests without a usable request ID or with a stale timestamp.
+// timestamp is in milliseconds since the epoch, as sent by the frontend's Date.now().
+func (p replayPolicy) checkRequest(requestID string, timestamp int64) error {
+	if requestID == "" {
+		return fmt.Errorf("request_id is required")
+	}
+	if len(requestID) > maxRequestIDLength {
+		return fmt.Errorf("request_id must be at most %d characters", maxRequestIDLength)
+	}
+	if timestamp == 0 {
+		return fmt.Errorf("timestamp is required")
+	}
+
+	skew := time.Since(time.UnixMilli(timestamp))
+	if skew > p.skew || skew < -p.skew {
+		return fmt.Errorf("timestamp is outside the allowed window of %s", p.skew)
+	}
+	return nil
+}
+
+// deployResponse builds the body returned when a deployment job is accepted.
+func deployResponse(appID, requestID, deploymentID, jobID string) map[string]interface{} {
+	response := map[string]interface{}{
+		"status":        "accepted",
+		"message":       fmt.Sprintf("Deployment of %s started", appID),
+		"request_id":    requestID,
+		"deployment_id": deploymentID,
+		"job_id":        jobID,
+	}
+	if jobID != "" {
+		response["events_url"] = "/api/jobs/" + jobID + "/events"
+	}
+	return response
+}
+
+// writeReplayedDeploy answers a resubmitted deploy request with the original result.
+// A request ID reused for a different app is a conflict rather than a resubmission.
+func writeReplayedDeploy(w http.ResponseWriter, prior *store.DeployRequest, appID string) {
+	if prior.AppID != appID {
+		http.Error(w, "request_id was already used for a different app", http.StatusConflict)
+		return
+	}
+
+	log.Printf("Request %s was already handled, returning deployment %s", prior.ID, prior.DeploymentID)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Idempotent-Replayed", "true")
+	w.WriteHeader(http.StatusAccepted)
+	if err := json.NewEncoder(w).Encode(deployResponse(prior.AppID, prior.ID, prior.DeploymentID, prior.JobID)); err != nil {
+		logging.Errorf("Error encoding deploy response: %v", err)
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"example.com/m/v2/catalog"
+	"example.com/m/v2/logging"
+	"example.com/m/v2/store"
+	"example.com/m/v2/vault"
+)
+
+// handleListSecrets is the HTTP handler for GET /api/secrets.
+// It only ever returns metadata; pass ?deployment_id= to list one deployment's secrets.
+func handleListSecrets(db *store.DB, secrets *vault.Vault) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		event := newAuditEvent(r, auditSecretsList)
+		event.DeploymentID = r.URL.Query().Get("deployment_id")
+
+		list, err := secrets.List(event.DeploymentID)
+		if err != nil {
+			recordAudit(db, event, store.OutcomeFailure, err.Error())
+			http.Error(w, "Failed to load secrets", http.StatusInternalServerError)
+			logging.Errorf("Error listing secrets: %v", err)
+			return
+		}
+		recordAudit(db, event, store.OutcomeSuccess, "")
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(map[string]interface{}{"secrets": list}); err != nil {
+			http.Error(w, "Failed to write response", http.StatusInternalServerError)
+			logging.Errorf("Error encoding secret list: %v", err)
+		}
+	}
+}
+
+// storeSecrets moves a deployment's sensitive configuration values into the vault.
+// It returns the secret IDs keyed by field, ready to be saved on the deployment record.
+func storeSecrets(secrets *vault.Vault, app *catalog.App, deploymentID string, config map[string]interface{}) (map[string]string, error) {
+	refs := make(map[string]string)
+	for field, value := range config {
+		plaintext, ok := value.(string)
+		if !ok || plaintext == "" || !(app.SensitiveField(field) || isSensitiveField(field)) {
+			continue
+		}
+		id, err := secrets.Store(deploymentID, field, plaintext)
+		if err != nil {
+			// Don't leave half a set of credentials behind
+			deleteSecrets(secrets, refs)
+			return nil, err
+		}
+		refs[field] = id
+	}
+	return refs, nil
+}
+
+// resolveConfig returns a deployment's configuration with its secrets filled back in,
+// for handing to a deployer.
+func resolveConfig(secrets *vault.Vault, d *store.Deployment) (map[string]interface{}, error) {
+	config := make(map[string]interface{}, len(d.Config))
+	for k, v := range d.Config {
+		config[k] = v
+	}
+	for field, id := range d.Secrets {
+		plaintext, err := secrets.Reveal(id)
+		if err != nil {
+			return nil, err
+		}
+		config[field] = plaintext
+	}
+	return config, nil
+}
+
+// deleteSecrets removes the given secrets, logging any that can't be removed.
+func deleteSecrets(secrets *vault.Vault, refs map[string]string) {
+	for field, id := range refs {
+		if err := secrets.Delete(id); err != nil {
+			logging.Errorf("Error deleting secret %s (%s): %v", id, field, err)
+		}
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"example.com/m/v2/deploy"
+	"example.com/m/v2/logging"
+	"example.com/m/v2/store"
+	"github.com/go-chi/chi/v5"
+)
+
+// defaultMetricsRange is how much history GET /api/deployments/{id}/metrics returns
+// unless ?since= asks for more or less.
+const defaultMetricsRange = time.Hour
+
+// collectStatsEvery samples the resource usage of every managed container each
+// interval until ctx is cancelled, and folds it into the stored history.
+func collectStatsEvery(ctx context.Context, source deploy.StatsSource, db *store.DB, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		// Docker spends a second or two measuring CPU, so don't let a slow daemon overlap readings
+		readCtx, cancel := context.WithTimeout(ctx, interval)
+		stats, err := source.CollectStats(readCtx)
+		cancel()
+		if err != nil && ctx.Err() == nil {
+			logging.Errorf("Error collecting container stats: %v", err)
+		}
+
+		samples := make([]store.MetricSample, 0, len(stats))
+		for _, s := range stats {
+			samples = append(samples, store.MetricSample{
+				DeploymentID:     s.DeploymentID,
+				Container:        s.Container,
+				Time:             s.Time,
+				CPUPercent:       s.CPUPercent,
+				MemoryBytes:      s.MemoryBytes,
+				MemoryLimitBytes: s.MemoryLimitBytes,
+				NetworkRxBytes:   s.NetworkRxBytes,
+				NetworkTxBytes:   s.NetworkTxBytes,
+				BlockReadBytes:   s.BlockReadBytes,
+				BlockWriteBytes:  s.BlockWriteBytes,
+			})
+		}
+		if len(samples) > 0 {
+			if err := db.RecordMetrics(samples); err != nil {
+				logging.Errorf("Error saving container stats: %v", err)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// handleDeploymentMetrics is the HTTP handler for GET /api/deployments/{id}/metrics.
+// It returns a deployment's CPU, memory, network and block I/O history, plus the
+// latest reading of each container for an at-a-glance health view.
+//
+// ?since= sets how far back to go, as an RFC 3339 time or a duration such as 24h
+// (default 1h). ?resolution= picks raw, 1m or 1h points; by default it is the finest
+// resolution still kept for the whole range.
+func handleDeploymentMetrics(source deploy.StatsSource, db *store.DB, interval time.Duration) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		deploymentID := chi.URLParam(r, "id")
+
+		if source == nil {
+			http.Error(w, "This deployment backend doesn't collect resource usage", http.StatusNotImplemented)
+			return
+		}
+
+		now := time.Now()
+		since := now.Add(-defaultMetricsRange)
+		if value := r.URL.Query().Get("since"); value != "" {
+			parsed, err := parseSince(value, now)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			since = parsed
+		}
+
+		resolution := store.MetricResolutions[len(store.MetricResolutions)-1]
+		if name := r.URL.Query().Get("resolution"); name != "" {
+			res, ok := store.MetricResolutionByName(name)
+			if !ok {
+				http.Error(w, fmt.Sprintf("Unknown resolution %q", name), http.StatusBadRequest)
+				return
+			}
+			resolution = res
+		} else {
+			for _, res := range store.MetricResolutions {
+				if now.Sub(since) <= res.Retention {
+					resolution = res
+					break
+				}
+			}
+		}
+
+		if _, err := db.GetDeployment(deploymentID); errors.Is(err, store.ErrNotFound) {
+			http.Error(w, "Deployment not found", http.StatusNotFound)
+			return
+		} else if err != nil {
+			http.Error(w, "Failed to load deployment", http.StatusInternalServerError)
+			logging.Errorf("Error loading deployment %s: %v", deploymentID, err)
+			return
+		}
+
+		points, err := db.ListMetrics(deploymentID, resolution.Name, since)
+		if err != nil {
+			http.Error(w, "Failed to load metrics", http.StatusInternalServerError)
+			logging.Errorf("Error loading metrics of %s: %v", deploymentID, err)
+			return
+		}
+
+		// A container with no reading in the last few intervals has stopped, so it has no latest
+		recent, err := db.ListMetrics(deploymentID, "raw", now.Add(-3*interval))
+		if err != nil {
+			http.Error(w, "Failed to load metrics", http.StatusInternalServerError)
+			logging.Errorf("Error loading metrics of %s: %v", deploymentID, err)
+			return
+		}
+		latest := map[string]*store.MetricPoint{}
+		for _, p := range recent {
+			latest[p.Container] = p
+		}
+
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"deployment_id": deploymentID,
+			"resolution":    resolution.Name,
+			"since":         since.UTC(),
+			"points":        points,
+			"latest":        latest,
+		})
+	}
+}
+
+// parseSince reads a starting point given as an RFC 3339 time or as a duration before now.
+func parseSince(value string, now time.Time) (time.Time, error) {
+	if since, err := time.Parse(time.RFC3339, value); err == nil {
+		return since, nil
+	}
+	if ago, err := time.ParseDuration(value); err == nil && ago > 0 {
+		return now.Add(-ago), nil
+	}
+	return time.Time{}, errors.New("since must be an RFC 3339 time or a duration such as 10m")
+}
@@ -0,0 +1,309 @@
+package store
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// Audit outcomes.
+const (
+	OutcomeSuccess = "success"
+	OutcomeFailure = "failure"
+	OutcomeDenied  = "denied"
+)
+
+var (
+	// ErrNoAuditKey is returned when the audit log is used before SetAuditKey.
+	ErrNoAuditKey = errors.New("audit key not set")
+	// ErrAuditBroken is returned when an audit log written before hashes were keyed
+	// can't be re-keyed because its chain is already broken.
+	ErrAuditBroken = errors.New("audit log hash chain is broken")
+)
+
+// auditKeyedKey is the meta key marking an audit log whose hashes are keyed.
+var auditKeyedKey = []byte("audit_keyed")
+
+// auditHeadKey is the meta key holding the sequence number and hash of the newest
+// audit event, so deleting events from the end of the log is also detectable.
+var auditHeadKey = []byte("audit_head")
+
+// AuditEvent is one entry in the append-only audit log.
+//
+// Each event carries the hash of the event before it, and its own hash covers
+// every other field, so editing, removing or reordering events breaks the chain.
+// Hashes are HMACs keyed with a server secret, so someone who can write to the
+// database still can't forge a chain that verifies.
+type AuditEvent struct {
+	Seq          uint64    `json:"seq"`
+	Time         time.Time `json:"time"`
+	Actor        string    `json:"actor"`
+	ActorID      string    `json:"actor_id,omitempty"`
+	SourceIP     string    `json:"source_ip,omitempty"`
+	Action       string    `json:"action"`
+	AppID        string    `json:"app_id,omitempty"`
+	DeploymentID string    `json:"deployment_id,omitempty"`
+	RequestID    string    `json:"request_id,omitempty"`
+	Target       string    `json:"target,omitempty"`
+	Outcome      string    `json:"outcome"`
+	Message      string    `json:"message,omitempty"`
+	// Diff holds the fields the action changed. Sensitive values are redacted before recording.
+	Diff     map[string]Change `json:"diff,omitempty"`
+	PrevHash string            `json:"prev_hash"`
+	Hash     string            `json:"hash"`
+}
+
+// Change is the before and after value of one field in an audit diff.
+type Change struct {
+	From interface{} `json:"from"`
+	To   interface{} `json:"to"`
+}
+
+// AuditFilter selects audit events. Zero fields match everything.
+type AuditFilter struct {
+	Since  time.Time
+	Until  time.Time
+	Actor  string
+	AppID  string
+	Action string
+	// Limit caps the number of events returned, newest first.
+	Limit int
+}
+
+// AuditVerification is the result of checking the audit log's hash chain.
+type AuditVerification struct {
+	Intact bool   `json:"intact"`
+	Events uint64 `json:"events"`
+	// BrokenAt is the sequence number of the first event that doesn't fit the chain.
+	BrokenAt uint64 `json:"broken_at,omitempty"`
+	Reason   string `json:"reason,omitempty"`
+}
+
+// AppendAudit adds an event to the end of the audit log, filling in its
+// sequence number, time and hashes.
+func (db *DB) AppendAudit(e *AuditEvent) error {
+	if db.auditKey == nil {
+		return ErrNoAuditKey
+	}
+	return db.bolt.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(auditBucket)
+		seq, err := b.NextSequence()
+		if err != nil {
+			return err
+		}
+
+		// Chain onto the newest event, found by key rather than the head record
+		// so a damaged head can't hide a gap.
+		prevHash := ""
+		if _, last := b.Cursor().Last(); last != nil {
+			var prev AuditEvent
+			if err := json.Unmarshal(last, &prev); err != nil {
+				return err
+			}
+			prevHash = prev.Hash
+		}
+
+		e.Seq = seq
+		e.Time = time.Now().UTC()
+		e.PrevHash = prevHash
+		if e.Hash, err = hashAuditEvent(db.auditKey, e); err != nil {
+			return err
+		}
+
+		data, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		if err := b.Put(auditKey(seq), data); err != nil {
+			return err
+		}
+		return tx.Bucket(metaBucket).Put(auditHeadKey, []byte(fmt.Sprintf("%d:%s", seq, e.Hash)))
+	})
+}
+
+// ListAudit returns the audit events matching filter, newest first.
+func (db *DB) ListAudit(filter AuditFilter) ([]*AuditEvent, error) {
+	events := []*AuditEvent{}
+	err := db.bolt.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(auditBucket).Cursor()
+		for k, v := c.Last(); k != nil; k, v = c.Prev() {
+			var e AuditEvent
+			if err := json.Unmarshal(v, &e); err != nil {
+				return err
+			}
+			// Events are in time order, so everything after this is too old.
+			if !filter.Since.IsZero() && e.Time.Before(filter.Since) {
+				break
+			}
+			if !filter.Until.IsZero() && e.Time.After(filter.Until) {
+				continue
+			}
+			if (filter.Actor != "" && e.Actor != filter.Actor) ||
+				(filter.AppID != "" && e.AppID != filter.AppID) ||
+				(filter.Action != "" && e.Action != filter.Action) {
+				continue
+			}
+			events = append(events, &e)
+			if filter.Limit > 0 && len(events) >= filter.Limit {
+				break
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return events, nil
+}
+
+// SetAuditKey sets the secret the audit log's hashes are keyed with. It must be
+// called before events are appended or verified.
+//
+// A log written before hashes were keyed is re-hashed with the key the first time,
+// provided its chain is intact; if it isn't, ErrAuditBroken is returned and the log
+// is left as it was, still set to fail verification.
+func (db *DB) SetAuditKey(key []byte) error {
+	db.auditKey = key
+	return db.bolt.Update(func(tx *bolt.Tx) error {
+		meta := tx.Bucket(metaBucket)
+		if meta.Get(auditKeyedKey) != nil {
+			return nil
+		}
+		check, err := verifyAuditChain(tx, nil)
+		if err != nil {
+			return err
+		}
+		if !check.Intact {
+			return fmt.Errorf("%w at event %d: %s", ErrAuditBroken, check.BrokenAt, check.Reason)
+		}
+
+		b := tx.Bucket(auditBucket)
+		var events []*AuditEvent
+		err = b.ForEach(func(_, v []byte) error {
+			var e AuditEvent
+			if err := json.Unmarshal(v, &e); err != nil {
+				return err
+			}
+			events = append(events, &e)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		prevHash := ""
+		for _, e := range events {
+			e.PrevHash = prevHash
+			if e.Hash, err = hashAuditEvent(key, e); err != nil {
+				return err
+			}
+			data, err := json.Marshal(e)
+			if err != nil {
+				return err
+			}
+			if err := b.Put(auditKey(e.Seq), data); err != nil {
+				return err
+			}
+			prevHash = e.Hash
+		}
+		if len(events) > 0 {
+			if err := meta.Put(auditHeadKey, []byte(fmt.Sprintf("%d:%s", len(events), prevHash))); err != nil {
+				return err
+			}
+		}
+		return meta.Put(auditKeyedKey, []byte("hmac-sha256"))
+	})
+}
+
+// VerifyAudit walks the whole audit log and checks every link in the hash chain.
+// It reads every event, so it's only run when asked for.
+func (db *DB) VerifyAudit() (*AuditVerification, error) {
+	if db.auditKey == nil {
+		return nil, ErrNoAuditKey
+	}
+	var result *AuditVerification
+	err := db.bolt.View(func(tx *bolt.Tx) error {
+		var err error
+		result, err = verifyAuditChain(tx, db.auditKey)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// verifyAuditChain checks the audit log in tx against hashes keyed with key.
+func verifyAuditChain(tx *bolt.Tx, key []byte) (*AuditVerification, error) {
+	result := &AuditVerification{Intact: true}
+	broken := func(seq uint64, reason string) (*AuditVerification, error) {
+		result.Intact = false
+		result.BrokenAt = seq
+		result.Reason = reason
+		return result, nil
+	}
+
+	var expectSeq uint64 = 1
+	prevHash := ""
+	c := tx.Bucket(auditBucket).Cursor()
+	for k, v := c.First(); k != nil; k, v = c.Next() {
+		var e AuditEvent
+		if err := json.Unmarshal(v, &e); err != nil {
+			return broken(expectSeq, "event is not valid JSON")
+		}
+		if binary.BigEndian.Uint64(k) != expectSeq || e.Seq != expectSeq {
+			return broken(expectSeq, "event is missing or out of order")
+		}
+		if e.PrevHash != prevHash {
+			return broken(e.Seq, "previous hash does not match the event before it")
+		}
+		hash, err := hashAuditEvent(key, &e)
+		if err != nil {
+			return nil, err
+		}
+		if !hmac.Equal([]byte(hash), []byte(e.Hash)) {
+			return broken(e.Seq, "event has been modified")
+		}
+		prevHash = e.Hash
+		result.Events = e.Seq
+		expectSeq++
+	}
+
+	// The head record catches events cut off the end of the log.
+	head := tx.Bucket(metaBucket).Get(auditHeadKey)
+	want := []byte(fmt.Sprintf("%d:%s", result.Events, prevHash))
+	if (head != nil || result.Events > 0) && !bytes.Equal(head, want) {
+		return broken(result.Events+1, "events have been removed from the end of the log")
+	}
+	return result, nil
+}
+
+// hashAuditEvent returns the HMAC of an event's contents, chained to its predecessor.
+// A nil key gives the plain SHA-256 hash logs were written with before hashes were keyed.
+func hashAuditEvent(key []byte, e *AuditEvent) (string, error) {
+	unhashed := *e
+	unhashed.Hash = ""
+	data, err := json.Marshal(&unhashed)
+	if err != nil {
+		return "", err
+	}
+	if key == nil {
+		sum := sha256.Sum256(data)
+		return hex.EncodeToString(sum[:]), nil
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write(data)
+	return hex.EncodeToString(mac.Sum(nil)), nil
+}
+
+// auditKey keys events by sequence number so they sort in the order they were written.
+func auditKey(seq uint64) []byte {
+	return binary.BigEndian.AppendUint64(nil, seq)
+}
@@ -0,0 +1,189 @@
+package store
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+func openTestDB(t *testing.T) *DB {
+	t.Helper()
+	db, err := Open(filepath.Join(t.TempDir(), "being.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+// rewrite replaces events in the log as someone with access to the database file
+// could, re-chaining the hashes from the first one changed with key.
+func rewrite(t *testing.T, db *DB, key []byte, change func(e *AuditEvent)) {
+	t.Helper()
+	err := db.bolt.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(auditBucket)
+		prevHash := ""
+		c := b.Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			var e AuditEvent
+			if err := json.Unmarshal(v, &e); err != nil {
+				return err
+			}
+			change(&e)
+			e.PrevHash = prevHash
+			var err error
+			if e.Hash, err = hashAuditEvent(key, &e); err != nil {
+				return err
+			}
+			data, _ := json.Marshal(&e)
+			if err := b.Put(k, data); err != nil {
+				return err
+			}
+			prevHash = e.Hash
+		}
+		return tx.Bucket(metaBucket).Put(auditHeadKey, []byte(fmt.Sprintf("%d:%s", b.Sequence(), prevHash)))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func appendEvents(t *testing.T, db *DB, n int) {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		if err := db.AppendAudit(&AuditEvent{Actor: "alice", Action: "deploy", Outcome: OutcomeSuccess}); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestVerifyAudit(t *testing.T) {
+	key := []byte("audit key")
+	tests := []struct {
+		name   string
+		tamper func(t *testing.T, db *DB)
+		// wantBrokenAt is 0 for an intact log.
+		wantBrokenAt uint64
+	}{
+		{name: "intact", tamper: func(t *testing.T, db *DB) {}},
+		{
+			name: "edited",
+			tamper: func(t *testing.T, db *DB) {
+				db.bolt.Update(func(tx *bolt.Tx) error {
+					b := tx.Bucket(auditBucket)
+					var e AuditEvent
+					json.Unmarshal(b.Get(auditKey(2)), &e)
+					e.Actor = "mallory"
+					data, _ := json.Marshal(&e)
+					return b.Put(auditKey(2), data)
+				})
+			},
+			wantBrokenAt: 2,
+		},
+		{
+			// Without the key, a forger can only re-chain with a key of their own
+			name: "re-chained with another key",
+			tamper: func(t *testing.T, db *DB) {
+				rewrite(t, db, []byte("forged"), func(e *AuditEvent) {
+					if e.Seq == 2 {
+						e.Actor = "mallory"
+					}
+				})
+			},
+			wantBrokenAt: 1,
+		},
+		{
+			name: "re-chained without a key",
+			tamper: func(t *testing.T, db *DB) {
+				rewrite(t, db, nil, func(e *AuditEvent) {})
+			},
+			wantBrokenAt: 1,
+		},
+		{
+			name: "truncated",
+			tamper: func(t *testing.T, db *DB) {
+				db.bolt.Update(func(tx *bolt.Tx) error {
+					return tx.Bucket(auditBucket).Delete(auditKey(3))
+				})
+			},
+			wantBrokenAt: 3,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := openTestDB(t)
+			if err := db.SetAuditKey(key); err != nil {
+				t.Fatal(err)
+			}
+			appendEvents(t, db, 3)
+			tt.tamper(t, db)
+
+			result, err := db.VerifyAudit()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result.Intact != (tt.wantBrokenAt == 0) || result.BrokenAt != tt.wantBrokenAt {
+				t.Errorf("VerifyAudit = %+v, want broken at %d", result, tt.wantBrokenAt)
+			}
+		})
+	}
+}
+
+func TestSetAuditKeyRekeysOldLog(t *testing.T) {
+	db := openTestDB(t)
+	db.auditKey = []byte("setup")
+	appendEvents(t, db, 3)
+	// Make it look like a log written before hashes were keyed
+	rewrite(t, db, nil, func(e *AuditEvent) {})
+	db.bolt.Update(func(tx *bolt.Tx) error { return tx.Bucket(metaBucket).Delete(auditKeyedKey) })
+
+	if err := db.SetAuditKey([]byte("audit key")); err != nil {
+		t.Fatal(err)
+	}
+	result, err := db.VerifyAudit()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.Intact || result.Events != 3 {
+		t.Errorf("VerifyAudit after re-keying = %+v, want 3 intact events", result)
+	}
+	// It's only done once; a log that's already keyed isn't re-keyed with another key
+	if err := db.SetAuditKey([]byte("another key")); err != nil {
+		t.Fatal(err)
+	}
+	if result, _ := db.VerifyAudit(); result.Intact {
+		t.Error("log verifies under a different key")
+	}
+}
+
+func TestSetAuditKeyKeepsBrokenLog(t *testing.T) {
+	db := openTestDB(t)
+	db.auditKey = []byte("setup")
+	appendEvents(t, db, 3)
+	rewrite(t, db, nil, func(e *AuditEvent) {})
+	db.bolt.Update(func(tx *bolt.Tx) error {
+		tx.Bucket(metaBucket).Delete(auditKeyedKey)
+		return tx.Bucket(auditBucket).Delete(auditKey(2))
+	})
+
+	if err := db.SetAuditKey([]byte("audit key")); !errors.Is(err, ErrAuditBroken) {
+		t.Fatalf("SetAuditKey = %v, want ErrAuditBroken", err)
+	}
+	if result, _ := db.VerifyAudit(); result.Intact {
+		t.Error("a broken log verifies after SetAuditKey")
+	}
+}
+
+func TestAuditNeedsKey(t *testing.T) {
+	db := openTestDB(t)
+	if err := db.AppendAudit(&AuditEvent{Action: "deploy"}); !errors.Is(err, ErrNoAuditKey) {
+		t.Errorf("AppendAudit without a key = %v, want ErrNoAuditKey", err)
+	}
+	if _, err := db.VerifyAudit(); !errors.Is(err, ErrNoAuditKey) {
+		t.Errorf("VerifyAudit without a key = %v, want ErrNoAuditKey", err)
+	}
+}
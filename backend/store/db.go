@@ -0,0 +1,181 @@
+// Package store persists the backend's state in an embedded bbolt database.
+package store
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// ErrNotFound is returned when a record doesn't exist.
+var ErrNotFound = errors.New("not found")
+
+var (
+	metaBucket       = []byte("meta")
+	schemaVersionKey = []byte("schema_version")
+	deploymentBucket = []byte("deployments")
+	requestBucket    = []byte("requests")
+	secretBucket     = []byte("secrets")
+	userBucket       = []byte("users")
+	usernameBucket   = []byte("usernames")
+	sessionBucket    = []byte("sessions")
+	tokenBucket      = []byte("tokens")
+	auditBucket      = []byte("audit")
+	metricsBucket    = []byte("metrics")
+)
+
+// migrations upgrade the schema one version at a time.
+// Never edit or reorder an existing entry; append a new one instead.
+var migrations = []func(tx *bolt.Tx) error{
+	// 1: deployments keyed by deployment ID.
+	func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(deploymentBucket)
+		return err
+	},
+	// 2: deploy requests, for replay protection and idempotency. They're keyed by
+	// "<user ID>/<request ID>" (see requestKey), since clients pick request IDs;
+	// entries from before that carry the bare request ID and age out with retention.
+	func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(requestBucket)
+		return err
+	},
+	// 3: encrypted secrets keyed by secret ID.
+	func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(secretBucket)
+		return err
+	},
+	// 4: users keyed by user ID, an index from username to user ID, and login sessions.
+	func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{userBucket, usernameBucket, sessionBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	},
+	// 5: user roles. Everyone who could log in before roles existed had full access.
+	func(tx *bolt.Tx) error {
+		b := tx.Bucket(userBucket)
+		return b.ForEach(func(k, v []byte) error {
+			var u User
+			if err := json.Unmarshal(v, &u); err != nil {
+				return err
+			}
+			if u.Role == "" {
+				u.Role = "admin"
+			}
+			return putJSON(b, string(k), &u)
+		})
+	},
+	// 6: API tokens keyed by the hash of the token.
+	func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(tokenBucket)
+		return err
+	},
+	// 7: the audit log, keyed by sequence number.
+	func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(auditBucket)
+		return err
+	},
+	// 8: container resource usage history, a bucket per deployment holding a bucket per resolution.
+	func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(metricsBucket)
+		return err
+	},
+}
+
+// DB is the backend's persistent store.
+type DB struct {
+	bolt *bolt.DB
+	// auditKey keys the audit log's hashes; see SetAuditKey.
+	auditKey []byte
+}
+
+// Open opens (or creates) the database at path and brings its schema up to date.
+func Open(path string) (*DB, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, fmt.Errorf("failed to create data directory: %w", err)
+	}
+
+	// The timeout stops a second backend instance from hanging on the file lock forever.
+	bdb, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open database %s: %w", path, err)
+	}
+
+	db := &DB{bolt: bdb}
+	if err := db.migrate(); err != nil {
+		bdb.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+// Close releases the database file.
+func (db *DB) Close() error {
+	return db.bolt.Close()
+}
+
+// GetMeta returns a value from the meta bucket, or nil if it isn't set.
+func (db *DB) GetMeta(key string) ([]byte, error) {
+	var value []byte
+	err := db.bolt.View(func(tx *bolt.Tx) error {
+		// Values are only valid inside the transaction, so copy it out.
+		value = append([]byte(nil), tx.Bucket(metaBucket).Get([]byte(key))...)
+		return nil
+	})
+	if len(value) == 0 {
+		return nil, err
+	}
+	return value, err
+}
+
+// PutMeta stores a value in the meta bucket.
+func (db *DB) PutMeta(key string, value []byte) error {
+	return db.bolt.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(metaBucket).Put([]byte(key), value)
+	})
+}
+
+// migrate applies every migration newer than the stored schema version.
+// Each migration runs in its own transaction together with the version bump.
+func (db *DB) migrate() error {
+	for {
+		done := false
+		err := db.bolt.Update(func(tx *bolt.Tx) error {
+			meta, err := tx.CreateBucketIfNotExists(metaBucket)
+			if err != nil {
+				return err
+			}
+
+			version := 0
+			if raw := meta.Get(schemaVersionKey); raw != nil {
+				version = int(binary.BigEndian.Uint64(raw))
+			}
+			if version > len(migrations) {
+				return fmt.Errorf("database schema version %d is newer than this build supports (%d)", version, len(migrations))
+			}
+			if version == len(migrations) {
+				done = true
+				return nil
+			}
+
+			if err := migrations[version](tx); err != nil {
+				return fmt.Errorf("migration %d failed: %w", version+1, err)
+			}
+			return meta.Put(schemaVersionKey, binary.BigEndian.AppendUint64(nil, uint64(version+1)))
+		})
+		if err != nil {
+			return err
+		}
+		if done {
+			return nil
+		}
+	}
+}
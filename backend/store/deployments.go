@@ -0,0 +1,166 @@
+package store
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// Deployment lifecycle states.
+const (
+	StateDeploying = "deploying"
+	StateDeployed  = "deployed"
+	StateFailed    = "failed"
+	StateDestroyed = "destroyed"
+	// StateUpgrading and StateUpdating mark a deployed app whose containers are being
+	// replaced, for another image or a new configuration.
+	StateUpgrading = "upgrading"
+	StateUpdating  = "updating"
+)
+
+// Deployment is the persisted record of one deployed app.
+type Deployment struct {
+	ID        string `json:"id"`
+	AppID     string `json:"app_id"`
+	RequestID string `json:"request_id"`
+	// UserID is the user who requested the deployment; request IDs are scoped to them.
+	UserID string `json:"user_id,omitempty"`
+	// Config is the user's configuration with sensitive fields redacted.
+	Config map[string]interface{} `json:"config"`
+	// Secrets maps sensitive configuration fields to the IDs of their encrypted values.
+	Secrets     map[string]string `json:"secrets,omitempty"`
+	ContainerID string            `json:"container_id,omitempty"`
+	Release     string            `json:"release,omitempty"`
+	Image       string            `json:"image,omitempty"`
+	State       string            `json:"state"`
+	// Resumes counts how often an interrupted deployment, upgrade or update has been
+	// restarted on startup.
+	Resumes int `json:"resumes,omitempty"`
+	// Pending is the upgrade or update in progress, saved before the deployer starts
+	// on it so one cut off by a restart can be finished or undone.
+	Pending   *PendingChange `json:"pending,omitempty"`
+	History   []Transition   `json:"history"`
+	CreatedAt time.Time      `json:"created_at"`
+	UpdatedAt time.Time      `json:"updated_at"`
+}
+
+// PendingChange is a checkpoint of an upgrade or configuration update.
+type PendingChange struct {
+	// PreviousImage is what the deployment ran before the change.
+	PreviousImage string `json:"previous_image,omitempty"`
+	// Image is what an upgrade moves to.
+	Image string `json:"image,omitempty"`
+	// Config and Secrets replace the deployment's own once an update succeeds.
+	Config  map[string]interface{} `json:"config,omitempty"`
+	Secrets map[string]string      `json:"secrets,omitempty"`
+}
+
+// Transition records a deployment entering a state.
+type Transition struct {
+	State   string    `json:"state"`
+	Message string    `json:"message,omitempty"`
+	At      time.Time `json:"at"`
+}
+
+// CreateDeployment saves a new deployment record in its initial state.
+func (db *DB) CreateDeployment(d *Deployment) error {
+	now := time.Now().UTC()
+	d.CreatedAt = now
+	d.UpdatedAt = now
+	d.History = append(d.History, Transition{State: d.State, At: now})
+
+	return db.bolt.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(deploymentBucket)
+		if b.Get([]byte(d.ID)) != nil {
+			return fmt.Errorf("deployment %s already exists", d.ID)
+		}
+		return putJSON(b, d.ID, d)
+	})
+}
+
+// GetDeployment loads a deployment by ID.
+func (db *DB) GetDeployment(id string) (*Deployment, error) {
+	var d Deployment
+	err := db.bolt.View(func(tx *bolt.Tx) error {
+		return getJSON(tx.Bucket(deploymentBucket), id, &d)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &d, nil
+}
+
+// ListDeployments returns every deployment, oldest first.
+func (db *DB) ListDeployments() ([]*Deployment, error) {
+	var deployments []*Deployment
+	err := db.bolt.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(deploymentBucket).ForEach(func(_, v []byte) error {
+			var d Deployment
+			if err := json.Unmarshal(v, &d); err != nil {
+				return err
+			}
+			deployments = append(deployments, &d)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(deployments, func(i, j int) bool {
+		return deployments[i].CreatedAt.Before(deployments[j].CreatedAt)
+	})
+	return deployments, nil
+}
+
+// UpdateDeployment applies fn to a deployment and saves the result atomically.
+func (db *DB) UpdateDeployment(id string, fn func(d *Deployment) error) error {
+	return db.bolt.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(deploymentBucket)
+		var d Deployment
+		if err := getJSON(b, id, &d); err != nil {
+			return err
+		}
+		if err := fn(&d); err != nil {
+			return err
+		}
+		d.UpdatedAt = time.Now().UTC()
+		return putJSON(b, id, &d)
+	})
+}
+
+// SetDeploymentState moves a deployment to a new state and records the transition.
+func (db *DB) SetDeploymentState(id, state, message string) error {
+	return db.UpdateDeployment(id, func(d *Deployment) error {
+		d.Transition(state, message)
+		return nil
+	})
+}
+
+// Transition moves the deployment to a new state and appends it to the history.
+// Use it inside UpdateDeployment when other fields change at the same time.
+func (d *Deployment) Transition(state, message string) {
+	d.State = state
+	d.History = append(d.History, Transition{State: state, Message: message, At: time.Now().UTC()})
+}
+
+// putJSON stores v under key as JSON.
+func putJSON(b *bolt.Bucket, key string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return b.Put([]byte(key), data)
+}
+
+// getJSON loads the JSON stored under key into v.
+func getJSON(b *bolt.Bucket, key string, v interface{}) error {
+	data := b.Get([]byte(key))
+	if data == nil {
+		return fmt.Errorf("%w: %s", ErrNotFound, key)
+	}
+	return json.Unmarshal(data, v)
+}
@@ -0,0 +1,204 @@
+package store
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// MetricResolution is one tier of the resource usage history. Every reading is
+// folded into each tier's point for the step it falls in, and a tier's points are
+// dropped once they're older than its retention.
+type MetricResolution struct {
+	Name      string
+	Step      time.Duration
+	Retention time.Duration
+}
+
+// MetricResolutions are the history tiers, finest first. The raw tier keeps every
+// reading as it was collected.
+var MetricResolutions = []MetricResolution{
+	{Name: "raw", Step: 0, Retention: time.Hour},
+	{Name: "1m", Step: time.Minute, Retention: 24 * time.Hour},
+	{Name: "1h", Step: time.Hour, Retention: 30 * 24 * time.Hour},
+}
+
+// MetricResolutionByName returns the tier with the given name.
+func MetricResolutionByName(name string) (MetricResolution, bool) {
+	for _, res := range MetricResolutions {
+		if res.Name == name {
+			return res, true
+		}
+	}
+	return MetricResolution{}, false
+}
+
+// MetricSample is one reading of a container's resource usage.
+// Network and block I/O are running totals since the container started.
+type MetricSample struct {
+	DeploymentID     string
+	Container        string
+	Time             time.Time
+	CPUPercent       float64
+	MemoryBytes      uint64
+	MemoryLimitBytes uint64
+	NetworkRxBytes   uint64
+	NetworkTxBytes   uint64
+	BlockReadBytes   uint64
+	BlockWriteBytes  uint64
+}
+
+// MetricPoint summarises the readings of one container over one step of a tier:
+// CPU and memory are averaged with their peak kept, totals are the latest seen.
+type MetricPoint struct {
+	Time             time.Time `json:"time"`
+	Container        string    `json:"container"`
+	Samples          int       `json:"samples"`
+	CPUPercent       float64   `json:"cpu_percent"`
+	CPUPercentMax    float64   `json:"cpu_percent_max"`
+	MemoryBytes      uint64    `json:"memory_bytes"`
+	MemoryBytesMax   uint64    `json:"memory_bytes_max"`
+	MemoryLimitBytes uint64    `json:"memory_limit_bytes"`
+	NetworkRxBytes   uint64    `json:"network_rx_bytes"`
+	NetworkTxBytes   uint64    `json:"network_tx_bytes"`
+	BlockReadBytes   uint64    `json:"block_read_bytes"`
+	BlockWriteBytes  uint64    `json:"block_write_bytes"`
+}
+
+// add folds a reading into the point.
+func (p *MetricPoint) add(s MetricSample) {
+	p.Samples++
+	n := float64(p.Samples)
+	p.CPUPercent += (s.CPUPercent - p.CPUPercent) / n
+	p.MemoryBytes = uint64(float64(p.MemoryBytes) + (float64(s.MemoryBytes)-float64(p.MemoryBytes))/n)
+	p.CPUPercentMax = max(p.CPUPercentMax, s.CPUPercent)
+	p.MemoryBytesMax = max(p.MemoryBytesMax, s.MemoryBytes)
+	p.MemoryLimitBytes = s.MemoryLimitBytes
+	p.NetworkRxBytes = s.NetworkRxBytes
+	p.NetworkTxBytes = s.NetworkTxBytes
+	p.BlockReadBytes = s.BlockReadBytes
+	p.BlockWriteBytes = s.BlockWriteBytes
+}
+
+// RecordMetrics folds readings into every tier of their deployments' history.
+func (db *DB) RecordMetrics(samples []MetricSample) error {
+	return db.bolt.Update(func(tx *bolt.Tx) error {
+		root := tx.Bucket(metricsBucket)
+		for _, s := range samples {
+			deployment, err := root.CreateBucketIfNotExists([]byte(s.DeploymentID))
+			if err != nil {
+				return err
+			}
+			for _, res := range MetricResolutions {
+				tier, err := deployment.CreateBucketIfNotExists([]byte(res.Name))
+				if err != nil {
+					return err
+				}
+				start := s.Time.UTC()
+				if res.Step > 0 {
+					start = start.Truncate(res.Step)
+				}
+				key := metricKey(start, s.Container)
+
+				point := MetricPoint{Time: start, Container: s.Container}
+				if v := tier.Get(key); v != nil {
+					if err := json.Unmarshal(v, &point); err != nil {
+						return err
+					}
+				}
+				point.add(s)
+				data, err := json.Marshal(&point)
+				if err != nil {
+					return err
+				}
+				if err := tier.Put(key, data); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// ListMetrics returns a deployment's history at one resolution from since onwards, oldest first.
+func (db *DB) ListMetrics(deploymentID, resolution string, since time.Time) ([]*MetricPoint, error) {
+	points := []*MetricPoint{}
+	err := db.bolt.View(func(tx *bolt.Tx) error {
+		deployment := tx.Bucket(metricsBucket).Bucket([]byte(deploymentID))
+		if deployment == nil {
+			return nil
+		}
+		tier := deployment.Bucket([]byte(resolution))
+		if tier == nil {
+			return nil
+		}
+		c := tier.Cursor()
+		for k, v := c.Seek(metricKey(since.UTC(), "")); k != nil; k, v = c.Next() {
+			var p MetricPoint
+			if err := json.Unmarshal(v, &p); err != nil {
+				return err
+			}
+			points = append(points, &p)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return points, nil
+}
+
+// PruneMetrics drops the points each tier no longer keeps, and the history of
+// deployments with nothing left, returning how many points were removed.
+func (db *DB) PruneMetrics(now time.Time) (int, error) {
+	removed := 0
+	err := db.bolt.Update(func(tx *bolt.Tx) error {
+		root := tx.Bucket(metricsBucket)
+		var empty [][]byte
+		err := root.ForEachBucket(func(id []byte) error {
+			deployment := root.Bucket(id)
+			left := 0
+			for _, res := range MetricResolutions {
+				tier := deployment.Bucket([]byte(res.Name))
+				if tier == nil {
+					continue
+				}
+				// Keys start with the time, so expired points are all at the front
+				cutoff := metricKey(now.Add(-res.Retention).UTC(), "")
+				c := tier.Cursor()
+				for k, _ := c.First(); k != nil && string(k) < string(cutoff); k, _ = c.First() {
+					if err := c.Delete(); err != nil {
+						return err
+					}
+					removed++
+				}
+				if k, _ := c.First(); k != nil {
+					left++
+				}
+			}
+			if left == 0 {
+				empty = append(empty, append([]byte(nil), id...))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, id := range empty {
+			if err := root.DeleteBucket(id); err != nil {
+				return fmt.Errorf("failed to remove metrics of %s: %w", id, err)
+			}
+		}
+		return nil
+	})
+	return removed, err
+}
+
+// metricKey orders points by time, then container.
+func metricKey(t time.Time, container string) []byte {
+	seconds := max(t.Unix(), 0) // The zero time sorts first rather than wrapping around
+	return append(binary.BigEndian.AppendUint64(nil, uint64(seconds)), container...)
+}
@@ -0,0 +1,113 @@
+package store
+
+import (
+	"encoding/json"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// DeployRequest records a deploy request ID and the deployment it started,
+// so a resubmitted request can be answered without deploying twice.
+// Request IDs are chosen by clients, so they are only unique per user: one user
+// reusing another's ID neither collides with it nor gets its deployment back.
+type DeployRequest struct {
+	ID           string    `json:"id"`
+	UserID       string    `json:"user_id,omitempty"`
+	AppID        string    `json:"app_id"`
+	DeploymentID string    `json:"deployment_id"`
+	JobID        string    `json:"job_id,omitempty"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+// requestKey is the key a user's deploy request is stored under.
+func requestKey(userID, id string) string {
+	return userID + "/" + id
+}
+
+// GetDeployRequest loads a deploy request by the user who sent it and its request ID.
+func (db *DB) GetDeployRequest(userID, id string) (*DeployRequest, error) {
+	var req DeployRequest
+	err := db.bolt.View(func(tx *bolt.Tx) error {
+		return getJSON(tx.Bucket(requestBucket), requestKey(userID, id), &req)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &req, nil
+}
+
+// ClaimDeployRequest records req unless its user has sent its request ID before.
+// It returns the earlier request when there is one, in which case nothing is written;
+// checking and claiming in one transaction stops two concurrent duplicates both winning.
+func (db *DB) ClaimDeployRequest(req *DeployRequest) (*DeployRequest, error) {
+	req.CreatedAt = time.Now().UTC()
+
+	var existing *DeployRequest
+	err := db.bolt.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(requestBucket)
+		key := requestKey(req.UserID, req.ID)
+		if data := b.Get([]byte(key)); data != nil {
+			existing = &DeployRequest{}
+			return json.Unmarshal(data, existing)
+		}
+		return putJSON(b, key, req)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return existing, nil
+}
+
+// SetDeployRequestJob records the job started for a claimed request.
+func (db *DB) SetDeployRequestJob(userID, id, jobID string) error {
+	return db.bolt.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(requestBucket)
+		key := requestKey(userID, id)
+		var req DeployRequest
+		if err := getJSON(b, key, &req); err != nil {
+			return err
+		}
+		req.JobID = jobID
+		return putJSON(b, key, &req)
+	})
+}
+
+// ReleaseDeployRequest forgets a claimed request, so it can be retried after a failure
+// that happened before anything was deployed.
+func (db *DB) ReleaseDeployRequest(userID, id string) error {
+	return db.bolt.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(requestBucket).Delete([]byte(requestKey(userID, id)))
+	})
+}
+
+// PruneDeployRequests deletes requests recorded before cutoff and returns how many were removed.
+func (db *DB) PruneDeployRequests(cutoff time.Time) (int, error) {
+	removed := 0
+	err := db.bolt.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(requestBucket)
+		var expired [][]byte
+		err := b.ForEach(func(k, v []byte) error {
+			var req DeployRequest
+			if err := json.Unmarshal(v, &req); err != nil {
+				return err
+			}
+			if req.CreatedAt.Before(cutoff) {
+				// Keys can't be deleted while iterating, so collect them first.
+				expired = append(expired, append([]byte(nil), k...))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, k := range expired {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+		}
+		removed = len(expired)
+		return nil
+	})
+	return removed, err
+}
@@ -0,0 +1,75 @@
+package store
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// Secret is an encrypted credential belonging to a deployment.
+// The store only ever sees ciphertext; encryption is the vault's job.
+type Secret struct {
+	ID           string    `json:"id"`
+	DeploymentID string    `json:"deployment_id"`
+	Field        string    `json:"field"`
+	Nonce        []byte    `json:"nonce"`
+	Ciphertext   []byte    `json:"ciphertext"`
+	CreatedAt    time.Time `json:"created_at"`
+	UpdatedAt    time.Time `json:"updated_at"`
+}
+
+// PutSecret creates or replaces a secret.
+func (db *DB) PutSecret(s *Secret) error {
+	now := time.Now().UTC()
+	if s.CreatedAt.IsZero() {
+		s.CreatedAt = now
+	}
+	s.UpdatedAt = now
+
+	return db.bolt.Update(func(tx *bolt.Tx) error {
+		return putJSON(tx.Bucket(secretBucket), s.ID, s)
+	})
+}
+
+// GetSecret loads a secret by ID.
+func (db *DB) GetSecret(id string) (*Secret, error) {
+	var s Secret
+	err := db.bolt.View(func(tx *bolt.Tx) error {
+		return getJSON(tx.Bucket(secretBucket), id, &s)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// ListSecrets returns every secret, or only a deployment's secrets if deploymentID is set.
+func (db *DB) ListSecrets(deploymentID string) ([]*Secret, error) {
+	var secrets []*Secret
+	err := db.bolt.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(secretBucket).ForEach(func(_, v []byte) error {
+			var s Secret
+			if err := json.Unmarshal(v, &s); err != nil {
+				return err
+			}
+			if deploymentID == "" || s.DeploymentID == deploymentID {
+				secrets = append(secrets, &s)
+			}
+			return nil
+		})
+	})
+	return secrets, err
+}
+
+// DeleteSecret removes a secret.
+func (db *DB) DeleteSecret(id string) error {
+	return db.bolt.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(secretBucket)
+		if b.Get([]byte(id)) == nil {
+			return fmt.Errorf("%w: %s", ErrNotFound, id)
+		}
+		return b.Delete([]byte(id))
+	})
+}
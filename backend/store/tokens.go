@@ -0,0 +1,149 @@
+package store
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// APIToken is a personal token for scripting the API. Like sessions, it is keyed
+// by a hash of the token; the token itself is only shown once, when it is created.
+type APIToken struct {
+	// ID identifies the token in the API without revealing anything about it.
+	ID     string `json:"id"`
+	Hash   string `json:"hash"`
+	UserID string `json:"user_id"`
+	Name   string `json:"name"`
+	// Prefix is the start of the token, so users can tell their tokens apart.
+	Prefix string `json:"prefix"`
+	// Endpoints restricts the token to these paths; empty means every path the user can use.
+	Endpoints  []string   `json:"endpoints,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+	ExpiresAt  time.Time  `json:"expires_at"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+}
+
+// CreateToken saves a new API token.
+func (db *DB) CreateToken(t *APIToken) error {
+	t.CreatedAt = time.Now().UTC()
+	return db.bolt.Update(func(tx *bolt.Tx) error {
+		return putJSON(tx.Bucket(tokenBucket), t.Hash, t)
+	})
+}
+
+// GetTokenByHash loads a token by the hash of its value. Expired tokens are reported as not found.
+func (db *DB) GetTokenByHash(hash string) (*APIToken, error) {
+	var t APIToken
+	err := db.bolt.View(func(tx *bolt.Tx) error {
+		return getJSON(tx.Bucket(tokenBucket), hash, &t)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if time.Now().After(t.ExpiresAt) {
+		return nil, fmt.Errorf("%w: token expired", ErrNotFound)
+	}
+	return &t, nil
+}
+
+// ListTokens returns a user's tokens, newest first.
+func (db *DB) ListTokens(userID string) ([]*APIToken, error) {
+	var tokens []*APIToken
+	err := db.bolt.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(tokenBucket).ForEach(func(_, v []byte) error {
+			var t APIToken
+			if err := json.Unmarshal(v, &t); err != nil {
+				return err
+			}
+			if t.UserID == userID {
+				tokens = append(tokens, &t)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(tokens, func(i, j int) bool {
+		return tokens[i].CreatedAt.After(tokens[j].CreatedAt)
+	})
+	return tokens, nil
+}
+
+// TouchToken records that a token was just used.
+func (db *DB) TouchToken(hash string, at time.Time) error {
+	return db.bolt.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(tokenBucket)
+		var t APIToken
+		if err := getJSON(b, hash, &t); err != nil {
+			return err
+		}
+		t.LastUsedAt = &at
+		return putJSON(b, hash, &t)
+	})
+}
+
+// DeleteToken revokes one of a user's tokens by its ID.
+func (db *DB) DeleteToken(userID, id string) error {
+	return db.bolt.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(tokenBucket)
+		var key []byte
+		err := b.ForEach(func(k, v []byte) error {
+			var t APIToken
+			if err := json.Unmarshal(v, &t); err != nil {
+				return err
+			}
+			if t.ID == id && t.UserID == userID {
+				key = append([]byte(nil), k...)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if key == nil {
+			return fmt.Errorf("%w: %s", ErrNotFound, id)
+		}
+		return b.Delete(key)
+	})
+}
+
+// RevokeTokens deletes all of a user's tokens and returns how many were removed.
+func (db *DB) RevokeTokens(userID string) (int, error) {
+	removed := 0
+	err := db.bolt.Update(func(tx *bolt.Tx) error {
+		var err error
+		removed, err = deleteTokens(tx, userID)
+		return err
+	})
+	return removed, err
+}
+
+// deleteTokens deletes all of a user's tokens in tx.
+func deleteTokens(tx *bolt.Tx, userID string) (int, error) {
+	b := tx.Bucket(tokenBucket)
+	var owned [][]byte
+	err := b.ForEach(func(k, v []byte) error {
+		var t APIToken
+		if err := json.Unmarshal(v, &t); err != nil {
+			return err
+		}
+		if t.UserID == userID {
+			owned = append(owned, append([]byte(nil), k...))
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	for _, k := range owned {
+		if err := b.Delete(k); err != nil {
+			return 0, err
+		}
+	}
+	return len(owned), nil
+}
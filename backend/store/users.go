@@ -0,0 +1,304 @@
+package store
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	// ErrUsernameTaken is returned when creating a user whose username already exists.
+	ErrUsernameTaken = errors.New("username already taken")
+	// ErrSetupDone is returned when creating the first user after users already exist.
+	ErrSetupDone = errors.New("initial user already exists")
+)
+
+// User is a local dashboard account.
+type User struct {
+	ID       string `json:"id"`
+	Username string `json:"username"`
+	// PasswordHash is an encoded argon2id hash; it must never be sent to clients.
+	PasswordHash string `json:"password_hash"`
+	// Role is "viewer", "operator" or "admin"; see package auth.
+	Role string `json:"role"`
+	// AppGrants lists apps the user may manage on top of what their role allows.
+	AppGrants []string  `json:"app_grants,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// Session is a logged-in browser session. It is keyed by a hash of the session
+// token, so a leaked database doesn't hand out working cookies.
+type Session struct {
+	ID        string    `json:"id"`
+	UserID    string    `json:"user_id"`
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// CreateUser saves a new user. Usernames are unique, ignoring case.
+func (db *DB) CreateUser(u *User) error {
+	return db.bolt.Update(func(tx *bolt.Tx) error {
+		return createUser(tx, u)
+	})
+}
+
+// CreateFirstUser saves u only if no users exist yet, for the first-run setup.
+// Checking and creating in one transaction stops two setups racing each other.
+func (db *DB) CreateFirstUser(u *User) error {
+	return db.bolt.Update(func(tx *bolt.Tx) error {
+		if k, _ := tx.Bucket(userBucket).Cursor().First(); k != nil {
+			return ErrSetupDone
+		}
+		return createUser(tx, u)
+	})
+}
+
+// createUser saves u and indexes its username.
+func createUser(tx *bolt.Tx, u *User) error {
+	now := time.Now().UTC()
+	u.CreatedAt = now
+	u.UpdatedAt = now
+
+	names := tx.Bucket(usernameBucket)
+	key := []byte(strings.ToLower(u.Username))
+	if names.Get(key) != nil {
+		return fmt.Errorf("%w: %s", ErrUsernameTaken, u.Username)
+	}
+	if err := names.Put(key, []byte(u.ID)); err != nil {
+		return err
+	}
+	return putJSON(tx.Bucket(userBucket), u.ID, u)
+}
+
+// HasUsers reports whether any user exists, i.e. whether first-run setup is done.
+func (db *DB) HasUsers() (bool, error) {
+	found := false
+	err := db.bolt.View(func(tx *bolt.Tx) error {
+		k, _ := tx.Bucket(userBucket).Cursor().First()
+		found = k != nil
+		return nil
+	})
+	return found, err
+}
+
+// GetUser loads a user by ID.
+func (db *DB) GetUser(id string) (*User, error) {
+	var u User
+	err := db.bolt.View(func(tx *bolt.Tx) error {
+		return getJSON(tx.Bucket(userBucket), id, &u)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &u, nil
+}
+
+// GetUserByUsername loads a user by username, ignoring case.
+func (db *DB) GetUserByUsername(username string) (*User, error) {
+	var u User
+	err := db.bolt.View(func(tx *bolt.Tx) error {
+		id := tx.Bucket(usernameBucket).Get([]byte(strings.ToLower(username)))
+		if id == nil {
+			return fmt.Errorf("%w: %s", ErrNotFound, username)
+		}
+		return getJSON(tx.Bucket(userBucket), string(id), &u)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &u, nil
+}
+
+// ListUsers returns every user, sorted by username.
+func (db *DB) ListUsers() ([]*User, error) {
+	var users []*User
+	err := db.bolt.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(userBucket).ForEach(func(_, v []byte) error {
+			var u User
+			if err := json.Unmarshal(v, &u); err != nil {
+				return err
+			}
+			users = append(users, &u)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(users, func(i, j int) bool {
+		return strings.ToLower(users[i].Username) < strings.ToLower(users[j].Username)
+	})
+	return users, nil
+}
+
+// UpdateUser applies fn to a user and saves the result atomically.
+// check runs against every user after the change, inside the same transaction,
+// so invariants such as "at least one admin" can't be broken by concurrent updates.
+func (db *DB) UpdateUser(id string, fn func(u *User) error, check func(users []*User) error) error {
+	return db.bolt.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(userBucket)
+		var u User
+		if err := getJSON(b, id, &u); err != nil {
+			return err
+		}
+		if err := fn(&u); err != nil {
+			return err
+		}
+		u.UpdatedAt = time.Now().UTC()
+		if err := putJSON(b, id, &u); err != nil {
+			return err
+		}
+		return runUserCheck(tx, check)
+	})
+}
+
+// DeleteUser removes a user, their username, and all their sessions and API tokens.
+// check works as in UpdateUser.
+func (db *DB) DeleteUser(id string, check func(users []*User) error) error {
+	return db.bolt.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(userBucket)
+		var u User
+		if err := getJSON(b, id, &u); err != nil {
+			return err
+		}
+		if err := b.Delete([]byte(id)); err != nil {
+			return err
+		}
+		if err := tx.Bucket(usernameBucket).Delete([]byte(strings.ToLower(u.Username))); err != nil {
+			return err
+		}
+
+		// Log the user out everywhere, and revoke their API tokens.
+		if _, err := deleteSessions(tx, id, ""); err != nil {
+			return err
+		}
+		if _, err := deleteTokens(tx, id); err != nil {
+			return err
+		}
+		return runUserCheck(tx, check)
+	})
+}
+
+// runUserCheck calls check, if set, with every user as seen by tx.
+func runUserCheck(tx *bolt.Tx, check func(users []*User) error) error {
+	if check == nil {
+		return nil
+	}
+	var users []*User
+	err := tx.Bucket(userBucket).ForEach(func(_, v []byte) error {
+		var u User
+		if err := json.Unmarshal(v, &u); err != nil {
+			return err
+		}
+		users = append(users, &u)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return check(users)
+}
+
+// CreateSession saves a new login session.
+func (db *DB) CreateSession(s *Session) error {
+	return db.bolt.Update(func(tx *bolt.Tx) error {
+		return putJSON(tx.Bucket(sessionBucket), s.ID, s)
+	})
+}
+
+// GetSession loads a session by ID. Expired sessions are reported as not found.
+func (db *DB) GetSession(id string) (*Session, error) {
+	var s Session
+	err := db.bolt.View(func(tx *bolt.Tx) error {
+		return getJSON(tx.Bucket(sessionBucket), id, &s)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if time.Now().After(s.ExpiresAt) {
+		return nil, fmt.Errorf("%w: session expired", ErrNotFound)
+	}
+	return &s, nil
+}
+
+// DeleteSession removes a session. Deleting a session that doesn't exist is not an error.
+func (db *DB) DeleteSession(id string) error {
+	return db.bolt.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(sessionBucket).Delete([]byte(id))
+	})
+}
+
+// EndSessions deletes a user's sessions, except keep if it's set, and returns how
+// many were removed.
+func (db *DB) EndSessions(userID, keep string) (int, error) {
+	removed := 0
+	err := db.bolt.Update(func(tx *bolt.Tx) error {
+		var err error
+		removed, err = deleteSessions(tx, userID, keep)
+		return err
+	})
+	return removed, err
+}
+
+// deleteSessions deletes a user's sessions in tx, except keep.
+func deleteSessions(tx *bolt.Tx, userID, keep string) (int, error) {
+	b := tx.Bucket(sessionBucket)
+	var owned [][]byte
+	err := b.ForEach(func(k, v []byte) error {
+		var s Session
+		if err := json.Unmarshal(v, &s); err != nil {
+			return err
+		}
+		if s.UserID == userID && s.ID != keep {
+			owned = append(owned, append([]byte(nil), k...))
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	for _, k := range owned {
+		if err := b.Delete(k); err != nil {
+			return 0, err
+		}
+	}
+	return len(owned), nil
+}
+
+// PruneSessions deletes expired sessions and returns how many were removed.
+func (db *DB) PruneSessions() (int, error) {
+	removed := 0
+	now := time.Now()
+	err := db.bolt.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(sessionBucket)
+		var expired [][]byte
+		err := b.ForEach(func(k, v []byte) error {
+			var s Session
+			if err := json.Unmarshal(v, &s); err != nil {
+				return err
+			}
+			if now.After(s.ExpiresAt) {
+				expired = append(expired, append([]byte(nil), k...))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, k := range expired {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+		}
+		removed = len(expired)
+		return nil
+	})
+	return removed, err
+}
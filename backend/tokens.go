@@ -0,0 +1,191 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"example.com/m/v2/auth"
+	"example.com/m/v2/logging"
+	"example.com/m/v2/store"
+	"github.com/go-chi/chi/v5"
+)
+
+const (
+	// defaultTokenDays is how long a token lasts when the request doesn't say.
+	defaultTokenDays = 90
+	// maxTokenDays caps token lifetimes; every token has to expire.
+	maxTokenDays = 365
+)
+
+// TokenRequest is the body of POST /api/tokens.
+type TokenRequest struct {
+	Name string `json:"name"`
+	// Endpoints restricts the token to these API paths; see auth.ValidEndpoint.
+	Endpoints     []string `json:"endpoints"`
+	ExpiresInDays int      `json:"expires_in_days"`
+}
+
+// TokenView is an API token as returned by the API. The token itself is never
+// included, except once in the response that creates it.
+type TokenView struct {
+	ID         string     `json:"id"`
+	Name       string     `json:"name"`
+	Prefix     string     `json:"prefix"`
+	Endpoints  []string   `json:"endpoints"`
+	CreatedAt  time.Time  `json:"created_at"`
+	ExpiresAt  time.Time  `json:"expires_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	Expired    bool       `json:"expired"`
+}
+
+// newTokenView builds the API representation of a token.
+func newTokenView(t *store.APIToken) TokenView {
+	endpoints := t.Endpoints
+	if endpoints == nil {
+		endpoints = []string{}
+	}
+	return TokenView{
+		ID:         t.ID,
+		Name:       t.Name,
+		Prefix:     t.Prefix,
+		Endpoints:  endpoints,
+		CreatedAt:  t.CreatedAt,
+		ExpiresAt:  t.ExpiresAt,
+		LastUsedAt: t.LastUsedAt,
+		Expired:    time.Now().After(t.ExpiresAt),
+	}
+}
+
+// requireSession is middleware for routes an API token must never reach,
+// so a restricted token can't mint itself an unrestricted one.
+func requireSession(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, viaToken := auth.TokenFromContext(r.Context()); viaToken {
+			http.Error(w, "API tokens can only be managed from a logged-in session", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// handleListTokens is the HTTP handler for GET /api/tokens.
+// It lists the signed-in user's tokens, including expired ones.
+func handleListTokens(db *store.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, _ := auth.UserFromContext(r.Context())
+		tokens, err := db.ListTokens(user.ID)
+		if err != nil {
+			http.Error(w, "Failed to load tokens", http.StatusInternalServerError)
+			logging.Errorf("Error listing tokens: %v", err)
+			return
+		}
+
+		views := []TokenView{}
+		for _, t := range tokens {
+			views = append(views, newTokenView(t))
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"tokens": views})
+	}
+}
+
+// handleCreateToken is the HTTP handler for POST /api/tokens.
+// The token acts as the signed-in user, so it can never do more than they can.
+func handleCreateToken(db *store.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req TokenRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		if req.Name == "" || len(req.Name) > 100 {
+			http.Error(w, "name is required and must be at most 100 characters", http.StatusBadRequest)
+			return
+		}
+		for _, endpoint := range req.Endpoints {
+			if !auth.ValidEndpoint(endpoint) {
+				http.Error(w, fmt.Sprintf("invalid endpoint %q: use an /api/ path, optionally ending in *, or %s", endpoint, auth.MetricsPath), http.StatusBadRequest)
+				return
+			}
+		}
+		if req.ExpiresInDays == 0 {
+			req.ExpiresInDays = defaultTokenDays
+		}
+		if req.ExpiresInDays < 1 || req.ExpiresInDays > maxTokenDays {
+			http.Error(w, fmt.Sprintf("expires_in_days must be between 1 and %d", maxTokenDays), http.StatusBadRequest)
+			return
+		}
+
+		value, hash, err := auth.NewToken()
+		if err != nil {
+			http.Error(w, "Failed to create token", http.StatusInternalServerError)
+			logging.Errorf("Error generating token: %v", err)
+			return
+		}
+		id, err := randomID()
+		if err != nil {
+			http.Error(w, "Failed to create token", http.StatusInternalServerError)
+			logging.Errorf("Error generating token ID: %v", err)
+			return
+		}
+
+		user, _ := auth.UserFromContext(r.Context())
+		token := &store.APIToken{
+			ID:        id,
+			Hash:      hash,
+			UserID:    user.ID,
+			Name:      req.Name,
+			Prefix:    value[:len(auth.TokenPrefix)+6],
+			Endpoints: req.Endpoints,
+			ExpiresAt: time.Now().UTC().AddDate(0, 0, req.ExpiresInDays),
+		}
+		if err := db.CreateToken(token); err != nil {
+			http.Error(w, "Failed to create token", http.StatusInternalServerError)
+			logging.Errorf("Error saving token: %v", err)
+			return
+		}
+
+		log.Printf("Created API token %s (%s) for %s", token.ID, token.Name, user.Username)
+		event := newAuditEvent(r, auditTokenCreate)
+		event.Target = token.ID
+		event.Diff = map[string]store.Change{
+			"name":       {To: token.Name},
+			"endpoints":  {To: token.Endpoints},
+			"expires_at": {To: token.ExpiresAt},
+		}
+		recordAudit(db, event, store.OutcomeSuccess, "")
+		writeJSON(w, http.StatusCreated, map[string]interface{}{
+			// This is the only time the token is ever shown
+			"token":   value,
+			"details": newTokenView(token),
+		})
+	}
+}
+
+// handleRevokeToken is the HTTP handler for DELETE /api/tokens/{id}.
+func handleRevokeToken(db *store.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, _ := auth.UserFromContext(r.Context())
+		id := chi.URLParam(r, "id")
+
+		err := db.DeleteToken(user.ID, id)
+		if errors.Is(err, store.ErrNotFound) {
+			http.Error(w, "Token not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Failed to revoke token", http.StatusInternalServerError)
+			logging.Errorf("Error revoking token %s: %v", id, err)
+			return
+		}
+
+		log.Printf("Revoked API token %s of %s", id, user.Username)
+		event := newAuditEvent(r, auditTokenRevoke)
+		event.Target = id
+		recordAudit(db, event, store.OutcomeSuccess, "")
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,431 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"example.com/m/v2/catalog"
+	"example.com/m/v2/deploy"
+	"example.com/m/v2/jobs"
+	"example.com/m/v2/logging"
+	"example.com/m/v2/metrics"
+	"example.com/m/v2/registry"
+	"example.com/m/v2/store"
+	"example.com/m/v2/vault"
+	"github.com/go-chi/chi/v5"
+)
+
+// registryTimeout bounds the registry lookups for one deployment.
+const registryTimeout = 30 * time.Second
+
+// updateStatus is what the last check found about newer images for a deployment.
+type updateStatus struct {
+	DeploymentID string `json:"deployment_id"`
+	// Image is the image reference the deployment runs.
+	Image string `json:"image"`
+	// CurrentDigest and LatestDigest are what the running image was pulled as and
+	// what its tag points to in the registry now; they differ when the tag has moved.
+	CurrentDigest string `json:"current_digest,omitempty"`
+	LatestDigest  string `json:"latest_digest,omitempty"`
+	// NewerTags are newer versions of the running tag, newest first.
+	NewerTags []string `json:"newer_tags,omitempty"`
+	// CatalogImage is set when the app's manifest has moved on to another image.
+	CatalogImage    string `json:"catalog_image,omitempty"`
+	UpdateAvailable bool   `json:"update_available"`
+	// Error explains why the registry couldn't be asked, in which case only the
+	// catalog was compared.
+	Error     string    `json:"error,omitempty"`
+	CheckedAt time.Time `json:"checked_at"`
+}
+
+// updateChecker keeps the latest update status of every deployment, and which
+// deployments are being upgraded.
+type updateChecker struct {
+	deployer deploy.Deployer
+	catalog  *catalog.Catalog
+	registry *registry.Client
+
+	mu        sync.Mutex
+	statuses  map[string]*updateStatus
+	upgrading map[string]bool
+}
+
+// newUpdateChecker creates a checker that compares deployments with the catalog and registries.
+func newUpdateChecker(deployer deploy.Deployer, cat *catalog.Catalog, reg *registry.Client) *updateChecker {
+	return &updateChecker{
+		deployer:  deployer,
+		catalog:   cat,
+		registry:  reg,
+		statuses:  map[string]*updateStatus{},
+		upgrading: map[string]bool{},
+	}
+}
+
+// check compares what a deployment runs with the catalog and its registry, and
+// records the outcome. A registry that can't be reached is reported in the status
+// rather than failing the check.
+func (c *updateChecker) check(ctx context.Context, d *store.Deployment) (*updateStatus, error) {
+	live, err := c.deployer.Status(ctx, d.ID)
+	if err != nil {
+		return nil, err
+	}
+	image := live.Image
+	if image == "" {
+		image = d.Image
+	}
+	repo, tag, _, err := registry.Split(image)
+	if err != nil {
+		return nil, err
+	}
+
+	status := &updateStatus{
+		DeploymentID:  d.ID,
+		Image:         image,
+		CurrentDigest: live.ImageDigest,
+		CheckedAt:     time.Now().UTC(),
+	}
+	if app, ok := c.catalog.Get(d.AppID); ok && !sameImage(app.Image, image) {
+		status.CatalogImage = app.Image
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, registryTimeout)
+	defer cancel()
+	tagged := repo + ":" + tag
+	if digest, err := c.registry.Digest(ctx, tagged); err != nil {
+		status.Error = err.Error()
+	} else {
+		status.LatestDigest = digest
+	}
+	if tags, err := c.registry.Tags(ctx, tagged); err != nil {
+		status.Error = err.Error()
+	} else {
+		status.NewerTags = registry.NewerTags(tag, tags)
+	}
+
+	status.UpdateAvailable = status.CatalogImage != "" || len(status.NewerTags) > 0 ||
+		(status.CurrentDigest != "" && status.LatestDigest != "" && status.CurrentDigest != status.LatestDigest)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if prev := c.statuses[d.ID]; status.UpdateAvailable && (prev == nil || !prev.UpdateAvailable) {
+		log.Printf("An update is available for deployment %s", d.ID)
+	}
+	c.statuses[d.ID] = status
+	return status, nil
+}
+
+// get returns the latest update status of a deployment, or nil if it hasn't been checked.
+func (c *updateChecker) get(deploymentID string) *updateStatus {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.statuses[deploymentID]
+}
+
+// retain forgets every deployment not in live, such as destroyed ones.
+func (c *updateChecker) retain(live map[string]bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for id := range c.statuses {
+		if !live[id] {
+			delete(c.statuses, id)
+		}
+	}
+}
+
+// claim marks a deployment as being upgraded or reconfigured, reporting false if
+// it already is; only one job may replace its containers at a time.
+func (c *updateChecker) claim(deploymentID string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.upgrading[deploymentID] {
+		return false
+	}
+	c.upgrading[deploymentID] = true
+	return true
+}
+
+// release ends an upgrade or update, and forgets the deployment's status since it no longer
+// describes what runs.
+func (c *updateChecker) release(deploymentID string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.upgrading, deploymentID)
+	delete(c.statuses, deploymentID)
+}
+
+// checkUpdatesEvery checks every deployed deployment for updates each interval until
+// ctx is cancelled.
+func checkUpdatesEvery(ctx context.Context, checker *updateChecker, db *store.DB, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		deployments, err := db.ListDeployments()
+		if err != nil {
+			logging.Errorf("Error listing deployments for update checks: %v", err)
+		}
+		live := map[string]bool{}
+		for _, d := range deployments {
+			if d.State != store.StateDeployed {
+				continue
+			}
+			live[d.ID] = true
+			if _, err := checker.check(ctx, d); err != nil && ctx.Err() == nil {
+				logging.Errorf("Error checking %s for updates: %v", d.ID, err)
+			}
+		}
+		if err == nil {
+			checker.retain(live)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// sameImage reports whether two image references name the same repository and tag,
+// whatever digest either is pinned to.
+func sameImage(a, b string) bool {
+	repoA, tagA, _, errA := registry.Split(a)
+	repoB, tagB, _, errB := registry.Split(b)
+	return errA == nil && errB == nil && repoA == repoB && tagA == tagB
+}
+
+// handleDeploymentUpdates is the HTTP handler for GET /api/deployments/{id}/updates.
+// It reports whether a newer image is available: the tag now points to a different
+// digest, there are newer version tags, or the catalog has moved to another image.
+// Answers come from the latest periodic check unless ?refresh=true asks for one now.
+func handleDeploymentUpdates(db *store.DB, checker *updateChecker) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		deploymentID := chi.URLParam(r, "id")
+
+		d, err := db.GetDeployment(deploymentID)
+		if errors.Is(err, store.ErrNotFound) {
+			http.Error(w, "Deployment not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Failed to load deployment", http.StatusInternalServerError)
+			logging.Errorf("Error loading deployment %s: %v", deploymentID, err)
+			return
+		}
+		if d.State == store.StateDestroyed {
+			http.Error(w, "Deployment has been destroyed", http.StatusGone)
+			return
+		}
+
+		status := checker.get(deploymentID)
+		if status == nil || r.URL.Query().Get("refresh") == "true" {
+			status, err = checker.check(r.Context(), d)
+			if errors.Is(err, deploy.ErrNotFound) {
+				http.Error(w, "Deployment is not running", http.StatusConflict)
+				return
+			}
+			if err != nil {
+				http.Error(w, "Failed to check for updates", http.StatusInternalServerError)
+				logging.Errorf("Error checking %s for updates: %v", deploymentID, err)
+				return
+			}
+		}
+		writeJSON(w, http.StatusOK, status)
+	}
+}
+
+// UpgradeRequest is the optional body of POST /api/deployments/{id}/upgrade.
+type UpgradeRequest struct {
+	// Tag moves the deployment to another tag of the image it runs, such as one of
+	// the newer tags reported by /updates.
+	Tag string `json:"tag,omitempty"`
+}
+
+// handleUpgradeDeployment is the HTTP handler for POST /api/deployments/{id}/upgrade.
+// It starts a job that pulls the new image and recreates the deployment with the
+// same volumes and credentials, waiting for it to pass its health checks. If it
+// doesn't, the previous image is put back.
+//
+// Without a tag, the deployment moves to the catalog's image if that has changed,
+// and otherwise to whatever its own tag points to now.
+func handleUpgradeDeployment(deployer deploy.Deployer, db *store.DB, secrets *vault.Vault, jobManager *jobs.Manager, checker *updateChecker) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		deploymentID := chi.URLParam(r, "id")
+
+		var req UpgradeRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+
+		d, err := db.GetDeployment(deploymentID)
+		if errors.Is(err, store.ErrNotFound) {
+			http.Error(w, "Deployment not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Failed to load deployment", http.StatusInternalServerError)
+			logging.Errorf("Error loading deployment %s: %v", deploymentID, err)
+			return
+		}
+		if d.State != store.StateDeployed {
+			http.Error(w, fmt.Sprintf("Only a deployed app can be upgraded; this one is %s", d.State), http.StatusConflict)
+			return
+		}
+
+		// Work out the image to move to; only tags of the same repository are allowed
+		current := d.Image
+		app, ok := checker.catalog.Get(d.AppID)
+		if current == "" && ok {
+			current = app.Image
+		}
+		repo, tag, _, err := registry.Split(current)
+		if err != nil {
+			http.Error(w, "Deployment has no usable image reference", http.StatusConflict)
+			logging.Errorf("Error reading image of %s: %v", deploymentID, err)
+			return
+		}
+		target := repo + ":" + tag
+		switch {
+		case req.Tag != "":
+			target = repo + ":" + req.Tag
+			if _, _, _, err := registry.Split(target); err != nil {
+				http.Error(w, fmt.Sprintf("Invalid tag %q", req.Tag), http.StatusBadRequest)
+				return
+			}
+		case ok && !sameImage(app.Image, current):
+			target = app.Image
+		}
+
+		if !checker.claim(deploymentID) {
+			http.Error(w, "Deployment is already being upgraded", http.StatusConflict)
+			return
+		}
+
+		event := newAuditEvent(r, auditDeployUpgrade)
+		event.AppID = d.AppID
+		event.DeploymentID = deploymentID
+		event.Diff = map[string]store.Change{"image": {From: current, To: target}}
+
+		job := jobManager.Start("upgrade", deploymentID, func(ctx context.Context, progress func(step, message string, percent float64)) (interface{}, error) {
+			defer checker.release(deploymentID)
+			ctx = deploy.WithProgress(ctx, func(p deploy.Progress) {
+				progress(p.Step, p.Message, p.Percent)
+			})
+			result, err := runUpgrade(ctx, deployer, db, secrets, checker.registry, d, target, event)
+			if err != nil {
+				return failureReport(err), err
+			}
+			return result, nil
+		})
+
+		writeJSON(w, http.StatusAccepted, map[string]interface{}{
+			"status":        "accepted",
+			"message":       fmt.Sprintf("Upgrade of %s to %s started", deploymentID, target),
+			"deployment_id": deploymentID,
+			"job_id":        job.Info().ID,
+			"image":         target,
+			"events_url":    "/api/jobs/" + job.Info().ID + "/events",
+		})
+	}
+}
+
+// runUpgrade moves a deployment to target and records the outcome. The image is
+// pinned to the digest its tag has now, so what was checked is what gets pulled,
+// unless the registry can't say.
+func runUpgrade(ctx context.Context, deployer deploy.Deployer, db *store.DB, secrets *vault.Vault, reg *registry.Client, d *store.Deployment, target string, event store.AuditEvent) (*deploy.Result, error) {
+	image := target
+	if digest, err := reg.Digest(ctx, target); err != nil {
+		logging.Warnf("Could not resolve %s in its registry, upgrading to the tag: %v", target, err)
+	} else {
+		image = target + "@" + digest
+		if live, err := deployer.Status(ctx, d.ID); err == nil && live.ImageDigest == digest && sameImage(live.Image, target) {
+			// An upgrade resumed after a restart may find it had finished
+			if d.State != store.StateDeployed {
+				err := db.UpdateDeployment(d.ID, func(d *store.Deployment) error {
+					d.Image, d.Pending = image, nil
+					d.Transition(store.StateDeployed, "Upgraded to "+image)
+					return nil
+				})
+				if err != nil {
+					logging.Errorf("Error saving deployment %s: %v", d.ID, err)
+				}
+			}
+			recordAudit(db, event, store.OutcomeSuccess, "already up to date")
+			return &deploy.Result{DeploymentID: d.ID, AppID: d.AppID, Image: live.Image, Status: "up to date"}, nil
+		}
+	}
+
+	// The upgrade reads the credentials back out of the vault to recreate the app with them
+	config, err := resolveConfig(secrets, d)
+	if err != nil {
+		recordAudit(db, event, store.OutcomeFailure, err.Error())
+		metrics.RecordOperation("upgrade", d.AppID, metrics.OutcomeFailure)
+		return nil, err
+	}
+	if len(d.Secrets) > 0 {
+		reveal := event
+		reveal.Action, reveal.Diff = auditSecretsReveal, nil
+		recordAudit(db, reveal, store.OutcomeSuccess, fmt.Sprintf("%d credentials read for upgrade", len(d.Secrets)))
+	}
+
+	// Checkpoint the upgrade, so a restart part way through can finish or undo it; see recovery.go
+	err = db.UpdateDeployment(d.ID, func(d *store.Deployment) error {
+		if d.State == store.StateDeployed {
+			d.Resumes = 0 // a fresh change, rather than one resumed after a restart
+		}
+		d.Pending = &store.PendingChange{PreviousImage: d.Image, Image: image}
+		d.Transition(store.StateUpgrading, "Upgrading to "+image)
+		return nil
+	})
+	if err != nil {
+		recordAudit(db, event, store.OutcomeFailure, "failed to save deployment: "+err.Error())
+		metrics.RecordOperation("upgrade", d.AppID, metrics.OutcomeFailure)
+		return nil, fmt.Errorf("failed to save deployment %s: %w", d.ID, err)
+	}
+
+	log.Printf("Upgrading %s to %s", d.ID, image)
+	result, err := deployer.Upgrade(ctx, d.ID, config, image)
+	if err != nil {
+		// Rolled back, the deployment is still running as it was before
+		state, message := store.StateFailed, "Upgrade to "+target+" failed: "+err.Error()
+		var failed *deploy.PipelineError
+		if errors.As(err, &failed) && failed.RolledBack {
+			state, message = store.StateDeployed, "Upgrade to "+target+" failed and was rolled back: "+failed.Cause.Error()
+		}
+		logging.Errorf("Upgrade of %s failed: %v", d.ID, err)
+		saveErr := db.UpdateDeployment(d.ID, func(d *store.Deployment) error {
+			d.Pending = nil
+			d.Transition(state, message)
+			return nil
+		})
+		if saveErr != nil {
+			logging.Errorf("Error saving deployment %s: %v", d.ID, saveErr)
+		}
+		recordAudit(db, event, store.OutcomeFailure, err.Error())
+		metrics.RecordOperation("upgrade", d.AppID, metrics.OutcomeFailure)
+		return nil, err
+	}
+
+	err = db.UpdateDeployment(d.ID, func(d *store.Deployment) error {
+		d.ContainerID = result.ContainerID
+		d.Image = result.Image
+		d.Pending = nil
+		d.Transition(store.StateDeployed, "Upgraded to "+result.Image)
+		return nil
+	})
+	if err != nil {
+		logging.Errorf("Error saving deployment %s: %v", d.ID, err)
+	}
+	log.Printf("Upgrade of %s finished: %s", d.ID, result.Image)
+	recordAudit(db, event, store.OutcomeSuccess, result.Image)
+	metrics.RecordOperation("upgrade", d.AppID, metrics.OutcomeSuccess)
+	return result, nil
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"example.com/m/v2/deploy"
+	"example.com/m/v2/registry"
+	"example.com/m/v2/store"
+)
+
+const (
+	oldDigest = "sha256:1111111111111111111111111111111111111111111111111111111111111111"
+	newDigest = "sha256:2222222222222222222222222222222222222222222222222222222222222222"
+)
+
+// newTagRegistry serves the manifest digests of joplin/server's tags, without auth.
+func newTagRegistry(t *testing.T, digests map[string]string) string {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		digest, ok := digests[strings.TrimPrefix(r.URL.Path, "/v2/joplin/server/manifests/")]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Docker-Content-Digest", digest)
+	}))
+	t.Cleanup(srv.Close)
+	return strings.TrimPrefix(srv.URL, "http://")
+}
+
+func TestRunUpgrade(t *testing.T) {
+	tests := []struct {
+		name       string
+		digests    map[string]string
+		live       *deploy.Status
+		upgradeErr error
+		// wantUpgrade is the image the deployer is asked for, after the registry's host.
+		wantUpgrade string
+		wantErr     bool
+		wantState   string
+		wantImage   string
+		wantOutcome string
+	}{
+		{
+			name:        "pinned to the new digest",
+			digests:     map[string]string{"3.1": newDigest},
+			wantUpgrade: "/joplin/server:3.1@" + newDigest,
+			wantState:   store.StateDeployed,
+			wantImage:   "/joplin/server:3.1@" + newDigest,
+			wantOutcome: store.OutcomeSuccess,
+		},
+		{
+			name:        "health check fails",
+			digests:     map[string]string{"3.1": newDigest},
+			upgradeErr:  &deploy.PipelineError{Operation: "upgrade", RolledBack: true, Cause: errors.New("container being-joplin-server-1 reported unhealthy")},
+			wantUpgrade: "/joplin/server:3.1@" + newDigest,
+			wantErr:     true,
+			// Rolled back, the deployment still runs the digest it was pinned to
+			wantState:   store.StateDeployed,
+			wantImage:   "/joplin/server:3.0@" + oldDigest,
+			wantOutcome: store.OutcomeFailure,
+		},
+		{
+			name:        "rollback fails",
+			digests:     map[string]string{"3.1": newDigest},
+			upgradeErr:  &deploy.PipelineError{Operation: "upgrade", Cause: errors.New("unhealthy")},
+			wantUpgrade: "/joplin/server:3.1@" + newDigest,
+			wantErr:     true,
+			wantState:   store.StateFailed,
+			wantImage:   "/joplin/server:3.0@" + oldDigest,
+			wantOutcome: store.OutcomeFailure,
+		},
+		{
+			name:        "registry doesn't know the tag",
+			digests:     map[string]string{},
+			wantUpgrade: "/joplin/server:3.1",
+			wantState:   store.StateDeployed,
+			wantImage:   "/joplin/server:3.1",
+			wantOutcome: store.OutcomeSuccess,
+		},
+		{
+			name:        "already running the digest",
+			digests:     map[string]string{"3.1": newDigest},
+			live:        &deploy.Status{ImageDigest: newDigest},
+			wantState:   store.StateDeployed,
+			wantImage:   "/joplin/server:3.0@" + oldDigest,
+			wantOutcome: store.OutcomeSuccess,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newConfigFixture(t)
+			host := newTagRegistry(t, tt.digests)
+			err := f.db.UpdateDeployment("joplin-server-1", func(d *store.Deployment) error {
+				d.Image = host + "/joplin/server:3.0@" + oldDigest
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			d, err := f.db.GetDeployment("joplin-server-1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			f.deployer.upgradeErr = tt.upgradeErr
+			if tt.live != nil {
+				live := *tt.live
+				live.Image = host + "/joplin/server:3.1"
+				f.deployer.status = &live
+			}
+			event := store.AuditEvent{Action: auditDeployUpgrade, DeploymentID: d.ID}
+
+			_, err = runUpgrade(context.Background(), f.deployer, f.db, f.secrets, registry.New(http.DefaultClient), d, host+"/joplin/server:3.1", event)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("runUpgrade: %v, want error %v", err, tt.wantErr)
+			}
+			var want []string
+			if tt.wantUpgrade != "" {
+				want = []string{host + tt.wantUpgrade}
+			}
+			if !reflect.DeepEqual(f.deployer.upgrades, want) {
+				t.Errorf("upgraded to %v, want %v", f.deployer.upgrades, want)
+			}
+			d, err = f.db.GetDeployment("joplin-server-1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if d.State != tt.wantState || d.Image != host+tt.wantImage {
+				t.Errorf("record is %s running %s, want %s running %s", d.State, d.Image, tt.wantState, host+tt.wantImage)
+			}
+			if event := lastAudit(t, f.db, auditDeployUpgrade); event.Outcome != tt.wantOutcome {
+				t.Errorf("audit outcome %s, want %s", event.Outcome, tt.wantOutcome)
+			}
+		})
+	}
+}
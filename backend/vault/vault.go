@@ -0,0 +1,242 @@
+// Package vault keeps deployment credentials encrypted at rest.
+//
+// Secrets are sealed with AES-256-GCM under a master key that never touches the
+// database. Each ciphertext is bound to its secret ID, so swapping records around
+// in the database makes them fail to decrypt rather than leak into the wrong place.
+package vault
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"example.com/m/v2/store"
+)
+
+// KeySize is the master key length in bytes (AES-256).
+const KeySize = 32
+
+// checkKey is the meta key holding a value sealed with the master key, so a wrong
+// key is caught at startup instead of on the first redeploy.
+const checkKey = "vault_check"
+
+// checkPlaintext is what the check value decrypts to.
+const checkPlaintext = "being.software vault"
+
+// ErrWrongKey is returned when the master key doesn't match the one the database was sealed with.
+var ErrWrongKey = errors.New("master key does not match this database")
+
+// Metadata describes a secret without its value. It is all the API ever returns.
+type Metadata struct {
+	ID           string    `json:"id"`
+	DeploymentID string    `json:"deployment_id"`
+	Field        string    `json:"field"`
+	CreatedAt    time.Time `json:"created_at"`
+	UpdatedAt    time.Time `json:"updated_at"`
+}
+
+// Vault seals and opens secrets stored in the database.
+type Vault struct {
+	db   *store.DB
+	aead cipher.AEAD
+}
+
+// LoadKey reads the master key. envValue (from VAULT_KEY) wins over keyFile;
+// both hold the key base64 encoded. If neither is set and create is true, a new
+// key is generated and written to keyFile.
+func LoadKey(envValue, keyFile string, create bool) ([]byte, error) {
+	if envValue != "" {
+		return decodeKey(envValue)
+	}
+
+	data, err := os.ReadFile(keyFile)
+	if errors.Is(err, fs.ErrNotExist) && create {
+		return generateKey(keyFile)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read master key: %w", err)
+	}
+	return decodeKey(string(data))
+}
+
+// DeriveKey derives a key for purpose from the master key, so other parts of the
+// server get a secret of their own without being handed the master key.
+func DeriveKey(master []byte, purpose string) ([]byte, error) {
+	return hkdf.Key(sha256.New, master, nil, purpose, KeySize)
+}
+
+// generateKey creates a random master key and saves it to path, readable only by us.
+func generateKey(path string) ([]byte, error) {
+	key := make([]byte, KeySize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, fmt.Errorf("failed to generate master key: %w", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, fmt.Errorf("failed to create key directory: %w", err)
+	}
+	// O_EXCL stops us from clobbering a key another process just wrote.
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create master key file: %w", err)
+	}
+	defer f.Close()
+	if _, err := f.WriteString(base64.StdEncoding.EncodeToString(key) + "\n"); err != nil {
+		return nil, fmt.Errorf("failed to write master key file: %w", err)
+	}
+	return key, nil
+}
+
+// decodeKey parses a base64 master key.
+func decodeKey(value string) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(value))
+	if err != nil {
+		return nil, fmt.Errorf("master key is not valid base64: %w", err)
+	}
+	if len(key) != KeySize {
+		return nil, fmt.Errorf("master key must be %d bytes, got %d", KeySize, len(key))
+	}
+	return key, nil
+}
+
+// Open creates a vault over db. The first time a database is opened, the key is
+// recorded; afterwards Open fails with ErrWrongKey if a different key is supplied.
+func Open(db *store.DB, key []byte) (*Vault, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cipher: %w", err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create GCM: %w", err)
+	}
+	v := &Vault{db: db, aead: aead}
+
+	check, err := db.GetMeta(checkKey)
+	if err != nil {
+		return nil, err
+	}
+	if check == nil {
+		sealed, err := v.seal(checkKey, checkPlaintext)
+		if err != nil {
+			return nil, err
+		}
+		return v, db.PutMeta(checkKey, sealed)
+	}
+	if plaintext, err := v.open(checkKey, check); err != nil || plaintext != checkPlaintext {
+		return nil, ErrWrongKey
+	}
+	return v, nil
+}
+
+// Store encrypts a deployment's credential and returns the new secret's ID.
+func (v *Vault) Store(deploymentID, field, plaintext string) (string, error) {
+	id, err := newSecretID()
+	if err != nil {
+		return "", err
+	}
+	secret := &store.Secret{ID: id, DeploymentID: deploymentID, Field: field}
+	if err := v.put(secret, plaintext); err != nil {
+		return "", err
+	}
+	return id, nil
+}
+
+// Rotate replaces the value of an existing secret, keeping its ID.
+func (v *Vault) Rotate(id, plaintext string) error {
+	secret, err := v.db.GetSecret(id)
+	if err != nil {
+		return err
+	}
+	return v.put(secret, plaintext)
+}
+
+// Reveal decrypts a secret. Its result must only ever go to a deployer, never to a client.
+func (v *Vault) Reveal(id string) (string, error) {
+	secret, err := v.db.GetSecret(id)
+	if err != nil {
+		return "", err
+	}
+	sealed := append(append([]byte(nil), secret.Nonce...), secret.Ciphertext...)
+	plaintext, err := v.open(id, sealed)
+	if err != nil {
+		return "", fmt.Errorf("failed to decrypt secret %s: %w", id, err)
+	}
+	return plaintext, nil
+}
+
+// List returns metadata for every secret, or only a deployment's if deploymentID is set.
+func (v *Vault) List(deploymentID string) ([]Metadata, error) {
+	secrets, err := v.db.ListSecrets(deploymentID)
+	if err != nil {
+		return nil, err
+	}
+	list := make([]Metadata, 0, len(secrets))
+	for _, s := range secrets {
+		list = append(list, Metadata{
+			ID:           s.ID,
+			DeploymentID: s.DeploymentID,
+			Field:        s.Field,
+			CreatedAt:    s.CreatedAt,
+			UpdatedAt:    s.UpdatedAt,
+		})
+	}
+	return list, nil
+}
+
+// Delete removes a secret.
+func (v *Vault) Delete(id string) error {
+	return v.db.DeleteSecret(id)
+}
+
+// put seals plaintext into secret and saves it.
+func (v *Vault) put(secret *store.Secret, plaintext string) error {
+	sealed, err := v.seal(secret.ID, plaintext)
+	if err != nil {
+		return err
+	}
+	nonceSize := v.aead.NonceSize()
+	secret.Nonce, secret.Ciphertext = sealed[:nonceSize], sealed[nonceSize:]
+	return v.db.PutSecret(secret)
+}
+
+// seal encrypts plaintext bound to id, returning nonce || ciphertext.
+func (v *Vault) seal(id, plaintext string) ([]byte, error) {
+	nonce := make([]byte, v.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %w", err)
+	}
+	return v.aead.Seal(nonce, nonce, []byte(plaintext), []byte(id)), nil
+}
+
+// open reverses seal.
+func (v *Vault) open(id string, sealed []byte) (string, error) {
+	nonceSize := v.aead.NonceSize()
+	if len(sealed) < nonceSize {
+		return "", errors.New("sealed value is too short")
+	}
+	plaintext, err := v.aead.Open(nil, sealed[:nonceSize], sealed[nonceSize:], []byte(id))
+	if err != nil {
+		return "", err
+	}
+	return string(plaintext), nil
+}
+
+// newSecretID returns a random secret ID.
+func newSecretID() (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", fmt.Errorf("failed to generate secret ID: %w", err)
+	}
+	return hex.EncodeToString(buf), nil
+}
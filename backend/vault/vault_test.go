@@ -0,0 +1,264 @@
+package vault
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"example.com/m/v2/store"
+)
+
+func openTestVault(t *testing.T) (*Vault, *store.DB) {
+	t.Helper()
+	db, err := store.Open(filepath.Join(t.TempDir(), "being.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	v, err := Open(db, bytes.Repeat([]byte{1}, KeySize))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return v, db
+}
+
+func TestStoreReveal(t *testing.T) {
+	tests := []struct {
+		name      string
+		plaintext string
+	}{
+		{name: "password", plaintext: "correct horse battery staple"},
+		{name: "empty", plaintext: ""},
+		{name: "unicode", plaintext: "pässwörd 🔑"},
+		{name: "long", plaintext: strings.Repeat("x", 64<<10)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v, db := openTestVault(t)
+			id, err := v.Store("notes-1", "dbPassword", tt.plaintext)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := v.Reveal(id)
+			if err != nil || got != tt.plaintext {
+				t.Fatalf("Reveal = %q, %v", got, err)
+			}
+
+			// Only ciphertext reaches the database
+			secret, err := db.GetSecret(id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.plaintext != "" && bytes.Contains(secret.Ciphertext, []byte(tt.plaintext)) {
+				t.Error("plaintext stored in the database")
+			}
+		})
+	}
+}
+
+func TestRevealTampered(t *testing.T) {
+	tests := []struct {
+		name   string
+		tamper func(t *testing.T, db *store.DB, v *Vault, id string)
+	}{
+		{
+			name: "flipped ciphertext bit",
+			tamper: func(t *testing.T, db *store.DB, v *Vault, id string) {
+				secret, _ := db.GetSecret(id)
+				secret.Ciphertext[0] ^= 1
+				if err := db.PutSecret(secret); err != nil {
+					t.Fatal(err)
+				}
+			},
+		},
+		{
+			name: "changed nonce",
+			tamper: func(t *testing.T, db *store.DB, v *Vault, id string) {
+				secret, _ := db.GetSecret(id)
+				secret.Nonce[0] ^= 1
+				if err := db.PutSecret(secret); err != nil {
+					t.Fatal(err)
+				}
+			},
+		},
+		{
+			name: "truncated",
+			tamper: func(t *testing.T, db *store.DB, v *Vault, id string) {
+				secret, _ := db.GetSecret(id)
+				secret.Nonce, secret.Ciphertext = secret.Nonce[:4], nil
+				if err := db.PutSecret(secret); err != nil {
+					t.Fatal(err)
+				}
+			},
+		},
+		{
+			// Copying another secret's sealed value over this one's must not reveal it here
+			name: "ciphertext swapped between IDs",
+			tamper: func(t *testing.T, db *store.DB, v *Vault, id string) {
+				otherID, err := v.Store("wiki-1", "adminPassword", "someone else's")
+				if err != nil {
+					t.Fatal(err)
+				}
+				secret, _ := db.GetSecret(id)
+				other, _ := db.GetSecret(otherID)
+				secret.Nonce, secret.Ciphertext = other.Nonce, other.Ciphertext
+				if err := db.PutSecret(secret); err != nil {
+					t.Fatal(err)
+				}
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v, db := openTestVault(t)
+			id, err := v.Store("notes-1", "dbPassword", "s3cret")
+			if err != nil {
+				t.Fatal(err)
+			}
+			tt.tamper(t, db, v, id)
+			if got, err := v.Reveal(id); err == nil {
+				t.Errorf("Reveal of a tampered secret = %q, want an error", got)
+			}
+		})
+	}
+}
+
+func TestOpenWrongKey(t *testing.T) {
+	v, db := openTestVault(t)
+	id, err := v.Store("notes-1", "dbPassword", "s3cret")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	other := bytes.Repeat([]byte{2}, KeySize)
+	if _, err := Open(db, other); !errors.Is(err, ErrWrongKey) {
+		t.Fatalf("Open with another key = %v, want ErrWrongKey", err)
+	}
+
+	// Even without the check value to catch it, another key can't open the secrets
+	if err := db.PutMeta(checkKey, nil); err != nil {
+		t.Fatal(err)
+	}
+	wrong, err := Open(db, other)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := wrong.Reveal(id); err == nil {
+		t.Errorf("Reveal with the wrong key = %q, want an error", got)
+	}
+}
+
+func TestRotate(t *testing.T) {
+	v, db := openTestVault(t)
+	id, err := v.Store("notes-1", "dbPassword", "old")
+	if err != nil {
+		t.Fatal(err)
+	}
+	before, _ := db.GetSecret(id)
+
+	if err := v.Rotate(id, "new"); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := v.Reveal(id); err != nil || got != "new" {
+		t.Errorf("Reveal after Rotate = %q, %v", got, err)
+	}
+	after, _ := db.GetSecret(id)
+	if bytes.Equal(before.Nonce, after.Nonce) {
+		t.Error("Rotate reused the nonce")
+	}
+	if after.DeploymentID != "notes-1" || after.Field != "dbPassword" || !after.CreatedAt.Equal(before.CreatedAt) {
+		t.Errorf("Rotate changed the secret's metadata: %+v", after)
+	}
+
+	if err := v.Rotate("missing", "new"); !errors.Is(err, store.ErrNotFound) {
+		t.Errorf("Rotate of a missing secret = %v, want store.ErrNotFound", err)
+	}
+}
+
+func TestList(t *testing.T) {
+	v, _ := openTestVault(t)
+	plaintexts := map[string]string{"dbPassword": "db-s3cret", "adminPassword": "admin-s3cret"}
+	for field, plaintext := range plaintexts {
+		if _, err := v.Store("notes-1", field, plaintext); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := v.Store("wiki-1", "dbPassword", "wiki-s3cret"); err != nil {
+		t.Fatal(err)
+	}
+
+	all, err := v.List("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != 3 {
+		t.Errorf("List(\"\") returned %d secrets, want 3", len(all))
+	}
+	list, err := v.List("notes-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 2 {
+		t.Fatalf("List(notes-1) returned %d secrets, want 2", len(list))
+	}
+	out, err := json.Marshal(all)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, plaintext := range []string{"db-s3cret", "admin-s3cret", "wiki-s3cret"} {
+		if bytes.Contains(out, []byte(plaintext)) {
+			t.Errorf("List leaks %q: %s", plaintext, out)
+		}
+	}
+}
+
+func TestLoadKey(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "keys", "vault.key")
+
+	if _, err := LoadKey("", path, false); err == nil {
+		t.Error("LoadKey without a key file or create succeeded")
+	}
+	key, err := LoadKey("", path, true)
+	if err != nil || len(key) != KeySize {
+		t.Fatalf("LoadKey creating a key = %d bytes, %v", len(key), err)
+	}
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("key file mode %v (%v), want 0600", info.Mode().Perm(), err)
+	}
+	again, err := LoadKey("", path, true)
+	if err != nil || !bytes.Equal(again, key) {
+		t.Errorf("LoadKey did not read back the key it created: %v", err)
+	}
+
+	env := bytes.Repeat([]byte{3}, KeySize)
+	if got, err := LoadKey(base64.StdEncoding.EncodeToString(env), path, true); err != nil || !bytes.Equal(got, env) {
+		t.Errorf("the environment's key did not win over the file: %v", err)
+	}
+	if _, err := LoadKey(base64.StdEncoding.EncodeToString(env[:16]), path, true); err == nil {
+		t.Error("a 16 byte key was accepted")
+	}
+}
+
+func TestDeriveKey(t *testing.T) {
+	master := bytes.Repeat([]byte{1}, KeySize)
+	audit, err := DeriveKey(master, "audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, _ := DeriveKey(master, "audit")
+	other, _ := DeriveKey(master, "other")
+	otherMaster, _ := DeriveKey(bytes.Repeat([]byte{2}, KeySize), "audit")
+
+	if len(audit) != KeySize || !bytes.Equal(audit, again) {
+		t.Errorf("DeriveKey = %x then %x, want the same %d bytes", audit, again, KeySize)
+	}
+	if bytes.Equal(audit, master) || bytes.Equal(audit, other) || bytes.Equal(audit, otherMaster) {
+		t.Error("derived key isn't distinct from the master key, other purposes or other master keys")
+	}
+}
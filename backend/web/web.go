@@ -0,0 +1,158 @@
+// Package web serves the dashboard: the SvelteKit frontend built as a static
+// single-page app.
+//
+// `npm run build` in frontend/ writes the app into web/dist, which is embedded in
+// the binary so a single file is all there is to install. For frontend development
+// a directory on disk can be served instead, picking up rebuilds without recompiling.
+package web
+
+import (
+	"embed"
+	"errors"
+	"io"
+	"io/fs"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"example.com/m/v2/logging"
+)
+
+//go:embed all:dist
+var embedded embed.FS
+
+// indexFile is the app shell, served for every route the frontend handles itself.
+const indexFile = "index.html"
+
+// immutablePrefix holds the assets SvelteKit names after a hash of their contents.
+const immutablePrefix = "_app/immutable/"
+
+// encodings are the precompressed variants the build writes, most preferred first.
+var encodings = []struct {
+	name      string
+	extension string
+}{
+	{"br", ".br"},
+	{"gzip", ".gz"},
+}
+
+// Embedded returns the frontend built into the binary.
+func Embedded() fs.FS {
+	dist, err := fs.Sub(embedded, "dist")
+	if err != nil {
+		// dist is embedded at compile time, so it is always there.
+		panic(err)
+	}
+	return dist
+}
+
+// HasIndex reports whether files contains a built frontend.
+func HasIndex(files fs.FS) bool {
+	_, err := fs.Stat(files, indexFile)
+	return err == nil
+}
+
+// Handler serves files, falling back to the app shell for paths that don't name a file,
+// such as /deploy/nextcloud, so the frontend's router can handle them.
+func Handler(files fs.FS) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		name := strings.TrimPrefix(path.Clean("/"+r.URL.Path), "/")
+		if name == "" {
+			name = indexFile
+		}
+
+		if info, err := fs.Stat(files, name); err != nil || info.IsDir() {
+			// A missing file with an extension is a broken asset link, not a page
+			if path.Ext(name) != "" && path.Ext(name) != ".html" {
+				http.NotFound(w, r)
+				return
+			}
+			name = indexFile
+		}
+
+		// Hashed assets never change under the same name; everything else must be revalidated
+		// so a new release's app shell is picked up straight away.
+		if strings.HasPrefix(name, immutablePrefix) {
+			w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+		} else {
+			w.Header().Set("Cache-Control", "no-cache")
+		}
+		serveFile(w, r, files, name)
+	})
+}
+
+// serveFile writes one file, using a precompressed variant the client accepts if the build has one.
+func serveFile(w http.ResponseWriter, r *http.Request, files fs.FS, name string) {
+	contentType := mime.TypeByExtension(path.Ext(name))
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Add("Vary", "Accept-Encoding")
+
+	accepted := r.Header.Get("Accept-Encoding")
+	for _, enc := range encodings {
+		if !acceptsEncoding(accepted, enc.name) {
+			continue
+		}
+		f, err := files.Open(name + enc.extension)
+		if err != nil {
+			continue
+		}
+		defer f.Close()
+		w.Header().Set("Content-Encoding", enc.name)
+		serveContent(w, r, name, f)
+		return
+	}
+
+	f, err := files.Open(name)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			http.Error(w, "The dashboard has not been built; run npm run build in frontend/", http.StatusNotFound)
+			return
+		}
+		http.Error(w, "Failed to read file", http.StatusInternalServerError)
+		logging.Errorf("Error opening frontend file %s: %v", name, err)
+		return
+	}
+	defer f.Close()
+	serveContent(w, r, name, f)
+}
+
+// serveContent hands a file to http.ServeContent, which handles HEAD, ranges and
+// conditional requests. Files from embed.FS and os.DirFS can both seek.
+func serveContent(w http.ResponseWriter, r *http.Request, name string, f fs.File) {
+	seeker, ok := f.(io.ReadSeeker)
+	if !ok {
+		http.Error(w, "Failed to read file", http.StatusInternalServerError)
+		logging.Errorf("Error serving frontend file %s: not seekable", name)
+		return
+	}
+	var modTime time.Time
+	if info, err := f.Stat(); err == nil {
+		modTime = info.ModTime()
+	}
+	http.ServeContent(w, r, name, modTime, seeker)
+}
+
+// acceptsEncoding reports whether an Accept-Encoding header allows the named encoding.
+func acceptsEncoding(header, name string) bool {
+	for _, part := range strings.Split(header, ",") {
+		coding, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		if !strings.EqualFold(strings.TrimSpace(coding), name) {
+			continue
+		}
+		// "gzip;q=0" explicitly refuses the encoding
+		q := strings.ReplaceAll(params, " ", "")
+		return q != "q=0" && q != "q=0.0" && q != "q=0.00" && q != "q=0.000"
+	}
+	return false
+}
@@ -1,9 +1,12 @@
 // API utility for backend calls
-import { dev } from '$app/environment';
+import { dev, browser } from '$app/environment';
+import { goto } from '$app/navigation';
 
+// Endpoints already start with /api, so in production the base is the origin the
+// dashboard was served from (the Go backend) unless VITE_API_URL points elsewhere.
 const API_BASE_URL = dev 
 	? 'http://localhost:8081' 
-	: (import.meta.env.VITE_API_URL || '/api');
+	: (import.meta.env.VITE_API_URL || '');
 
 // Security headers for all requests
 const getSecureHeaders = () => ({
@@ -22,6 +25,8 @@ async function secureApiRequest(endpoint, options = {}) {
 	const url = `${API_BASE_URL}${endpoint}`;
 
 	const requestOptions = {
+		// Send the session cookie, including to the dev server on another port
+		credentials: 'include',
 		...options,
 		headers: {
 			...getSecureHeaders(),
@@ -32,6 +37,11 @@ async function secureApiRequest(endpoint, options = {}) {
 	try {
 		const response = await fetch(url, requestOptions);
 
+		// Signed out (or the session expired): send the user to the login page
+		if (response.status === 401 && browser && !endpoint.startsWith('/api/auth/')) {
+			goto(`/login?redirect=${encodeURIComponent(window.location.pathname)}`);
+		}
+
 		if (!response.ok) {
 			// Handle different error status codes
 			let errorMessage = `HTTP error! status: ${response.status}`;
@@ -44,7 +54,13 @@ async function secureApiRequest(endpoint, options = {}) {
 				errorMessage = response.statusText || errorMessage;
 			}
 
-			throw new Error(errorMessage);
+			const error = new Error(errorMessage);
+			error.status = response.status;
+			throw error;
+		}
+
+		if (response.status === 204) {
+			return null;
 		}
 
 		return await response.json();
@@ -73,14 +89,166 @@ export async function fetchBackendStatus() {
 	}
 }
 
+/**
+ * Check whether the backend still needs its first admin account
+ * @returns {Promise<Object>} Object with `setup_required`
+ * @throws {Error} When the request fails
+ */
+export async function fetchSetupStatus() {
+	try {
+		return await secureApiRequest('/api/auth/setup', {
+			method: 'GET'
+		});
+	} catch (error) {
+		throw new Error(`Failed to check setup: ${error.message}`);
+	}
+}
+
+/**
+ * Create the first admin account and sign in as it
+ * @param {string} username - Admin username
+ * @param {string} password - Admin password
+ * @returns {Promise<Object>} Object with the signed-in `user`
+ * @throws {Error} When setup fails or has already been done
+ */
+export async function setupAdmin(username, password) {
+	try {
+		return await secureApiRequest('/api/auth/setup', {
+			method: 'POST',
+			body: JSON.stringify({ username, password })
+		});
+	} catch (error) {
+		throw new Error(`Setup failed: ${error.message}`);
+	}
+}
+
+/**
+ * Sign in; the backend sets an HttpOnly session cookie
+ * @param {string} username - Username
+ * @param {string} password - Password
+ * @returns {Promise<Object>} Object with the signed-in `user`
+ * @throws {Error} When the credentials are wrong
+ */
+export async function login(username, password) {
+	try {
+		return await secureApiRequest('/api/auth/login', {
+			method: 'POST',
+			body: JSON.stringify({ username, password })
+		});
+	} catch (error) {
+		throw new Error(`Login failed: ${error.message}`);
+	}
+}
+
+/**
+ * Sign out and clear the session cookie
+ * @returns {Promise<void>}
+ */
+export async function logout() {
+	await secureApiRequest('/api/auth/logout', {
+		method: 'POST'
+	});
+}
+
+/**
+ * Fetch the signed-in user
+ * @returns {Promise<Object>} Object with the signed-in `user`
+ * @throws {Error} When nobody is signed in
+ */
+export async function fetchCurrentUser() {
+	return await secureApiRequest('/api/auth/me', {
+		method: 'GET'
+	});
+}
+
+/**
+ * Request a single-use public key for wrapping the session key that encrypts sensitive fields
+ * @returns {Promise<Object>} Object with `key_id`, `algorithm`, `public_key` (base64 SPKI) and `expires_at`
+ * @throws {Error} When the request fails
+ */
+export async function fetchEncryptionKey() {
+	try {
+		return await secureApiRequest('/api/encryption/keys', {
+			method: 'POST'
+		});
+	} catch (error) {
+		throw new Error(`Failed to fetch encryption key: ${error.message}`);
+	}
+}
+
+/**
+ * Fetch every app in the backend catalog
+ * @returns {Promise<Object>} Object with an `apps` array of manifests
+ * @throws {Error} When the request fails
+ */
+export async function fetchApps() {
+	try {
+		return await secureApiRequest('/api/apps', {
+			method: 'GET'
+		});
+	} catch (error) {
+		throw new Error(`Failed to fetch apps: ${error.message}`);
+	}
+}
+
+/**
+ * Fetch an app's manifest from the backend catalog, including its form fields
+ * @param {string} appId - The application ID
+ * @returns {Promise<Object>} App manifest
+ * @throws {Error} When the request fails; `status` is 404 if the app isn't in the catalog
+ */
+export async function fetchAppManifest(appId) {
+	try {
+		return await secureApiRequest(`/api/apps/${encodeURIComponent(appId)}`, {
+			method: 'GET'
+		});
+	} catch (error) {
+		const failed = new Error(`Failed to fetch app manifest: ${error.message}`);
+		failed.status = error.status;
+		throw failed;
+	}
+}
+
+/**
+ * Fetch every managed deployment with its live state
+ * @returns {Promise<Object>} Object with a `deployments` array
+ * @throws {Error} When the request fails
+ */
+export async function fetchDeployments() {
+	try {
+		return await secureApiRequest('/api/deployments', {
+			method: 'GET'
+		});
+	} catch (error) {
+		throw new Error(`Failed to fetch deployments: ${error.message}`);
+	}
+}
+
+/**
+ * Fetch a single deployment, including its state history
+ * @param {string} deploymentId - The deployment ID returned by deployApplication
+ * @returns {Promise<Object>} Deployment details
+ * @throws {Error} When the request fails
+ */
+export async function fetchDeployment(deploymentId) {
+	try {
+		return await secureApiRequest(`/api/deployments/${encodeURIComponent(deploymentId)}`, {
+			method: 'GET'
+		});
+	} catch (error) {
+		throw new Error(`Failed to fetch deployment: ${error.message}`);
+	}
+}
+
 /**
  * Deploy an application with secure configuration handling
  * @param {string} appId - The application ID to deploy
  * @param {Object} formData - The configuration data for the application (may include encrypted fields)
+ * @param {string} requestId - Request ID; pass the same one when retrying so the deploy is idempotent
  * @returns {Promise<Object>} Deployment result
  * @throws {Error} When the deployment fails
  */
-export async function deployApplication(appId, formData = {}) {
+export async function deployApplication(appId, formData = {}, requestId = generateRequestId()) {
 	try {
 		// Sanitize the app ID to prevent injection
 		const sanitizedAppId = appId.replace(/[^a-zA-Z0-9-_]/g, '');
@@ -94,8 +262,8 @@ export async function deployApplication(appId, formData = {}) {
 			configuration: formData,
 			// Add timestamp for replay attack protection
 			timestamp: Date.now(),
-			// Add a request ID for tracking
-			request_id: generateRequestId()
+			// Add a request ID for tracking; resubmitting it returns the original deployment
+			request_id: requestId
 		};
 
 		const response = await secureApiRequest('/api/deploy', {
@@ -115,14 +283,47 @@ export async function deployApplication(appId, formData = {}) {
 }
 
 /**
- * Generate a unique request ID for tracking purposes
+ * Follow a background job's progress over Server-Sent Events
+ * @param {string} jobId - The job ID returned by deployApplication
+ * @param {Object} handlers - Callbacks: onProgress(event), onDone(event), onError(error)
+ * @returns {Function} Call to stop listening
+ */
+export function watchJob(jobId, { onProgress, onDone, onError } = {}) {
+	const source = new EventSource(`${API_BASE_URL}/api/jobs/${encodeURIComponent(jobId)}/events`, {
+		withCredentials: true
+	});
+
+	source.addEventListener('progress', (event) => {
+		onProgress?.(JSON.parse(event.data));
+	});
+
+	source.addEventListener('done', (event) => {
+		source.close();
+		onDone?.(JSON.parse(event.data));
+	});
+
+	source.addEventListener('error', (event) => {
+		// Job failures carry data; connection drops don't, and EventSource reconnects on its own
+		if (event.data) {
+			source.close();
+			onError?.(new Error(JSON.parse(event.data).message));
+		}
+	});
+
+	return () => source.close();
+}
+
+/**
+ * Generate a unique request ID for tracking purposes.
+ * Reuse the same ID when retrying a deployment so the backend doesn't deploy twice.
  * @returns {string} Random request ID
  */
-function generateRequestId() {
+export function generateRequestId() {
 	const chars = 'ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789';
-	let _result = '';
-	for (let i = 0; i < 16; i++) {
-		result += chars.charAt(Math.floor(Math.random() * chars.length));
+	const bytes = crypto.getRandomValues(new Uint8Array(16));
+	let result = '';
+	for (const byte of bytes) {
+		result += chars.charAt(byte % chars.length);
 	}
 	return result;
 }
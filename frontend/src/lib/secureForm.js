@@ -1,5 +1,6 @@
 import { writable } from 'svelte/store';
 import zxcvbn from 'zxcvbn';
+import { fetchEncryptionKey } from './api.js';
 
 /**
  * Secure form utility for handling sensitive deployment configuration
@@ -57,6 +58,29 @@ export const EncryptionUtils = {
 		);
 	},
 
+	/**
+	 * Wrap a session key with a server-issued RSA-OAEP public key
+	 * @param {CryptoKey} sessionKey - The AES-GCM session key (must be extractable)
+	 * @param {string} publicKeyBase64 - The server's public key as base64 SPKI
+	 * @returns {Promise<number[]>} Wrapped key bytes
+	 */
+	async wrapSessionKey(sessionKey, publicKeyBase64) {
+		const spki = Uint8Array.from(atob(publicKeyBase64), (c) => c.charCodeAt(0));
+		const serverKey = await crypto.subtle.importKey(
+			'spki',
+			spki,
+			{
+				name: 'RSA-OAEP',
+				hash: 'SHA-256'
+			},
+			false,
+			['wrapKey']
+		);
+
+		const wrapped = await crypto.subtle.wrapKey('raw', sessionKey, serverKey, { name: 'RSA-OAEP' });
+		return Array.from(new Uint8Array(wrapped));
+	},
+
 	/**
 	 * Encrypt sensitive data using AES-GCM
 	 * @param {string} plaintext - Data to encrypt
@@ -215,7 +239,6 @@ export function createSecureFormStore(fields) {
 
 		// Generate a session key for encrypting sensitive data
 		const sessionKey = await EncryptionUtils.generateKey();
-		const exportedKey = await crypto.subtle.exportKey('raw', sessionKey);
 
 		// Encrypt sensitive fields
 		const encryptedFields = {};
@@ -235,13 +258,16 @@ export function createSecureFormStore(fields) {
 			}
 		}
 
-		// Add encryption metadata if we encrypted anything
+		// Add encryption metadata if we encrypted anything.
+		// The session key only leaves the browser wrapped with a single-use server key.
 		if (sensitiveFieldsFound.length > 0) {
+			const serverKey = await fetchEncryptionKey();
 			prepared._encryption = {
-				sessionKey: Array.from(new Uint8Array(exportedKey)),
+				keyId: serverKey.key_id,
+				wrappedKey: await EncryptionUtils.wrapSessionKey(sessionKey, serverKey.public_key),
 				encryptedFields: encryptedFields,
 				algorithm: 'AES-GCM',
-				version: '1.0'
+				version: '2.0'
 			};
 		}
 
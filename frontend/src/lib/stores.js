@@ -1,98 +1,79 @@
 import { writable } from 'svelte/store';
 import {
-	GitBranch,
 	ShieldCheck,
 	Cloud,
 	Image,
 	Film,
 	Music,
 	Notebook,
-	Rss,
-	ChartLine,
-	Zap
+	Package
 } from 'svelte-lucide';
+import { fetchApps } from '$lib/api.js';
 
-// This store holds the list of applications available in the platform.
-// In the future, the status of each application will be updated based on deployment state.
-export const applications = writable([
-	{
-		id: 'nextcloud',
-		name: 'Nextcloud',
+// Card details the app catalog doesn't carry, by app ID. An app without an entry
+// still gets a card, with a generic icon and its manifest's description.
+const presentation = {
+	nextcloud: {
 		description: 'Replaces Google Drive, Calendar, and Contacts. Your complete data backend.',
 		icon: Cloud,
-		color: 'text-app-indigo',
-		status: 'Not Deployed'
+		color: 'text-app-indigo'
 	},
-	{
-		id: 'immich',
-		name: 'Immich',
+	immich: {
 		description: 'Replaces Google Photos. High-performance photo and video backups.',
 		icon: Image,
-		color: 'text-app-orange',
-		status: 'Not Deployed'
+		color: 'text-app-orange'
 	},
-	{
-		id: 'vaultwarden',
-		name: 'Vaultwarden',
+	vaultwarden: {
 		description: 'Replaces 1Password or LastPass. Secure, private password management.',
 		icon: ShieldCheck,
-		color: 'text-app-blue',
-		status: 'Not Deployed'
+		color: 'text-app-blue'
 	},
-	{
-		id: 'jellyfin',
-		name: 'Jellyfin',
+	jellyfin: {
 		description: 'Replaces Plex or your Netflix subscription. Stream your own media anywhere.',
 		icon: Film,
-		color: 'text-app-lavender',
-		status: 'Not Deployed'
+		color: 'text-app-lavender'
 	},
-	{
-		id: 'navidrome',
-		name: 'Navidrome',
+	navidrome: {
 		description: 'Replaces Spotify or Apple Music. Your personal music streaming server.',
 		icon: Music,
-		color: 'text-app-pink',
-		status: 'Not Deployed'
+		color: 'text-app-pink'
 	},
-	{
-		id: 'joplin-server',
-		name: 'Joplin Server',
+	'joplin-server': {
 		description: 'Replaces Evernote or OneNote. Syncs your notes across all devices securely.',
 		icon: Notebook,
-		color: 'text-app-gray',
-		status: 'Not Deployed'
-	},
-	{
-		id: 'freshrss',
-		name: 'FreshRSS',
-		description: 'Replaces Feedly. A modern, self-hosted RSS aggregator to curate your own news.',
-		icon: Rss,
-		color: 'text-app-yellow',
-		status: 'Not Deployed'
-	},
-	{
-		id: 'umami',
-		name: 'Umami',
-		description: 'Replaces Google Analytics. Simple, fast, privacy-focused website analytics.',
-		icon: ChartLine,
-		color: 'text-app-teal',
-		status: 'Not Deployed'
-	},
-	{
-		id: 'gitea',
-		name: 'Gitea',
-		description: 'Replaces GitHub. For developers who want to own their code.',
-		icon: GitBranch,
-		color: 'text-app-green',
-		status: 'Not Deployed'
-	},
-	{
-		id: 'n8n',
-		name: 'n8n',
-		description: 'Replaces Zapier. Automate workflows between your different apps.',
-		icon: Zap,
-		color: 'text-app-red',
-		status: 'Not Deployed'
+		color: 'text-app-gray'
 	}
-]);
+};
+
+/**
+ * Turn an app manifest from the backend catalog into the card shown for it
+ * @param {Object} manifest - App manifest
+ * @returns {Object} Card with `id`, `name`, `description`, `icon`, `status` and usually `color`
+ */
+export function toApplication(manifest) {
+	return {
+		id: manifest.id,
+		name: manifest.name,
+		description: manifest.description,
+		icon: Package,
+		...presentation[manifest.id],
+		status: 'Not Deployed'
+	};
+}
+
+// This store holds the list of applications available in the platform, as the
+// backend's app catalog lists them. It's empty until loadApplications runs.
+// In the future, the status of each application will be updated based on deployment state.
+export const applications = writable([]);
+
+/**
+ * Load the app catalog from the backend into the applications store
+ * @returns {Promise<Array>} The applications
+ * @throws {Error} When the catalog can't be fetched
+ */
+export async function loadApplications() {
+	const { apps } = await fetchApps();
+	const loaded = apps.map(toApplication);
+	applications.set(loaded);
+	return loaded;
+}
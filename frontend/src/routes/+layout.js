@@ -0,0 +1,4 @@
+// The dashboard is a single-page app served by the Go backend, which answers
+// every unknown path with the app shell; pages render in the browser.
+export const ssr = false;
+export const prerender = false;
@@ -0,0 +1,10 @@
+import { loadApplications } from '$lib/stores.js';
+
+export async function load() {
+	try {
+		await loadApplications();
+		return { loadError: null };
+	} catch (err) {
+		return { loadError: err.message };
+	}
+}
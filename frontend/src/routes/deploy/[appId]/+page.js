@@ -1,19 +1,23 @@
 import { error } from '@sveltejs/kit';
-import { get } from 'svelte/store';
-import { applications } from '$lib/stores.js';
+import { toApplication } from '$lib/stores.js';
+import { fetchAppManifest } from '$lib/api.js';
 
 export async function load({ params }) {
 	const { appId } = params;
 
-	// Get the application data from the store
-	const apps = get(applications);
-	const app = apps.find((a) => a.id === appId);
-
-	if (!app) {
-		throw error(404, 'Application not found');
+	// The backend's app catalog decides which apps exist and what their forms ask for
+	let manifest;
+	try {
+		manifest = await fetchAppManifest(appId);
+	} catch (err) {
+		if (err.status === 404) {
+			throw error(404, 'Application not found');
+		}
+		throw error(503, `App catalog unavailable: ${err.message}`);
 	}
 
 	return {
-		app
+		app: toApplication(manifest),
+		manifest
 	};
 }
@@ -1,4 +1,5 @@
-import adapter from '@sveltejs/adapter-cloudflare';
+import cloudflare from '@sveltejs/adapter-cloudflare';
+import staticAdapter from '@sveltejs/adapter-static';
 import { vitePreprocess } from '@sveltejs/vite-plugin-svelte';
 
 /** @type {import('@sveltejs/kit').Config} */
@@ -11,7 +12,18 @@ const config = {
 		// adapter-auto only supports some environments, see https://svelte.dev/docs/kit/adapter-auto for a list.
 		// If your environment is not supported, or you settled on a specific environment, switch out the adapter.
 		// See https://svelte.dev/docs/kit/adapters for more information about adapters.
-		adapter: adapter(),
+		//
+		// The default build is a static single-page app written straight into the Go backend,
+		// which embeds it (see backend/web). ADAPTER=cloudflare builds for Cloudflare Pages instead.
+		adapter:
+			process.env.ADAPTER === 'cloudflare'
+				? cloudflare()
+				: staticAdapter({
+						pages: '../backend/web/dist',
+						assets: '../backend/web/dist',
+						fallback: 'index.html',
+						precompress: true
+					}),
 		alias: {
 			$lib: './src/lib'
 		}